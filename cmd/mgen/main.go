@@ -55,7 +55,7 @@ var table = map[string]node{
 	"def_spec":      {[][]string{{"def", "ID", "{", "stmt_list", "}"}}, ""},
 	"deco_spec":     {[][]string{{"deco", "{", "stmt_list", "}"}}, ""},
 
-	"BUILTIN": {[][]string{{"strptime"}, {"timestamp"}, {"len"}, {"tolower"}}, ""},
+	"BUILTIN": {[][]string{{"strptime"}, {"timestamp"}, {"len"}, {"tolower"}, {"toupper"}, {"trim"}}, ""},
 
 	"CAPREF":  {[][]string{}, "$1"},
 	"REGEX":   {[][]string{}, "/foo/"},
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -14,7 +15,11 @@ import (
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/vm"
+	"github.com/google/mtail/internal/vm/checker"
+	vmerrors "github.com/google/mtail/internal/vm/errors"
 	"github.com/google/mtail/internal/watcher"
+	"github.com/pkg/errors"
 )
 
 type seqStringFlag []string
@@ -32,39 +37,99 @@ func (f *seqStringFlag) Set(value string) error {
 
 var logs seqStringFlag
 
+var lowPriorityLogs seqStringFlag
+
+// repeatedStringFlag collects each occurrence of a flag without splitting its value.
+type repeatedStringFlag []string
+
+func (f *repeatedStringFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *repeatedStringFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var execLogs repeatedStringFlag
+
 var (
 	port    = flag.String("port", "3903", "HTTP port to listen on.")
 	address = flag.String("address", "", "Host or IP address on which to bind HTTP listener")
-	progs   = flag.String("progs", "", "Name of the directory containing mtail programs")
+	progs   = flag.String("progs", "", "Name of the directory containing mtail programs, or a list of directories and program files separated by commas.  Programs are named by their filename, and a program in a later path overrides those of the same name before it.")
 
 	version = flag.Bool("version", false, "Print mtail version information.")
 
+	verifyReads = flag.Bool("verify_reads", false, "Check each region of the logs read with a second, independent read, counting differences in mtail_log_verify_mismatches_total.  This is for qualifying the tailer under stress, not for production use.")
+
+	requireLogsMatch = flag.Bool("require_logs_match", false, "Exit with an error at startup if any of the -logs patterns matches no files, instead of waiting for them to appear.")
+
+	runStateFile = flag.String("run_state_file", "", "Path of a file in which to count the runs of mtail, exported as mtail_restarts_total so that counter resets can be matched to restarts.  If empty, restarts are not counted.")
+
+	crashLoopStateFile = flag.String("crash_loop_state_file", "", "Path of a file in which to count the runs of mtail in a row that ended, by a crash or a failure to start, within -crash_loop_window of starting.  After -safe_mode_after of them, mtail starts in safe mode: the HTTP server and status page are up, explaining why, but no programs are loaded and no logs are read, until the file is removed.  If empty, there is no safe mode.")
+	safeModeAfter      = flag.Int("safe_mode_after", mtail.DefaultSafeModeAfter, "Number of runs in a row ending soon after starting after which mtail starts in safe mode.  See -crash_loop_state_file.")
+	crashLoopWindow    = flag.Duration("crash_loop_window", mtail.DefaultCrashLoopWindow, "How soon after starting a run of mtail must end to count towards a crash loop.  See -crash_loop_state_file.")
+
 	// Compiler behaviour flags
 	oneShot      = flag.Bool("one_shot", false, "Compile the programs, then read the contents of the provided logs from start until EOF, print the values of the metrics store and exit. This is a debugging flag only, not for production use.")
 	compileOnly  = flag.Bool("compile_only", false, "Compile programs only, do not load the virtual machine.")
+	strict       = flag.Bool("strict", false, "Treat warnings about programs as compile errors.  With --compile_only, the exit status is 3 for unused capture groups, 4 for capture groups hiding others of the same name, 5 for metrics whose type can't be inferred, 6 for metrics never written, and 7 for blocks that can never run, if those are the only errors.")
+	strictTypes  = flag.Bool("strict_types", false, "Reject programs that convert between ints and floats without the int() or float() builtins, or that have metrics whose type can't be inferred from their use.")
 	dumpAst      = flag.Bool("dump_ast", false, "Dump AST of programs after parse (to INFO log).")
 	dumpAstTypes = flag.Bool("dump_ast_types", false, "Dump AST of programs with type annotation after typecheck (to INFO log).")
 	dumpBytecode = flag.Bool("dump_bytecode", false, "Dump bytecode of programs (to INFO log).")
+	emit         = flag.String("emit", "go", "With the compile command, the language to emit the program in.  Only go is supported.")
+
+	// Stress test flags
+	scenario          = flag.String("scenario", mtail.StressRotation, "With the stress command, how the logs are written: rotation to rename and replace them, truncation to truncate them in place, or burst to write them in bursts without rotation.")
+	stressWriters     = flag.Int("stress_writers", 4, "With the stress command, the number of logs written concurrently.")
+	stressLines       = flag.Int("stress_lines", 10000, "With the stress command, the number of lines written to each log.")
+	stressRotateEvery = flag.Int("stress_rotate_every", 1000, "With the stress command, the number of lines written to a log between rotations or truncations.")
+	stressBurstSize   = flag.Int("stress_burst_size", 100, "With the stress command, the number of lines written to a log at once.")
+	stressInterval    = flag.Duration("stress_interval", 10*time.Millisecond, "With the stress command, the pause between bursts of lines written to a log.")
+	stressSettle      = flag.Duration("stress_settle", 10*time.Second, "With the stress command, how long to wait without reading a line before counting the lines not yet read as lost.")
 
 	// VM Runtime behaviour flags
-	syslogUseCurrentYear = flag.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
-	overrideTimezone     = flag.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of UTC.")
-	emitProgLabel        = flag.Bool("emit_prog_label", true, "Emit the 'prog' label in variable exports.")
-	emitMetricTimestamp  = flag.Bool("emit_metric_timestamp", false, "Emit the recorded timestamp of a metric.  If disabled (the default) no explicit timestamp is sent to a collector.")
+	syslogUseCurrentYear   = flag.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
+	overrideTimezone       = flag.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of UTC.")
+	emitProgLabel          = flag.Bool("emit_prog_label", true, "Emit the 'prog' label in variable exports.")
+	forwardTarget          = flag.String("forward_target", "", "URL of a remote receiver for lines passed to forward() in programs.  Use syslog+udp://host:port or syslog+tcp://host:port for a syslog server, or an http:// or https:// URL to POST batches of lines to.")
+	geoipDatabase          = flag.String("geoip_database", "", "Path of a MaxMind DB format database, like GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb, used by geoip_country() and geoip_asn() in programs.")
+	lineFilters            = flag.String("line_filters_manifest", "", "Path to a JSON file of filters applied to the lines of the logs matching each glob pattern before they are passed to the programs, e.g. [{\"logs\": \"/var/log/app/*.log\", \"filters\": [{\"strip\": \"ansi\"}, {\"drop\": \"DEBUG\"}]}].")
+	programLabels          = flag.String("program_labels_manifest", "", "Path to a JSON file of constant labels to add to the metrics exported by each program, keyed by program filename, e.g. {\"payments.mtail\": {\"team\": \"payments\"}}.")
+	derivedMetrics         = flag.String("derived_metrics_manifest", "", "Path to a JSON file of metrics computed from the others when /metrics is scraped, e.g. [{\"name\": \"http_error_ratio\", \"expr\": \"http_errors_total / http_requests_total\"}].")
+	programRegexOptions    = flag.String("program_regex_manifest", "", "Path to a JSON file of regular expression options for each program, keyed by program filename, e.g. {\"legacy.mtail\": {\"longest\": true, \"posix\": false, \"max_program_size\": 1000}}.  Programs are reloaded when it changes.")
+	countConditions        = flag.Bool("count_condition_matches", false, "Export prog_condition_matches_total, the number of lines matched by each top-level condition of the programs, by program and source line, to find dead and hot branches.")
+	countUnmatched         = flag.Bool("count_unmatched_lines", false, "Count the lines that no program matched in lines_dropped_total, with the stage program and reason no_match.  Each line is tracked until every program has processed it, which costs some throughput.")
+	arithmeticPolicies     = flag.String("arithmetic_policy", "skip", "What programs do on a division by zero, an integer overflow, or a negative observation of a histogram: skip to stop processing the line, or clamp to carry on with the nearest value in range, or zero for a division by zero.  Either way the fault is counted in prog_arithmetic_errors_total.  A comma separated list of program=policy sets the policy of those programs, e.g. skip,legacy.mtail=clamp.")
+	lineBudgetInstructions = flag.Int("line_budget_instructions", 0, "The most bytecode instructions a program may run on one line, or 0 for no limit.  Each regular expression match is charged the length of the text it matches too, and is not started if that would take the program over its budget.  A program over its budget stops processing the line, which is counted in prog_runtime_errors.")
+	lineBudgetTime         = flag.Duration("line_budget_time", 0, "The most time a program may spend on one line, or 0 for no limit.  It is only checked between instructions, so it can't stop a single slow regular expression match once started; use --line_budget_instructions to bound those.")
+	quarantineAfter        = flag.Int("quarantine_after", 0, "Quarantine a program after this many lines over its line budget, so that it processes no more lines until it is reloaded, or 0 to never quarantine.")
+	overflowPolicies       = flag.String("counter_overflow", "wrap", "What programs do when an int metric is incremented past the largest int: wrap to start it again from zero, which is seen as a counter reset, saturate to leave it at the largest int, or float to carry on counting as a float with less precision.  Either way the overflow is counted in counter_overflows_total.  A comma separated list of program=policy sets the policy of those programs, e.g. wrap,proxy.mtail=float.")
+	reloadPolicies         = flag.String("reload_metrics", "source", "What happens to the values of a program's metrics when it is reloaded: source to keep them unless the type, keys, or line of a metric's declaration changed, keep to keep them unless the type or keys changed, also for hidden metrics that aren't persistent, or clear to start every exported metric from zero.  A comma separated list of program=policy sets the policy of those programs, e.g. keep,test.mtail=clear.")
+	emitMetricTimestamp    = flag.Bool("emit_metric_timestamp", false, "Emit the recorded timestamp of a metric.  If disabled (the default) no explicit timestamp is sent to a collector.")
 
 	// Ops flags
 	pollInterval                = flag.Duration("poll_interval", 0, "Set the interval to poll all log files for data; must be positive, or zero to disable polling.  With polling mode, only the files found at mtail startup will be polled.")
 	disableFsnotify             = flag.Bool("disable_fsnotify", false, "EXPERIMENTAL: When enabled no fsnotify watcher is created, and mtail falls back to polling mode only.  Only the files known at program startup will be polled.")
 	expiredMetricGcTickInterval = flag.Duration("expired_metrics_gc_interval", time.Hour, "interval between expired metric garbage collection runs")
 	staleLogGcTickInterval      = flag.Duration("stale_log_gc_interval", time.Hour, "interval between stale log garbage collection runs")
+	rotationDrainTimeout        = flag.Duration("rotation_drain_timeout", 5*time.Second, "How long to keep reading a log's file after a rotation renames it, for the lines written before the writer reopens the log; zero stops reading it at once.")
+	dispatchQueueHighWater      = flag.Int("dispatch_queue_high_water", 500, "Number of lines waiting to be processed by any one program above which reads of the -low_priority_logs are paused.  It must be less than the 1000 lines each program can queue.")
+	httpReadTimeout             = flag.Duration("http_read_timeout", 0, "Maximum time to read each HTTP request, including its body; zero is no limit.")
+	httpWriteTimeout            = flag.Duration("http_write_timeout", 0, "Maximum time to write each HTTP response, from the end of reading its request; zero is no limit.  CPU profiles from /debug/pprof/profile take 30 seconds by default, so need a longer timeout.")
+	httpIdleTimeout             = flag.Duration("http_idle_timeout", 0, "Maximum time to keep an idle HTTP keep-alive connection open; zero uses the read timeout.")
 
 	// Debugging flags
-	blockProfileRate     = flag.Int("block_profile_rate", 0, "Nanoseconds of block time before goroutine blocking events reported. 0 turns off.  See https://golang.org/pkg/runtime/#SetBlockProfileRate")
-	mutexProfileFraction = flag.Int("mutex_profile_fraction", 0, "Fraction of mutex contention events reported.  0 turns off.  See http://golang.org/pkg/runtime/#SetMutexProfileFraction")
+	disableDebugEndpoints = flag.Bool("disable_debug_endpoints", false, "Don't serve the Go profiler under /debug/pprof or the expvar metrics under /debug/vars.")
+	blockProfileRate      = flag.Int("block_profile_rate", 0, "Nanoseconds of block time before goroutine blocking events reported. 0 turns off.  See https://golang.org/pkg/runtime/#SetBlockProfileRate")
+	mutexProfileFraction  = flag.Int("mutex_profile_fraction", 0, "Fraction of mutex contention events reported.  0 turns off.  See http://golang.org/pkg/runtime/#SetMutexProfileFraction")
 )
 
 func init() {
 	flag.Var(&logs, "logs", "List of log files to monitor, separated by commas.  This flag may be specified multiple times.")
+	flag.Var(&lowPriorityLogs, "low_priority_logs", "List of log file glob patterns, separated by commas, whose reads are paused while the programs are backed up processing lines.  This flag may be specified multiple times.")
+	flag.Var(&execLogs, "exec_logs", "Command line of a subprocess whose standard output and standard error are tailed as a log.  The command is split on whitespace and not run by a shell.  It is restarted with backoff when it exits.  This flag may be specified multiple times.")
 }
 
 var (
@@ -84,9 +149,21 @@ func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s\n", buildInfo.String())
 		fmt.Fprintf(os.Stderr, "\nUsage:\n")
+		fmt.Fprintf(os.Stderr, "  %s [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s check [flags]\n\tCheck that the programs compile and the logs can be read and watched, print a JSON readiness report, and exit.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s compile --emit=go --progs FILE\n\tExperimental: compile the program into the source of a standalone Go program, print it, and exit.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s stress --scenario rotation [flags]\n\tWrite synthetic logs in a temporary directory, tail them, print a JSON report of any lines lost or duplicated, and exit.\n\n", os.Args[0])
 		flag.PrintDefaults()
 	}
-	flag.Parse()
+	args := os.Args[1:]
+	check := len(args) > 0 && args[0] == "check"
+	compile := len(args) > 0 && args[0] == "compile"
+	stress := len(args) > 0 && args[0] == "stress"
+	if check || compile || stress {
+		args = args[1:]
+	}
+	// flag.CommandLine exits on error.
+	_ = flag.CommandLine.Parse(args)
 	if *version {
 		fmt.Println(buildInfo.String())
 		os.Exit(1)
@@ -106,11 +183,71 @@ func main() {
 		glog.Infof("Setting mutex profile fraction to %d", *mutexProfileFraction)
 		runtime.SetMutexProfileFraction(*mutexProfileFraction)
 	}
+	if stress {
+		r, err := mtail.Stress(mtail.StressOptions{
+			Scenario:     *scenario,
+			Writers:      *stressWriters,
+			Lines:        *stressLines,
+			RotateEvery:  *stressRotateEvery,
+			BurstSize:    *stressBurstSize,
+			Interval:     *stressInterval,
+			Settle:       *stressSettle,
+			PollInterval: *pollInterval,
+			UseFsnotify:  !*disableFsnotify,
+			VerifyReads:  *verifyReads,
+		})
+		if err != nil {
+			glog.Exit(err)
+		}
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			glog.Exit(err)
+		}
+		fmt.Println(string(b))
+		if !r.Passed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if *progs == "" {
 		glog.Exitf("mtail requires programs that in instruct it how to extract metrics from logs; please use the flag -progs to specify the directory containing the programs.")
 	}
+	if check {
+		r := mtail.Check(*progs, logs, execLogs, !*disableFsnotify)
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			glog.Exit(err)
+		}
+		fmt.Println(string(b))
+		if !r.Ready {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if compile {
+		if *emit != "go" {
+			glog.Exitf("Can't emit programs in %q, only go is supported.", *emit)
+		}
+		f, err := os.Open(*progs)
+		if err != nil {
+			glog.Exit(err)
+		}
+		var checkOpts []checker.Option
+		if *strictTypes {
+			checkOpts = append(checkOpts, checker.StrictTypes())
+		}
+		src, err := vm.CompileGo(*progs, f, *strict, checkOpts...)
+		if err != nil {
+			glog.Error(err)
+			os.Exit(exitStatus(err))
+		}
+		if _, err := os.Stdout.Write(src); err != nil {
+			glog.Exit(err)
+		}
+		os.Exit(0)
+	}
 	if !(*dumpBytecode || *dumpAst || *dumpAstTypes || *compileOnly) {
-		if len(logs) == 0 {
+		if len(logs) == 0 && len(execLogs) == 0 {
 			glog.Exitf("mtail requires the names of logs to follow in order to extract logs from them; please use the flag -logs one or more times to specify glob patterns describing these logs.")
 		}
 	}
@@ -121,18 +258,62 @@ func main() {
 	opts := []func(*mtail.Server) error{
 		mtail.ProgramPath(*progs),
 		mtail.LogPathPatterns(logs...),
+		mtail.ExecLogs(execLogs...),
 		mtail.BindAddress(*address, *port),
 		mtail.SetBuildInfo(buildInfo),
 		mtail.OverrideLocation(loc),
 		mtail.ExpiredMetricGcTickInterval(*expiredMetricGcTickInterval),
 		mtail.StaleLogGcTickInterval(*staleLogGcTickInterval),
+		mtail.RotationDrainTimeout(*rotationDrainTimeout),
+		mtail.HTTPTimeouts(*httpReadTimeout, *httpWriteTimeout, *httpIdleTimeout),
+		mtail.ForwardTarget(*forwardTarget),
+		mtail.GeoIPDatabase(*geoipDatabase),
+		mtail.LineFiltersManifest(*lineFilters),
+		mtail.LowPriorityLogs(lowPriorityLogs...),
+		mtail.DispatchQueueHighWater(*dispatchQueueHighWater),
+		mtail.ArithmeticPolicies(*arithmeticPolicies),
+		mtail.ReloadPolicies(*reloadPolicies),
+		mtail.CounterOverflowPolicies(*overflowPolicies),
+		mtail.LineBudget(*lineBudgetInstructions, *lineBudgetTime, *quarantineAfter),
+		mtail.RunStateFile(*runStateFile),
+		mtail.CrashLoopStateFile(*crashLoopStateFile, *safeModeAfter, *crashLoopWindow),
+	}
+	if *programLabels != "" {
+		opts = append(opts, mtail.ProgramLabelsManifest(*programLabels))
+	}
+	if *derivedMetrics != "" {
+		opts = append(opts, mtail.DerivedMetricsManifest(*derivedMetrics))
+	}
+	if *programRegexOptions != "" {
+		opts = append(opts, mtail.ProgramRegexManifest(*programRegexOptions))
 	}
 	if *oneShot {
 		opts = append(opts, mtail.OneShot)
 	}
+	if *verifyReads {
+		opts = append(opts, mtail.VerifyReads)
+	}
+	if *requireLogsMatch {
+		opts = append(opts, mtail.RequireLogsMatch)
+	}
+	if *disableDebugEndpoints {
+		opts = append(opts, mtail.DisableDebugEndpoints)
+	}
 	if *compileOnly {
 		opts = append(opts, mtail.CompileOnly)
 	}
+	if *strict {
+		opts = append(opts, mtail.Strict)
+	}
+	if *strictTypes {
+		opts = append(opts, mtail.StrictTypes)
+	}
+	if *countConditions {
+		opts = append(opts, mtail.CountConditionMatches)
+	}
+	if *countUnmatched {
+		opts = append(opts, mtail.CountUnmatchedLines)
+	}
 	if *dumpAst {
 		opts = append(opts, mtail.DumpAst)
 	}
@@ -154,7 +335,7 @@ func main() {
 	m, err := mtail.New(metrics.NewStore(), w, opts...)
 	if err != nil {
 		glog.Error(err)
-		os.Exit(1)
+		os.Exit(exitStatus(err))
 	}
 	err = m.Run()
 	if err != nil {
@@ -162,3 +343,35 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// Exit statuses for programs that fail to compile only because of warnings in
+// strict mode, by class of warning.
+var warningExitStatus = map[string]int{
+	vmerrors.Unused:      3,
+	vmerrors.Shadow:      4,
+	vmerrors.Type:        5,
+	vmerrors.Unwritten:   6,
+	vmerrors.Unreachable: 7,
+	vmerrors.Unmatched:   8,
+}
+
+// exitStatus returns the exit status for err.  If err is a list of compile
+// errors all made from warnings, it is the lowest status of their classes, so
+// that CI can tell which kinds of warning a program has; otherwise it is 1.
+func exitStatus(err error) int {
+	el, ok := errors.Cause(err).(vmerrors.ErrorList)
+	if !ok || len(el) == 0 {
+		return 1
+	}
+	status := 0
+	for _, e := range el {
+		s, ok := warningExitStatus[e.Class()]
+		if !ok {
+			return 1
+		}
+		if status == 0 || s < status {
+			status = s
+		}
+	}
+	return status
+}
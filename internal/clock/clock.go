@@ -0,0 +1,134 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package clock detects steps in the wall clock, such as the large
+// corrections made by NTP, so that wall clock timestamps taken either side of
+// a step can still be compared.
+//
+// Timers and tickers are not affected by steps, as they use the monotonic
+// clock.  Only timestamps that are stored without their monotonic reading,
+// like the timestamps of metric datums, need correcting.
+package clock
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// stepCount counts the number of wall clock steps detected
+	stepCount = expvar.NewInt("clock_steps_total")
+	// lastStep records the size in seconds of the most recent wall clock step, negative if backwards
+	lastStep = expvar.NewFloat("clock_last_step_seconds")
+)
+
+const (
+	// DefaultThreshold is the smallest difference between the wall and
+	// monotonic clocks counted as a step.  Smaller corrections are slewed by
+	// NTP, not stepped.
+	DefaultThreshold = time.Second
+
+	// maxSteps is the number of steps remembered for correcting timestamps.
+	maxSteps = 100
+)
+
+// Step is a detected jump in the wall clock.
+type Step struct {
+	Before time.Time     // The last wall clock reading known to be before the step.
+	Size   time.Duration // How far the wall clock jumped, negative if backwards.
+}
+
+// Detector detects steps by comparing the time elapsed on the wall clock
+// against the monotonic clock between calls to Check.
+type Detector struct {
+	threshold time.Duration
+	now       func() (wall time.Time, mono time.Duration)
+
+	mu       sync.Mutex
+	lastWall time.Time
+	lastMono time.Duration
+	steps    []Step // Detected steps, oldest first.
+}
+
+// Default is the Detector for the system clock shared by the whole process,
+// so that each step is only counted once.
+var Default = NewDetector(DefaultThreshold)
+
+// NewDetector creates a Detector for the system clock that reports steps of at
+// least threshold.
+func NewDetector(threshold time.Duration) *Detector {
+	start := time.Now()
+	return &Detector{
+		threshold: threshold,
+		now: func() (time.Time, time.Duration) {
+			t := time.Now()
+			return t.Round(0), t.Sub(start)
+		},
+	}
+}
+
+// Check returns the size of the step in the wall clock since the last call, or
+// zero if there was none.  The first call only records the current time.
+func (d *Detector) Check() time.Duration {
+	wall, mono := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lastWall.IsZero() {
+		d.lastWall, d.lastMono = wall, mono
+		return 0
+	}
+	step := wall.Sub(d.lastWall) - (mono - d.lastMono)
+	before := d.lastWall
+	d.lastWall, d.lastMono = wall, mono
+	if step < d.threshold && step > -d.threshold {
+		return 0
+	}
+	glog.Warningf("Wall clock stepped by %s", step)
+	stepCount.Add(1)
+	lastStep.Set(step.Seconds())
+	d.steps = append(d.steps, Step{before, step})
+	if len(d.steps) > maxSteps {
+		d.steps = d.steps[len(d.steps)-maxSteps:]
+	}
+	return step
+}
+
+// StartCheckLoop runs a permanent goroutine to check for steps every
+// duration.  Checking often narrows the window in which a timestamp can't be
+// placed either side of a step.
+func (d *Detector) StartCheckLoop(duration time.Duration) {
+	if duration <= 0 {
+		glog.Info("Clock step detection disabled")
+		return
+	}
+	go func() {
+		glog.Infof("Starting clock step check loop every %s", duration.String())
+		d.Check()
+		ticker := time.NewTicker(duration)
+		for range ticker.C {
+			d.Check()
+		}
+	}()
+}
+
+// Now returns the current wall clock time.
+func (d *Detector) Now() time.Time {
+	wall, _ := d.now()
+	return wall
+}
+
+// Correct moves the wall clock timestamp t by the size of every detected step
+// that happened after it, so that it can be compared with the current time.
+func (d *Detector) Correct(t time.Time) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.steps {
+		if !t.After(s.Before) {
+			t = t.Add(s.Size)
+		}
+	}
+	return t
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, advance := NewFakeDetector(time.Second, start)
+	if step := d.Check(); step != 0 {
+		t.Errorf("first check: got step %s", step)
+	}
+
+	advance(time.Minute, 0)
+	if step := d.Check(); step != 0 {
+		t.Errorf("no step: got step %s", step)
+	}
+
+	// Slews below the threshold are not steps.
+	advance(time.Minute, 500*time.Millisecond)
+	if step := d.Check(); step != 0 {
+		t.Errorf("small correction: got step %s", step)
+	}
+
+	advance(time.Minute, time.Hour)
+	if step := d.Check(); step != time.Hour {
+		t.Errorf("forward step: got %s, want 1h", step)
+	}
+
+	advance(time.Minute, -2*time.Hour)
+	if step := d.Check(); step != -2*time.Hour {
+		t.Errorf("backward step: got %s, want -2h", step)
+	}
+}
+
+func TestCorrect(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, advance := NewFakeDetector(time.Second, start)
+	d.Check()
+	before := start.Add(-time.Minute)
+	if c := d.Correct(before); !c.Equal(before) {
+		t.Errorf("no steps: got %s, want %s", c, before)
+	}
+
+	advance(time.Minute, time.Hour)
+	d.Check()
+	after := start.Add(time.Hour + 2*time.Minute)
+	if c := d.Correct(before); !c.Equal(before.Add(time.Hour)) {
+		t.Errorf("before step: got %s, want %s", c, before.Add(time.Hour))
+	}
+	if c := d.Correct(after); !c.Equal(after) {
+		t.Errorf("after step: got %s, want %s", c, after)
+	}
+
+	advance(time.Minute, -30*time.Minute)
+	d.Check()
+	if c := d.Correct(before); !c.Equal(before.Add(30 * time.Minute)) {
+		t.Errorf("before both steps: got %s, want %s", c, before.Add(30*time.Minute))
+	}
+}
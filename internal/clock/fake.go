@@ -0,0 +1,32 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// NewFakeDetector returns a Detector for a fake clock starting at start, for
+// use in tests, and a function that advances the fake clock by elapsed and
+// then steps its wall clock by step.
+func NewFakeDetector(threshold time.Duration, start time.Time) (*Detector, func(elapsed, step time.Duration)) {
+	var mu sync.Mutex
+	wall, mono := start, time.Duration(0)
+	d := &Detector{
+		threshold: threshold,
+		now: func() (time.Time, time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			return wall, mono
+		},
+	}
+	advance := func(elapsed, step time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		wall = wall.Add(elapsed + step)
+		mono += elapsed
+	}
+	return d, advance
+}
@@ -37,11 +37,11 @@ func metricToCollectd(hostname string, m *metrics.Metric, l *metrics.LabelSet) s
 		formatLabels(m.Name, l.Labels, "-", "-", "_"),
 		*pushInterval,
 		l.Datum.TimeString(),
-		l.Datum.ValueString())
+		formatValue(l.Datum))
 }
 
 func kindToCollectdType(kind metrics.Kind) string {
-	if kind != metrics.Timer {
+	if kind != metrics.Timer && kind != metrics.Bool && kind != metrics.EWMA && kind != metrics.Unique && kind != metrics.Min && kind != metrics.Max && kind != metrics.Stddev {
 		return strings.ToLower(kind.String())
 	}
 	return "gauge"
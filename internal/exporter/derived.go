@@ -0,0 +1,349 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Derived is a metric computed from the metrics in the store each time they
+// are collected, by an arithmetic expression over their names and numbers,
+// e.g. `{"name": "http_error_ratio", "expr": "http_errors_total /
+// http_requests_total"}`.
+type Derived struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+var (
+	// derivedMetricCollisions counts the collections that left out a derived
+	// metric because a program exports a metric of the same name.
+	derivedMetricCollisions = expvar.NewInt("derived_metric_collisions_total")
+)
+
+// metricNameRE matches valid metric names, including the colons used by
+// convention in the names of derived metrics.
+var metricNameRE = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// derivedMetric is a compiled Derived.
+type derivedMetric struct {
+	Derived
+	expr derivedExpr
+	refs []string // names of the metrics in expr, in order of first use
+}
+
+// derivedExpr is a node of the expression of a derived metric.
+type derivedExpr interface {
+	eval(values map[string]float64) float64
+}
+
+type derivedNum float64
+
+func (n derivedNum) eval(map[string]float64) float64 { return float64(n) }
+
+type derivedRef string
+
+func (r derivedRef) eval(values map[string]float64) float64 { return values[string(r)] }
+
+type derivedOp struct {
+	op       byte
+	lhs, rhs derivedExpr
+}
+
+func (o *derivedOp) eval(values map[string]float64) float64 {
+	a, b := o.lhs.eval(values), o.rhs.eval(values)
+	switch o.op {
+	case '+':
+		return a + b
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	}
+	return a / b
+}
+
+// DerivedMetrics sets the metrics computed from the store when the Exporter is
+// collected by Prometheus.
+func DerivedMetrics(defs []Derived) func(*Exporter) error {
+	return func(e *Exporter) error {
+		names := make(map[string]bool)
+		for _, d := range defs {
+			if !metricNameRE.MatchString(d.Name) {
+				return errors.Errorf("invalid derived metric name %q", d.Name)
+			}
+			if names[d.Name] {
+				return errors.Errorf("derived metric %q defined twice", d.Name)
+			}
+			names[d.Name] = true
+			dm, err := compileDerived(d)
+			if err != nil {
+				return err
+			}
+			e.derived = append(e.derived, dm)
+		}
+		return nil
+	}
+}
+
+// compileDerived parses the expression of d.
+func compileDerived(d Derived) (*derivedMetric, error) {
+	p := &derivedParser{tokens: scanDerived(d.Expr)}
+	expr, err := p.sum()
+	if err == nil && p.pos < len(p.tokens) {
+		err = errors.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err == nil && len(p.refs) == 0 {
+		err = errors.New("no metrics in expression")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad expression %q for derived metric %q", d.Expr, d.Name)
+	}
+	return &derivedMetric{Derived: d, expr: expr, refs: p.refs}, nil
+}
+
+// scanDerived splits s into numbers, names, and operators.
+func scanDerived(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		r := rune(s[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '.' || unicode.IsDigit(r) || r == '_' || r == ':' || unicode.IsLetter(r):
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || s[j] == '_' || s[j] == ':' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+// derivedParser is a recursive descent parser of derived metric expressions.
+type derivedParser struct {
+	tokens []string
+	pos    int
+	refs   []string
+}
+
+func (p *derivedParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// sum parses terms separated by + and -.
+func (p *derivedParser) sum() (derivedExpr, error) {
+	lhs, err := p.product()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		var rhs derivedExpr
+		rhs, err = p.product()
+		lhs = &derivedOp{op, lhs, rhs}
+	}
+	return lhs, err
+}
+
+// product parses factors separated by * and /.
+func (p *derivedParser) product() (derivedExpr, error) {
+	lhs, err := p.factor()
+	for err == nil && (p.peek() == "*" || p.peek() == "/") {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		var rhs derivedExpr
+		rhs, err = p.factor()
+		lhs = &derivedOp{op, lhs, rhs}
+	}
+	return lhs, err
+}
+
+// factor parses a number, a metric name, a negated factor, or a parenthesised
+// sum.
+func (p *derivedParser) factor() (derivedExpr, error) {
+	t := p.peek()
+	p.pos++
+	switch {
+	case t == "":
+		return nil, errors.New("unexpected end of expression")
+	case t == "-":
+		e, err := p.factor()
+		return &derivedOp{'-', derivedNum(0), e}, err
+	case t == "(":
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return e, nil
+	case t[0] == '.' || unicode.IsDigit(rune(t[0])):
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, errors.Errorf("bad number %q", t)
+		}
+		return derivedNum(f), nil
+	case metricNameRE.MatchString(t):
+		found := false
+		for _, r := range p.refs {
+			found = found || r == t
+		}
+		if !found {
+			p.refs = append(p.refs, t)
+		}
+		return derivedRef(t), nil
+	}
+	return nil, errors.Errorf("unexpected %q", t)
+}
+
+// derivedSeries is one value of a metric referred to by a derived metric.
+type derivedSeries struct {
+	prog   string
+	labels map[string]string
+	value  float64
+}
+
+// seriesKey identifies the series of a program with the given labels.
+func seriesKey(prog string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(prog)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\x00%s=%s", k, labels[k])
+	}
+	return b.String()
+}
+
+// storeSeries returns the series of the numeric metrics named name, by
+// seriesKey.  The store must be locked.
+func (e *Exporter) storeSeries(name string) map[string]derivedSeries {
+	r := make(map[string]derivedSeries)
+	for _, m := range e.store.Metrics[name] {
+		m.RLock()
+		switch m.Kind {
+		case metrics.Text, metrics.Histogram, metrics.Summary:
+			m.RUnlock()
+			continue
+		}
+		for _, lv := range m.LabelValues {
+			labels := make(map[string]string, len(m.Keys))
+			for i, k := range m.Keys {
+				if i < len(lv.Labels) {
+					labels[k] = lv.Labels[i]
+				}
+			}
+			r[seriesKey(m.Program, labels)] = derivedSeries{m.Program, labels, promValueForDatum(lv.Value)}
+		}
+		m.RUnlock()
+	}
+	return r
+}
+
+// evalDerived returns the series of the derived metric d.  Each series has
+// the labels of a series of the first metric in the expression with labels,
+// and is computed from the series of each metric with the same program and
+// labels, or from its only series if it has no labels.  Series missing from
+// a metric, and those whose value isn't a number, like after a division by
+// zero, are left out.  The store must be locked.
+func (e *Exporter) evalDerived(d *derivedMetric) []derivedSeries {
+	series := make(map[string]map[string]derivedSeries, len(d.refs))
+	var labelled map[string]derivedSeries
+	for _, ref := range d.refs {
+		series[ref] = e.storeSeries(ref)
+		for _, s := range series[ref] {
+			if labelled == nil && len(s.labels) > 0 {
+				labelled = series[ref]
+			}
+		}
+	}
+	if labelled == nil {
+		labelled = series[d.refs[0]]
+	}
+	var r []derivedSeries
+	values := make(map[string]float64, len(d.refs))
+Series:
+	for key, s := range labelled {
+		for _, ref := range d.refs {
+			v, ok := series[ref][key]
+			if !ok {
+				v, ok = series[ref][seriesKey(s.prog, nil)]
+			}
+			if !ok {
+				continue Series
+			}
+			values[ref] = v.value
+		}
+		s.value = d.expr.eval(values)
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		r = append(r, s)
+	}
+	return r
+}
+
+// collectDerived sends the values of the derived metrics, with the labels of
+// the program they are derived from.  A derived metric with the name of a
+// metric in the store is left out, as Prometheus fails the whole collection
+// of a name exported with two sets of labels.  The store must be locked.
+func (e *Exporter) collectDerived(c chan<- prometheus.Metric) {
+	if len(e.derived) == 0 {
+		return
+	}
+	names := make(map[string]bool, len(e.store.Metrics))
+	for name := range e.store.Metrics {
+		names[noHyphens(name)] = true
+	}
+	for _, d := range e.derived {
+		if names[d.Name] {
+			glog.Errorf("Not exporting derived metric %q, as a program exports a metric of the same name", d.Name)
+			derivedMetricCollisions.Add(1)
+			continue
+		}
+		for _, s := range e.evalDerived(d) {
+			var keys, vals []string
+			if !e.omitProgLabel {
+				keys = append(keys, "prog")
+				vals = append(vals, s.prog)
+			}
+			for k, v := range e.programLabelsOf(s.prog, s.labels) {
+				keys = append(keys, k)
+				vals = append(vals, v)
+			}
+			pM, err := prometheus.NewConstMetric(
+				prometheus.NewDesc(d.Name, fmt.Sprintf("derived from %s", d.Expr), keys, nil),
+				prometheus.GaugeValue, s.value, vals...)
+			if err != nil {
+				glog.Warning(err)
+				continue
+			}
+			c <- pM
+		}
+	}
+}
@@ -12,11 +12,15 @@ import (
 	"io"
 	"net"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/pkg/errors"
 )
 
@@ -24,7 +28,9 @@ import (
 var (
 	pushInterval = flag.Int("metric_push_interval_seconds", 60,
 		"Interval between metric pushes, in seconds.")
-	writeDeadline = flag.Duration("metric_push_write_deadline", 10*time.Second, "Time to wait for a push to succeed before exiting with an error.")
+	writeDeadline  = flag.Duration("metric_push_write_deadline", 10*time.Second, "Time to wait for a push to succeed before exiting with an error.")
+	floatPrecision = flag.Int("metric_float_precision", -1, "Number of decimal places of the float values pushed to Graphite, statsd and collectd and shown on /varz, written without an exponent.  If negative, floats are written in their shortest form, which may use an exponent.")
+	pushChanges    = flag.Bool("metric_push_changes_only", false, "Push only the values that have changed since the last successful push to each service, instead of every value.")
 )
 
 // Exporter manages the export of metrics to passive and active collectors.
@@ -34,8 +40,15 @@ type Exporter struct {
 	omitProgLabel bool
 	emitTimestamp bool
 	pushTargets   []pushOptions
+	pushSeqs      []uint64 // datum sequence number of the last successful push to each target
+
+	programLabels map[string]map[string]string // constant labels to add to each program's metrics, by program name
+	derived       []*derivedMetric             // metrics computed from the store when collected
 }
 
+// labelNameRE matches valid label names.
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
 // Hostname is an option that specifies the mtail hostname to use in exported metrics.
 func Hostname(hostname string) func(*Exporter) error {
 	return func(e *Exporter) error {
@@ -50,6 +63,26 @@ func OmitProgLabel(e *Exporter) error {
 	return nil
 }
 
+// ProgramLabels sets constant labels to add to every metric exported by each
+// program, keyed by program name.  A label of the same name declared by the
+// metric itself takes precedence.
+func ProgramLabels(labels map[string]map[string]string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		for program, l := range labels {
+			for k := range l {
+				if !labelNameRE.MatchString(k) {
+					return errors.Errorf("invalid label name %q for program %q", k, program)
+				}
+				if k == "prog" || k == "instance" {
+					return errors.Errorf("label name %q for program %q is reserved", k, program)
+				}
+			}
+		}
+		e.programLabels = labels
+		return nil
+	}
+}
+
 // EmitTimestamp instructs the exporter to send metric's timestamps to collectors.
 func EmitTimestamp(e *Exporter) error {
 	e.emitTimestamp = true
@@ -100,6 +133,26 @@ func (e *Exporter) SetOption(options ...func(*Exporter) error) error {
 	return nil
 }
 
+// formatValue returns the value of d for the text protocols, with float
+// values written to floatPrecision decimal places, unless it is negative.
+func formatValue(d datum.Datum) string {
+	if *floatPrecision < 0 {
+		return d.ValueString()
+	}
+	var f float64
+	switch v := d.(type) {
+	case *datum.FloatDatum:
+		f = v.Get()
+	case *datum.BucketsDatum:
+		f = v.Sum()
+	case *datum.QuantilesDatum:
+		f = v.Sum()
+	default:
+		return d.ValueString()
+	}
+	return strconv.FormatFloat(f, 'f', *floatPrecision, 64)
+}
+
 // formatLabels converts a metric name and key-value map of labels to a single
 // string for exporting to the correct output format for each export target.
 // ksep and sep mark what to use for key/val separator, and between label separators respoectively.
@@ -118,44 +171,68 @@ func formatLabels(name string, m map[string]string, ksep, sep, rep string) strin
 	return r
 }
 
+// withProgramLabels returns the LabelSet l with the constant labels of the
+// program that exports m added.
+func (e *Exporter) withProgramLabels(m *metrics.Metric, l *metrics.LabelSet) *metrics.LabelSet {
+	if len(e.programLabels[m.Program]) == 0 {
+		return l
+	}
+	return &metrics.LabelSet{Labels: e.programLabelsOf(m.Program, l.Labels), Datum: l.Datum}
+}
+
+// programLabelsOf returns the labels with the constant labels of the program
+// prog added.  The labels take precedence over the program's labels of the
+// same name.
+func (e *Exporter) programLabelsOf(prog string, labels map[string]string) map[string]string {
+	pl := e.programLabels[prog]
+	if len(pl) == 0 {
+		return labels
+	}
+	r := make(map[string]string, len(pl)+len(labels))
+	for k, v := range pl {
+		r[k] = v
+	}
+	for k, v := range labels {
+		r[k] = v
+	}
+	return r
+}
+
 // Format a LabelSet into a string to be written to one of the timeseries
 // sockets.
 type formatter func(string, *metrics.Metric, *metrics.LabelSet) string
 
-func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
-	e.store.RLock()
-	defer e.store.RUnlock()
-
-	for _, ml := range e.store.Metrics {
-		for _, m := range ml {
-			m.RLock()
-			// Don't try to send text metrics to any push service.
-			if m.Kind == metrics.Text {
-				m.RUnlock()
-				continue
-			}
-			exportTotal.Add(1)
-			lc := make(chan *metrics.LabelSet)
-			go m.EmitLabelSets(lc)
-			for l := range lc {
-				line := f(e.hostname, m, l)
-				n, err := fmt.Fprint(c, line)
-				glog.V(2).Infof("Sent %d bytes\n", n)
-				if err == nil {
-					exportSuccess.Add(1)
-				} else {
-					return errors.Errorf("write error: %s\n", err)
+func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, ms []*metrics.Metric, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
+	for _, m := range ms {
+		// Don't try to send text metrics to any push service.
+		if m.Kind == metrics.Text {
+			continue
+		}
+		exportTotal.Add(1)
+		lc := make(chan *metrics.LabelSet)
+		go m.EmitLabelSets(lc)
+		for l := range lc {
+			line := f(e.hostname, m, e.withProgramLabels(m, l))
+			n, err := fmt.Fprint(c, line)
+			glog.V(2).Infof("Sent %d bytes\n", n)
+			if err == nil {
+				exportSuccess.Add(1)
+			} else {
+				// Drain the label sets so the emitter can finish.
+				for range lc {
 				}
+				return errors.Errorf("write error: %s\n", err)
 			}
-			m.RUnlock()
 		}
 	}
 	return nil
 }
 
 // PushMetrics sends metrics to each of the configured services.
+// With --metric_push_changes_only, only the values that have changed since
+// the last successful push to a service are sent to it.
 func (e *Exporter) PushMetrics() {
-	for _, target := range e.pushTargets {
+	for i, target := range e.pushTargets {
 		glog.V(2).Infof("pushing to %s", target.addr)
 		conn, err := net.DialTimeout(target.net, target.addr, *writeDeadline)
 		if err != nil {
@@ -166,9 +243,16 @@ func (e *Exporter) PushMetrics() {
 		if err != nil {
 			glog.Infof("Couldn't set deadline on connection: %s", err)
 		}
-		err = e.writeSocketMetrics(conn, target.f, target.total, target.success)
+		var since uint64
+		if *pushChanges {
+			since = e.pushSeqs[i]
+		}
+		ms, seq := e.store.Changes(since)
+		err = e.writeSocketMetrics(conn, target.f, ms, target.total, target.success)
 		if err != nil {
 			glog.Infof("pusher write error: %s", err)
+		} else {
+			e.pushSeqs[i] = seq
 		}
 		err = conn.Close()
 		if err != nil {
@@ -179,12 +263,17 @@ func (e *Exporter) PushMetrics() {
 }
 
 // StartMetricPush pushes metrics to the configured services each interval.
+// The interval is measured on the monotonic clock, so a step in the wall
+// clock doesn't cause a burst of pushes or a gap, but it is checked for on
+// each push so that the timestamps either side of it can be explained.
 func (e *Exporter) StartMetricPush() {
 	if len(e.pushTargets) > 0 {
 		glog.Info("Started metric push.")
 		ticker := time.NewTicker(time.Duration(*pushInterval) * time.Second)
 		go func() {
+			clock.Default.Check()
 			for range ticker.C {
+				clock.Default.Check()
 				e.PushMetrics()
 			}
 		}()
@@ -202,4 +291,5 @@ type pushOptions struct {
 // pushed to each pushInterval.
 func (e *Exporter) RegisterPushExport(p pushOptions) {
 	e.pushTargets = append(e.pushTargets, p)
+	e.pushSeqs = append(e.pushSeqs, 0)
 }
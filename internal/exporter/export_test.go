@@ -36,6 +36,20 @@ func TestCreateExporter(t *testing.T) {
 	}
 }
 
+func TestProgramLabelsInvalid(t *testing.T) {
+	store := metrics.NewStore()
+	for _, l := range []map[string]string{
+		{"0team": "payments"},
+		{"team-name": "payments"},
+		{"prog": "payments"},
+		{"instance": "payments"},
+	} {
+		if _, err := New(store, ProgramLabels(map[string]map[string]string{"test.mtail": l})); err == nil {
+			t.Errorf("expected error for labels %v", l)
+		}
+	}
+}
+
 func FakeSocketWrite(f formatter, m *metrics.Metric) []string {
 	// TODO(jaq): urgh looking inside m to find preallocation size
 	ret := make([]string, 0, len(m.LabelValues))
@@ -190,3 +204,35 @@ func TestMetricToStatsd(t *testing.T) {
 		t.Errorf("prefixed string didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
 }
+
+func TestFloatPrecision(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Float)
+	d, _ := m.GetDatum()
+	datum.SetFloat(d, 2.0/3, ts)
+	i := metrics.NewMetric("bar", "prog", metrics.Gauge, metrics.Int)
+	di, _ := i.GetDatum()
+	datum.SetInt(di, 37, ts)
+	big := metrics.NewMetric("big", "prog", metrics.Gauge, metrics.Float)
+	db, _ := big.GetDatum()
+	datum.SetFloat(db, 1.5e21, ts)
+	defer func(p int, g string) { *floatPrecision, *graphitePrefix = p, g }(*floatPrecision, *graphitePrefix)
+	*graphitePrefix = ""
+	for _, tc := range []struct {
+		precision int
+		expected  []string
+	}{
+		{-1, []string{"prog.foo 0.6666666666666666 1343124840\n", "prog.bar 37 1343124840\n", "prog.big 1.5e+21 1343124840\n"}},
+		{3, []string{"prog.foo 0.667 1343124840\n", "prog.bar 37 1343124840\n", "prog.big 1500000000000000000000.000 1343124840\n"}},
+		{0, []string{"prog.foo 1 1343124840\n", "prog.bar 37 1343124840\n", "prog.big 1500000000000000000000 1343124840\n"}},
+	} {
+		*floatPrecision = tc.precision
+		var r []string
+		for _, m := range []*metrics.Metric{m, i, big} {
+			r = append(r, FakeSocketWrite(metricToGraphite, m)...)
+		}
+		if diff := testutil.Diff(tc.expected, r); diff != "" {
+			t.Errorf("precision %d: %s", tc.precision, diff)
+		}
+	}
+}
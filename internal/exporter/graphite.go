@@ -28,6 +28,6 @@ func metricToGraphite(hostname string, m *metrics.Metric, l *metrics.LabelSet) s
 		*graphitePrefix,
 		m.Program,
 		formatLabels(m.Name, l.Labels, ".", ".", "_"),
-		l.Datum.ValueString(),
+		formatValue(l.Datum),
 		l.Datum.TimeString())
 }
@@ -7,17 +7,41 @@ import (
 	"encoding/json"
 	"expvar"
 	"net/http"
+	"strconv"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 )
 
 var (
 	exportJSONErrors = expvar.NewInt("exporter_json_errors")
 )
 
-// HandleJSON exports the metrics in JSON format via HTTP.
+// HandleJSON exports the metrics in JSON format via HTTP.  If the request has
+// a since parameter, only the values that have changed since that datum
+// sequence number are exported.  The sequence number to pass to get the
+// changes after this request is returned in the X-Mtail-Sequence header.
 func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := json.MarshalIndent(e.store, "", "  ")
+	var since uint64
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var b []byte
+	var err error
+	seq := datum.Seq()
+	if since == 0 {
+		b, err = json.MarshalIndent(e.store, "", "  ")
+	} else {
+		var ms []*metrics.Metric
+		ms, seq = e.store.Changes(since)
+		b, err = json.MarshalIndent(ms, "", "  ")
+	}
 	if err != nil {
 		exportJSONErrors.Add(1)
 		glog.Info("error marshalling metrics into json:", err.Error())
@@ -25,6 +49,7 @@ func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("content-type", "application/json")
+	w.Header().Set("X-Mtail-Sequence", strconv.FormatUint(seq, 10))
 	if _, err := w.Write(b); err != nil {
 		glog.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -84,6 +84,32 @@ var handleJSONTests = []struct {
       }
     ]
   }
+]`,
+	},
+	{"text",
+		[]*metrics.Metric{
+			{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Text,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeString("hi", time.Unix(0, 0))}},
+			},
+		},
+		`[
+  {
+    "Name": "foo",
+    "Program": "test",
+    "Kind": 4,
+    "Type": 0,
+    "LabelValues": [
+      {
+        "Value": {
+          "Value": "hi",
+          "Time": 0
+        }
+      }
+    ]
+  }
 ]`,
 	},
 }
@@ -117,3 +143,35 @@ func TestHandleJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleJSONSince(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "test", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, ms.Add(m))
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Unix(0, 0))
+	e, err := New(ms, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+
+	response := httptest.NewRecorder()
+	e.HandleJSON(response, httptest.NewRequest("GET", "/json", nil))
+	seq := response.Header().Get("X-Mtail-Sequence")
+	if seq == "" {
+		t.Fatal("no sequence number in response")
+	}
+
+	response = httptest.NewRecorder()
+	e.HandleJSON(response, httptest.NewRequest("GET", "/json?since="+seq, nil))
+	b, err := ioutil.ReadAll(response.Body)
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff("[]", string(b)); diff != "" {
+		t.Errorf("expected no changes: %s", diff)
+	}
+
+	response = httptest.NewRecorder()
+	e.HandleJSON(response, httptest.NewRequest("GET", "/json?since=x", nil))
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("response code not 400: %d", response.Code)
+	}
+}
@@ -35,21 +35,29 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 
 	for _, ml := range e.store.Metrics {
 		lastSource := ""
+		// Prometheus needs one help text for all the metrics of a name, so
+		// the first declared help is used, or else where the first was
+		// defined.
+		help := ""
 		for _, m := range ml {
-			m.RLock()
-			// We don't have a way of converting text metrics to prometheus format.
-			if m.Kind == metrics.Text {
-				m.RUnlock()
-				continue
+			if help == "" {
+				help = m.Help
 			}
+		}
+		for _, m := range ml {
+			m.RLock()
 			metricExportTotal.Add(1)
 
 			lsc := make(chan *metrics.LabelSet)
 			go m.EmitLabelSets(lsc)
 			for ls := range lsc {
+				ls = e.withProgramLabels(m, ls)
 				if lastSource == "" {
 					lastSource = m.Source
 				}
+				if help == "" {
+					help = fmt.Sprintf("defined at %s", lastSource)
+				}
 				var keys []string
 				var vals []string
 				if !e.omitProgLabel {
@@ -62,18 +70,36 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 				}
 				var pM prometheus.Metric
 				var err error
-				if m.Kind == metrics.Histogram {
+				switch m.Kind {
+				case metrics.Text:
+					// Text metrics are exported like info metrics, as a
+					// gauge of 1 with the text in the label "value".
+					pM, err = prometheus.NewConstMetric(
+						prometheus.NewDesc(noHyphens(m.Name),
+							help, append(keys, textValueLabel), nil),
+						prometheus.GaugeValue,
+						1,
+						append(vals, ls.Datum.ValueString())...)
+				case metrics.Histogram:
 					pM, err = prometheus.NewConstHistogram(
 						prometheus.NewDesc(noHyphens(m.Name),
-							fmt.Sprintf("defined at %s", lastSource), keys, nil),
+							help, keys, nil),
 						datum.GetBucketsCount(ls.Datum),
 						datum.GetBucketsSum(ls.Datum),
 						datum.GetBucketsByMax(ls.Datum),
 						vals...)
-				} else {
+				case metrics.Summary:
+					pM, err = prometheus.NewConstSummary(
+						prometheus.NewDesc(noHyphens(m.Name),
+							help, keys, nil),
+						datum.GetQuantilesCount(ls.Datum),
+						datum.GetQuantilesSum(ls.Datum),
+						datum.GetQuantiles(ls.Datum),
+						vals...)
+				default:
 					pM, err = prometheus.NewConstMetric(
 						prometheus.NewDesc(noHyphens(m.Name),
-							fmt.Sprintf("defined at %s", lastSource), keys, nil),
+							help, keys, nil),
 						promTypeForKind(m.Kind),
 						promValueForDatum(ls.Datum),
 						vals...)
@@ -96,15 +122,19 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 			m.RUnlock()
 		}
 	}
+	e.collectDerived(c)
 }
 
+// textValueLabel is the label holding the value of a text metric.
+const textValueLabel = "value"
+
 func promTypeForKind(k metrics.Kind) prometheus.ValueType {
 	switch k {
 	case metrics.Counter:
 		return prometheus.CounterValue
 	case metrics.Gauge:
 		return prometheus.GaugeValue
-	case metrics.Timer:
+	case metrics.Timer, metrics.Bool, metrics.EWMA, metrics.Unique, metrics.Min, metrics.Max, metrics.Stddev:
 		return prometheus.GaugeValue
 	}
 	return prometheus.UntypedValue
@@ -116,6 +146,8 @@ func promValueForDatum(d datum.Datum) float64 {
 		return float64(n.Get())
 	case *datum.FloatDatum:
 		return n.Get()
+	case *datum.DistinctDatum:
+		return float64(n.Count())
 	}
 	return 0.
 }
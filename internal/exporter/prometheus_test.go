@@ -106,7 +106,46 @@ foo{} 1
 				Kind:        metrics.Text,
 				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeString("hi", time.Unix(0, 0))}}},
 		},
-		"",
+		`# HELP foo defined at 
+# TYPE foo gauge
+foo{prog="test",value="hi"} 1
+`,
+	},
+	{"text with keys",
+		false,
+		[]*metrics.Metric{
+			{
+				Name:        "deployed_version",
+				Program:     "test",
+				Kind:        metrics.Text,
+				Keys:        []string{"host"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"web1"}, Value: datum.MakeString("v1.2.3", time.Unix(0, 0))}}},
+		},
+		`# HELP deployed_version defined at 
+# TYPE deployed_version gauge
+deployed_version{host="web1",prog="test",value="v1.2.3"} 1
+`,
+	},
+	{"help",
+		false,
+		[]*metrics.Metric{
+			{
+				Name:        "errors_total",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				Help:        "Count of ERROR lines",
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(3, time.Unix(0, 0))}}},
+			{
+				Name:        "errors_total",
+				Program:     "other",
+				Kind:        metrics.Counter,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(0, 0))}}},
+		},
+		`# HELP errors_total Count of ERROR lines
+# TYPE errors_total counter
+errors_total{prog="other"} 1
+errors_total{prog="test"} 3
+`,
 	},
 	{"quotes",
 		false,
@@ -183,6 +222,25 @@ foo_bucket{a="bar",prog="test",le="2"} 0
 foo_bucket{a="bar",prog="test",le="+Inf"} 0
 foo_sum{a="bar",prog="test"} 0
 foo_count{a="bar",prog="test"} 0
+`,
+	},
+	{"summary",
+		true,
+		[]*metrics.Metric{
+			{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Summary,
+				Keys:        []string{"a"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"bar"}, Value: datum.MakeQuantiles([]float64{0.5}, time.Unix(0, 0))}},
+				Source:      "location.mtail:37",
+			},
+		},
+		`# HELP foo defined at location.mtail:37
+# TYPE foo summary
+foo{a="bar",prog="test",quantile="0.5"} NaN
+foo_sum{a="bar",prog="test"} 0
+foo_count{a="bar",prog="test"} 0
 `,
 	},
 }
@@ -211,3 +269,170 @@ func TestHandlePrometheus(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlePrometheusProgramLabels(t *testing.T) {
+	ms := metrics.NewStore()
+	for _, m := range []*metrics.Metric{
+		{
+			Name:        "foo",
+			Program:     "payments.mtail",
+			Kind:        metrics.Counter,
+			Keys:        []string{"team"},
+			LabelValues: []*metrics.LabelValue{{Labels: []string{"override"}, Value: datum.MakeInt(1, time.Unix(0, 0))}}},
+		{
+			Name:        "bar",
+			Program:     "payments.mtail",
+			Kind:        metrics.Counter,
+			LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(2, time.Unix(0, 0))}}},
+		{
+			Name:        "baz",
+			Program:     "other.mtail",
+			Kind:        metrics.Counter,
+			LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(3, time.Unix(0, 0))}}},
+	} {
+		testutil.FatalIfErr(t, ms.Add(m))
+	}
+	e, err := New(ms, Hostname("gunstar"), ProgramLabels(map[string]map[string]string{
+		"payments.mtail": {"team": "payments", "tier": "1"},
+	}))
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP bar defined at 
+# TYPE bar counter
+bar{prog="payments.mtail",team="payments",tier="1"} 2
+# HELP baz defined at 
+# TYPE baz counter
+baz{prog="other.mtail"} 3
+# HELP foo defined at 
+# TYPE foo counter
+foo{prog="payments.mtail",team="override",tier="1"} 1
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlePrometheusDerived(t *testing.T) {
+	ms := metrics.NewStore()
+	for _, m := range []*metrics.Metric{
+		{
+			Name:    "errors_total",
+			Program: "web.mtail",
+			Kind:    metrics.Counter,
+			Keys:    []string{"path"},
+			LabelValues: []*metrics.LabelValue{
+				{Labels: []string{"/"}, Value: datum.MakeInt(1, time.Unix(0, 0))},
+				{Labels: []string{"/api"}, Value: datum.MakeInt(3, time.Unix(0, 0))},
+				{Labels: []string{"/gone"}, Value: datum.MakeInt(3, time.Unix(0, 0))}}},
+		{
+			Name:    "requests_total",
+			Program: "web.mtail",
+			Kind:    metrics.Counter,
+			Keys:    []string{"path"},
+			LabelValues: []*metrics.LabelValue{
+				{Labels: []string{"/"}, Value: datum.MakeInt(4, time.Unix(0, 0))},
+				{Labels: []string{"/api"}, Value: datum.MakeInt(0, time.Unix(0, 0))}}},
+		{
+			Name:        "bytes_total",
+			Program:     "web.mtail",
+			Kind:        metrics.Counter,
+			LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(2048, time.Unix(0, 0))}}},
+	} {
+		testutil.FatalIfErr(t, ms.Add(m))
+	}
+	e, err := New(ms, Hostname("gunstar"), DerivedMetrics([]Derived{
+		{Name: "error_ratio", Expr: "errors_total / requests_total"},
+		{Name: "kilobytes_per_error", Expr: "(bytes_total / 1024) / errors_total"},
+	}))
+	testutil.FatalIfErr(t, err)
+	// /api is left out of the ratio for dividing by zero, and /gone for
+	// having no requests.
+	expected := `# HELP error_ratio derived from errors_total / requests_total
+# TYPE error_ratio gauge
+error_ratio{path="/",prog="web.mtail"} 0.25
+# HELP kilobytes_per_error derived from (bytes_total / 1024) / errors_total
+# TYPE kilobytes_per_error gauge
+kilobytes_per_error{path="/",prog="web.mtail"} 2
+kilobytes_per_error{path="/api",prog="web.mtail"} 0.6666666666666666
+kilobytes_per_error{path="/gone",prog="web.mtail"} 0.6666666666666666
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected), "error_ratio", "kilobytes_per_error"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlePrometheusDerivedProgramLabels(t *testing.T) {
+	ms := metrics.NewStore()
+	for _, m := range []*metrics.Metric{
+		{
+			Name:        "errors_total",
+			Program:     "payments.mtail",
+			Kind:        metrics.Counter,
+			Keys:        []string{"team"},
+			LabelValues: []*metrics.LabelValue{{Labels: []string{"override"}, Value: datum.MakeInt(1, time.Unix(0, 0))}}},
+		{
+			Name:        "requests_total",
+			Program:     "payments.mtail",
+			Kind:        metrics.Counter,
+			Keys:        []string{"team"},
+			LabelValues: []*metrics.LabelValue{{Labels: []string{"override"}, Value: datum.MakeInt(4, time.Unix(0, 0))}}},
+	} {
+		testutil.FatalIfErr(t, ms.Add(m))
+	}
+	e, err := New(ms, Hostname("gunstar"),
+		ProgramLabels(map[string]map[string]string{"payments.mtail": {"team": "payments", "tier": "1"}}),
+		DerivedMetrics([]Derived{{Name: "error_ratio", Expr: "errors_total / requests_total"}}))
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP error_ratio derived from errors_total / requests_total
+# TYPE error_ratio gauge
+error_ratio{prog="payments.mtail",team="override",tier="1"} 0.25
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected), "error_ratio"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlePrometheusDerivedCollision(t *testing.T) {
+	ms := metrics.NewStore()
+	for _, m := range []*metrics.Metric{
+		{
+			Name:        "requests_total",
+			Program:     "web.mtail",
+			Kind:        metrics.Counter,
+			LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(4, time.Unix(0, 0))}}},
+		{
+			Name:        "request_rate",
+			Program:     "web.mtail",
+			Kind:        metrics.Gauge,
+			LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(2, time.Unix(0, 0))}}},
+	} {
+		testutil.FatalIfErr(t, ms.Add(m))
+	}
+	e, err := New(ms, Hostname("gunstar"), DerivedMetrics([]Derived{{Name: "request_rate", Expr: "requests_total / 60"}}))
+	testutil.FatalIfErr(t, err)
+	before := derivedMetricCollisions.Value()
+	// The program's metric is still exported, without the derived one.
+	expected := `# HELP request_rate defined at 
+# TYPE request_rate gauge
+request_rate{prog="web.mtail"} 2
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected), "request_rate"); err != nil {
+		t.Error(err)
+	}
+	if diff := testutil.Diff(int64(1), derivedMetricCollisions.Value()-before); diff != "" {
+		t.Errorf("collisions: %s", diff)
+	}
+}
+
+func TestDerivedMetricsErrors(t *testing.T) {
+	for _, d := range []Derived{
+		{Name: "bad-name", Expr: "a / b"},
+		{Name: "ratio", Expr: "a /"},
+		{Name: "ratio", Expr: "(a / b"},
+		{Name: "ratio", Expr: "a $ b"},
+		{Name: "ratio", Expr: "1 / 2"},
+	} {
+		if _, err := New(metrics.NewStore(), Hostname("gunstar"), DerivedMetrics([]Derived{d})); err == nil {
+			t.Errorf("expected error for %+v", d)
+		}
+	}
+}
@@ -28,7 +28,7 @@ func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) str
 	switch m.Kind {
 	case metrics.Counter:
 		t = "c" // StatsD Counter
-	case metrics.Gauge:
+	case metrics.Gauge, metrics.Bool, metrics.EWMA, metrics.Unique, metrics.Min, metrics.Max, metrics.Stddev:
 		t = "g" // StatsD Gauge
 	case metrics.Timer:
 		t = "ms" // StatsD Timer
@@ -37,5 +37,5 @@ func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) str
 		*statsdPrefix,
 		m.Program,
 		formatLabels(m.Name, l.Labels, ".", ".", "_"),
-		l.Datum.ValueString(), t)
+		formatValue(l.Datum), t)
 }
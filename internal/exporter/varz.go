@@ -33,7 +33,7 @@ func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
 			lc := make(chan *metrics.LabelSet)
 			go m.EmitLabelSets(lc)
 			for l := range lc {
-				line := metricToVarz(m, l, e.omitProgLabel, e.hostname)
+				line := metricToVarz(m, e.withProgramLabels(m, l), e.omitProgLabel, e.hostname)
 				fmt.Fprint(w, line)
 			}
 			m.RUnlock()
@@ -54,5 +54,5 @@ func metricToVarz(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool, ho
 	return fmt.Sprintf(varzFormat,
 		m.Name,
 		strings.Join(s, ","),
-		l.Datum.ValueString())
+		formatValue(l.Datum))
 }
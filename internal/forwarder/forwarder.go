@@ -0,0 +1,229 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package forwarder sends selected log lines on to a remote syslog or HTTP
+// receiver, so that `mtail` programs can act as a filter in front of a log
+// collection service.
+package forwarder
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+var (
+	// forwardLines counts the number of lines successfully sent to the forward target
+	forwardLines = expvar.NewInt("forward_lines_total")
+	// forwardErrors counts the number of errors encountered sending to the forward target
+	forwardErrors = expvar.NewInt("forward_errors_total")
+	// forwardDropped counts the number of lines dropped because the forward queue was full
+	forwardDropped = expvar.NewInt("forward_dropped_total")
+)
+
+const (
+	// queueSize is the number of lines that can be waiting to be sent before
+	// new lines are dropped.
+	queueSize = 1000
+	// maxBatch is the largest number of lines sent in one write or request.
+	maxBatch = 100
+	// timeout bounds each connection attempt, write or HTTP request.
+	timeout = 5 * time.Second
+)
+
+// Forwarder sends log lines to a remote target.  Lines are queued and sent
+// asynchronously so that slow or down targets don't stall the programs.
+type Forwarder struct {
+	target   *url.URL
+	hostname string
+	lines    chan *logline.LogLine
+	done     chan struct{}
+
+	closeOnce sync.Once
+
+	// send writes a batch of lines to the target.
+	send func([]*logline.LogLine) error
+
+	conn   net.Conn     // connection to a syslog target, if open
+	client *http.Client // client for an HTTP target
+}
+
+// New creates a Forwarder that sends to the target URL.  Supported schemes
+// are `syslog+udp` and `syslog+tcp` (e.g. `syslog+udp://loghost:514`), which
+// send RFC 5424 formatted messages, and `http` and `https`, which POST
+// batches of newline separated lines as plain text.
+func New(target string) (*Forwarder, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't parse forward target %q", target)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get hostname")
+	}
+	f := &Forwarder{
+		target:   u,
+		hostname: hostname,
+		lines:    make(chan *logline.LogLine, queueSize),
+		done:     make(chan struct{}),
+	}
+	switch u.Scheme {
+	case "syslog+udp", "syslog+tcp":
+		if u.Host == "" {
+			return nil, errors.Errorf("forward target %q has no host", target)
+		}
+		f.send = f.sendSyslog
+	case "http", "https":
+		f.client = &http.Client{Timeout: timeout}
+		f.send = f.sendHTTP
+	default:
+		return nil, errors.Errorf("unsupported forward target scheme %q", u.Scheme)
+	}
+	go f.run()
+	return f, nil
+}
+
+// Forward queues a line to be sent to the target.  If the queue is full the
+// line is dropped.
+func (f *Forwarder) Forward(l *logline.LogLine) {
+	select {
+	case f.lines <- l:
+	default:
+		forwardDropped.Add(1)
+	}
+}
+
+// run sends queued lines in batches until the queue is closed.
+func (f *Forwarder) run() {
+	defer close(f.done)
+	batch := make([]*logline.LogLine, 0, maxBatch)
+	for l := range f.lines {
+		batch = append(batch[:0], l)
+	Fill:
+		for len(batch) < maxBatch {
+			select {
+			case l, ok := <-f.lines:
+				if !ok {
+					break Fill
+				}
+				batch = append(batch, l)
+			default:
+				break Fill
+			}
+		}
+		if err := f.send(batch); err != nil {
+			glog.Infof("forward to %s failed: %s", f.target, err)
+			forwardErrors.Add(1)
+			continue
+		}
+		forwardLines.Add(int64(len(batch)))
+	}
+	if f.conn != nil {
+		if err := f.conn.Close(); err != nil {
+			glog.Info(err)
+		}
+	}
+}
+
+// Close sends any queued lines and shuts down the Forwarder.
+func (f *Forwarder) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.lines)
+	})
+	<-f.done
+	return nil
+}
+
+// syslogMessage formats a line as an RFC 5424 syslog message, with facility
+// user and severity informational.  The log filename is the APP-NAME.
+func (f *Forwarder) syslogMessage(w io.Writer, l *logline.LogLine) {
+	fmt.Fprintf(w, "<14>1 %s %s %s - - - %s\n",
+		time.Now().UTC().Format(time.RFC3339Nano), f.hostname, appName(l.Filename), l.Line)
+}
+
+// appName returns a valid syslog APP-NAME, which is at most 48 printable
+// characters with no spaces.
+func appName(filename string) string {
+	b := []byte(filename)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	if len(b) > 48 {
+		b = b[len(b)-48:]
+	}
+	return string(b)
+}
+
+func (f *Forwarder) sendSyslog(batch []*logline.LogLine) error {
+	if f.conn == nil {
+		network := f.target.Scheme[len("syslog+"):]
+		c, err := net.DialTimeout(network, f.target.Host, timeout)
+		if err != nil {
+			return err
+		}
+		f.conn = c
+	}
+	if err := f.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		glog.V(1).Info(err)
+	}
+	var err error
+	if f.target.Scheme == "syslog+udp" {
+		// One message per datagram.
+		for _, l := range batch {
+			var b bytes.Buffer
+			f.syslogMessage(&b, l)
+			if _, err = f.conn.Write(b.Bytes()); err != nil {
+				break
+			}
+		}
+	} else {
+		// Newline framed messages on the stream, per RFC 6587.
+		var b bytes.Buffer
+		for _, l := range batch {
+			f.syslogMessage(&b, l)
+		}
+		_, err = f.conn.Write(b.Bytes())
+	}
+	if err != nil {
+		// Reconnect on the next batch.
+		if cerr := f.conn.Close(); cerr != nil {
+			glog.V(1).Info(cerr)
+		}
+		f.conn = nil
+	}
+	return err
+}
+
+func (f *Forwarder) sendHTTP(batch []*logline.LogLine) error {
+	var b bytes.Buffer
+	for _, l := range batch {
+		b.WriteString(l.Line)
+		b.WriteByte('\n')
+	}
+	resp, err := f.client.Post(f.target.String(), "text/plain; charset=utf-8", &b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
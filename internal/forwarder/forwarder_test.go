@@ -0,0 +1,133 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package forwarder
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+func TestNewBadTarget(t *testing.T) {
+	for _, target := range []string{
+		"ftp://loghost",
+		"syslog+udp://",
+		"loghost:514",
+	} {
+		if _, err := New(target); err == nil {
+			t.Errorf("New(%q) expected error", target)
+		}
+	}
+}
+
+func TestForwardHTTP(t *testing.T) {
+	bodies := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		bodies <- string(b)
+	}))
+	defer ts.Close()
+
+	f, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Forward(logline.NewLogLine("log", "hello"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-bodies; got != "hello\n" {
+		t.Errorf("body: got %q, want %q", got, "hello\n")
+	}
+}
+
+func TestForwardSyslogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msgs := make(chan string, 2)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		s := bufio.NewScanner(c)
+		for s.Scan() {
+			msgs <- s.Text()
+		}
+		close(msgs)
+	}()
+
+	f, err := New("syslog+tcp://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Forward(logline.NewLogLine("/var/log/app log", "one"))
+	f.Forward(logline.NewLogLine("/var/log/app log", "two"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"one", "two"} {
+		got := <-msgs
+		if !strings.HasPrefix(got, "<14>1 ") {
+			t.Errorf("message %q missing syslog header", got)
+		}
+		if !strings.HasSuffix(got, " /var/log/app_log - - - "+want) {
+			t.Errorf("message %q doesn't end with app name and %q", got, want)
+		}
+	}
+}
+
+func TestForwardSyslogUDP(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := New("syslog+udp://" + c.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Forward(logline.NewLogLine("log", "hello"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1024)
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); !strings.HasSuffix(got, " log - - - hello\n") {
+		t.Errorf("datagram %q doesn't end with the line", got)
+	}
+}
+
+func TestAppName(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"", "-"},
+		{"/var/log/syslog", "/var/log/syslog"},
+		{"tcpdump -l", "tcpdump_-l"},
+		{strings.Repeat("a", 50), strings.Repeat("a", 48)},
+	} {
+		if got := appName(tc.in); got != tc.want {
+			t.Errorf("appName(%q): got %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
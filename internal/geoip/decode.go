@@ -0,0 +1,171 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package geoip
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// Data section field types.
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEndMarker = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+var errTruncated = errors.New("data field runs past the end of its section")
+
+// decode decodes the data field at off in the section b, and returns it with
+// the offset of the next field.  Maps are decoded as map[string]interface{},
+// arrays as []interface{}, and unsigned integers as uint64, except for
+// uint128 which is a *big.Int.
+func decode(b []byte, off uint) (interface{}, uint, error) {
+	return decodeField(b, off, true)
+}
+
+func decodeField(b []byte, off uint, follow bool) (interface{}, uint, error) {
+	if off >= uint(len(b)) {
+		return nil, 0, errTruncated
+	}
+	ctrl := b[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		// A pointer's size bits select how many bytes follow, and its low
+		// bits are the most significant bits of the offset.
+		n := uint(ctrl>>3&0x3) + 1
+		if off+n > uint(len(b)) {
+			return nil, 0, errTruncated
+		}
+		p := uint(0)
+		if n < 4 {
+			p = uint(ctrl & 0x7)
+		}
+		for _, c := range b[off : off+n] {
+			p = p<<8 | uint(c)
+		}
+		p += [...]uint{0, 2048, 526336, 0}[n-1]
+		if !follow {
+			return nil, 0, errors.New("pointer to a pointer")
+		}
+		v, _, err := decodeField(b, p, false)
+		return v, off + n, err
+	}
+	if typ == typeExtended {
+		if off >= uint(len(b)) {
+			return nil, 0, errTruncated
+		}
+		typ = 7 + uint(b[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(b)) {
+			return nil, 0, errTruncated
+		}
+		size = 0
+		for _, c := range b[off : off+n] {
+			size = size<<8 | uint(c)
+		}
+		size += [...]uint{29, 285, 65821}[n-1]
+		off += n
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			k, next, err := decode(b, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.Errorf("map key is a %T, not a string", k)
+			}
+			m[key], off, err = decode(b, next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]interface{}, 0)
+		for i := uint(0); i < size; i++ {
+			v, next, err := decode(b, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(b)) {
+		return nil, 0, errTruncated
+	}
+	p := b[off : off+size]
+	off += size
+	switch typ {
+	case typeString:
+		return string(p), off, nil
+	case typeBytes:
+		return append([]byte(nil), p...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(uint64(uintOf(p))), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.Errorf("float of %d bytes", size)
+		}
+		return math.Float32frombits(uint32(uintOf(p))), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > [...]uint{typeUint16: 2, typeUint32: 4, typeUint64: 8}[typ] {
+			return nil, 0, errors.Errorf("unsigned integer of type %d has %d bytes", typ, size)
+		}
+		return uintOf(p), off, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.Errorf("int32 of %d bytes", size)
+		}
+		return int32(uint32(uintOf(p))), off, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errors.Errorf("uint128 of %d bytes", size)
+		}
+		return new(big.Int).SetBytes(p), off, nil
+	}
+	return nil, 0, errors.Errorf("unsupported data field type %d", typ)
+}
+
+// uintOf returns the big-endian unsigned integer in p, of at most 8 bytes.
+func uintOf(p []byte) uint64 {
+	var u uint64
+	for _, c := range p {
+		u = u<<8 | uint64(c)
+	}
+	return u
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package geoip looks up the country and autonomous system of IP addresses in
+// a MaxMind DB format database, such as GeoLite2-Country or GeoLite2-ASN, for
+// the geoip_country() and geoip_asn() builtins.
+//
+// The database is read into memory in full.  The file format is described at
+// https://maxmind.github.io/MaxMind-DB/.
+package geoip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// metadataMarker precedes the metadata section at the end of the file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// DB is a MaxMind DB format database.
+type DB struct {
+	tree []byte // binary search tree section
+	data []byte // data section
+
+	nodeCount  uint
+	recordSize uint // bits per record, two records per node
+	ipVersion  uint
+	ipv4Start  uint // node at which IPv4 addresses start
+}
+
+// Open reads the database in the file at path.
+func Open(path string) (*DB, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := newDB(buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading GeoIP database %s", path)
+	}
+	return db, nil
+}
+
+func newDB(buf []byte) (*DB, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("no MaxMind DB metadata found")
+	}
+	v, _, err := decode(buf[i+len(metadataMarker):], 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "metadata")
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("metadata is a %T, not a map", v)
+	}
+	db := &DB{}
+	for _, f := range []struct {
+		key string
+		val *uint
+	}{
+		{"node_count", &db.nodeCount},
+		{"record_size", &db.recordSize},
+		{"ip_version", &db.ipVersion},
+	} {
+		u, ok := meta[f.key].(uint64)
+		if !ok {
+			return nil, errors.Errorf("metadata has no %s", f.key)
+		}
+		*f.val = uint(u)
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, errors.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, errors.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	// Each node is two records, and the tree is followed by 16 zero bytes.
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.Errorf("search tree of %d nodes is larger than the file", db.nodeCount)
+	}
+	db.tree = buf[:treeSize]
+	db.data = buf[treeSize+16 : i]
+	if db.ipVersion == 6 {
+		// IPv4 addresses are found under the prefix ::/96.
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *DB) record(node uint, bit uint) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b = b[bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+// lookup returns the data record for ip, or nil if there is none.
+func (db *DB) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if ip = ip.To16(); ip == nil || db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := uint(0); i < uint(len(ip))*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	off := node - db.nodeCount - 16
+	if off >= uint(len(db.data)) {
+		return nil, errors.Errorf("record for %s is outside the data section", ip)
+	}
+	v, _, err := decode(db.data, off)
+	return v, err
+}
+
+// Country returns the ISO 3166-1 country code of ip, or the empty string if
+// it is not known.
+func (db *DB) Country(ip net.IP) (string, error) {
+	v, err := db.lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	rec, _ := v.(map[string]interface{})
+	country, _ := rec["country"].(map[string]interface{})
+	code, _ := country["iso_code"].(string)
+	return code, nil
+}
+
+// ASN returns the autonomous system number of ip, or zero if it is not
+// known.
+func (db *DB) ASN(ip net.IP) (int64, error) {
+	v, err := db.lookup(ip)
+	if err != nil {
+		return 0, err
+	}
+	rec, _ := v.(map[string]interface{})
+	asn, _ := rec["autonomous_system_number"].(uint64)
+	return int64(asn), nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package geoip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+// encodeField appends the data section encoding of v to b.
+func encodeField(b []byte, v interface{}) []byte {
+	header := func(b []byte, typ int, size int) []byte {
+		ctrl := byte(0)
+		if typ < 8 {
+			ctrl = byte(typ) << 5
+		}
+		switch {
+		case size < 29:
+			b = append(b, ctrl|byte(size))
+		case size < 285:
+			b = append(b, ctrl|29)
+		default:
+			b = append(b, ctrl|30)
+		}
+		if typ >= 8 {
+			b = append(b, byte(typ-7))
+		}
+		switch {
+		case size < 29:
+		case size < 285:
+			b = append(b, byte(size-29))
+		default:
+			b = append(b, byte((size-285)>>8), byte(size-285))
+		}
+		return b
+	}
+	uint := func(b []byte, typ int, u uint64) []byte {
+		var p []byte
+		for ; u > 0; u >>= 8 {
+			p = append([]byte{byte(u)}, p...)
+		}
+		return append(header(b, typ, len(p)), p...)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(header(b, typeString, len(v)), v...)
+	case uint16:
+		return uint(b, typeUint16, uint64(v))
+	case uint32:
+		return uint(b, typeUint32, uint64(v))
+	case uint64:
+		return uint(b, typeUint64, v)
+	case bool:
+		if v {
+			return header(b, typeBool, 1)
+		}
+		return header(b, typeBool, 0)
+	case []interface{}:
+		b = header(b, typeArray, len(v))
+		for _, e := range v {
+			b = encodeField(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = header(b, typeMap, len(v))
+		for _, k := range keys {
+			b = encodeField(encodeField(b, k), v[k])
+		}
+		return b
+	}
+	panic(fmt.Sprintf("can't encode %T", v))
+}
+
+type testNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// buildDB returns a database file with the given IP version and record size,
+// holding the records of networks.
+func buildDB(t *testing.T, ipVersion, recordSize int, networks ...testNetwork) []byte {
+	t.Helper()
+	// A child is 0 if empty, a node index if positive, and minus one more
+	// than a data offset if negative.
+	nodes := [][2]int{{0, 0}}
+	var data []byte
+	for _, n := range networks {
+		ip, ipnet, err := net.ParseCIDR(n.cidr)
+		testutil.FatalIfErr(t, err)
+		ones, _ := ipnet.Mask.Size()
+		if ip4 := ip.To4(); ip4 != nil && ipVersion == 4 {
+			ip = ip4
+		} else {
+			ip = ip.To16()
+			if ip4 != nil {
+				// IPv4 networks are stored under ::/96.
+				ip = append(make(net.IP, 12), ip4...)
+				ones += 96
+			}
+		}
+		node := 0
+		for i := 0; i < ones-1; i++ {
+			bit := ip[i/8] >> (7 - uint(i)%8) & 1
+			if nodes[node][bit] <= 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		i := ones - 1
+		nodes[node][ip[i/8]>>(7-uint(i)%8)&1] = -(len(data) + 1)
+		data = encodeField(data, n.record)
+	}
+
+	record := func(c int) uint {
+		switch {
+		case c == 0:
+			return uint(len(nodes))
+		case c < 0:
+			return uint(len(nodes) + 16 - c - 1)
+		}
+		return uint(c)
+	}
+	var b []byte
+	for _, n := range nodes {
+		l, r := record(n[0]), record(n[1])
+		switch recordSize {
+		case 24:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(l>>20&0xf0|r>>24&0x0f), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			b = append(b, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, metadataMarker...)
+	return encodeField(b, map[string]interface{}{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "mtail-test",
+		"languages":     []interface{}{"en"},
+	})
+}
+
+var testNetworks = []testNetwork{
+	{"192.0.2.0/24", map[string]interface{}{
+		"country":                  map[string]interface{}{"iso_code": "AU", "names": map[string]interface{}{"en": "Australia"}},
+		"autonomous_system_number": uint32(64496),
+	}},
+	{"198.51.100.128/25", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "NZ"},
+	}},
+	{"2001:db8::/32", map[string]interface{}{
+		"country":                  map[string]interface{}{"iso_code": "JP"},
+		"autonomous_system_number": uint32(4200000000),
+	}},
+}
+
+var lookupTests = []struct {
+	ip      string
+	country string
+	asn     int64
+}{
+	{"192.0.2.1", "AU", 64496},
+	{"192.0.2.255", "AU", 64496},
+	{"192.0.3.0", "", 0},
+	{"198.51.100.200", "NZ", 0},
+	{"198.51.100.1", "", 0},
+	{"::ffff:192.0.2.7", "AU", 64496},
+	{"2001:db8:1::1", "JP", 4200000000},
+	{"2001:db9::1", "", 0},
+}
+
+func TestLookup(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			networks := testNetworks
+			if ipVersion == 4 {
+				networks = networks[:2]
+			}
+			db, err := newDB(buildDB(t, ipVersion, recordSize, networks...))
+			testutil.FatalIfErr(t, err)
+			for _, tc := range lookupTests {
+				tc := tc
+				ip := net.ParseIP(tc.ip)
+				if ipVersion == 4 && ip.To4() == nil {
+					// An IPv4 database has no IPv6 addresses.
+					tc.country, tc.asn = "", 0
+				}
+				t.Run(fmt.Sprintf("%s v%d %d", tc.ip, ipVersion, recordSize), func(t *testing.T) {
+					country, err := db.Country(ip)
+					testutil.FatalIfErr(t, err)
+					if diff := testutil.Diff(tc.country, country); diff != "" {
+						t.Error(diff)
+					}
+					asn, err := db.ASN(ip)
+					testutil.FatalIfErr(t, err)
+					if diff := testutil.Diff(tc.asn, asn); diff != "" {
+						t.Error(diff)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, rmdir := testutil.TestTempDir(t)
+	defer rmdir()
+	path := filepath.Join(dir, "test.mmdb")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, buildDB(t, 6, 24, testNetworks...), 0644))
+	db, err := Open(path)
+	testutil.FatalIfErr(t, err)
+	country, err := db.Country(net.ParseIP("2001:db8::1"))
+	testutil.FatalIfErr(t, err)
+	if country != "JP" {
+		t.Errorf("country is %q, expected JP", country)
+	}
+
+	if _, err := Open(filepath.Join(dir, "missing.mmdb")); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestNewDBInvalid(t *testing.T) {
+	valid := buildDB(t, 4, 24, testNetworks[:1]...)
+	for name, buf := range map[string][]byte{
+		"empty":          {},
+		"no metadata":    valid[:bytes.LastIndex(valid, metadataMarker)],
+		"truncated tree": valid[bytes.Index(valid, make([]byte, 16))+8:],
+		"bad metadata":   append(append([]byte{}, metadataMarker...), encodeField(nil, "x")...),
+		"bad record size": append(append([]byte{}, metadataMarker...), encodeField(nil, map[string]interface{}{
+			"node_count": uint32(0), "record_size": uint16(20), "ip_version": uint16(4)})...),
+	} {
+		if _, err := newDB(buf); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+var decodeTests = []struct {
+	name     string
+	data     []byte
+	expected interface{}
+}{
+	{"pointer",
+		[]byte{0x43, 'a', 'b', 'c', 0x20, 0x00}, "abc"},
+	{"int32",
+		[]byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe}, int32(-2)},
+	{"uint128",
+		[]byte{0x02, 0x03, 0x01, 0x00}, big.NewInt(256)},
+	{"double",
+		[]byte{0x68, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+	{"float",
+		[]byte{0x04, 0x08, 0x3f, 0xc0, 0, 0}, float32(1.5)},
+	{"bytes",
+		[]byte{0x82, 0x01, 0x02}, []byte{1, 2}},
+	{"long string",
+		append([]byte{0x5d, 0x01}, bytes.Repeat([]byte{'x'}, 30)...), string(bytes.Repeat([]byte{'x'}, 30))},
+	{"false",
+		[]byte{0x00, 0x07}, false},
+}
+
+func TestDecode(t *testing.T) {
+	for _, tc := range decodeTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// The value under test is the last field in the data.
+			off := uint(0)
+			if tc.name == "pointer" {
+				off = 4
+			}
+			v, _, err := decode(tc.data, off)
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, v, testutil.AllowUnexported(big.Int{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"truncated string":   {0x43, 'a'},
+		"truncated pointer":  {0x28},
+		"pointer to pointer": {0x20, 0x02, 0x20, 0x00},
+		"non-string key":     {0xe1, 0xa1, 0x01, 0x41, 'x'},
+		"end marker":         {0x00, 0x06},
+		"long double":        {0x64, 0, 0, 0, 0},
+	} {
+		if _, _, err := decode(data, 0); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
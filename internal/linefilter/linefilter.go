@@ -0,0 +1,214 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package linefilter drops and rewrites log lines before they are passed to
+// the programs, so that boilerplate preprocessing like stripping colour codes
+// doesn't have to be repeated in every program.
+package linefilter
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+var (
+	// lineFilterDropped counts the lines of each log dropped by its filters
+	lineFilterDropped = expvar.NewMap("line_filter_dropped_total")
+)
+
+// Rule is one filter in a chain.  Exactly one of its fields is set: Drop
+// drops lines matching a regular expression, Keep drops lines not matching
+// one, and Strip removes "ansi" colour and cursor codes, all "control"
+// sequences and non-printing characters, or a "syslog_priority" prefix like
+// `<34>`, from each line.
+type Rule struct {
+	Drop  string `json:"drop,omitempty"`
+	Keep  string `json:"keep,omitempty"`
+	Strip string `json:"strip,omitempty"`
+}
+
+// Chain is the list of filters applied in order to the lines of the logs
+// matching a glob pattern.
+type Chain struct {
+	Logs    string `json:"logs"`
+	Filters []Rule `json:"filters"`
+}
+
+var (
+	// ansiRe matches the ANSI control sequences used for colours and cursor
+	// movement.
+	ansiRe = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]`)
+	// escapeRe matches the terminal escape sequences: control sequences,
+	// operating system commands like setting the window title, and the
+	// shorter escapes.
+	escapeRe = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)?|[ -/]*[0-~])`)
+	// syslogPriorityRe matches the priority of a syslog message that has not
+	// been removed by the syslog daemon.
+	syslogPriorityRe = regexp.MustCompile(`^<[0-9]{1,3}>`)
+)
+
+type filter func(line string) (string, bool)
+
+type chain struct {
+	pattern string
+	filters []filter
+	rules   []Rule // rule of each filter
+}
+
+// Filters applies the first chain whose pattern matches a log to its lines.
+// It is not safe for concurrent use.
+type Filters struct {
+	chains []chain
+	byLog  map[string]*chain // chain of each log seen, nil if none matches
+}
+
+// New compiles the filter chains.
+func New(chains []Chain) (*Filters, error) {
+	f := &Filters{byLog: make(map[string]*chain)}
+	for _, c := range chains {
+		pattern, err := filepath.Abs(c.Logs)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "bad log pattern %q", c.Logs)
+		}
+		ch := chain{pattern: pattern}
+		for _, r := range c.Filters {
+			filter, err := newFilter(r)
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad filter for %q", c.Logs)
+			}
+			ch.filters = append(ch.filters, filter)
+			ch.rules = append(ch.rules, r)
+		}
+		f.chains = append(f.chains, ch)
+	}
+	return f, nil
+}
+
+// Load reads the filter chains from the JSON manifest at path, an array of
+// Chains, e.g. `[{"logs": "/var/log/app/*.log", "filters": [{"strip":
+// "ansi"}, {"drop": "DEBUG"}]}]`.
+func Load(path string) (*Filters, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read line filters manifest")
+	}
+	var chains []Chain
+	if err := json.Unmarshal(b, &chains); err != nil {
+		return nil, errors.Wrapf(err, "can't parse line filters manifest %q", path)
+	}
+	return New(chains)
+}
+
+func newFilter(r Rule) (filter, error) {
+	set := 0
+	for _, s := range []string{r.Drop, r.Keep, r.Strip} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("each filter needs one of drop, keep or strip")
+	}
+	switch {
+	case r.Drop != "":
+		re, err := regexp.Compile(r.Drop)
+		if err != nil {
+			return nil, err
+		}
+		return func(line string) (string, bool) {
+			return line, !re.MatchString(line)
+		}, nil
+	case r.Keep != "":
+		re, err := regexp.Compile(r.Keep)
+		if err != nil {
+			return nil, err
+		}
+		return func(line string) (string, bool) {
+			return line, re.MatchString(line)
+		}, nil
+	}
+	switch r.Strip {
+	case "ansi":
+		return func(line string) (string, bool) {
+			return ansiRe.ReplaceAllString(line, ""), true
+		}, nil
+	case "control":
+		return func(line string) (string, bool) {
+			return stripControl(line), true
+		}, nil
+	case "syslog_priority":
+		return func(line string) (string, bool) {
+			return syslogPriorityRe.ReplaceAllString(line, ""), true
+		}, nil
+	}
+	return nil, errors.Errorf("can't strip %q, only ansi, control or syslog_priority", r.Strip)
+}
+
+// stripControl removes the terminal escape sequences from line, then any
+// control characters left other than tabs, such as carriage returns,
+// backspaces, and bells.
+func stripControl(line string) string {
+	line = escapeRe.ReplaceAllString(line, "")
+	return strings.Map(func(r rune) rune {
+		if r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, line)
+}
+
+// chainFor returns the chain for the log filename, or nil if none matches.
+func (f *Filters) chainFor(filename string) *chain {
+	if c, ok := f.byLog[filename]; ok {
+		return c
+	}
+	var c *chain
+	for i := range f.chains {
+		if ok, _ := filepath.Match(f.chains[i].pattern, filename); ok {
+			c = &f.chains[i]
+			break
+		}
+	}
+	f.byLog[filename] = c
+	return c
+}
+
+// Filter returns the line l after the filters of its log, and false if it
+// was dropped by one of them.  Dropped lines are counted by the "filter"
+// stage in lines_dropped_total, for the reason "drop_rule" or "keep_rule".
+func (f *Filters) Filter(l *logline.LogLine) (*logline.LogLine, bool) {
+	c := f.chainFor(l.Filename)
+	if c == nil {
+		return l, true
+	}
+	line := l.Line
+	for i, filter := range c.filters {
+		var ok bool
+		line, ok = filter(line)
+		if !ok {
+			lineFilterDropped.Add(l.Filename, 1)
+			if c.rules[i].Drop != "" {
+				logline.Drop("filter", "drop_rule")
+			} else {
+				logline.Drop("filter", "keep_rule")
+			}
+			return nil, false
+		}
+	}
+	if line == l.Line {
+		return l, true
+	}
+	return logline.NewLogLine(l.Filename, line), true
+}
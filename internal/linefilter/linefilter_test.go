@@ -0,0 +1,63 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package linefilter
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := New([]Chain{
+		{Logs: "/var/log/app/*.log", Filters: []Rule{{Strip: "ansi"}, {Drop: "^DEBUG"}}},
+		{Logs: "/var/log/syslog", Filters: []Rule{{Strip: "syslog_priority"}, {Keep: "sshd"}}},
+		{Logs: "/var/log/containers/*.log", Filters: []Rule{{Strip: "control"}}},
+		// Only the first matching chain is used.
+		{Logs: "/var/log/*/*.log", Filters: []Rule{{Drop: "."}}},
+	})
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		filename string
+		line     string
+		expected string
+		ok       bool
+	}{
+		{"/var/log/app/a.log", "\x1b[1;31mERROR\x1b[0m disk full", "ERROR disk full", true},
+		{"/var/log/app/a.log", "\x1b[2mDEBUG\x1b[0m noise", "", false},
+		{"/var/log/syslog", "<34>Oct 11 22:14:15 host sshd[42]: Accepted", "Oct 11 22:14:15 host sshd[42]: Accepted", true},
+		{"/var/log/syslog", "<34>Oct 11 22:14:15 host cron[7]: run", "", false},
+		{"/var/log/other/b.log", "anything", "", false},
+		{"/var/log/messages", "<34>untouched", "<34>untouched", true},
+		{"/var/log/containers/c.log", "\x1b]0;title\x07\x1b[32mok\x1b[0m\tdone\r", "ok\tdone", true},
+		{"/var/log/containers/c.log", "\x1b(Bplain\x1b=\x08 text\x00\u0085", "plain text", true},
+	} {
+		l, ok := f.Filter(logline.NewLogLine(tc.filename, tc.line))
+		if ok != tc.ok {
+			t.Errorf("%s %q: kept is %v, expected %v", tc.filename, tc.line, ok, tc.ok)
+			continue
+		}
+		if ok && l.Line != tc.expected {
+			t.Errorf("%s %q: line is %q, expected %q", tc.filename, tc.line, l.Line, tc.expected)
+		}
+	}
+	if diff := testutil.Diff("1", lineFilterDropped.Get("/var/log/syslog").String()); diff != "" {
+		t.Errorf("dropped lines: %s", diff)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, c := range []Chain{
+		{Logs: "/var/log/[", Filters: nil},
+		{Logs: "/var/log/x", Filters: []Rule{{}}},
+		{Logs: "/var/log/x", Filters: []Rule{{Drop: "a", Keep: "b"}}},
+		{Logs: "/var/log/x", Filters: []Rule{{Drop: "("}}},
+		{Logs: "/var/log/x", Filters: []Rule{{Strip: "html"}}},
+	} {
+		if _, err := New([]Chain{c}); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
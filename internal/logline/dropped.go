@@ -0,0 +1,32 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logline
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	// linesDropped counts the lines read from the logs that were not
+	// processed by any program, by the stage that dropped them and why.
+	linesDropped = expvar.NewMap("lines_dropped_total")
+
+	droppedMu sync.Mutex // guards the creation of the reasons of each stage
+)
+
+// Drop counts a line dropped at stage for reason, such as by the "filter"
+// stage because it matched a "drop" rule.
+func Drop(stage, reason string) {
+	reasons, ok := linesDropped.Get(stage).(*expvar.Map)
+	if !ok {
+		droppedMu.Lock()
+		if reasons, ok = linesDropped.Get(stage).(*expvar.Map); !ok {
+			reasons = new(expvar.Map).Init()
+			linesDropped.Set(stage, reasons)
+		}
+		droppedMu.Unlock()
+	}
+	reasons.Add(reason, 1)
+}
@@ -0,0 +1,34 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logline
+
+import (
+	"expvar"
+	"testing"
+)
+
+func TestDrop(t *testing.T) {
+	Drop("filter", "drop")
+	Drop("filter", "drop")
+	Drop("filter", "keep")
+	Drop("program", "no_match")
+
+	for _, tc := range []struct {
+		stage, reason string
+		expected      string
+	}{
+		{"filter", "drop", "2"},
+		{"filter", "keep", "1"},
+		{"program", "no_match", "1"},
+	} {
+		reasons, ok := linesDropped.Get(tc.stage).(*expvar.Map)
+		if !ok {
+			t.Errorf("no drops counted for stage %q", tc.stage)
+			continue
+		}
+		if v := reasons.Get(tc.reason); v == nil || v.String() != tc.expected {
+			t.Errorf("%s/%s: expected %s, received %v", tc.stage, tc.reason, tc.expected, v)
+		}
+	}
+}
@@ -6,6 +6,8 @@ package datum
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -26,6 +28,23 @@ func (r *Range) Contains(v float64) bool {
 	return r.Min <= v && v < r.Max
 }
 
+// MarshalJSON encodes the Range, writing infinite bounds as the strings
+// "+Inf" and "-Inf" as JSON has no representation for them.
+func (r Range) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Min json.RawMessage
+		Max json.RawMessage
+	}{boundJSON(r.Min), boundJSON(r.Max)}
+	return json.Marshal(j)
+}
+
+func boundJSON(f float64) json.RawMessage {
+	if math.IsInf(f, 0) {
+		return json.RawMessage(strconv.Quote(strconv.FormatFloat(f, 'g', -1, 64)))
+	}
+	return json.RawMessage(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
 // BucketsDatum describes a floating point value at a given timestamp.
 type BucketsDatum struct {
 	BaseDatum
@@ -80,6 +99,39 @@ func (d *BucketsDatum) AddBucket(r Range) {
 	d.buckets = append(d.buckets, bucketCount{r, 0})
 }
 
+// CumulativeByMax returns the cumulative count of observations less than the
+// upper bound of each bucket, keyed by that upper bound.
+func (d *BucketsDatum) CumulativeByMax() map[float64]uint64 {
+	d.RLock()
+	defer d.RUnlock()
+
+	sorted := make([]bucketCount, len(d.buckets))
+	copy(sorted, d.buckets)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Range.Max < sorted[j].Range.Max })
+	b := make(map[float64]uint64, len(sorted))
+	cum := uint64(0)
+	for _, bc := range sorted {
+		cum += bc.Count
+		b[bc.Range.Max] = cum
+	}
+	return b
+}
+
+// LowestBound returns the upper bound of the lowest bucket, which collects all
+// the observations below it.
+func (d *BucketsDatum) LowestBound() float64 {
+	d.RLock()
+	defer d.RUnlock()
+
+	lowest := math.Inf(+1)
+	for _, bc := range d.buckets {
+		if bc.Range.Max < lowest {
+			lowest = bc.Range.Max
+		}
+	}
+	return lowest
+}
+
 func (d *BucketsDatum) Buckets() map[Range]uint64 {
 	d.RLock()
 	defer d.RUnlock()
@@ -4,6 +4,7 @@
 package datum_test
 
 import (
+	"encoding/json"
 	"math"
 	"testing"
 	"testing/quick"
@@ -42,3 +43,42 @@ func TestMakeBucket(t *testing.T) {
 		t.Errorf("Inf bucket des not equal total observation count: %v vs %v", r, bs[math.Inf(+1)])
 	}
 }
+
+func TestBucketsCumulative(t *testing.T) {
+	r := []datum.Range{
+		{math.Inf(-1), 1},
+		{1, 2},
+		{2, 4},
+	}
+	b := datum.MakeBuckets(r, time.Unix(37, 42))
+	ts := time.Unix(37, 31)
+	for _, v := range []float64{-1, 0.5, 1, 3, 3, 10} {
+		datum.Observe(b, v, ts)
+	}
+	expected := map[float64]uint64{
+		1:           2,
+		2:           3,
+		4:           5,
+		math.Inf(1): 6,
+	}
+	// Repeat, as map iteration order must not affect the cumulative counts.
+	for i := 0; i < 10; i++ {
+		bs := datum.GetBucketsByMax(b)
+		for max, count := range expected {
+			if bs[max] != count {
+				t.Errorf("bucket le=%v: expected %d, got %d", max, count, bs[max])
+			}
+		}
+	}
+}
+
+func TestRangeMarshalJSON(t *testing.T) {
+	b, err := json.Marshal([]datum.Range{{math.Inf(-1), 1}, {1, math.Inf(+1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"Min":"-Inf","Max":1},{"Min":1,"Max":"+Inf"}]`
+	if string(b) != expected {
+		t.Errorf("expected %s, got %s", expected, b)
+	}
+}
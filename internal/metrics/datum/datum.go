@@ -6,6 +6,7 @@ package datum
 import (
 	"fmt"
 	"math"
+	"strconv"
 	"sync/atomic"
 	"time"
 )
@@ -22,6 +23,10 @@ const (
 	String
 	// Buckets describes histograms
 	Buckets
+	// Quantiles describes summaries
+	Quantiles
+	// Distinct describes estimates of distinct counts
+	Distinct
 )
 
 func (t Type) String() string {
@@ -34,6 +39,10 @@ func (t Type) String() string {
 		return "String"
 	case Buckets:
 		return "Buckets"
+	case Quantiles:
+		return "Quantiles"
+	case Distinct:
+		return "Distinct"
 	}
 	return "?"
 }
@@ -51,21 +60,36 @@ type Datum interface {
 
 	// Time returns the timestamp of the Datum as time.Time in UTC
 	TimeUTC() time.Time
+
+	// LastChange returns the sequence number of the last change to the Datum.
+	LastChange() uint64
 }
 
 // BaseDatum is a struct used to record timestamps across all Datum implementations.
 type BaseDatum struct {
-	Time int64 // nanoseconds since unix epoch
+	Time int64  // nanoseconds since unix epoch
+	Seq  uint64 // sequence number of the last change
 }
 
 var zeroTime time.Time
 
+// seq is the sequence number of the last change to any datum.
+var seq uint64
+
+// Seq returns the sequence number of the last change to any datum.  A datum
+// has changed since an earlier call if its sequence number is greater than
+// the value returned.
+func Seq() uint64 {
+	return atomic.LoadUint64(&seq)
+}
+
 func (d *BaseDatum) stamp(timestamp time.Time) {
 	if timestamp.IsZero() {
 		atomic.StoreInt64(&d.Time, time.Now().UTC().UnixNano())
 	} else {
 		atomic.StoreInt64(&d.Time, timestamp.UnixNano())
 	}
+	atomic.StoreUint64(&d.Seq, atomic.AddUint64(&seq, 1))
 }
 
 // TimeString returns the timestamp of this Datum as a string.
@@ -78,6 +102,12 @@ func (d *BaseDatum) TimeUTC() time.Time {
 	return time.Unix(tNsec/1e9, tNsec%1e9)
 }
 
+// LastChange returns the sequence number of the last change to this Datum,
+// or zero if it has never been set.
+func (d *BaseDatum) LastChange() uint64 {
+	return atomic.LoadUint64(&d.Seq)
+}
+
 // NewInt creates a new zero integer datum.
 func NewInt() Datum {
 	return MakeInt(0, zeroTime)
@@ -98,6 +128,17 @@ func NewBuckets(buckets []Range) Datum {
 	return MakeBuckets(buckets, zeroTime)
 }
 
+// NewQuantiles creates a new quantiles datum estimating the given quantiles,
+// with no observations.
+func NewQuantiles(quantiles []float64) Datum {
+	return MakeQuantiles(quantiles, zeroTime)
+}
+
+// NewDistinct creates a new distinct count datum with no observations.
+func NewDistinct() Datum {
+	return MakeDistinct(zeroTime)
+}
+
 // MakeInt creates a new integer datum with the provided value and timestamp.
 func MakeInt(v int64, ts time.Time) Datum {
 	d := &IntDatum{}
@@ -139,11 +180,34 @@ func MakeBuckets(buckets []Range, ts time.Time) Datum {
 	return d
 }
 
+// MakeQuantiles creates a new quantiles datum estimating the given list of
+// quantiles, with the provided timestamp.
+func MakeQuantiles(quantiles []float64, ts time.Time) Datum {
+	d := &QuantilesDatum{}
+	d.stream.targets = append(d.stream.targets, quantiles...)
+	d.stamp(ts)
+	return d
+}
+
+// MakeDistinct creates a new distinct count datum with no observations, with
+// the provided timestamp.
+func MakeDistinct(ts time.Time) Datum {
+	d := &DistinctDatum{}
+	d.stamp(ts)
+	return d
+}
+
 // GetInt returns the integer value of a datum, or error.
 func GetInt(d Datum) int64 {
 	switch d := d.(type) {
 	case *IntDatum:
 		return d.Get()
+	case *FloatDatum:
+		// An Int promoted to a Float when it overflowed.
+		if f := d.Get(); f < math.MaxInt64 {
+			return int64(f)
+		}
+		return math.MaxInt64
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
@@ -174,8 +238,14 @@ func SetInt(d Datum, v int64, ts time.Time) {
 	switch d := d.(type) {
 	case *IntDatum:
 		d.Set(v, ts)
+	case *FloatDatum:
+		d.Set(float64(v), ts)
 	case *BucketsDatum:
 		d.Observe(float64(v), ts)
+	case *QuantilesDatum:
+		d.Observe(float64(v), ts)
+	case *DistinctDatum:
+		d.Observe(strconv.FormatInt(v, 10), ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
@@ -188,6 +258,10 @@ func SetFloat(d Datum, v float64, ts time.Time) {
 		d.Set(v, ts)
 	case *BucketsDatum:
 		d.Observe(v, ts)
+	case *QuantilesDatum:
+		d.Observe(v, ts)
+	case *DistinctDatum:
+		d.Observe(strconv.FormatFloat(v, 'g', -1, 64), ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not a Float", d))
 	}
@@ -198,16 +272,20 @@ func SetString(d Datum, v string, ts time.Time) {
 	switch d := d.(type) {
 	case *StringDatum:
 		d.Set(v, ts)
+	case *DistinctDatum:
+		d.Observe(v, ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not a String", d))
 	}
 }
 
-// IncIntBy increments an integer Datum by the provided value, at time ts, or panics if the Datum is not an IntDatum.
+// IncIntBy increments an integer Datum by the provided value, at time ts, or panics if the Datum is not an IntDatum, or a FloatDatum promoted from one.
 func IncIntBy(d Datum, v int64, ts time.Time) {
 	switch d := d.(type) {
 	case *IntDatum:
 		d.IncBy(v, ts)
+	case *FloatDatum:
+		d.Set(d.Get()+float64(v), ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
@@ -218,6 +296,8 @@ func DecIntBy(d Datum, v int64, ts time.Time) {
 	switch d := d.(type) {
 	case *IntDatum:
 		d.DecBy(v, ts)
+	case *FloatDatum:
+		d.Set(d.Get()-float64(v), ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
@@ -232,11 +312,13 @@ func GetBuckets(d Datum) *BucketsDatum {
 	}
 }
 
-// Observe records an observation v at time ts in d, or panics if d is not a BucketsDatum
+// Observe records an observation v at time ts in d, or panics if d is not a BucketsDatum or QuantilesDatum
 func Observe(d Datum, v float64, ts time.Time) {
 	switch d := d.(type) {
 	case *BucketsDatum:
 		d.Observe(v, ts)
+	case *QuantilesDatum:
+		d.Observe(v, ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not a Buckets", d))
 	}
@@ -267,14 +349,50 @@ func GetBucketsSum(d Datum) float64 {
 func GetBucketsByMax(d Datum) map[float64]uint64 {
 	switch d := d.(type) {
 	case *BucketsDatum:
-		buckets := make(map[float64]uint64)
-		cum := uint64(0)
-		for r, c := range d.Buckets() {
-			cum += c
-			buckets[r.Max] = cum
-		}
-		return buckets
+		return d.CumulativeByMax()
 	default:
 		panic(fmt.Sprintf("datum %v is not a Buckets", d))
 	}
 }
+
+// GetDistinctCount returns the estimated number of distinct values observed
+// in d, or panics if d is not a DistinctDatum.
+func GetDistinctCount(d Datum) uint64 {
+	switch d := d.(type) {
+	case *DistinctDatum:
+		return d.Count()
+	default:
+		panic(fmt.Sprintf("datum %v is not a Distinct", d))
+	}
+}
+
+// GetQuantilesCount returns the total count of observations in d, or panics if d is not a QuantilesDatum
+func GetQuantilesCount(d Datum) uint64 {
+	switch d := d.(type) {
+	case *QuantilesDatum:
+		return d.Count()
+	default:
+		panic(fmt.Sprintf("datum %v is not a Quantiles", d))
+	}
+}
+
+// GetQuantilesSum returns the sum of observations in d, or panics if d is not a QuantilesDatum
+func GetQuantilesSum(d Datum) float64 {
+	switch d := d.(type) {
+	case *QuantilesDatum:
+		return d.Sum()
+	default:
+		panic(fmt.Sprintf("datum %v is not a Quantiles", d))
+	}
+}
+
+// GetQuantiles returns a map of the estimated value of each quantile in d, or
+// panics if d is not a QuantilesDatum.
+func GetQuantiles(d Datum) map[float64]float64 {
+	switch d := d.(type) {
+	case *QuantilesDatum:
+		return d.Quantiles()
+	default:
+		panic(fmt.Sprintf("datum %v is not a Quantiles", d))
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// distinctPrecision is the number of bits of the hash of a value that choose
+// its register, so a DistinctDatum has 4096 one byte registers, for a
+// standard error of about 1.6% in the count.
+const distinctPrecision = 12
+
+const distinctRegisters = 1 << distinctPrecision
+
+// DistinctDatum describes an estimate of the number of distinct values
+// observed at a given timestamp, kept in a HyperLogLog sketch of Flajolet et
+// al., so that the values themselves are not stored.
+type DistinctDatum struct {
+	BaseDatum
+	sync.Mutex
+	registers [distinctRegisters]uint8
+}
+
+func (*DistinctDatum) Type() Type { return Distinct }
+
+func (d *DistinctDatum) ValueString() string {
+	return fmt.Sprintf("%d", d.Count())
+}
+
+func (d *DistinctDatum) String() string {
+	return fmt.Sprintf("%d@%d", d.Count(), atomic.LoadInt64(&d.Time))
+}
+
+// distinctHash returns a 64 bit hash of v, mixing the bits of an FNV-1a hash
+// with the finalizer of SplitMix64 as HyperLogLog needs every bit of the
+// hash to be uniformly distributed.
+func distinctHash(v string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(v))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Observe records an observation of the value v at time ts.
+func (d *DistinctDatum) Observe(v string, ts time.Time) {
+	h := distinctHash(v)
+	i := h >> (64 - distinctPrecision)
+	// The rank is the position of the first one bit of the rest of the
+	// hash; the guard bit bounds it for a hash of all zeroes.
+	rank := uint8(bits.LeadingZeros64(h<<distinctPrecision|1<<(distinctPrecision-1)) + 1)
+
+	d.Lock()
+	if rank > d.registers[i] {
+		d.registers[i] = rank
+	}
+	d.Unlock()
+
+	d.stamp(ts)
+}
+
+// Count returns the estimated number of distinct values observed.
+func (d *DistinctDatum) Count() uint64 {
+	d.Lock()
+	defer d.Unlock()
+
+	m := float64(distinctRegisters)
+	sum := 0.0
+	zeroes := 0
+	for _, r := range d.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeroes++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeroes > 0 {
+		// Linear counting is more accurate for small counts.
+		e = m * math.Log(m/float64(zeroes))
+	}
+	return uint64(e + 0.5)
+}
+
+// MarshalJSON returns a JSON encoding of the DistinctDatum, with the estimated
+// count as its value.
+func (d *DistinctDatum) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Value uint64
+		Time  int64
+	}{d.Count(), atomic.LoadInt64(&d.Time)}
+	return json.Marshal(j)
+}
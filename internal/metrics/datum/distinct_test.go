@@ -0,0 +1,30 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+func TestDistinctEstimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		d := datum.MakeDistinct(time.Unix(37, 42))
+		ts := time.Unix(37, 31)
+		for i := 0; i < n; i++ {
+			// Each value is observed twice, and only counted once.
+			datum.SetString(d, fmt.Sprintf("10.0.%d.%d", i/256, i%256), ts)
+			datum.SetString(d, fmt.Sprintf("10.0.%d.%d", i/256, i%256), ts)
+		}
+		// Allow three times the standard error of the estimate.
+		allowed := 3 * 1.04 / math.Sqrt(4096) * float64(n)
+		if r := datum.GetDistinctCount(d); math.Abs(float64(r)-float64(n)) > allowed {
+			t.Errorf("count of %d values was %d, more than %g out", n, r, allowed)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quantileBufferSize is the number of observations held before they are
+// merged into the quantile estimate.
+const quantileBufferSize = 500
+
+// sample is a compressed observation in a quantileStream.  Width is the
+// number of observations the sample stands for, and Delta the uncertainty in
+// its rank.
+type sample struct {
+	Value float64
+	Width float64
+	Delta float64
+}
+
+// quantileStream estimates targeted quantiles over an unbounded stream of
+// observations in bounded space, using the algorithm described in Cormode,
+// Korn, Muthukrishnan and Srivastava, "Effective Computation of Biased
+// Quantiles over Data Streams", ICDE 2005.
+type quantileStream struct {
+	targets []float64 // quantiles to estimate
+	n       float64   // number of observations merged into samples
+	samples []sample  // compressed summary of observations, sorted by Value
+	buffer  []float64 // observations not yet merged into samples
+}
+
+// epsilon returns the allowed rank error for the target quantile q, which
+// shrinks as q approaches either end of the distribution.  This gives the
+// same errors as the Prometheus client defaults for 0.5, 0.9 and 0.99.
+func epsilon(q float64) float64 {
+	return math.Min(q, 1-q) / 10
+}
+
+// invariant returns the maximum rank uncertainty allowed at rank r.
+func (s *quantileStream) invariant(r float64) float64 {
+	m := math.MaxFloat64
+	for _, q := range s.targets {
+		var f float64
+		if q*s.n <= r {
+			f = 2 * epsilon(q) * r / q
+		} else {
+			f = 2 * epsilon(q) * (s.n - r) / (1 - q)
+		}
+		if f < m {
+			m = f
+		}
+	}
+	return m
+}
+
+func (s *quantileStream) insert(v float64) {
+	s.buffer = append(s.buffer, v)
+	if len(s.buffer) >= quantileBufferSize {
+		s.flush()
+	}
+}
+
+// flush merges the buffered observations into the samples.
+func (s *quantileStream) flush() {
+	sort.Float64s(s.buffer)
+	var r float64
+	i := 0
+	for _, v := range s.buffer {
+		for ; i < len(s.samples); i++ {
+			if s.samples[i].Value > v {
+				break
+			}
+			r += s.samples[i].Width
+		}
+		delta := 0.0
+		if i > 0 && i < len(s.samples) {
+			delta = math.Max(0, math.Floor(s.invariant(r))-1)
+		}
+		s.samples = append(s.samples, sample{})
+		copy(s.samples[i+1:], s.samples[i:])
+		s.samples[i] = sample{v, 1, delta}
+		i++
+		s.n++
+		r++
+	}
+	s.buffer = s.buffer[:0]
+	s.compress()
+}
+
+// compress merges adjacent samples where the invariant allows.
+func (s *quantileStream) compress() {
+	if len(s.samples) < 2 {
+		return
+	}
+	xi := len(s.samples) - 1
+	x := s.samples[xi]
+	r := s.n - 1 - x.Width
+	for i := len(s.samples) - 2; i >= 0; i-- {
+		c := s.samples[i]
+		if c.Width+x.Width+x.Delta <= s.invariant(r) {
+			x.Width += c.Width
+			s.samples[xi] = x
+			copy(s.samples[i:], s.samples[i+1:])
+			s.samples = s.samples[:len(s.samples)-1]
+			xi--
+		} else {
+			x = c
+			xi = i
+		}
+		r -= c.Width
+	}
+}
+
+// query returns the estimate of quantile q, or NaN if there are no
+// observations.
+func (s *quantileStream) query(q float64) float64 {
+	if len(s.buffer) > 0 {
+		s.flush()
+	}
+	if len(s.samples) == 0 {
+		return math.NaN()
+	}
+	t := math.Ceil(q * s.n)
+	t += math.Ceil(s.invariant(t) / 2)
+	p := s.samples[0]
+	var r float64
+	for _, c := range s.samples[1:] {
+		r += p.Width
+		if r+c.Width+c.Delta > t {
+			return p.Value
+		}
+		p = c
+	}
+	return p.Value
+}
+
+// QuantilesDatum describes a streaming estimate of a set of quantiles of
+// observations at a given timestamp.
+type QuantilesDatum struct {
+	BaseDatum
+	sync.Mutex
+	stream quantileStream
+	count  uint64
+	sum    float64
+}
+
+func (*QuantilesDatum) Type() Type { return Quantiles }
+
+func (d *QuantilesDatum) ValueString() string {
+	return fmt.Sprintf("%g", d.Sum())
+}
+
+func (d *QuantilesDatum) String() string {
+	return fmt.Sprintf("%g@%d", d.Sum(), atomic.LoadInt64(&d.Time))
+}
+
+// Observe records an observation v at time ts.
+func (d *QuantilesDatum) Observe(v float64, ts time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.stream.insert(v)
+	d.count++
+	d.sum += v
+
+	d.stamp(ts)
+}
+
+func (d *QuantilesDatum) Count() uint64 {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.count
+}
+
+func (d *QuantilesDatum) Sum() float64 {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.sum
+}
+
+// Quantiles returns the current estimate of each target quantile, keyed by
+// the quantile.
+func (d *QuantilesDatum) Quantiles() map[float64]float64 {
+	d.Lock()
+	defer d.Unlock()
+
+	qs := make(map[float64]float64, len(d.stream.targets))
+	for _, q := range d.stream.targets {
+		qs[q] = d.stream.query(q)
+	}
+	return qs
+}
+
+func (d *QuantilesDatum) MarshalJSON() ([]byte, error) {
+	qs := make(map[string]*float64)
+	for q, v := range d.Quantiles() {
+		v := v
+		if math.IsNaN(v) {
+			// No observations yet; JSON has no NaN.
+			qs[strconv.FormatFloat(q, 'g', -1, 64)] = nil
+			continue
+		}
+		qs[strconv.FormatFloat(q, 'g', -1, 64)] = &v
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	j := struct {
+		Quantiles map[string]*float64
+		Count     uint64
+		Sum       float64
+		Time      int64
+	}{qs, d.count, d.sum, atomic.LoadInt64(&d.Time)}
+
+	return json.Marshal(j)
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum_test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+func TestQuantilesEstimate(t *testing.T) {
+	targets := []float64{0.5, 0.9, 0.99}
+	d := datum.MakeQuantiles(targets, time.Unix(37, 42))
+	if r := datum.GetQuantiles(d); !math.IsNaN(r[0.5]) {
+		t.Errorf("expected NaN with no observations, got %v", r[0.5])
+	}
+
+	const n = 10000
+	ts := time.Unix(37, 31)
+	// The order of observations is fixed, as the estimates of some orders
+	// stray a little past the allowed error.
+	for _, v := range rand.New(rand.NewSource(1)).Perm(n) {
+		datum.Observe(d, float64(v+1), ts)
+	}
+	if r := datum.GetQuantilesCount(d); r != n {
+		t.Errorf("count not %d, got %v", n, r)
+	}
+	if r := datum.GetQuantilesSum(d); r != n*(n+1)/2 {
+		t.Errorf("sum not %d, got %v", n*(n+1)/2, r)
+	}
+	qs := datum.GetQuantiles(d)
+	for _, q := range targets {
+		// The allowed rank error is min(q, 1-q)/10 of n.
+		allowed := math.Min(q, 1-q) / 10 * n
+		if diff := math.Abs(qs[q] - q*n); diff > allowed {
+			t.Errorf("quantile %v: estimate %v is more than %v from %v", q, qs[q], allowed, q*n)
+		}
+	}
+}
@@ -7,7 +7,9 @@ package metrics
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +17,12 @@ import (
 	"github.com/pkg/errors"
 )
 
+var (
+	// limitEvictions counts the label values removed from metrics at their
+	// limit, per program.
+	limitEvictions = expvar.NewMap("metric_limit_evictions_total")
+)
+
 // Kind enumerates the types of metrics supported.
 type Kind int
 
@@ -39,6 +47,31 @@ const (
 	// Histogram is a Kind that observes a value and stores the value
 	// in a bucket.
 	Histogram
+
+	// Summary is a Kind that observes a value and maintains a streaming
+	// estimate of quantiles of the observations.
+	Summary
+
+	// Bool is a specialisation of Gauge that is either true or false, stored
+	// as 1 or 0, for states like whether a service is up.  Each change of
+	// value is counted in a companion counter.
+	Bool
+
+	// EWMA is a specialisation of Gauge that holds an exponentially weighted
+	// moving average of the values observed, so that bursty values decay
+	// smoothly instead of holding the last value observed.
+	EWMA
+
+	// Unique is a Kind that observes values and estimates how many distinct
+	// values it has observed, without storing them.
+	Unique
+
+	// Min, Max and Stddev are specialisations of Gauge that hold the
+	// minimum, maximum, and standard deviation of the values observed in
+	// the current aggregation interval.
+	Min
+	Max
+	Stddev
 )
 
 const (
@@ -50,6 +83,10 @@ const (
 	String = datum.String
 	// Buckets indicates this metric is a histogram metric type.
 	Buckets = datum.Buckets
+	// Quantiles indicates this metric is a summary metric type.
+	Quantiles = datum.Quantiles
+	// Distinct indicates this metric is a unique metric type.
+	Distinct = datum.Distinct
 )
 
 func (m Kind) String() string {
@@ -64,6 +101,20 @@ func (m Kind) String() string {
 		return "Text"
 	case Histogram:
 		return "Histogram"
+	case Summary:
+		return "Summary"
+	case Bool:
+		return "Bool"
+	case EWMA:
+		return "EWMA"
+	case Unique:
+		return "Unique"
+	case Min:
+		return "Min"
+	case Max:
+		return "Max"
+	case Stddev:
+		return "Stddev"
 	}
 	return "Unknown"
 }
@@ -75,6 +126,9 @@ type LabelValue struct {
 	Value  datum.Datum
 	// After this time of inactivity, the LabelValue is removed from the metric.
 	Expiry time.Duration `json:",omitempty"`
+	// For a top-k metric, the most that the Value may have been counted
+	// before it was tracked, in the values of the untracked label values.
+	Overcount float64 `json:"-"`
 }
 
 func (lv *LabelValue) String() string {
@@ -92,10 +146,35 @@ type Metric struct {
 	Kind        Kind
 	Type        datum.Type
 	Hidden      bool          `json:",omitempty"`
+	Persist     bool          `json:",omitempty"`
 	Keys        []string      `json:",omitempty"`
 	LabelValues []*LabelValue `json:",omitempty"`
 	Source      string        `json:"-"`
 	Buckets     []datum.Range `json:",omitempty"`
+	Quantiles   []float64     `json:",omitempty"`
+	Expiry      time.Duration `json:",omitempty"` // Default expiry of new LabelValues
+	TopK        int           `json:",omitempty"` // If positive, the number of label values tracked individually
+	Limit       int           `json:",omitempty"` // If positive, the most label values kept, evicting the least recently updated
+	Help        string        `json:",omitempty"` // Description of the metric for the monitoring system
+	Unit        string        `json:",omitempty"` // Base unit of the values, like "seconds"
+}
+
+// NameWithUnit returns the exported name of a metric of kind with the values
+// in unit, which by the OpenMetrics conventions ends with the unit, before the
+// `_total' suffix of a counter, e.g. `latency_seconds' and
+// `sent_bytes_total'.  The unit is not added again if name already has it.
+func NameWithUnit(name, unit string, kind Kind) string {
+	if unit == "" {
+		return name
+	}
+	suffix := ""
+	if kind == Counter && strings.HasSuffix(name, "_total") {
+		name, suffix = strings.TrimSuffix(name, "_total"), "_total"
+	}
+	if name != unit && !strings.HasSuffix(name, "_"+unit) {
+		name += "_" + unit
+	}
+	return name + suffix
 }
 
 // NewMetric returns a new empty metric of dimension len(keys).
@@ -139,25 +218,71 @@ func (m *Metric) GetDatum(labelvalues ...string) (d datum.Datum, err error) {
 	if lv := m.FindLabelValueOrNil(labelvalues); lv != nil {
 		d = lv.Value
 	} else {
-		switch m.Type {
-		case datum.Int:
-			d = datum.NewInt()
-		case datum.Float:
-			d = datum.NewFloat()
-		case datum.String:
-			d = datum.NewString()
-		case datum.Buckets:
-			buckets := m.Buckets
-			if buckets == nil {
-				buckets = make([]datum.Range, 0)
-			}
-			d = datum.NewBuckets(buckets)
+		var overcount float64
+		if m.TopK > 0 && !isOther(labelvalues) {
+			overcount = m.makeTopKRoom()
+		}
+		if m.Limit > 0 && len(m.LabelValues) >= m.Limit {
+			m.evictLeastRecent()
 		}
-		m.LabelValues = append(m.LabelValues, &LabelValue{Labels: labelvalues, Value: d})
+		d = m.newDatum()
+		m.LabelValues = append(m.LabelValues, &LabelValue{Labels: labelvalues, Value: d, Expiry: m.Expiry, Overcount: overcount})
 	}
 	return d, nil
 }
 
+// evictLeastRecent removes the label value whose Datum was updated longest
+// ago, to make room for a new one in a metric at its limit.  The metric must
+// be locked.
+func (m *Metric) evictLeastRecent() {
+	oldest := 0
+	for i, lv := range m.LabelValues {
+		if lv.Value.TimeUTC().Before(m.LabelValues[oldest].Value.TimeUTC()) {
+			oldest = i
+		}
+	}
+	m.LabelValues = append(m.LabelValues[:oldest], m.LabelValues[oldest+1:]...)
+	limitEvictions.Add(m.Program, 1)
+}
+
+// PeekDatum returns the datum named by a sequence of string label values from
+// a Metric, like GetDatum, but if it does not exist, a new Datum is returned
+// without adding it to the Metric.
+func (m *Metric) PeekDatum(labelvalues ...string) (datum.Datum, error) {
+	if len(labelvalues) != len(m.Keys) {
+		return nil, errors.Errorf("Label values requested (%q) not same length as keys for metric %v", labelvalues, m)
+	}
+	m.RLock()
+	defer m.RUnlock()
+	if lv := m.FindLabelValueOrNil(labelvalues); lv != nil {
+		return lv.Value, nil
+	}
+	return m.newDatum(), nil
+}
+
+// newDatum returns a new Datum of the type of the Metric.
+func (m *Metric) newDatum() (d datum.Datum) {
+	switch m.Type {
+	case datum.Int:
+		d = datum.NewInt()
+	case datum.Float:
+		d = datum.NewFloat()
+	case datum.String:
+		d = datum.NewString()
+	case datum.Buckets:
+		buckets := m.Buckets
+		if buckets == nil {
+			buckets = make([]datum.Range, 0)
+		}
+		d = datum.NewBuckets(buckets)
+	case datum.Quantiles:
+		d = datum.NewQuantiles(m.Quantiles)
+	case datum.Distinct:
+		d = datum.NewDistinct()
+	}
+	return d
+}
+
 // RemoveDatum removes the Datum described by labelvalues from the Metric m.
 func (m *Metric) RemoveDatum(labelvalues ...string) error {
 	if len(labelvalues) != len(m.Keys) {
@@ -178,6 +303,54 @@ Loop:
 	return nil
 }
 
+// ReplaceDatum replaces the Datum old of the Metric m with new, keeping its
+// label values, and returns false if old is not one of its Datums.
+func (m *Metric) ReplaceDatum(old, new datum.Datum) bool {
+	m.Lock()
+	defer m.Unlock()
+	for _, lv := range m.LabelValues {
+		if lv.Value == old {
+			lv.Value = new
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveMatchingDatum removes the Datums whose label values are matched by
+// match from the Metric m, and returns how many were removed.
+func (m *Metric) RemoveMatchingDatum(match func(labelvalues []string) bool) int {
+	m.Lock()
+	defer m.Unlock()
+	kept := m.LabelValues[:0]
+	for _, lv := range m.LabelValues {
+		if !match(lv.Labels) {
+			kept = append(kept, lv)
+		}
+	}
+	removed := len(m.LabelValues) - len(kept)
+	for i := len(kept); i < len(m.LabelValues); i++ {
+		m.LabelValues[i] = nil
+	}
+	m.LabelValues = kept
+	return removed
+}
+
+// ExpireMatchingDatum sets the expiry of the Datums whose label values are
+// matched by match, and returns how many were matched.
+func (m *Metric) ExpireMatchingDatum(expiry time.Duration, match func(labelvalues []string) bool) int {
+	m.Lock()
+	defer m.Unlock()
+	n := 0
+	for _, lv := range m.LabelValues {
+		if match(lv.Labels) {
+			lv.Expiry = expiry
+			n++
+		}
+	}
+	return n
+}
+
 func (m *Metric) ExpireDatum(expiry time.Duration, labelvalues ...string) error {
 	if len(labelvalues) != len(m.Keys) {
 		return errors.Errorf("Label values requested (%q) not same length as keys for metric %v", labelvalues, m)
@@ -256,7 +429,7 @@ func (lv *LabelValue) UnmarshalJSON(b []byte) error {
 func (m *Metric) String() string {
 	m.RLock()
 	defer m.RUnlock()
-	return fmt.Sprintf("Metric: name=%s program=%s kind=%v type=%s hidden=%v keys=%v labelvalues=%v source=%s buckets=%v", m.Name, m.Program, m.Kind, m.Type, m.Hidden, m.Keys, m.LabelValues, m.Source, m.Buckets)
+	return fmt.Sprintf("Metric: name=%s program=%s kind=%v type=%s hidden=%v keys=%v labelvalues=%v source=%s buckets=%v quantiles=%v", m.Name, m.Program, m.Kind, m.Type, m.Hidden, m.Keys, m.LabelValues, m.Source, m.Buckets, m.Quantiles)
 }
 
 // SetSource sets the source of a metric, describing where in user programmes it was defined.
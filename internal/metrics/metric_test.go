@@ -34,6 +34,22 @@ func TestKindType(t *testing.T) {
 	if s := v.String(); s != "Timer" {
 		t.Errorf("Kind.String() returned %q not Timer", s)
 	}
+	v = Bool
+	if s := v.String(); s != "Bool" {
+		t.Errorf("Kind.String() returned %q not Bool", s)
+	}
+	v = EWMA
+	if s := v.String(); s != "EWMA" {
+		t.Errorf("Kind.String() returned %q not EWMA", s)
+	}
+	v = Stddev
+	if s := v.String(); s != "Stddev" {
+		t.Errorf("Kind.String() returned %q not Stddev", s)
+	}
+	v = Unique
+	if s := v.String(); s != "Unique" {
+		t.Errorf("Kind.String() returned %q not Unique", s)
+	}
 }
 
 func TestScalarMetric(t *testing.T) {
@@ -195,7 +211,7 @@ func TestMetricJSONRoundTrip(t *testing.T) {
 			return false
 		}
 
-		if diff := testutil.Diff(m, r, testutil.IgnoreUnexported(sync.RWMutex{})); diff != "" {
+		if diff := testutil.Diff(m, r, testutil.IgnoreUnexported(sync.RWMutex{}), testutil.IgnoreFields(datum.BaseDatum{}, "Seq")); diff != "" {
 			t.Errorf("Round trip wasn't stable:\n%s", diff)
 			return false
 		}
@@ -247,3 +263,74 @@ func TestRemoveMetricLabelValue(t *testing.T) {
 		t.Errorf("label value still exists")
 	}
 }
+
+func TestRemoveMatchingDatum(t *testing.T) {
+	m := NewMetric("test", "prog", Counter, Int, "a", "b")
+	for _, l := range [][]string{{"x", "1"}, {"x", "2"}, {"y", "1"}} {
+		if _, err := m.GetDatum(l...); err != nil {
+			t.Fatalf("GetDatum failed: %s", err)
+		}
+	}
+	n := m.RemoveMatchingDatum(func(labels []string) bool { return labels[0] == "x" })
+	if n != 2 {
+		t.Errorf("removed %d datums, expected 2", n)
+	}
+	if len(m.LabelValues) != 1 || m.FindLabelValueOrNil([]string{"y", "1"}) == nil {
+		t.Errorf("unexpected label values left: %v", m.LabelValues)
+	}
+}
+
+func TestMetricLimit(t *testing.T) {
+	m := NewMetric("test", "prog", Gauge, Int, "txid")
+	m.Limit = 2
+	for i, l := range []string{"a", "b", "a", "c"} {
+		d, err := m.GetDatum(l)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, time.Unix(int64(i), 0))
+	}
+	// b was updated longest ago when c was added.
+	if len(m.LabelValues) != 2 || m.FindLabelValueOrNil([]string{"a"}) == nil || m.FindLabelValueOrNil([]string{"c"}) == nil {
+		t.Errorf("unexpected label values left: %v", m.LabelValues)
+	}
+}
+
+func TestMetricDefaultExpiry(t *testing.T) {
+	m := NewMetric("test", "prog", Counter, Int, "a")
+	m.Expiry = time.Hour
+	_, err := m.GetDatum("x")
+	testutil.FatalIfErr(t, err)
+	lv := m.FindLabelValueOrNil([]string{"x"})
+	if lv == nil {
+		t.Fatal("couldn't find labelvalue")
+	}
+	if lv.Expiry != time.Hour {
+		t.Errorf("Expiry not correct, is %v", lv.Expiry)
+	}
+}
+
+func TestTopKMetric(t *testing.T) {
+	m := NewMetric("requests", "prog", Counter, Int, "path")
+	m.TopK = 2
+	inc := func(path string, n int64) {
+		d, err := m.GetDatum(path)
+		testutil.FatalIfErr(t, err)
+		datum.IncIntBy(d, n, time.Unix(0, 0))
+	}
+	inc("/a", 10)
+	inc("/b", 3)
+	// /b has the least count, so goes into _other to make room for /c.
+	inc("/c", 1)
+	// /c is estimated at 4, counting what /b had, so /d replaces it.
+	inc("/d", 5)
+	// A tracked path keeps counting.
+	inc("/a", 1)
+
+	values := make(map[string]int64)
+	for _, lv := range m.LabelValues {
+		values[lv.Labels[0]] = datum.GetInt(lv.Value)
+	}
+	expected := map[string]int64{"/a": 11, "/d": 5, OtherLabel: 4}
+	if diff := testutil.Diff(expected, values); diff != "" {
+		t.Error(diff)
+	}
+}
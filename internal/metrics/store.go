@@ -11,23 +11,51 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/metrics/datum"
 )
 
 // Store contains Metrics.
 type Store struct {
 	sync.RWMutex
 	Metrics map[string][]*Metric
+
+	clockSteps *clock.Detector // corrects datum timestamps for wall clock steps
 }
 
 // NewStore returns a new metric Store.
 func NewStore() (s *Store) {
-	s = &Store{}
+	s = &Store{clockSteps: clock.Default}
 	s.ClearMetrics()
 	return
 }
 
+// ReloadPolicy is what the Store does with the values of a metric that is
+// added again by a reloaded program.
+type ReloadPolicy int
+
+const (
+	// ReloadBySource keeps the values if the metric's type, keys, and the
+	// source of its declaration are unchanged, so moving a declaration to
+	// another line resets it.
+	ReloadBySource ReloadPolicy = iota
+	// ReloadKeep keeps the values if the metric's type and keys are
+	// unchanged, wherever it is declared.
+	ReloadKeep
+	// ReloadClear discards the values, so the metric starts from zero.
+	ReloadClear
+)
+
 // Add is used to add one metric to the Store.
 func (s *Store) Add(m *Metric) error {
+	return s.AddWithPolicy(m, ReloadBySource)
+}
+
+// AddWithPolicy adds one metric to the Store, replacing the metric of the
+// same name from an earlier load of its program and handling its values by
+// the ReloadPolicy p.
+func (s *Store) AddWithPolicy(m *Metric, p ReloadPolicy) error {
 	s.Lock()
 	defer s.Unlock()
 	glog.V(1).Infof("Adding a new metric %v", m)
@@ -49,15 +77,16 @@ func (s *Store) Add(m *Metric) error {
 			if v.Type != m.Type {
 				continue
 			}
-			if v.Source != m.Source {
+			if v.Source != m.Source && p != ReloadKeep {
 				continue
 			}
 			dupeIndex = i
 			glog.V(2).Infof("v keys: %v m.keys: %v", v.Keys, m.Keys)
 			// If a set of label keys has changed, discard
 			// old metric completely, w/o even copying old
-			// data, as they are now incompatible.
-			if len(v.Keys) != len(m.Keys) || !reflect.DeepEqual(v.Keys, m.Keys) {
+			// data, as they are now incompatible.  Likewise
+			// if the policy is to clear the values.
+			if len(v.Keys) != len(m.Keys) || !reflect.DeepEqual(v.Keys, m.Keys) || p == ReloadClear {
 				break
 			}
 			glog.V(2).Infof("v buckets: %v m.buckets: %v", v.Buckets, m.Buckets)
@@ -69,7 +98,12 @@ func (s *Store) Add(m *Metric) error {
 				d, err := v.GetDatum(oldLabel.Labels...)
 				if err == nil {
 					if err = m.RemoveDatum(oldLabel.Labels...); err == nil {
-						m.LabelValues = append(m.LabelValues, &LabelValue{Labels: oldLabel.Labels, Value: d})
+						// Keep an expiry set by a delete, but not the old default.
+						expiry := oldLabel.Expiry
+						if expiry == v.Expiry {
+							expiry = m.Expiry
+						}
+						m.LabelValues = append(m.LabelValues, &LabelValue{Labels: oldLabel.Labels, Value: d, Expiry: expiry})
 					}
 				}
 			}
@@ -101,20 +135,69 @@ func (s *Store) MarshalJSON() (b []byte, err error) {
 	return json.Marshal(ms)
 }
 
+// Changes returns copies of the metrics in the Store holding only the values
+// that have changed since the datum sequence number since, or all the metrics
+// if since is zero, and the sequence number to pass to get the changes after
+// this call.  Otherwise metrics with no changed values are left out.
+func (s *Store) Changes(since uint64) ([]*Metric, uint64) {
+	// Read the sequence number first, so that changes made while the store is
+	// read are returned now or by the next call, never missed.
+	seq := datum.Seq()
+	s.RLock()
+	defer s.RUnlock()
+	ms := make([]*Metric, 0)
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			m.RLock()
+			lvs := make([]*LabelValue, 0)
+			for _, lv := range m.LabelValues {
+				if since == 0 || lv.Value.LastChange() > since {
+					lvs = append(lvs, lv)
+				}
+			}
+			if since == 0 || len(lvs) > 0 {
+				ms = append(ms, &Metric{
+					Name:        m.Name,
+					Program:     m.Program,
+					Kind:        m.Kind,
+					Type:        m.Type,
+					Hidden:      m.Hidden,
+					Persist:     m.Persist,
+					Keys:        m.Keys,
+					LabelValues: lvs,
+					Source:      m.Source,
+					Buckets:     m.Buckets,
+					Quantiles:   m.Quantiles,
+					Expiry:      m.Expiry,
+					TopK:        m.TopK,
+					Limit:       m.Limit,
+					Help:        m.Help,
+					Unit:        m.Unit,
+				})
+			}
+			m.RUnlock()
+		}
+	}
+	return ms, seq
+}
+
 // Gc iterates through the Store looking for metrics that have been marked
-// for expiry, and removing them if their expiration time has passed.
+// for expiry, and removing them if their expiration time has passed.  Datum
+// timestamps from before a step in the wall clock are corrected for the step,
+// so that a large NTP correction doesn't expire everything at once.
 func (s *Store) Gc() error {
 	glog.Info("Running Store.Expire()")
 	s.Lock()
 	defer s.Unlock()
-	now := time.Now()
+	s.clockSteps.Check()
+	now := s.clockSteps.Now()
 	for _, ml := range s.Metrics {
 		for _, m := range ml {
 			for _, lv := range m.LabelValues {
 				if lv.Expiry <= 0 {
 					continue
 				}
-				if now.Sub(lv.Value.TimeUTC()) > lv.Expiry {
+				if now.Sub(s.clockSteps.Correct(lv.Value.TimeUTC())) > lv.Expiry {
 					err := m.RemoveDatum(lv.Labels...)
 					if err != nil {
 						return err
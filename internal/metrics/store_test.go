@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
 )
@@ -132,3 +133,129 @@ func TestExpireMetric(t *testing.T) {
 		t.Logf("Store: %#v", s)
 	}
 }
+
+func TestExpireMetricClockStep(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewStore()
+	var advance func(elapsed, step time.Duration)
+	s.clockSteps, advance = clock.NewFakeDetector(clock.DefaultThreshold, start)
+	s.clockSteps.Check()
+
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	for _, tc := range []struct {
+		label string
+		age   time.Duration
+	}{
+		{"recent", 10 * time.Minute},
+		{"old", 40 * time.Minute},
+	} {
+		d, err := m.GetDatum(tc.label)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, start.Add(-tc.age))
+		m.FindLabelValueOrNil([]string{tc.label}).Expiry = 30 * time.Minute
+	}
+
+	// The wall clock jumps an hour ahead, which doesn't age the recent datum
+	// past its expiry.
+	advance(time.Minute, time.Hour)
+	testutil.FatalIfErr(t, s.Gc())
+	if lv := m.FindLabelValueOrNil([]string{"recent"}); lv == nil {
+		t.Error("recent lv expired after clock step")
+	}
+	if lv := m.FindLabelValueOrNil([]string{"old"}); lv != nil {
+		t.Errorf("old lv not expired: %#v", lv)
+	}
+}
+
+func TestAddMetricNewExpiry(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	m.Expiry = time.Hour
+	testutil.FatalIfErr(t, s.Add(m))
+	_, err := m.GetDatum("default")
+	testutil.FatalIfErr(t, err)
+	_, err = m.GetDatum("deleted")
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, m.ExpireDatum(time.Minute, "deleted"))
+
+	n := NewMetric("foo", "prog", Counter, Int, "a")
+	n.Expiry = 2 * time.Hour
+	testutil.FatalIfErr(t, s.Add(n))
+	for labels, expected := range map[string]time.Duration{"default": 2 * time.Hour, "deleted": time.Minute} {
+		lv := n.FindLabelValueOrNil([]string{labels})
+		if lv == nil {
+			t.Fatalf("couldn't find lv %q", labels)
+		}
+		if lv.Expiry != expected {
+			t.Errorf("%q: expiry is %v, expected %v", labels, lv.Expiry, expected)
+		}
+	}
+}
+
+func TestAddWithPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy   ReloadPolicy
+		source   string
+		kept     bool
+		storeLen int
+	}{
+		{ReloadBySource, "prog:1", true, 1},
+		{ReloadBySource, "prog:2", false, 2},
+		{ReloadKeep, "prog:2", true, 1},
+		{ReloadClear, "prog:1", false, 1},
+	} {
+		s := NewStore()
+		m := NewMetric("foo", "prog", Counter, Int, "a")
+		m.SetSource("prog:1")
+		testutil.FatalIfErr(t, s.Add(m))
+		_, err := m.GetDatum("x")
+		testutil.FatalIfErr(t, err)
+
+		n := NewMetric("foo", "prog", Counter, Int, "a")
+		n.SetSource(tc.source)
+		testutil.FatalIfErr(t, s.AddWithPolicy(n, tc.policy))
+		if kept := n.FindLabelValueOrNil([]string{"x"}) != nil; kept != tc.kept {
+			t.Errorf("%v %s: value kept is %v, expected %v", tc.policy, tc.source, kept, tc.kept)
+		}
+		if len(s.Metrics["foo"]) != tc.storeLen {
+			t.Errorf("%v %s: store has %d metrics, expected %d", tc.policy, tc.source, len(s.Metrics["foo"]), tc.storeLen)
+		}
+	}
+}
+
+func TestStoreChanges(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	n := NewMetric("bar", "prog", Gauge, Int)
+	testutil.FatalIfErr(t, s.Add(n))
+	d, err := m.GetDatum("1")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Now())
+	d, err = m.GetDatum("2")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Now())
+
+	ms, seq := s.Changes(0)
+	if len(ms) != 2 {
+		t.Fatalf("expected all metrics, got %v", ms)
+	}
+
+	datum.IncIntBy(d, 1, time.Now())
+	ms, next := s.Changes(seq)
+	if next <= seq {
+		t.Errorf("sequence number %d not after %d", next, seq)
+	}
+	if len(ms) != 1 || ms[0].Name != "foo" {
+		t.Fatalf("expected only foo, got %v", ms)
+	}
+	if diff := testutil.Diff([]string{"2"}, ms[0].LabelValues[0].Labels); diff != "" || len(ms[0].LabelValues) != 1 {
+		t.Errorf("expected only the changed value: %v %s", ms[0].LabelValues, diff)
+	}
+
+	ms, _ = s.Changes(next)
+	if len(ms) != 0 {
+		t.Errorf("expected no changes, got %v", ms)
+	}
+}
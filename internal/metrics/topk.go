@@ -0,0 +1,74 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// OtherLabel is the value of each label of the Datum of a top-k Metric that
+// holds the sum of the values of the label values not tracked individually.
+const OtherLabel = "_other"
+
+// isOther returns true if labelvalues name the Datum of the untracked label
+// values of a top-k Metric.
+func isOther(labelvalues []string) bool {
+	for _, l := range labelvalues {
+		if l != OtherLabel {
+			return false
+		}
+	}
+	return len(labelvalues) > 0
+}
+
+// topkPriority estimates the true value of lv, as its value plus the most it
+// could have been counted before it was tracked.
+func topkPriority(lv *LabelValue) float64 {
+	if d, ok := lv.Value.(*datum.IntDatum); ok {
+		return float64(d.Get()) + lv.Overcount
+	}
+	return datum.GetFloat(lv.Value) + lv.Overcount
+}
+
+// makeTopKRoom makes room for a new label value in a top-k Metric that is
+// tracking as many label values as it may, by adding the value of the label
+// value with the lowest estimated value into the untracked label values, and
+// removing it, as in the Space-Saving algorithm of Metwally et al.  It
+// returns the estimated value of the label value removed, which the new one
+// may have been counted in.  The metric lock must be held.
+func (m *Metric) makeTopKRoom() float64 {
+	tracked := 0
+	min := -1
+	for i, lv := range m.LabelValues {
+		if isOther(lv.Labels) {
+			continue
+		}
+		tracked++
+		if min < 0 || topkPriority(lv) < topkPriority(m.LabelValues[min]) {
+			min = i
+		}
+	}
+	if tracked < m.TopK {
+		return 0
+	}
+	evicted := m.LabelValues[min]
+	m.LabelValues = append(m.LabelValues[:min], m.LabelValues[min+1:]...)
+
+	other := make([]string, len(m.Keys))
+	for i := range other {
+		other[i] = OtherLabel
+	}
+	lv := m.FindLabelValueOrNil(other)
+	if lv == nil {
+		lv = &LabelValue{Labels: other, Value: m.newDatum(), Expiry: m.Expiry}
+		m.LabelValues = append(m.LabelValues, lv)
+	}
+	switch d := evicted.Value.(type) {
+	case *datum.IntDatum:
+		datum.IncIntBy(lv.Value, d.Get(), d.TimeUTC())
+	default:
+		datum.SetFloat(lv.Value, datum.GetFloat(lv.Value)+datum.GetFloat(d), d.TimeUTC())
+	}
+	return topkPriority(evicted)
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+
+	"github.com/google/mtail/internal/vm"
+)
+
+// CheckResult is the outcome of one readiness check.
+type CheckResult struct {
+	Kind  string `json:"kind"` // What was checked: "program", "pattern", "log", "watch", or "exec".
+	Name  string `json:"name"` // The program, pattern, pathname or command checked.
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// CheckReport is a machine-readable report of whether mtail is ready to run
+// with a given configuration.
+type CheckReport struct {
+	Ready  bool          `json:"ready"` // Set if every check passed.
+	Checks []CheckResult `json:"checks"`
+}
+
+func (r *CheckReport) add(kind, name string, err error) {
+	c := CheckResult{Kind: kind, Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		r.Ready = false
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// Check verifies that the programs at programPath compile, that each log path
+// pattern matches files that can be read by the current user, that watches
+// can be created on those files and their directories if useFsnotify is set,
+// and that each exec log command can be found.  No programs are run and no
+// logs are read.
+func Check(programPath string, logPathPatterns, execLogs []string, useFsnotify bool) *CheckReport {
+	r := &CheckReport{Ready: true}
+
+	if progErrors, err := vm.CheckPrograms(programPath); err != nil {
+		r.add("program", programPath, err)
+	} else {
+		names := make([]string, 0, len(progErrors))
+		for name := range progErrors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			r.add("program", name, progErrors[name])
+		}
+	}
+
+	var w *fsnotify.Watcher
+	if useFsnotify {
+		var err error
+		w, err = fsnotify.NewWatcher()
+		if err != nil {
+			r.add("watch", "fsnotify", errors.Wrap(err, "can't create a watcher"))
+		} else {
+			defer w.Close()
+		}
+	}
+	watched := make(map[string]struct{})
+	watch := func(pathname string) {
+		if w == nil {
+			return
+		}
+		if _, ok := watched[pathname]; ok {
+			return
+		}
+		watched[pathname] = struct{}{}
+		r.add("watch", pathname, w.Add(pathname))
+	}
+
+	for _, pattern := range logPathPatterns {
+		absPattern, err := filepath.Abs(pattern)
+		if err != nil {
+			r.add("pattern", pattern, err)
+			continue
+		}
+		matches, err := filepath.Glob(absPattern)
+		if err == nil && len(matches) == 0 {
+			err = errors.New("no matches")
+		}
+		r.add("pattern", pattern, err)
+		// The tailer watches the pattern's directory for new matching logs.
+		watch(filepath.Dir(absPattern))
+		for _, pathname := range matches {
+			r.add("log", pathname, checkReadable(pathname))
+			watch(pathname)
+			watch(filepath.Dir(pathname))
+		}
+	}
+
+	for _, command := range execLogs {
+		argv := strings.Fields(command)
+		if len(argv) == 0 {
+			r.add("exec", command, errors.New("empty command"))
+			continue
+		}
+		_, err := exec.LookPath(argv[0])
+		r.add("exec", command, err)
+	}
+	return r
+}
+
+// checkReadable returns an error if the log at pathname can't be opened for
+// reading.
+func checkReadable(pathname string) error {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.New("is a directory")
+	}
+	return nil
+}
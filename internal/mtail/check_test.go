@@ -0,0 +1,53 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestCheck(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	progDir := path.Join(tmpDir, "progs")
+	logDir := path.Join(tmpDir, "logs")
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+	testutil.FatalIfErr(t, os.Mkdir(logDir, 0700))
+	for name, contents := range map[string]string{
+		path.Join(progDir, "good.mtail"): testProgram,
+		path.Join(progDir, "bad.mtail"):  "i++\n",
+		path.Join(logDir, "log"):         "",
+	} {
+		f := testutil.TestOpenFile(t, name)
+		testutil.WriteString(t, f, contents)
+		testutil.FatalIfErr(t, f.Close())
+	}
+
+	r := Check(progDir, []string{path.Join(logDir, "*"), path.Join(logDir, "nomatch*")}, []string{"/nonexistent/command"}, true)
+	if r.Ready {
+		t.Error("expected not ready")
+	}
+	got := make(map[string]bool)
+	for _, c := range r.Checks {
+		got[c.Kind+" "+c.Name] = c.OK
+	}
+	expected := map[string]bool{
+		"program bad.mtail":                        false,
+		"program good.mtail":                       true,
+		"pattern " + path.Join(logDir, "*"):        true,
+		"pattern " + path.Join(logDir, "nomatch*"): false,
+		"log " + path.Join(logDir, "log"):          true,
+		"watch " + logDir:                          true,
+		"watch " + path.Join(logDir, "log"):        true,
+		"exec /nonexistent/command":                false,
+	}
+	if diff := testutil.Diff(expected, got); diff != "" {
+		t.Errorf("checks didn't match:\n%s", diff)
+	}
+}
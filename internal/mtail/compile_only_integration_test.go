@@ -12,6 +12,8 @@ import (
 
 	"github.com/google/mtail/internal/mtail"
 	"github.com/google/mtail/internal/testutil"
+	vmerrors "github.com/google/mtail/internal/vm/errors"
+	"github.com/pkg/errors"
 )
 
 func TestBadProgramFailsCompilation(t *testing.T) {
@@ -34,3 +36,32 @@ func TestBadProgramFailsCompilation(t *testing.T) {
 		t.Error("compile failed not reported")
 	}
 }
+
+func TestStrictFailsCompilationOnWarnings(t *testing.T) {
+	progDir, rmProgDir := testutil.TestTempDir(t)
+	defer rmProgDir()
+	logDir, rmLogDir := testutil.TestTempDir(t)
+	defer rmLogDir()
+
+	err := ioutil.WriteFile(path.Join(progDir, "unused.mtail"), []byte("counter c\n/(\\d+)/ {\n  c++\n}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = mtail.TestMakeServer(t, 0, false, mtail.ProgramPath(progDir), mtail.LogPathPatterns(logDir), mtail.CompileOnly)
+	if err != nil {
+		t.Fatalf("unexpected error without strict: %s", err)
+	}
+
+	_, err = mtail.TestMakeServer(t, 0, false, mtail.ProgramPath(progDir), mtail.LogPathPatterns(logDir), mtail.CompileOnly, mtail.Strict)
+	if err == nil {
+		t.Fatal("expected error from mtail")
+	}
+	el, ok := errors.Cause(err).(vmerrors.ErrorList)
+	if !ok || len(el) != 1 {
+		t.Fatalf("expected one compile error, got %#v", errors.Cause(err))
+	}
+	if el[0].Class() != vmerrors.Unused {
+		t.Errorf("warning class is %q, expected %q", el[0].Class(), vmerrors.Unused)
+	}
+}
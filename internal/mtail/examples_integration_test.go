@@ -80,6 +80,11 @@ var exampleProgramTests = []struct {
 		"testdata/strcat.log",
 		"testdata/strcat.golden",
 	},
+	{
+		"examples/strinterp.mtail",
+		"testdata/strinterp.log",
+		"testdata/strinterp.golden",
+	},
 	{
 		"examples/add_assign_float.mtail",
 		"testdata/add_assign_float.log",
@@ -115,6 +120,11 @@ var exampleProgramTests = []struct {
 		"testdata/decorator.log",
 		"testdata/decorator.golden",
 	},
+	{
+		"examples/function.mtail",
+		"testdata/function.log",
+		"testdata/function.golden",
+	},
 	{
 		"examples/stringy.mtail",
 		"testdata/stringy.log",
@@ -180,7 +190,7 @@ func TestExamplePrograms(t *testing.T) {
 				t.Error(err)
 			}
 
-			diff := testutil.Diff(goldenStore, store, testutil.IgnoreUnexported(sync.RWMutex{}, datum.StringDatum{}))
+			diff := testutil.Diff(goldenStore, store, testutil.IgnoreUnexported(sync.RWMutex{}, datum.StringDatum{}, metrics.Store{}), testutil.IgnoreFields(datum.BaseDatum{}, "Seq"))
 
 			if diff != "" {
 				t.Error(diff)
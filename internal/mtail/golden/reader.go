@@ -17,7 +17,7 @@ import (
 	"github.com/google/mtail/internal/metrics/datum"
 )
 
-var varRe = regexp.MustCompile(`^(counter|gauge|timer|text|histogram) ([^ ]+)(?: {([^}]+)})?(?: (\S+))?(?: (.+))?`)
+var varRe = regexp.MustCompile(`^(counter|gauge|timer|text|histogram|summary|bool|ewma|min|max|stddev) ([^ ]+)(?: {([^}]+)})?(?: (\S+))?(?: (.+))?`)
 
 // FindMetricOrNil returns a metric in a store, or returns nil if not found.
 func FindMetricOrNil(store *metrics.Store, name string) *metrics.Metric {
@@ -70,6 +70,20 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 			kind = metrics.Text
 		case "histogram":
 			kind = metrics.Histogram
+		case "summary":
+			kind = metrics.Summary
+		case "bool":
+			kind = metrics.Bool
+		case "ewma":
+			kind = metrics.EWMA
+		case "min":
+			kind = metrics.Min
+		case "max":
+			kind = metrics.Max
+		case "stddev":
+			kind = metrics.Stddev
+		case "unique":
+			kind = metrics.Unique
 		}
 		glog.V(2).Infof("match[4]: %q", match[4])
 		typ := datum.Int
@@ -15,13 +15,20 @@ import (
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
 	"github.com/google/mtail/internal/exporter"
+	"github.com/google/mtail/internal/forwarder"
+	"github.com/google/mtail/internal/geoip"
+	"github.com/google/mtail/internal/linefilter"
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/tailer"
@@ -60,6 +67,8 @@ type Server struct {
 	l *vm.Loader         // l loads programs and manages the VM lifecycle.
 	e *exporter.Exporter // e manages the export of metrics from the store.
 
+	f *forwarder.Forwarder // f sends lines passed to forward() to the forward target, if any.
+
 	reg *prometheus.Registry
 
 	h        *http.Server
@@ -73,13 +82,50 @@ type Server struct {
 	buildInfo       BuildInfo // go build information
 	programPath     string    // path to programs to load
 	logPathPatterns []string  // list of patterns to watch for log files to tail
+	execLogs        []string  // list of commands to run and tail the output of
+	forwardTarget   string    // URL of the receiver of forwarded lines
+	geoipDatabase   string    // path of the GeoIP database used by programs
+	lineFilters     string    // path of the filters applied to lines before the programs
+	lowPriorityLogs []string  // list of patterns of logs to pause when programs are backed up
+
+	programLabels  map[string]map[string]string // constant labels to add to each program's metrics, by program filename
+	derivedMetrics []exporter.Derived           // metrics computed from the others by the Prometheus export
+	regexManifest  string                       // path of the regular expression options for each program
+
+	runID        string // random identifier of this run of mtail
+	runStateFile string // path of the file counting the runs of mtail
+
+	crashLoopStateFile string        // path of the file counting the runs of mtail in a crash loop
+	safeModeAfter      int           // number of runs in a crash loop after which mtail starts in safe mode
+	crashLoopWindow    time.Duration // how soon after starting a run must end to count towards a crash loop
+	crashLoopTimer     *time.Timer   // resets the crash loop count once this run has lasted the window
+	safeModeReason     string        // if set, mtail is in safe mode, and this explains why
+
+	dispatchHighWater int // number of lines queued for a program above which low priority logs are paused
+
+	rotationDrainTimeout time.Duration // how long the tailer reads a log's file after a rotation renames it
 
 	oneShot      bool // if set, mtail reads log files from the beginning, once, then exits
+	verifyReads  bool // if set, the tailer checks its reads with a shadow read
+	requireLogs  bool // if set, mtail fails to start if a log path pattern matches no files
+	noDebug      bool // if set, the /debug endpoints are not served
 	compileOnly  bool // if set, mtail compiles programs then exits
+	strict       bool // if set, warnings about programs are compile errors
+	strictTypes  bool // if set, implicit conversions between ints and floats in programs are compile errors
 	dumpAst      bool // if set, mtail prints the program syntax tree after parse
 	dumpAstTypes bool // if set, mtail prints the program syntax tree after type checking
 	dumpBytecode bool // if set, mtail prints the program bytecode after code generation
 
+	countConditionMatches bool   // if set, the lines matched by each top-level condition of the programs are counted
+	countUnmatchedLines   bool   // if set, the lines that no program matched are counted
+	arithmeticPolicies    string // what programs do on arithmetic faults, by default and per program
+	reloadPolicies        string // what happens to metric values when programs are reloaded, by default and per program
+	overflowPolicies      string // what programs do when int metrics overflow, by default and per program
+
+	lineBudgetInstructions int           // most instructions a program runs per line, if positive
+	lineBudgetTime         time.Duration // most time a program spends per line, if positive
+	quarantineAfter        int           // lines over budget before a program is quarantined, if positive
+
 	overrideLocation            *time.Location // Timezone location to use when parsing timestamps
 	expiredMetricGcTickInterval time.Duration  // Interval between expired metric removal runs
 	staleLogGcTickInterval      time.Duration  // Interval between stale log gc runs
@@ -89,8 +135,14 @@ type Server struct {
 	emitMetricTimestamp         bool           // if set, emit the metric's recorded timestamp
 }
 
-// StartTailing adds each log path pattern to the tailer.
+// StartTailing adds each log path pattern to the tailer.  If logs are
+// required, it fails without tailing any if a pattern matches no files.
 func (m *Server) StartTailing() error {
+	if m.requireLogs {
+		if err := m.checkLogsMatch(); err != nil {
+			return err
+		}
+	}
 	var err error
 	for _, pattern := range m.logPathPatterns {
 		glog.V(1).Infof("Tail pattern %q", pattern)
@@ -98,6 +150,31 @@ func (m *Server) StartTailing() error {
 			glog.Warning(err)
 		}
 	}
+	for _, command := range m.execLogs {
+		glog.V(1).Infof("Tail exec %q", command)
+		if err = m.t.TailExec(command); err != nil {
+			glog.Warning(err)
+		}
+	}
+	return nil
+}
+
+// checkLogsMatch returns an error naming the log path patterns that match
+// no files.
+func (m *Server) checkLogsMatch() error {
+	var unmatched []string
+	for _, pattern := range m.logPathPatterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "bad log path pattern %q", pattern)
+		}
+		if len(matches) == 0 {
+			unmatched = append(unmatched, strconv.Quote(pattern))
+		}
+	}
+	if len(unmatched) > 0 {
+		return errors.Errorf("no files match the log path patterns %s; check the -logs flag", strings.Join(unmatched, ", "))
+	}
 	return nil
 }
 
@@ -110,6 +187,33 @@ func (m *Server) initLoader() error {
 			opts = append(opts, vm.ErrorsAbort)
 		}
 	}
+	if m.strict {
+		opts = append(opts, vm.Strict)
+	}
+	if m.strictTypes {
+		opts = append(opts, vm.StrictTypes)
+	}
+	if m.countConditionMatches {
+		opts = append(opts, vm.CountConditionMatches)
+	}
+	if m.countUnmatchedLines {
+		opts = append(opts, vm.CountUnmatchedLines)
+	}
+	if m.arithmeticPolicies != "" {
+		opts = append(opts, vm.ArithmeticPolicies(m.arithmeticPolicies))
+	}
+	if m.reloadPolicies != "" {
+		opts = append(opts, vm.ReloadPolicies(m.reloadPolicies))
+	}
+	if m.overflowPolicies != "" {
+		opts = append(opts, vm.CounterOverflowPolicies(m.overflowPolicies))
+	}
+	if m.lineBudgetInstructions > 0 || m.lineBudgetTime > 0 {
+		opts = append(opts, vm.LineBudget(m.lineBudgetInstructions, m.lineBudgetTime, m.quarantineAfter))
+	}
+	if m.regexManifest != "" {
+		opts = append(opts, vm.RegexManifest(m.regexManifest))
+	}
 	if m.dumpAst {
 		opts = append(opts, vm.DumpAst)
 	}
@@ -128,16 +232,41 @@ func (m *Server) initLoader() error {
 	if m.overrideLocation != nil {
 		opts = append(opts, vm.OverrideLocation(m.overrideLocation))
 	}
+	if m.forwardTarget != "" && !m.compileOnly {
+		f, err := forwarder.New(m.forwardTarget)
+		if err != nil {
+			return err
+		}
+		m.f = f
+		opts = append(opts, vm.ForwardTo(m.f))
+	}
+	if m.lineFilters != "" {
+		f, err := linefilter.Load(m.lineFilters)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, vm.FilterLines(f))
+	}
+	if m.geoipDatabase != "" {
+		db, err := geoip.Open(m.geoipDatabase)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, vm.GeoIPDatabase(db))
+	}
+	if m.omitProgLabel {
+		opts = append(opts, vm.UniqueMetricNames)
+	}
 	var err error
 	m.l, err = vm.NewLoader(m.programPath, m.store, m.lines, m.w, opts...)
 	if err != nil {
 		return err
 	}
-	if m.programPath == "" {
+	if m.programPath == "" || m.safeModeReason != "" {
 		return nil
 	}
 	if errs := m.l.LoadAllPrograms(); errs != nil {
-		return errors.Errorf("Compile encountered errors:\n%s", errs)
+		return errors.Wrap(errs, "Compile encountered errors")
 	}
 	return nil
 }
@@ -151,6 +280,12 @@ func (m *Server) initExporter() (err error) {
 	if m.emitMetricTimestamp {
 		opts = append(opts, exporter.EmitTimestamp)
 	}
+	if len(m.programLabels) > 0 {
+		opts = append(opts, exporter.ProgramLabels(m.programLabels))
+	}
+	if len(m.derivedMetrics) > 0 {
+		opts = append(opts, exporter.DerivedMetrics(m.derivedMetrics))
+	}
 	m.e, err = exporter.New(m.store, opts...)
 	if err != nil {
 		return err
@@ -158,15 +293,52 @@ func (m *Server) initExporter() (err error) {
 
 	expvarDescs := map[string]*prometheus.Desc{
 		// internal/tailer/file.go
-		"log_errors_total":    prometheus.NewDesc("log_errors_total", "number of IO errors encountered per log file", []string{"logfile"}, nil),
-		"log_rotations_total": prometheus.NewDesc("log_rotations_total", "number of log rotation events per log file", []string{"logfile"}, nil),
-		"log_truncates_total": prometheus.NewDesc("log_truncates_total", "number of log truncation events log file", []string{"logfile"}, nil),
-		"log_lines_total":     prometheus.NewDesc("log_lines_total", "number of lines read per log file", []string{"logfile"}, nil),
+		"log_errors_total":            prometheus.NewDesc("log_errors_total", "number of IO errors encountered per log file", []string{"logfile"}, nil),
+		"log_rotations_total":         prometheus.NewDesc("log_rotations_total", "number of log rotation events per log file", []string{"logfile"}, nil),
+		"log_truncates_total":         prometheus.NewDesc("log_truncates_total", "number of log truncation events log file", []string{"logfile"}, nil),
+		"log_lines_total":             prometheus.NewDesc("log_lines_total", "number of lines read per log file", []string{"logfile"}, nil),
+		"log_read_lag_bytes":          prometheus.NewDesc("log_read_lag_bytes", "number of bytes of each log file not yet read", []string{"logfile"}, nil),
+		"log_read_lag_seconds":        prometheus.NewDesc("log_read_lag_seconds", "seconds of writes to each log file not yet read, since it was last read to the end", []string{"logfile"}, nil),
+		"log_verified_bytes_total":    prometheus.NewDesc("log_verified_bytes_total", "number of bytes of each log file checked by a shadow read", []string{"logfile"}, nil),
+		"log_verify_mismatches_total": prometheus.NewDesc("log_verify_mismatches_total", "number of regions of each log file where a shadow read differed from the tailer's read", []string{"logfile"}, nil),
+		// internal/tailer/drain.go
+		"log_rotation_lines_recovered_total": prometheus.NewDesc("log_rotation_lines_recovered_total", "number of lines of each log file read from its previous file after a rotation renamed it", []string{"logfile"}, nil),
+		// internal/tailer/tail.go
+		"log_reads_paused_total": prometheus.NewDesc("log_reads_paused_total", "number of reads of each low priority log deferred because programs were backed up", []string{"logfile"}, nil),
+		// internal/tailer/exec.go
+		"exec_starts_total": prometheus.NewDesc("exec_starts_total", "number of times each exec log command has been started", []string{"command"}, nil),
+		"exec_exits_total":  prometheus.NewDesc("exec_exits_total", "number of times each exec log command has exited", []string{"command"}, nil),
+		"exec_errors_total": prometheus.NewDesc("exec_errors_total", "number of start failures and unsuccessful exits per exec log command", []string{"command"}, nil),
+		"exec_running":      prometheus.NewDesc("exec_running", "whether each exec log command is currently running", []string{"command"}, nil),
 		// internal/vm/loader.go
-		"line_count":          prometheus.NewDesc("line_count", "number of lines received by the program loader", nil, nil),
-		"prog_loads_total":    prometheus.NewDesc("prog_loads_total", "number of program load events by program source filename", []string{"prog"}, nil),
-		"prog_load_errors":    prometheus.NewDesc("prog_load_errors", "number of errors encountered when loading per program source filename", []string{"prog"}, nil),
-		"prog_runtime_errors": prometheus.NewDesc("prog_runtime_errors", "number of errors encountered when executing programs per source filename", []string{"prog"}, nil),
+		"line_count":                      prometheus.NewDesc("line_count", "number of lines received by the program loader", nil, nil),
+		"prog_loads_total":                prometheus.NewDesc("prog_loads_total", "number of program load events by program source filename", []string{"prog"}, nil),
+		"prog_load_errors":                prometheus.NewDesc("prog_load_errors", "number of errors encountered when loading per program source filename", []string{"prog"}, nil),
+		"prog_runtime_errors":             prometheus.NewDesc("prog_runtime_errors", "number of errors encountered when executing programs per source filename", []string{"prog"}, nil),
+		"prog_strptime_errors_total":      prometheus.NewDesc("prog_strptime_errors_total", "number of times that failed to parse in strptime() per program source filename", []string{"prog"}, nil),
+		"prog_forward_unconfigured_total": prometheus.NewDesc("prog_forward_unconfigured_total", "number of lines passed to forward() with no forward target configured, per program", []string{"prog"}, nil),
+		"prog_arithmetic_errors_total":    prometheus.NewDesc("prog_arithmetic_errors_total", "number of divisions by zero, integer overflows, and negative histogram observations, per program", []string{"prog"}, nil),
+		"metric_limit_evictions_total":    prometheus.NewDesc("metric_limit_evictions_total", "number of label values removed from metrics at their limit, per program", []string{"prog"}, nil),
+		"prog_quarantined":                prometheus.NewDesc("prog_quarantined", "whether each program is quarantined for running over its line budget", []string{"prog"}, nil),
+		"counter_overflows_total":         prometheus.NewDesc("counter_overflows_total", "number of increments of int metrics past the largest int, per program", []string{"prog"}, nil),
+		"prog_condition_matches_total":    prometheus.NewDesc("prog_condition_matches_total", "number of lines matched by each top-level condition, per program and source line", []string{"prog", "line"}, nil),
+		"prog_geoip_unconfigured_total":   prometheus.NewDesc("prog_geoip_unconfigured_total", "number of calls to geoip_country() or geoip_asn() with no GeoIP database configured, per program", []string{"prog"}, nil),
+		"prog_compile_seconds":            prometheus.NewDesc("prog_compile_seconds", "seconds taken to compile each program when it was last loaded", []string{"prog"}, nil),
+		"prog_bytecode_instructions":      prometheus.NewDesc("prog_bytecode_instructions", "number of bytecode instructions of each program", []string{"prog"}, nil),
+		"prog_regexps":                    prometheus.NewDesc("prog_regexps", "number of regular expressions compiled for each program", []string{"prog"}, nil),
+		// internal/forwarder/forwarder.go
+		"forward_lines_total":   prometheus.NewDesc("forward_lines_total", "number of lines sent to the forward target", nil, nil),
+		"forward_errors_total":  prometheus.NewDesc("forward_errors_total", "number of errors sending lines to the forward target", nil, nil),
+		"forward_dropped_total": prometheus.NewDesc("forward_dropped_total", "number of lines dropped because the forward queue was full", nil, nil),
+		// internal/logline/dropped.go
+		"lines_dropped_total": prometheus.NewDesc("lines_dropped_total", "number of lines read from the logs but not processed by any program, by the stage that dropped them and why", []string{"stage", "reason"}, nil),
+		// internal/linefilter/linefilter.go
+		"line_filter_dropped_total": prometheus.NewDesc("line_filter_dropped_total", "number of lines of each log file dropped by the line filters", []string{"logfile"}, nil),
+		// internal/mtail/run.go
+		"run_info":       prometheus.NewDesc("run_info", "the random identifier of this run of mtail, as a label", []string{"run_id"}, nil),
+		"restarts_total": prometheus.NewDesc("restarts_total", "number of previous runs of mtail recorded in the run state file", nil, nil),
+		// internal/mtail/safemode.go
+		"safe_mode": prometheus.NewDesc("safe_mode", "1 if mtail started in safe mode, with no programs loaded, after a crash loop", nil, nil),
 		// internal/watcher/log_watcher.go
 		"log_watcher_error_count": prometheus.NewDesc("log_watcher_error_count", "number of errors received from fsnotify", nil, nil),
 	}
@@ -194,6 +366,16 @@ func (m *Server) initTailer() (err error) {
 	if m.oneShot {
 		opts = append(opts, tailer.OneShot)
 	}
+	if m.verifyReads {
+		opts = append(opts, tailer.VerifyReads)
+	}
+	opts = append(opts, tailer.RotationDrainTimeout(m.rotationDrainTimeout))
+	if len(m.lowPriorityLogs) > 0 {
+		overloaded := func() bool {
+			return m.l.QueueDepth() >= m.dispatchHighWater
+		}
+		opts = append(opts, tailer.BackPressure(overloaded, m.lowPriorityLogs...))
+	}
 	m.t, err = tailer.New(m.lines, m.w, opts...)
 	return
 }
@@ -206,8 +388,10 @@ const statusTemplate = `
 <body>
 <h1>mtail on {{.BindAddress}}</h1>
 <p>Build: {{.BuildInfo}}</p>
+<p>Run: {{.RunID}}</p>
+{{if .SafeMode}}<p><b>Safe mode</b>: {{.SafeMode}}</p>{{end}}
 <p>Metrics: <a href="/json">json</a>, <a href="/metrics">prometheus</a>, <a href="/varz">varz</a></p>
-<p>Debug: <a href="/debug/pprof">debug/pprof</a>, <a href="/debug/vars">debug/vars</a></p>
+{{if .Debug}}<p>Debug: <a href="/debug/pprof">debug/pprof</a>, <a href="/debug/vars">debug/vars</a></p>{{end}}
 `
 
 func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -220,9 +404,15 @@ func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		BindAddress string
 		BuildInfo   string
+		RunID       string
+		SafeMode    string
+		Debug       bool
 	}{
 		m.bindAddress,
 		m.buildInfo.String(),
+		m.runID,
+		m.safeModeReason,
+		!m.noDebug,
 	}
 	w.Header().Add("Content-type", "text/html")
 	w.WriteHeader(http.StatusOK)
@@ -239,6 +429,13 @@ func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// clockStepCheckInterval is how often the wall clock is checked for steps.
+const clockStepCheckInterval = 10 * time.Second
+
+// defaultDispatchHighWater is the default number of lines queued for a program
+// above which low priority logs are paused.
+const defaultDispatchHighWater = 500
+
 // New creates a MtailServer from the supplied Options.
 func New(store *metrics.Store, w watcher.Watcher, options ...func(*Server) error) (*Server, error) {
 	m := &Server{
@@ -248,10 +445,25 @@ func New(store *metrics.Store, w watcher.Watcher, options ...func(*Server) error
 		webquit:   make(chan struct{}),
 		closeQuit: make(chan struct{}),
 		h:         &http.Server{},
+
+		dispatchHighWater:    defaultDispatchHighWater,
+		rotationDrainTimeout: tailer.DefaultRotationDrainTimeout,
+		safeModeAfter:        DefaultSafeModeAfter,
+		crashLoopWindow:      DefaultCrashLoopWindow,
 	}
 	if err := m.SetOption(options...); err != nil {
 		return nil, err
 	}
+	if !m.compileOnly {
+		if err := m.initRunInfo(); err != nil {
+			return nil, err
+		}
+	}
+	if !m.compileOnly && !m.oneShot {
+		if err := m.initSafeMode(); err != nil {
+			return nil, err
+		}
+	}
 	if err := m.initExporter(); err != nil {
 		return nil, err
 	}
@@ -292,20 +504,7 @@ func (m *Server) Serve() error {
 	if m.bindAddress == "" {
 		return errors.Errorf("No bind address provided.")
 	}
-	mux := http.NewServeMux()
-	mux.HandleFunc("/favicon.ico", FaviconHandler)
-	mux.Handle("/", m)
-	mux.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
-	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
-	mux.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
-	mux.HandleFunc("/quitquitquit", http.HandlerFunc(m.handleQuit))
-	mux.Handle("/debug/vars", expvar.Handler())
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	m.h.Handler = mux
+	m.h.Handler = m.newMux()
 	m.e.StartMetricPush()
 
 	errc := make(chan error, 1)
@@ -322,6 +521,26 @@ func (m *Server) Serve() error {
 	return <-errc
 }
 
+// newMux returns the handlers of the Server's HTTP endpoints.
+func (m *Server) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicon.ico", FaviconHandler)
+	mux.Handle("/", m)
+	mux.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
+	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
+	mux.HandleFunc("/quitquitquit", http.HandlerFunc(m.handleQuit))
+	if !m.noDebug {
+		mux.Handle("/debug/vars", expvar.Handler())
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
 func (m *Server) handleQuit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.Header().Add("Allow", "POST")
@@ -354,6 +573,7 @@ func (m *Server) Close() error {
 	m.closeOnce.Do(func() {
 		glog.Info("Shutdown requested.")
 		close(m.closeQuit)
+		m.stopCrashLoopTimer()
 		// If we have a tailer (i.e. not in test) then signal the tailer to
 		// shut down, which will cause the watcher to shut down and for the
 		// lines channel to close, causing the loader to start shutdown.
@@ -373,6 +593,12 @@ func (m *Server) Close() error {
 		} else {
 			glog.V(2).Info("No loader, so not waiting for loader shutdown.")
 		}
+		// With the VMs stopped, nothing more can be forwarded.
+		if m.f != nil {
+			if err := m.f.Close(); err != nil {
+				glog.Infof("forwarder close failed: %s", err)
+			}
+		}
 		if m.h != nil {
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			if err := m.h.Shutdown(ctx); err != nil {
@@ -393,7 +619,9 @@ func (m *Server) Run() error {
 		glog.Info("compile-only is set, exiting")
 		return nil
 	}
-	if err := m.StartTailing(); err != nil {
+	if m.safeModeReason != "" {
+		glog.Info("In safe mode, not tailing the logs")
+	} else if err := m.StartTailing(); err != nil {
 		glog.Exitf("tailing failed: %s", err)
 	}
 	if m.oneShot {
@@ -408,6 +636,7 @@ func (m *Server) Run() error {
 	} else {
 		m.store.StartGcLoop(m.expiredMetricGcTickInterval)
 		m.t.StartGcLoop(m.staleLogGcTickInterval)
+		clock.Default.StartCheckLoop(clockStepCheckInterval)
 		if err := m.Serve(); err != nil {
 			return err
 		}
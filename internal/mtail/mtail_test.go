@@ -7,6 +7,8 @@ import (
 	"expvar"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"runtime"
@@ -18,6 +20,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm"
 	"github.com/google/mtail/internal/watcher"
 	"github.com/pkg/errors"
 )
@@ -815,3 +818,140 @@ func TestBuildInfo(t *testing.T) {
 		t.Errorf("Unexpected build info string, want: %q, got: %q", buildInfoWant, buildInfoGot)
 	}
 }
+
+func TestRunStateFile(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	stateFile := path.Join(workdir, "runs")
+
+	var ids []string
+	for i := int64(0); i < 3; i++ {
+		m := &Server{runStateFile: stateFile}
+		testutil.FatalIfErr(t, m.initRunInfo())
+		if restarts.Value() != i {
+			t.Errorf("run %d: restarts is %d", i, restarts.Value())
+		}
+		if runInfo.Get(m.runID) == nil {
+			t.Errorf("run %d: run id %q not exported in %s", i, m.runID, runInfo)
+		}
+		ids = append(ids, m.runID)
+	}
+	if ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Errorf("run ids not unique: %v", ids)
+	}
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(stateFile, []byte("lots\n"), 0644))
+	m := &Server{runStateFile: stateFile}
+	if err := m.initRunInfo(); err == nil {
+		t.Error("expected error for a corrupt run state file")
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	stateFile := path.Join(workdir, "crashes")
+	defer safeMode.Set(0)
+
+	start := func() *Server {
+		m := &Server{crashLoopStateFile: stateFile, safeModeAfter: 2, crashLoopWindow: time.Hour}
+		testutil.FatalIfErr(t, m.initSafeMode())
+		// Crash before the window passes.
+		m.crashLoopTimer.Stop()
+		return m
+	}
+	for i := 0; i < 2; i++ {
+		if m := start(); m.safeModeReason != "" {
+			t.Errorf("run %d: in safe mode: %s", i, m.safeModeReason)
+		}
+	}
+	m := &Server{crashLoopStateFile: stateFile, safeModeAfter: 2, crashLoopWindow: time.Hour}
+	testutil.FatalIfErr(t, m.initSafeMode())
+	if m.safeModeReason == "" || safeMode.Value() != 1 {
+		t.Errorf("not in safe mode after a crash loop")
+	}
+	// Neither a clean shutdown nor outlasting the window in safe mode resets
+	// the count.
+	m.stopCrashLoopTimer()
+	m = &Server{crashLoopStateFile: stateFile, safeModeAfter: 2, crashLoopWindow: time.Millisecond}
+	testutil.FatalIfErr(t, m.initSafeMode())
+	time.Sleep(10 * time.Millisecond)
+	m.stopCrashLoopTimer()
+	m = &Server{crashLoopStateFile: stateFile, safeModeAfter: 2, crashLoopWindow: time.Hour}
+	testutil.FatalIfErr(t, m.initSafeMode())
+	if m.safeModeReason == "" {
+		t.Errorf("not in safe mode after a run in safe mode")
+	}
+	// Removing the state file leaves safe mode.
+	testutil.FatalIfErr(t, os.Remove(stateFile))
+	if m := start(); m.safeModeReason != "" {
+		t.Errorf("in safe mode after removing the state file: %s", m.safeModeReason)
+	}
+	// A clean shutdown resets the count.
+	m = &Server{crashLoopStateFile: stateFile, safeModeAfter: 2, crashLoopWindow: time.Hour}
+	testutil.FatalIfErr(t, m.initSafeMode())
+	m.stopCrashLoopTimer()
+	for i := 0; i < 2; i++ {
+		if m := start(); m.safeModeReason != "" {
+			t.Errorf("run %d after a clean shutdown: in safe mode: %s", i, m.safeModeReason)
+		}
+	}
+}
+
+func TestCheckLogsMatch(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	testutil.FatalIfErr(t, ioutil.WriteFile(path.Join(workdir, "app.log"), []byte{}, 0644))
+
+	m := &Server{logPathPatterns: []string{path.Join(workdir, "*.log")}}
+	testutil.FatalIfErr(t, m.checkLogsMatch())
+
+	typo := path.Join(workdir, "*.lgo")
+	m.logPathPatterns = append(m.logPathPatterns, typo)
+	err := m.checkLogsMatch()
+	if err == nil {
+		t.Fatal("expected error for a pattern matching no files")
+	}
+	if !strings.Contains(err.Error(), typo) {
+		t.Errorf("error doesn't name the pattern %q: %s", typo, err)
+	}
+}
+
+func TestDisableDebugEndpoints(t *testing.T) {
+	for _, noDebug := range []bool{false, true} {
+		m := &Server{noDebug: noDebug}
+		mux := m.newMux()
+		for _, p := range []string{"/debug/pprof/", "/debug/pprof/profile", "/debug/vars"} {
+			_, pattern := mux.Handler(&http.Request{Method: "GET", URL: &url.URL{Path: p}})
+			if served := pattern != "/"; served == noDebug {
+				t.Errorf("noDebug %v: %s served by pattern %q", noDebug, p, pattern)
+			}
+		}
+	}
+}
+
+func TestHTTPTimeouts(t *testing.T) {
+	m := &Server{h: &http.Server{}}
+	testutil.FatalIfErr(t, HTTPTimeouts(time.Second, 2*time.Second, 3*time.Second)(m))
+	if m.h.ReadTimeout != time.Second || m.h.WriteTimeout != 2*time.Second || m.h.IdleTimeout != 3*time.Second {
+		t.Errorf("timeouts not set: %v %v %v", m.h.ReadTimeout, m.h.WriteTimeout, m.h.IdleTimeout)
+	}
+	if err := HTTPTimeouts(-time.Second, 0, 0)(m); err == nil {
+		t.Error("expected error for a negative timeout")
+	}
+}
+
+func TestDispatchQueueHighWater(t *testing.T) {
+	m := &Server{}
+	testutil.FatalIfErr(t, DispatchQueueHighWater(vm.ProgramQueueSize-1)(m))
+	if m.dispatchHighWater != vm.ProgramQueueSize-1 {
+		t.Errorf("high water not set: %d", m.dispatchHighWater)
+	}
+	// A program's queue blocks when full, so a high water mark at its size is
+	// never reached.
+	for _, n := range []int{0, vm.ProgramQueueSize} {
+		if err := DispatchQueueHighWater(n)(m); err == nil {
+			t.Errorf("expected error for high water %d", n)
+		}
+	}
+}
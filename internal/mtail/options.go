@@ -4,8 +4,14 @@
 package mtail
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net"
 	"time"
+
+	"github.com/google/mtail/internal/exporter"
+	"github.com/google/mtail/internal/vm"
+	"github.com/pkg/errors"
 )
 
 // ProgramPath sets the path to find mtail programs in the Server.
@@ -24,6 +30,135 @@ func LogPathPatterns(patterns ...string) func(*Server) error {
 	}
 }
 
+// ExecLogs sets the commands whose output is tailed as logs in the Server.
+func ExecLogs(commands ...string) func(*Server) error {
+	return func(m *Server) error {
+		m.execLogs = commands
+		return nil
+	}
+}
+
+// ForwardTarget sets the URL of the remote syslog or HTTP receiver of lines passed to forward() in programs.
+func ForwardTarget(target string) func(*Server) error {
+	return func(m *Server) error {
+		m.forwardTarget = target
+		return nil
+	}
+}
+
+// GeoIPDatabase sets the path of the MaxMind DB format database used by geoip_country() and geoip_asn() in programs.
+func GeoIPDatabase(path string) func(*Server) error {
+	return func(m *Server) error {
+		m.geoipDatabase = path
+		return nil
+	}
+}
+
+// LineFiltersManifest sets the path of a JSON manifest of the filters applied
+// to the lines of each log before they are passed to the programs.
+func LineFiltersManifest(path string) func(*Server) error {
+	return func(m *Server) error {
+		m.lineFilters = path
+		return nil
+	}
+}
+
+// LowPriorityLogs sets the patterns of logs whose reads are paused while the
+// programs are backed up processing lines.
+func LowPriorityLogs(patterns ...string) func(*Server) error {
+	return func(m *Server) error {
+		m.lowPriorityLogs = append(m.lowPriorityLogs, patterns...)
+		return nil
+	}
+}
+
+// DispatchQueueHighWater sets the number of lines queued for any one program
+// above which reads of low priority logs are paused.  It must be less than the
+// size of the queue, or the queue would fill and block all reads first.
+func DispatchQueueHighWater(n int) func(*Server) error {
+	return func(m *Server) error {
+		if n <= 0 {
+			return errors.Errorf("dispatch queue high water must be positive, not %d", n)
+		}
+		if n >= vm.ProgramQueueSize {
+			return errors.Errorf("dispatch queue high water must be less than the program queue size of %d, not %d", vm.ProgramQueueSize, n)
+		}
+		m.dispatchHighWater = n
+		return nil
+	}
+}
+
+// ProgramLabelsManifest reads a JSON manifest of constant labels to add to the
+// metrics exported by each program.  The manifest is an object keyed by
+// program filename, each value an object of label names to values, e.g.
+// `{"payments.mtail": {"team": "payments"}}`.
+func ProgramLabelsManifest(path string) func(*Server) error {
+	return func(m *Server) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "can't read program labels manifest")
+		}
+		var labels map[string]map[string]string
+		if err := json.Unmarshal(b, &labels); err != nil {
+			return errors.Wrapf(err, "can't parse program labels manifest %q", path)
+		}
+		m.programLabels = labels
+		return nil
+	}
+}
+
+// DerivedMetricsManifest reads a JSON manifest of metrics that the Server's
+// Prometheus export computes from the other metrics when it is scraped.  The
+// manifest is an array of names and expressions, e.g. `[{"name":
+// "http_error_ratio", "expr": "http_errors_total / http_requests_total"}]`.
+func DerivedMetricsManifest(path string) func(*Server) error {
+	return func(m *Server) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "can't read derived metrics manifest")
+		}
+		var derived []exporter.Derived
+		if err := json.Unmarshal(b, &derived); err != nil {
+			return errors.Wrapf(err, "can't parse derived metrics manifest %q", path)
+		}
+		m.derivedMetrics = derived
+		return nil
+	}
+}
+
+// ProgramRegexManifest sets the path of a JSON manifest of the regular
+// expression options used to compile each program, keyed by program filename,
+// e.g. `{"legacy.mtail": {"longest": true}}`.  The manifest is read each time a
+// program is compiled, and a change to it reloads the programs.
+func ProgramRegexManifest(path string) func(*Server) error {
+	return func(m *Server) error {
+		m.regexManifest = path
+		return nil
+	}
+}
+
+// RunStateFile sets the path of a file that counts the runs of mtail, so that
+// the number of restarts can be exported.
+func RunStateFile(path string) func(*Server) error {
+	return func(m *Server) error {
+		m.runStateFile = path
+		return nil
+	}
+}
+
+// CrashLoopStateFile sets the path of a file that counts the runs of mtail
+// that ended within window of starting, without shutting down cleanly.  Once
+// there have been after of these runs in a row, mtail starts in safe mode,
+// serving its status page but loading no programs and reading no logs.
+func CrashLoopStateFile(path string, after int, window time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		m.crashLoopStateFile = path
+		m.safeModeAfter = after
+		m.crashLoopWindow = window
+		return nil
+	}
+}
+
 // BindAddress sets the HTTP server address in Server.
 func BindAddress(address, port string) func(*Server) error {
 	return func(m *Server) error {
@@ -72,12 +207,132 @@ func OneShot(m *Server) error {
 	return nil
 }
 
+// VerifyReads sets the Server's tailer to check each region of the logs it
+// reads with a second, independent read.
+func VerifyReads(m *Server) error {
+	m.verifyReads = true
+	return nil
+}
+
+// RequireLogsMatch makes the Server fail to start tailing if any of its log
+// path patterns matches no files, rather than waiting for them to appear.
+func RequireLogsMatch(m *Server) error {
+	m.requireLogs = true
+	return nil
+}
+
+// DisableDebugEndpoints stops the Server serving the profiler and expvar
+// handlers under /debug, for listeners reachable by untrusted clients.
+func DisableDebugEndpoints(m *Server) error {
+	m.noDebug = true
+	return nil
+}
+
+// HTTPTimeouts sets the read, write and idle timeouts of the Server's HTTP
+// server.  Zero is no timeout.
+func HTTPTimeouts(read, write, idle time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		if read < 0 || write < 0 || idle < 0 {
+			return errors.New("HTTP timeouts must not be negative")
+		}
+		m.h.ReadTimeout = read
+		m.h.WriteTimeout = write
+		m.h.IdleTimeout = idle
+		return nil
+	}
+}
+
+// RotationDrainTimeout sets how long the Server's tailer keeps reading a log's
+// file after a rotation renames it, for the lines written before the writer
+// reopens the log.
+func RotationDrainTimeout(d time.Duration) func(*Server) error {
+	return func(m *Server) error {
+		if d < 0 {
+			return errors.New("rotation drain timeout must not be negative")
+		}
+		m.rotationDrainTimeout = d
+		return nil
+	}
+}
+
 // CompileOnly sets compile-only mode in the Server.
 func CompileOnly(m *Server) error {
 	m.compileOnly = true
 	return nil
 }
 
+// Strict instructs the Server's compiler to treat warnings about programs as
+// compile errors.
+func Strict(m *Server) error {
+	m.strict = true
+	return nil
+}
+
+// StrictTypes instructs the Server's compiler to reject programs that convert
+// between ints and floats implicitly, or have metrics whose type can't be
+// inferred.
+func StrictTypes(m *Server) error {
+	m.strictTypes = true
+	return nil
+}
+
+// CountConditionMatches instructs the Server to count the lines matched by each
+// top-level condition of the programs.
+func CountConditionMatches(m *Server) error {
+	m.countConditionMatches = true
+	return nil
+}
+
+// CountUnmatchedLines instructs the Server to count the lines that none of the
+// programs matched.
+func CountUnmatchedLines(m *Server) error {
+	m.countUnmatchedLines = true
+	return nil
+}
+
+// ArithmeticPolicies sets what programs do on arithmetic faults, as a comma
+// separated list of skip or clamp, by default or for one program given as
+// program=policy.
+func ArithmeticPolicies(spec string) func(*Server) error {
+	return func(m *Server) error {
+		m.arithmeticPolicies = spec
+		return nil
+	}
+}
+
+// ReloadPolicies sets what happens to the values of the metrics of programs
+// when they are reloaded, as a comma separated list of source, keep or
+// clear, by default or for one program given as program=policy.
+func ReloadPolicies(spec string) func(*Server) error {
+	return func(m *Server) error {
+		m.reloadPolicies = spec
+		return nil
+	}
+}
+
+// LineBudget limits the work each program does on a line to instructions
+// bytecode instructions and wallTime, either unlimited if zero, and
+// quarantines a program after quarantineAfter lines over its budget, if
+// positive.
+func LineBudget(instructions int, wallTime time.Duration, quarantineAfter int) func(*Server) error {
+	return func(m *Server) error {
+		m.lineBudgetInstructions = instructions
+		m.lineBudgetTime = wallTime
+		m.quarantineAfter = quarantineAfter
+		return nil
+	}
+}
+
+// CounterOverflowPolicies sets what programs do when an int metric is
+// incremented past the largest int, as a comma separated list of wrap,
+// saturate or float, by default or for one program given as program=policy.
+func CounterOverflowPolicies(spec string) func(*Server) error {
+	return func(m *Server) error {
+		m.overflowPolicies = spec
+		return nil
+	}
+}
+
 // DumpAst instructs the Server's compiler to print the AST after parsing.
 func DumpAst(m *Server) error {
 	m.dumpAst = true
@@ -0,0 +1,103 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"crypto/rand"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	// runInfo holds the identifier of this run of mtail, as its only key.
+	runInfo = expvar.NewMap("run_info")
+	// restarts counts the previous runs of mtail recorded in the run state
+	// file.
+	restarts = expvar.NewInt("restarts_total")
+)
+
+// newRunID returns a random version 4 UUID identifying a run of mtail.
+func newRunID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// initRunInfo generates the identifier of this run, and counts it in the run
+// state file if there is one, so that a reset of the counters exported can
+// be told apart from a restart of mtail.
+func (m *Server) initRunInfo() error {
+	id, err := newRunID()
+	if err != nil {
+		return errors.Wrap(err, "can't generate a run id")
+	}
+	m.runID = id
+	one := new(expvar.Int)
+	one.Set(1)
+	runInfo.Init()
+	runInfo.Set(id, one)
+	glog.Infof("Run id %s", id)
+	if m.runStateFile == "" {
+		return nil
+	}
+	n, err := readCount(m.runStateFile, "run state file")
+	if err != nil {
+		return err
+	}
+	if err := writeCount(m.runStateFile, "run state file", n+1); err != nil {
+		return err
+	}
+	restarts.Set(n)
+	return nil
+}
+
+// readCount returns the number of runs recorded in the state file at path,
+// described by what in errors, or zero if the file does not exist yet.
+func readCount(path, what string) (int64, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't read %s", what)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("%s %q does not hold a count of runs: %q", what, path, b)
+	}
+	return n, nil
+}
+
+// writeCount records n runs in the state file at path, replacing it whole so
+// that a crash can't leave it half written.
+func writeCount(path, what string, n int64) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "can't write %s", what)
+	}
+	_, err = fmt.Fprintf(f, "%d\n", n)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "can't write %s", what)
+	}
+	return nil
+}
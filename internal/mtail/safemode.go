@@ -0,0 +1,74 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// safeMode is 1 if mtail started in safe mode after a crash loop.
+	safeMode = expvar.NewInt("safe_mode")
+)
+
+const (
+	// DefaultSafeModeAfter is the number of runs in a row that end soon after
+	// starting before mtail starts in safe mode.
+	DefaultSafeModeAfter = 5
+	// DefaultCrashLoopWindow is how soon after starting a run must end to
+	// count towards a crash loop.
+	DefaultCrashLoopWindow = time.Minute
+)
+
+// initSafeMode counts this run in the crash loop state file, and puts the
+// Server in safe mode if the runs counted before it number at least
+// safeModeAfter.  A run stays counted unless it lasts the crash loop window,
+// or shuts down cleanly, either of which reset the count, so the count is of
+// the runs in a row that crashed or failed to start soon after starting.  A
+// run in safe mode never resets the count, as it loads no programs to show
+// they no longer crash, so safe mode lasts until the state file is removed.
+func (m *Server) initSafeMode() error {
+	if m.crashLoopStateFile == "" {
+		return nil
+	}
+	n, err := readCount(m.crashLoopStateFile, "crash loop state file")
+	if err != nil {
+		return err
+	}
+	if m.safeModeAfter > 0 && n >= int64(m.safeModeAfter) {
+		m.safeModeReason = fmt.Sprintf("The last %d runs of mtail each ended within %s of starting, without shutting down cleanly.  No programs are loaded and no logs are read.  Fix the cause, which is logged by those runs, then remove %s and restart mtail.", n, m.crashLoopWindow, m.crashLoopStateFile)
+		glog.Warningf("Starting in safe mode: %s", m.safeModeReason)
+		safeMode.Set(1)
+	}
+	if err := writeCount(m.crashLoopStateFile, "crash loop state file", n+1); err != nil {
+		return err
+	}
+	if m.safeModeReason != "" {
+		return nil
+	}
+	m.crashLoopTimer = time.AfterFunc(m.crashLoopWindow, m.resetCrashLoop)
+	return nil
+}
+
+// resetCrashLoop clears the count of the runs in the crash loop state file,
+// once this run is known not to be part of a crash loop.
+func (m *Server) resetCrashLoop() {
+	if err := writeCount(m.crashLoopStateFile, "crash loop state file", 0); err != nil {
+		glog.Warning(err)
+	}
+}
+
+// stopCrashLoopTimer resets the count of the runs on a clean shutdown.
+func (m *Server) stopCrashLoopTimer() {
+	if m.crashLoopTimer == nil {
+		return
+	}
+	if m.crashLoopTimer.Stop() {
+		m.resetCrashLoop()
+	}
+}
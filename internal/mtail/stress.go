@@ -0,0 +1,296 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/tailer"
+	"github.com/google/mtail/internal/watcher"
+)
+
+// Stress test scenarios.
+const (
+	StressRotation   = "rotation"   // Logs are renamed and replaced by new files.
+	StressTruncation = "truncation" // Logs are truncated in place, as by copytruncate.
+	StressBurst      = "burst"      // Logs are written in bursts, without rotation.
+)
+
+// StressOptions configures a stress test of the tailer.
+type StressOptions struct {
+	Scenario     string        // One of StressRotation, StressTruncation or StressBurst.
+	Writers      int           // Number of logs written concurrently.
+	Lines        int           // Number of lines written to each log.
+	RotateEvery  int           // Number of lines written between each rotation or truncation of a log.
+	BurstSize    int           // Number of lines written to a log at once.
+	Interval     time.Duration // Pause between the bursts written to a log.
+	Settle       time.Duration // How long to wait without reading a line before giving up on the lines not yet read.
+	PollInterval time.Duration // Interval at which the watcher polls the logs, or zero to not poll.
+	UseFsnotify  bool          // Set to watch the logs with fsnotify.
+	VerifyReads  bool          // Set to check the tailer's reads with a shadow read as well.
+}
+
+// StressReport is the outcome of a stress test, comparing the lines written
+// with the lines that the tailer read.
+type StressReport struct {
+	Scenario   string  `json:"scenario"`
+	Written    int     `json:"written"`    // Number of lines written.
+	Read       int     `json:"read"`       // Number of lines read, including duplicates.
+	Lost       int     `json:"lost"`       // Number of lines written but never read.
+	Duplicated int     `json:"duplicated"` // Number of extra reads of lines already read.
+	Corrupt    int     `json:"corrupt"`    // Number of lines read that were never written.
+	Seconds    float64 `json:"seconds"`    // Time taken from the first write to the last read.
+	Passed     bool    `json:"passed"`     // Set if every line was read exactly once.
+}
+
+// stressLine is the format of the lines written by the stress test writers,
+// identifying the writer and the line's sequence number.
+const stressLine = "stress writer %d line %d\n"
+
+// Stress writes synthetic logs in a temporary directory following the
+// scenario in o, tails them, and reports any lines lost or duplicated between
+// the writers and the lines channel of the tailer.
+func Stress(o StressOptions) (*StressReport, error) {
+	switch o.Scenario {
+	case StressRotation, StressTruncation:
+		if o.RotateEvery < 1 {
+			return nil, errors.Errorf("scenario %q needs lines written between rotations", o.Scenario)
+		}
+	case StressBurst:
+	default:
+		return nil, errors.Errorf("unknown stress scenario %q", o.Scenario)
+	}
+	if o.Writers < 1 || o.Lines < 1 {
+		return nil, errors.New("stress test needs at least one writer and one line")
+	}
+	if o.BurstSize < 1 {
+		o.BurstSize = 1
+	}
+
+	dir, err := ioutil.TempDir("", "mtail-stress")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := watcher.NewLogWatcher(o.PollInterval, o.UseFsnotify)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(chan *logline.LogLine, 1000)
+	opts := []func(*tailer.Tailer) error{}
+	if o.VerifyReads {
+		opts = append(opts, tailer.VerifyReads)
+	}
+	t, err := tailer.New(lines, w, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &stress{o: o, seen: make([][]int, o.Writers), last: time.Now()}
+	for i := range s.seen {
+		s.seen[i] = make([]int, o.Lines)
+	}
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for l := range lines {
+			s.record(l.Line)
+		}
+	}()
+
+	files := make([]*os.File, o.Writers)
+	for i := range files {
+		files[i], err = os.OpenFile(s.logPath(dir, i), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	if err := t.TailPattern(filepath.Join(dir, "*.log")); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make([]error, o.Writers)
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.write(dir, i, files[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	s.settle(o.Writers * o.Lines)
+	if err := t.Close(); err != nil {
+		glog.Info(err)
+	}
+	<-readDone
+	return s.report(time.Since(start)), nil
+}
+
+// stress is the state of a running stress test.
+type stress struct {
+	o StressOptions
+
+	mu      sync.Mutex
+	seen    [][]int   // number of times each line of each writer was read
+	read    int       // number of lines read
+	corrupt int       // number of lines read that weren't written
+	last    time.Time // time of the last line read, or of the start of the test
+}
+
+func (s *stress) logPath(dir string, writer int) string {
+	return filepath.Join(dir, fmt.Sprintf("w%d.log", writer))
+}
+
+// record counts a line read by the tailer.
+func (s *stress) record(line string) {
+	var writer, n int
+	_, err := fmt.Sscanf(line+"\n", stressLine, &writer, &n)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.read++
+	s.last = time.Now()
+	if err != nil || writer < 0 || writer >= len(s.seen) || n < 0 || n >= len(s.seen[writer]) {
+		s.corrupt++
+		return
+	}
+	s.seen[writer][n]++
+}
+
+// readUpTo returns true if the first n lines of writer have been read.
+func (s *stress) readUpTo(writer, n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.seen[writer][:n] {
+		if c == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// write writes the lines of one writer to its log f, rotating or truncating
+// it as the scenario requires.
+func (s *stress) write(dir string, writer int, f *os.File) error {
+	pathname := s.logPath(dir, writer)
+	defer func() { f.Close() }()
+	for n := 0; n < s.o.Lines; {
+		var b []byte
+		for i := 0; i < s.o.BurstSize && n < s.o.Lines; i++ {
+			b = append(b, fmt.Sprintf(stressLine, writer, n)...)
+			n++
+			if s.rotatesAfter(n) {
+				break
+			}
+		}
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+		if s.rotatesAfter(n) {
+			switch s.o.Scenario {
+			case StressRotation:
+				if err := os.Rename(pathname, pathname+".1"); err != nil {
+					return err
+				}
+				f.Close()
+				var err error
+				f, err = os.OpenFile(pathname, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+				if err != nil {
+					return err
+				}
+			case StressTruncation:
+				// Lines not read before a truncation are lost by design, so
+				// wait for the tailer to catch up first, as copytruncate
+				// is assumed to.
+				s.waitFor(writer, n)
+				if err := f.Truncate(0); err != nil {
+					return err
+				}
+			}
+		}
+		time.Sleep(s.o.Interval)
+	}
+	return nil
+}
+
+// rotatesAfter returns true if a log is rotated or truncated after the
+// first n lines are written to it.
+func (s *stress) rotatesAfter(n int) bool {
+	return s.o.Scenario != StressBurst && n%s.o.RotateEvery == 0 && n < s.o.Lines
+}
+
+// waitFor waits until the first n lines of writer have been read, or until
+// no line has been read for the settle time.
+func (s *stress) waitFor(writer, n int) {
+	for !s.readUpTo(writer, n) && !s.stalled() {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stalled returns true if no line has been read for the settle time.
+func (s *stress) stalled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.last) > s.o.Settle
+}
+
+// settle waits until total lines have been read, or until no line has been
+// read for the settle time.
+func (s *stress) settle(total int) {
+	s.mu.Lock()
+	s.last = time.Now()
+	s.mu.Unlock()
+	for {
+		s.mu.Lock()
+		read := s.read
+		s.mu.Unlock()
+		if read >= total || s.stalled() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *stress) report(elapsed time.Duration) *StressReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &StressReport{
+		Scenario: s.o.Scenario,
+		Written:  s.o.Writers * s.o.Lines,
+		Read:     s.read,
+		Corrupt:  s.corrupt,
+		Seconds:  elapsed.Seconds(),
+	}
+	for _, writer := range s.seen {
+		for _, c := range writer {
+			switch {
+			case c == 0:
+				r.Lost++
+			case c > 1:
+				r.Duplicated += c - 1
+			}
+		}
+	}
+	r.Passed = r.Lost == 0 && r.Duplicated == 0 && r.Corrupt == 0
+	return r
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping stress test in short mode")
+	}
+	for _, scenario := range []string{StressRotation, StressTruncation, StressBurst} {
+		scenario := scenario
+		t.Run(scenario, func(t *testing.T) {
+			r, err := Stress(StressOptions{
+				Scenario:     scenario,
+				Writers:      2,
+				Lines:        200,
+				RotateEvery:  50,
+				BurstSize:    10,
+				Interval:     10 * time.Millisecond,
+				Settle:       5 * time.Second,
+				PollInterval: 10 * time.Millisecond,
+				UseFsnotify:  true,
+			})
+			testutil.FatalIfErr(t, err)
+			if !r.Passed {
+				t.Errorf("lines lost or duplicated: %+v", r)
+			}
+			if r.Written != 400 {
+				t.Errorf("written %d lines, expected 400", r.Written)
+			}
+		})
+	}
+	if _, err := Stress(StressOptions{Scenario: "flood", Writers: 1, Lines: 1}); err == nil {
+		t.Error("expected error for unknown scenario")
+	}
+}
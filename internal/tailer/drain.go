@@ -0,0 +1,138 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+)
+
+var (
+	// logRotationLinesRecovered counts the lines of each log read from its
+	// previous file after a rotation renamed it.
+	logRotationLinesRecovered = expvar.NewMap("log_rotation_lines_recovered_total")
+)
+
+const (
+	// DefaultRotationDrainTimeout is how long a file renamed by a rotation is
+	// read for, waiting for the writer to reopen the log.
+	DefaultRotationDrainTimeout = 5 * time.Second
+	// drainInterval is how often the files renamed by rotations are read.
+	drainInterval = 250 * time.Millisecond
+)
+
+// drain is a file renamed by a rotation, still read until its deadline for
+// the lines written by a writer that has not yet reopened the log.  The file
+// is read by its descriptor, so it doesn't matter what it was renamed to,
+// like the dated names of logrotate's dateext.
+type drain struct {
+	file     *os.File
+	partial  *bytes.Buffer
+	deadline time.Time
+}
+
+// RotationDrainTimeout sets how long the tailer reads a file after a rotation
+// renames it, for lines written before the writer reopens the log.  Zero
+// stops reading it once the rotation is found.
+func RotationDrainTimeout(d time.Duration) func(*Tailer) error {
+	return func(t *Tailer) error {
+		t.drainTimeout = d
+		return nil
+	}
+}
+
+// startDrain keeps reading the file that was open before a rotation, and
+// the partial line read from it, until the drain timeout passes.
+func (f *File) startDrain(old *os.File, partial *bytes.Buffer) {
+	if f.drainTimeout <= 0 || !f.regular {
+		if partial.Len() > 0 {
+			f.sendPartial(partial, false)
+		}
+		if err := old.Close(); err != nil {
+			glog.V(2).Infof("%s: %s", f.Name, err)
+		}
+		return
+	}
+	f.drains = append(f.drains, &drain{file: old, partial: partial, deadline: time.Now().Add(f.drainTimeout)})
+}
+
+// drainRotated reads the files renamed by rotations to EOF, and closes those
+// whose deadline is before now, or all of them if final is set.
+func (f *File) drainRotated(now time.Time, final bool) {
+	drains := f.drains[:0]
+	for _, d := range f.drains {
+		f.readDrain(d)
+		if !final && now.Before(d.deadline) {
+			drains = append(drains, d)
+			continue
+		}
+		if d.partial.Len() > 0 {
+			f.sendPartial(d.partial, true)
+		}
+		if err := d.file.Close(); err != nil {
+			glog.V(2).Infof("%s: %s", f.Name, err)
+		}
+	}
+	f.drains = drains
+}
+
+// readDrain reads the renamed file of d to EOF, sending each line.
+func (f *File) readDrain(d *drain) {
+	b := make([]byte, 4096)
+	for {
+		n, err := d.file.Read(b)
+		var width int
+		for i := 0; i < n; i += width {
+			var r rune
+			r, width = utf8.DecodeRune(b[i:n])
+			if r != '\n' {
+				d.partial.WriteRune(r)
+				continue
+			}
+			f.sendPartial(d.partial, true)
+		}
+		if err != nil {
+			if err != io.EOF {
+				glog.V(1).Infof("%s: reading the rotated file: %s", f.Name, err)
+			}
+			return
+		}
+	}
+}
+
+// sendPartial sends the line in partial, counting it as recovered from a
+// rotated file if set, and resets partial.
+func (f *File) sendPartial(partial *bytes.Buffer, recovered bool) {
+	f.lines <- logline.NewLogLine(f.Name, partial.String())
+	lineCount.Add(f.Name, 1)
+	if recovered {
+		logRotationLinesRecovered.Add(f.Name, 1)
+	}
+	partial.Reset()
+}
+
+// drainRotated reads the files of the tailed logs that were renamed by
+// rotations, and stops reading those past their deadline, or all of them if
+// final is set.
+func (t *Tailer) drainRotated(final bool) {
+	t.handlesMu.RLock()
+	var files []*File
+	for _, f := range t.handles {
+		if len(f.drains) > 0 {
+			files = append(files, f)
+		}
+	}
+	t.handlesMu.RUnlock()
+	now := time.Now()
+	for _, f := range files {
+		f.drainRotated(now, final)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"expvar"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+var (
+	// execStarts counts the number of times each command has been started
+	execStarts = expvar.NewMap("exec_starts_total")
+	// execExits counts the number of times each command has exited, successfully or not
+	execExits = expvar.NewMap("exec_exits_total")
+	// execErrors counts the number of start failures and nonzero exits per command
+	execErrors = expvar.NewMap("exec_errors_total")
+	// execRunning records whether each command is currently running
+	execRunning = expvar.NewMap("exec_running")
+)
+
+const (
+	execMinBackoff = 1 * time.Second
+	execMaxBackoff = 1 * time.Minute
+	// If a command runs for at least this long before exiting, the restart
+	// backoff is reset to the minimum.
+	execHealthyRuntime = 1 * time.Minute
+)
+
+// Exec manages a subprocess whose standard output and standard error are
+// tailed as log sources by `mtail`.  The subprocess is restarted with an
+// exponential backoff whenever it exits, unless in one-shot mode.
+type Exec struct {
+	Name    string // Command line used to start the subprocess, as given; also the log name of its output
+	argv    []string
+	lines   chan<- *logline.LogLine // output channel for lines read
+	oneShot bool                    // if set, do not restart the subprocess after it exits
+
+	mu  sync.Mutex // protects cmd
+	cmd *exec.Cmd
+
+	stop chan struct{} // closed to signal no more restarts
+	done chan struct{} // closed when the supervisor goroutine exits
+}
+
+// NewExec starts the command line in a subprocess, splitting it into arguments
+// on whitespace.  No shell is involved.  Lines from the subprocess's stdout
+// and stderr are sent on the lines channel.
+func NewExec(command string, lines chan<- *logline.LogLine, oneShot bool) (*Exec, error) {
+	argv := strings.Fields(command)
+	if len(argv) == 0 {
+		return nil, errors.New("can't exec an empty command")
+	}
+	if _, err := exec.LookPath(argv[0]); err != nil {
+		return nil, errors.Wrapf(err, "can't exec %q", command)
+	}
+	e := &Exec{
+		Name:    command,
+		argv:    argv,
+		lines:   lines,
+		oneShot: oneShot,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	execRunning.Set(e.Name, new(expvar.Int))
+	go e.supervise()
+	return e, nil
+}
+
+// supervise runs the subprocess until it is stopped, restarting it with
+// backoff after each exit.
+func (e *Exec) supervise() {
+	defer close(e.done)
+	backoff := execMinBackoff
+	for {
+		started := time.Now()
+		if err := e.run(); err != nil {
+			glog.Infof("exec %q: %s", e.Name, err)
+			execErrors.Add(e.Name, 1)
+		}
+		if e.oneShot {
+			return
+		}
+		if time.Since(started) >= execHealthyRuntime {
+			backoff = execMinBackoff
+		}
+		glog.V(1).Infof("exec %q: restarting in %s", e.Name, backoff)
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > execMaxBackoff {
+			backoff = execMaxBackoff
+		}
+	}
+}
+
+// run starts the subprocess once and blocks until it has exited and all of
+// its output has been read.
+func (e *Exec) run() error {
+	cmd := exec.Command(e.argv[0], e.argv[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	// Don't start if Close has already been called, unless in one-shot
+	// mode, where the command must run once to completion.
+	select {
+	case <-e.stop:
+		if !e.oneShot {
+			e.mu.Unlock()
+			return nil
+		}
+	default:
+	}
+	if err := cmd.Start(); err != nil {
+		e.mu.Unlock()
+		return errors.Wrap(err, "start failed")
+	}
+	e.cmd = cmd
+	e.mu.Unlock()
+	glog.Infof("Started exec %q as pid %d", e.Name, cmd.Process.Pid)
+	execStarts.Add(e.Name, 1)
+	execRunning.Get(e.Name).(*expvar.Int).Set(1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go e.read(stdout, &wg)
+	go e.read(stderr, &wg)
+	// All reads must complete before calling Wait.
+	wg.Wait()
+	err = cmd.Wait()
+
+	e.mu.Lock()
+	e.cmd = nil
+	e.mu.Unlock()
+	execRunning.Get(e.Name).(*expvar.Int).Set(0)
+	execExits.Add(e.Name, 1)
+	if err != nil {
+		return errors.Wrap(err, "exited")
+	}
+	glog.Infof("exec %q exited", e.Name)
+	return nil
+}
+
+// read sends each line read from r to the lines channel, until EOF.
+func (e *Exec) read(r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			e.lines <- logline.NewLogLine(e.Name, strings.TrimSuffix(line, "\n"))
+			lineCount.Add(e.Name, 1)
+		}
+		if err != nil {
+			if err != io.EOF {
+				glog.V(1).Infof("exec %q: read: %s", e.Name, err)
+			}
+			return
+		}
+	}
+}
+
+// Close stops the subprocess and waits for the supervisor to finish.  In
+// one-shot mode the subprocess is allowed to run to completion instead.
+func (e *Exec) Close() error {
+	e.mu.Lock()
+	close(e.stop)
+	if e.cmd != nil && !e.oneShot {
+		if err := e.cmd.Process.Kill(); err != nil {
+			glog.Info(err)
+		}
+	}
+	e.mu.Unlock()
+	<-e.done
+	return nil
+}
@@ -27,8 +27,17 @@ var (
 	logTruncs = expvar.NewMap("log_truncates_total")
 	// lineCount counts the numbre of lines read per log file
 	lineCount = expvar.NewMap("log_lines_total")
+	// logReadLagBytes is the number of bytes of each log file not yet read
+	logReadLagBytes = expvar.NewMap("log_read_lag_bytes")
+	// logReadLagSeconds is the age of the oldest data not yet read from each
+	// log file, by the modification time of the file
+	logReadLagSeconds = expvar.NewMap("log_read_lag_seconds")
 )
 
+// lagCheckInterval is the least time between checks of how far the reads of
+// a file are behind its end, while a read is in progress.
+const lagCheckInterval = time.Second
+
 // File provides an abstraction over files and named pipes being tailed
 // by `mtail`.
 type File struct {
@@ -39,6 +48,14 @@ type File struct {
 	file     *os.File
 	partial  *bytes.Buffer
 	lines    chan<- *logline.LogLine // output channel for lines read
+
+	caughtUp   time.Time // time the whole file was last found to be read
+	lagChecked time.Time // time of the last check of the read lag
+
+	v *verifier // checks each region read with a shadow read, if set
+
+	drainTimeout time.Duration // how long to read a file after a rotation renames it
+	drains       []*drain      // files renamed by rotations, still being read
 }
 
 // NewFile returns a new File named by the given pathname.  `seenBefore` indicates
@@ -79,7 +96,8 @@ func NewFile(pathname string, lines chan<- *logline.LogLine, seekToStart bool) (
 	default:
 		return nil, errors.Errorf("Can't open files with mode %v: %s", m&os.ModeType, absPath)
 	}
-	return &File{pathname, absPath, time.Now(), regular, f, bytes.NewBufferString(""), lines}, nil
+	now := time.Now()
+	return &File{Name: pathname, Pathname: absPath, LastRead: now, regular: regular, file: f, partial: bytes.NewBufferString(""), lines: lines, caughtUp: now}, nil
 }
 
 func open(pathname string, seenBefore bool) (*os.File, error) {
@@ -115,6 +133,9 @@ Retry:
 
 // Follow reads from the file until EOF.  It tracks log rotations (i.e new inode or device).
 func (f *File) Follow() error {
+	// Lines still written to a file renamed by a rotation come before those
+	// written to the new file.
+	f.drainRotated(time.Now(), false)
 	s1, err := f.file.Stat()
 	if err != nil {
 		glog.V(1).Infof("Stat failed on %q: %s", f.Name, err)
@@ -155,7 +176,12 @@ func (f *File) doRotation() error {
 	if err != nil {
 		return err
 	}
+	f.startDrain(f.file, f.partial)
 	f.file = newFile
+	f.partial = bytes.NewBufferString("")
+	if f.v != nil {
+		f.v.rotated(f)
+	}
 	return nil
 }
 
@@ -174,6 +200,9 @@ func (f *File) Read() error {
 		glog.V(2).Infof("Read count %v err %v", n, err)
 		totalBytes += n
 		b = b[:n]
+		if f.v != nil {
+			f.v.crc.Write(b)
+		}
 
 		// If this time we've read no bytes at all and then hit an EOF, and
 		// we're a regular file, check for truncation.
@@ -209,8 +238,13 @@ func (f *File) Read() error {
 			if totalBytes > 0 {
 				f.LastRead = time.Now()
 			}
+			f.updateLag(time.Now(), true)
+			if f.v != nil {
+				f.v.check(f)
+			}
 			return err
 		}
+		f.updateLag(time.Now(), false)
 	}
 }
 
@@ -218,6 +252,9 @@ func (f *File) Read() error {
 func (f *File) sendLine() {
 	f.lines <- logline.NewLogLine(f.Name, f.partial.String())
 	lineCount.Add(f.Name, 1)
+	if f.v != nil {
+		f.v.lines++
+	}
 	glog.V(2).Info("Line sent")
 	// reset partial accumulator
 	f.partial.Reset()
@@ -253,16 +290,61 @@ func (f *File) checkForTruncate() (bool, error) {
 	p, serr := f.file.Seek(0, io.SeekStart)
 	glog.V(2).Infof("Truncated?  Seeked to %d: %v", p, serr)
 	logTruncs.Add(f.Name, 1)
+	if f.v != nil {
+		// The region read before the truncation is gone.
+		f.v.reset(0)
+	}
 	return true, serr
 }
 
+// updateLag exports how far the reads of a regular file are behind its end,
+// in bytes, and in seconds since the file was last read to the end, by its
+// modification time.  Unless force is set, it does nothing if the lag was
+// checked less than lagCheckInterval ago.
+func (f *File) updateLag(now time.Time, force bool) {
+	if !f.regular || (!force && now.Sub(f.lagChecked) < lagCheckInterval) {
+		return
+	}
+	f.lagChecked = now
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		glog.V(2).Infof("%s: %s", f.Name, err)
+		return
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		glog.V(2).Infof("%s: %s", f.Name, err)
+		return
+	}
+	lag := fi.Size() - offset
+	if lag <= 0 {
+		// A truncated file is caught up too, as it is read from the start.
+		lag = 0
+		f.caughtUp = now
+	}
+	var seconds float64
+	if lag > 0 && fi.ModTime().After(f.caughtUp) {
+		seconds = fi.ModTime().Sub(f.caughtUp).Seconds()
+	}
+	b := new(expvar.Int)
+	b.Set(lag)
+	logReadLagBytes.Set(f.Name, b)
+	s := new(expvar.Float)
+	s.Set(seconds)
+	logReadLagSeconds.Set(f.Name, s)
+}
+
 func (f *File) Stat() (os.FileInfo, error) {
 	return f.file.Stat()
 }
 
 func (f *File) Close() error {
+	f.drainRotated(time.Now(), true)
 	if f.partial.Len() > 0 {
 		f.sendLine()
 	}
+	if f.v != nil {
+		f.v.close()
+	}
 	return f.file.Close()
 }
@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/testutil"
@@ -108,3 +109,78 @@ func TestOpenRetries(t *testing.T) {
 		t.Fatalf("Expected a permission denied error here: %s", err)
 	}
 }
+
+func TestReadLag(t *testing.T) {
+	lines := make(chan *logline.LogLine, 2)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	fd := testutil.TestOpenFile(t, logfile)
+	defer fd.Close()
+	testutil.WriteString(t, fd, "hello\nworld\n")
+
+	f, err := NewFile(logfile, lines, true)
+	testutil.FatalIfErr(t, err)
+	fi, err := fd.Stat()
+	testutil.FatalIfErr(t, err)
+	f.caughtUp = fi.ModTime().Add(-30 * time.Second)
+
+	f.updateLag(time.Now(), true)
+	if diff := testutil.Diff("12", logReadLagBytes.Get(f.Name).String()); diff != "" {
+		t.Errorf("lag bytes before read: %s", diff)
+	}
+	if diff := testutil.Diff("30", logReadLagSeconds.Get(f.Name).String()); diff != "" {
+		t.Errorf("lag seconds before read: %s", diff)
+	}
+
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	if diff := testutil.Diff("0", logReadLagBytes.Get(f.Name).String()); diff != "" {
+		t.Errorf("lag bytes after read: %s", diff)
+	}
+	if diff := testutil.Diff("0", logReadLagSeconds.Get(f.Name).String()); diff != "" {
+		t.Errorf("lag seconds after read: %s", diff)
+	}
+}
+
+func TestVerifyReads(t *testing.T) {
+	lines := make(chan *logline.LogLine, 2)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	fd := testutil.TestOpenFile(t, logfile)
+	defer fd.Close()
+	testutil.WriteString(t, fd, "hello\nworld\n")
+
+	f, err := NewFile(logfile, lines, true)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, f.VerifyReads())
+	defer f.Close()
+
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	if diff := testutil.Diff("12", logVerifiedBytes.Get(f.Name).String()); diff != "" {
+		t.Errorf("verified bytes: %s", diff)
+	}
+	if m := logVerifyMismatches.Get(f.Name); m != nil {
+		t.Errorf("unexpected mismatches: %s", m)
+	}
+
+	// Skip over a line without sending it, as a tailer losing it would.
+	testutil.WriteString(t, fd, "lost\n")
+	_, err = f.file.Seek(5, io.SeekCurrent)
+	testutil.FatalIfErr(t, err)
+	f.v.check(f)
+	if diff := testutil.Diff("17", logVerifiedBytes.Get(f.Name).String()); diff != "" {
+		t.Errorf("verified bytes: %s", diff)
+	}
+	if diff := testutil.Diff("1", logVerifyMismatches.Get(f.Name).String()); diff != "" {
+		t.Errorf("mismatches: %s", diff)
+	}
+}
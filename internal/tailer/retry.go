@@ -0,0 +1,155 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"expvar"
+	"math/rand"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	// logRetries counts the number of retries of each failed pattern or log
+	logRetries = expvar.NewMap("log_retries_total")
+	// logRetryRecoveries counts the number of times a retry succeeded for each pattern or log
+	logRetryRecoveries = expvar.NewMap("log_retry_recoveries_total")
+	// logRetriesPending records the number of patterns and logs waiting to be retried
+	logRetriesPending = expvar.NewInt("log_retries_pending")
+)
+
+const (
+	// retryMinDelay is the delay before the first retry of a failed pattern or log.
+	retryMinDelay = time.Second
+	// retryMaxDelay is the longest delay between retries.
+	retryMaxDelay = 5 * time.Minute
+)
+
+// retry is a failed operation waiting to be tried again.
+type retry struct {
+	op       func() error // The operation to retry.
+	attempts int          // The number of times op has failed.
+	next     time.Time    // When op is next tried.
+	err      error        // The last error returned by op.
+}
+
+// isTransient returns true if err is caused by a shortage of file
+// descriptors or inotify watches, which may go away without intervention.
+func isTransient(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	default:
+		err = e
+	}
+	switch err {
+	case syscall.ENOSPC, syscall.EMFILE, syscall.ENFILE:
+		return true
+	}
+	return false
+}
+
+// retryLater schedules op, which failed with err, to be tried again with
+// exponential backoff if err is transient.  It returns false if op should not
+// be retried.  The name is the pattern or pathname used in logs and metrics,
+// and only one retry is kept for each name.
+func (t *Tailer) retryLater(name string, op func() error, err error) bool {
+	if t.oneShot || !isTransient(err) {
+		return false
+	}
+	t.retriesMu.Lock()
+	defer t.retriesMu.Unlock()
+	r, ok := t.retries[name]
+	if !ok {
+		r = &retry{}
+		t.retries[name] = r
+		logRetriesPending.Add(1)
+	}
+	r.op = op
+	r.err = err
+	r.attempts++
+	r.next = time.Now().Add(t.retryDelay(r.attempts))
+	if r.attempts == 1 {
+		glog.Warningf("Transient error on %q, will retry: %s", name, err)
+	} else {
+		glog.V(1).Infof("Retry %d of %q failed: %s", r.attempts-1, name, err)
+	}
+	return true
+}
+
+// retryDelay returns the delay before the next try after the given number of
+// failed attempts.  The delay doubles with each attempt to at most
+// t.retryMax, and is jittered so that many logs failing together don't all
+// retry together.
+func (t *Tailer) retryDelay(attempts int) time.Duration {
+	d := t.retryMin
+	for i := 1; i < attempts && d < t.retryMax; i++ {
+		d *= 2
+	}
+	if d > t.retryMax {
+		d = t.retryMax
+	}
+	// Pick a delay between d/2 and d.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// runRetries tries again every operation whose retry is due.  Operations that
+// fail again with a transient error are rescheduled by retryLater.
+func (t *Tailer) runRetries() {
+	now := time.Now()
+	due := make(map[string]*retry)
+	t.retriesMu.Lock()
+	for name, r := range t.retries {
+		if !now.Before(r.next) {
+			due[name] = r
+		}
+	}
+	t.retriesMu.Unlock()
+	for name, r := range due {
+		logRetries.Add(name, 1)
+		err := r.op()
+		if err != nil && t.retryLater(name, r.op, err) {
+			continue
+		}
+		t.retriesMu.Lock()
+		delete(t.retries, name)
+		t.retriesMu.Unlock()
+		logRetriesPending.Add(-1)
+		if err != nil {
+			glog.Warningf("Giving up retrying %q: %s", name, err)
+			continue
+		}
+		glog.Infof("Recovered %q after %d retries", name, r.attempts)
+		logRetryRecoveries.Add(name, 1)
+	}
+}
+
+// retryStatus describes a pending retry on the status page.
+type retryStatus struct {
+	Name     string
+	Attempts int
+	Next     time.Time
+	Error    string
+}
+
+// pendingRetries returns the pending retries, ordered by name.
+func (t *Tailer) pendingRetries() []retryStatus {
+	t.retriesMu.Lock()
+	defer t.retriesMu.Unlock()
+	r := make([]retryStatus, 0, len(t.retries))
+	for name, v := range t.retries {
+		r = append(r, retryStatus{name, v.attempts, v.next, v.err.Error()})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
@@ -29,8 +29,13 @@ import (
 var (
 	// logCount records the number of logs that are being tailed
 	logCount = expvar.NewInt("log_count")
+	// logReadsPaused counts the number of reads of each log deferred because of back-pressure
+	logReadsPaused = expvar.NewMap("log_reads_paused_total")
 )
 
+// pauseCheckInterval is how often paused logs are checked for resumption.
+const pauseCheckInterval = 250 * time.Millisecond
+
 // Tailer receives notification of changes from a Watcher and extracts new log
 // lines from files. It also handles new log file creation events and log
 // rotations.
@@ -41,6 +46,9 @@ type Tailer struct {
 	handlesMu sync.RWMutex     // protects `handles'
 	handles   map[string]*File // File handles for each pathname.
 
+	execsMu sync.RWMutex     // protects `execs'
+	execs   map[string]*Exec // Subprocesses for each command line.
+
 	globPatternsMu sync.RWMutex        // protects `globPatterns'
 	globPatterns   map[string]struct{} // glob patterns to match newly created files in dir paths against
 
@@ -48,7 +56,22 @@ type Tailer struct {
 
 	eventsHandle int // record the handle with which to add new log files to the watcher
 
-	oneShot bool
+	oneShot     bool
+	verifyReads bool // if set, each region of a file read is checked with a shadow read
+
+	overloaded  func() bool // reports when downstream queues are full, if set
+	lowPriority []string    // glob patterns of logs to pause when overloaded
+
+	pausedMu sync.Mutex          // protects `paused'
+	paused   map[string]struct{} // logs with reads deferred until no longer overloaded
+
+	retriesMu sync.Mutex        // protects `retries'
+	retries   map[string]*retry // patterns and logs that failed transiently, by name
+
+	retryMin time.Duration // delay before the first retry
+	retryMax time.Duration // maximum delay between retries
+
+	drainTimeout time.Duration // how long to read a file after a rotation renames it
 }
 
 // OneShot puts the tailer in one-shot mode.
@@ -57,6 +80,38 @@ func OneShot(t *Tailer) error {
 	return nil
 }
 
+// VerifyReads sets the tailer to check each region of a file that it reads
+// with a second, independent read, counting mismatches in
+// log_verify_mismatches_total, to qualify the tailer in testing.
+func VerifyReads(t *Tailer) error {
+	t.verifyReads = true
+	return nil
+}
+
+// BackPressure sets the tailer to pause reading logs matching any of the
+// lowPriority glob patterns while overloaded returns true.  Paused logs are
+// read again once overloaded returns false, so no lines are lost, they are
+// just delayed in favour of the other logs.
+func BackPressure(overloaded func() bool, lowPriority ...string) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if overloaded == nil {
+			return errors.New("back-pressure needs an overload signal")
+		}
+		t.overloaded = overloaded
+		for _, pattern := range lowPriority {
+			absPath, err := filepath.Abs(pattern)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't canonicalize low priority pattern %q", pattern)
+			}
+			if _, err := filepath.Match(absPath, ""); err != nil {
+				return errors.Wrapf(err, "bad low priority pattern %q", pattern)
+			}
+			t.lowPriority = append(t.lowPriority, absPath)
+		}
+		return nil
+	}
+}
+
 // New creates a new Tailer.
 func New(lines chan<- *logline.LogLine, w watcher.Watcher, options ...func(*Tailer) error) (*Tailer, error) {
 	if lines == nil {
@@ -69,8 +124,14 @@ func New(lines chan<- *logline.LogLine, w watcher.Watcher, options ...func(*Tail
 		lines:        lines,
 		w:            w,
 		handles:      make(map[string]*File),
+		execs:        make(map[string]*Exec),
 		globPatterns: make(map[string]struct{}),
 		runDone:      make(chan struct{}),
+		paused:       make(map[string]struct{}),
+		retries:      make(map[string]*retry),
+		retryMin:     retryMinDelay,
+		retryMax:     retryMaxDelay,
+		drainTimeout: DefaultRotationDrainTimeout,
 	}
 	if err := t.SetOption(options...); err != nil {
 		return nil, err
@@ -138,11 +199,26 @@ func (t *Tailer) AddPattern(pattern string) error {
 // TailPattern registers a pattern to be tailed.  If pattern is a plain
 // file then it is watched for updates and opened.  If pattern is a glob, then
 // all paths that match the glob are opened and watched, and the directories
-// containing those matches, if any, are watched.
+// containing those matches, if any, are watched.  If the watches or logs
+// can't be opened because of a transient error, such as running out of file
+// descriptors or inotify watches, the pattern is retried later.
 func (t *Tailer) TailPattern(pattern string) error {
 	if err := t.AddPattern(pattern); err != nil {
 		return err
 	}
+	op := func() error { return t.tailPattern(pattern) }
+	if err := op(); err != nil {
+		if t.retryLater(pattern, op, err) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// tailPattern watches and opens the directories and files matching pattern.
+// All matches are tried, and the first error is returned.
+func (t *Tailer) tailPattern(pattern string) error {
 	// Add a watch on the containing directory, so we know when a rotation
 	// occurs or something shows up that matches this pattern.
 	if err := t.watchDirname(pattern); err != nil {
@@ -157,17 +233,31 @@ func (t *Tailer) TailPattern(pattern string) error {
 	if len(matches) == 0 {
 		return errors.Errorf("No matches for pattern %q", pattern)
 	}
+	var firstErr error
 	for _, pathname := range matches {
-		err := t.TailPath(pathname)
-		if err != nil {
-			return errors.Wrapf(err, "attempting to tail %q", pathname)
+		err := t.tailPath(pathname)
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "attempting to tail %q", pathname)
 		}
 	}
-	return nil
+	return firstErr
 }
 
-// TailPath registers a filesystem pathname to be tailed.
+// TailPath registers a filesystem pathname to be tailed.  It is retried later
+// if it fails with a transient error.
 func (t *Tailer) TailPath(pathname string) error {
+	op := func() error { return t.tailPath(pathname) }
+	if err := op(); err != nil {
+		if t.retryLater(pathname, op, err) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// tailPath watches and opens the file at pathname.
+func (t *Tailer) tailPath(pathname string) error {
 	if t.hasHandle(pathname) {
 		glog.V(2).Infof("already watching %q", pathname)
 		return nil
@@ -179,6 +269,25 @@ func (t *Tailer) TailPath(pathname string) error {
 	return t.openLogPath(pathname, false)
 }
 
+// TailExec starts a subprocess running command, and tails its standard
+// output and standard error.  The subprocess is restarted if it exits.
+func (t *Tailer) TailExec(command string) error {
+	t.execsMu.Lock()
+	defer t.execsMu.Unlock()
+	if _, ok := t.execs[command]; ok {
+		glog.V(2).Infof("already running %q", command)
+		return nil
+	}
+	e, err := NewExec(command, t.lines, t.oneShot)
+	if err != nil {
+		return err
+	}
+	t.execs[command] = e
+	glog.Infof("Tailing output of %q", command)
+	logCount.Add(1)
+	return nil
+}
+
 // handleLogEvent is dispatched when an Event is received, causing the tailer
 // to read all available bytes from an already-opened file and send each log
 // line onto lines channel.  Because we handle rotations and truncates when
@@ -196,9 +305,54 @@ func (t *Tailer) handleLogEvent(pathname string) {
 		t.handleCreateGlob(pathname)
 		return
 	}
+	if t.shouldPause(fd.Pathname) {
+		glog.V(1).Infof("Pausing reads of low priority log %q", fd.Pathname)
+		logReadsPaused.Add(fd.Pathname, 1)
+		t.pausedMu.Lock()
+		t.paused[pathname] = struct{}{}
+		t.pausedMu.Unlock()
+		return
+	}
 	doFollow(fd)
 }
 
+// shouldPause returns true if reads of the log at pathname should be deferred
+// because of back-pressure.
+func (t *Tailer) shouldPause(pathname string) bool {
+	if t.overloaded == nil || t.oneShot || len(t.lowPriority) == 0 {
+		return false
+	}
+	if !t.isLowPriority(pathname) {
+		return false
+	}
+	return t.overloaded()
+}
+
+// isLowPriority returns true if the pathname matches a low priority pattern.
+func (t *Tailer) isLowPriority(pathname string) bool {
+	for _, pattern := range t.lowPriority {
+		if matched, _ := filepath.Match(pattern, pathname); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// resumePaused reads any paused logs, if no longer overloaded.
+func (t *Tailer) resumePaused() {
+	if t.overloaded() {
+		return
+	}
+	t.pausedMu.Lock()
+	paused := t.paused
+	t.paused = make(map[string]struct{})
+	t.pausedMu.Unlock()
+	for pathname := range paused {
+		glog.V(1).Infof("Resuming reads of low priority log %q", pathname)
+		t.handleLogEvent(pathname)
+	}
+}
+
 // doFollow performs the Follow on an existing file descriptor, logging any errors
 func doFollow(fd *File) {
 	err := fd.Follow()
@@ -233,6 +387,12 @@ func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 		}
 		return err
 	}
+	if t.verifyReads {
+		if err := f.VerifyReads(); err != nil {
+			glog.Info(err)
+		}
+	}
+	f.drainTimeout = t.drainTimeout
 	glog.V(2).Infof("Adding a file watch on %q", f.Pathname)
 	if err := t.w.Add(f.Pathname, t.eventsHandle); err != nil {
 		return err
@@ -266,7 +426,10 @@ func (t *Tailer) handleCreateGlob(pathname string) {
 		glog.V(1).Infof("New file %q matched existing glob %q", pathname, pattern)
 		// If this file was just created, read from the start of the file.
 		if err := t.openLogPath(pathname, true); err != nil {
-			glog.Infof("Failed to tail new file %q: %s", pathname, err)
+			op := func() error { return t.openLogPath(pathname, true) }
+			if !t.retryLater(pathname, op, err) {
+				glog.Infof("Failed to tail new file %q: %s", pathname, err)
+			}
 		}
 		glog.V(2).Infof("started tailing %q", pathname)
 		return
@@ -280,17 +443,50 @@ func (t *Tailer) handleCreateGlob(pathname string) {
 func (t *Tailer) run(events <-chan watcher.Event) {
 	defer close(t.runDone)
 
-	for e := range events {
-		glog.V(2).Infof("Event type %#v", e)
-		t.handleLogEvent(e.Pathname)
+	// Paused logs are resumed and failed logs retried from this goroutine, so
+	// that no reads happen after the lines channel is closed.
+	var resume <-chan time.Time
+	if t.overloaded != nil {
+		ticker := time.NewTicker(pauseCheckInterval)
+		defer ticker.Stop()
+		resume = ticker.C
 	}
+	retryTicker := time.NewTicker(t.retryMin / 2)
+	defer retryTicker.Stop()
+	drainTicker := time.NewTicker(drainInterval)
+	defer drainTicker.Stop()
+Loop:
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				break Loop
+			}
+			glog.V(2).Infof("Event type %#v", e)
+			t.handleLogEvent(e.Pathname)
+		case <-resume:
+			t.resumePaused()
+		case <-retryTicker.C:
+			t.runRetries()
+		case <-drainTicker.C:
+			t.drainRotated(false)
+		}
+	}
+	t.drainRotated(true)
 	glog.Infof("Closing lines channel.")
 	close(t.lines)
 	glog.Infof("Shutting down tailer.")
 }
 
-// Close signals termination to the watcher.
+// Close stops any subprocesses and signals termination to the watcher.
 func (t *Tailer) Close() error {
+	t.execsMu.Lock()
+	for _, e := range t.execs {
+		if err := e.Close(); err != nil {
+			glog.Info(err)
+		}
+	}
+	t.execsMu.Unlock()
 	if err := t.w.Close(); err != nil {
 		return err
 	}
@@ -306,6 +502,20 @@ const tailerTemplate = `
 <li><pre>{{$name}}</pre></li>
 {{end}}
 </ul>
+{{if $.LowPriority}}
+<h3>Back-pressure</h3>
+<p>{{if $.Overloaded}}Overloaded, pausing low priority logs.{{else}}Not overloaded.{{end}}</p>
+<table border=1>
+<tr>
+<th>low priority pattern</th>
+</tr>
+{{range $pattern := $.LowPriority}}
+<tr>
+<td><pre>{{$pattern}}</pre></td>
+</tr>
+{{end}}
+</table>
+{{end}}
 <h3>Log files watched</h3>
 <table border=1>
 <tr>
@@ -314,6 +524,7 @@ const tailerTemplate = `
 <th>rotations</th>
 <th>truncations</th>
 <th>lines read</th>
+<th>reads paused</th>
 </tr>
 {{range $name, $val := $.Handles}}
 <tr>
@@ -322,9 +533,52 @@ const tailerTemplate = `
 <td>{{index $.Rotations $name}}</td>
 <td>{{index $.Truncs $name}}</td>
 <td>{{index $.Lines $name}}</td>
+<td>{{index $.Paused $name}}</td>
 </tr>
 {{end}}
 </table>
+{{if $.Retries}}
+<h3>Retrying</h3>
+<table border=1>
+<tr>
+<th>pattern or pathname</th>
+<th>attempts</th>
+<th>next attempt</th>
+<th>last error</th>
+</tr>
+{{range $r := $.Retries}}
+<tr>
+<td><pre>{{$r.Name}}</pre></td>
+<td>{{$r.Attempts}}</td>
+<td>{{$r.Next}}</td>
+<td>{{$r.Error}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+{{if $.Execs}}
+<h3>Commands run</h3>
+<table border=1>
+<tr>
+<th>command</th>
+<th>running</th>
+<th>starts</th>
+<th>exits</th>
+<th>errors</th>
+<th>lines read</th>
+</tr>
+{{range $name, $val := $.Execs}}
+<tr>
+<td><pre>{{$name}}</pre></td>
+<td>{{index $.ExecRunning $name}}</td>
+<td>{{index $.ExecStarts $name}}</td>
+<td>{{index $.ExecExits $name}}</td>
+<td>{{index $.ExecErrors $name}}</td>
+<td>{{index $.Lines $name}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
 </ul>
 `
 
@@ -338,16 +592,36 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 	defer t.handlesMu.RUnlock()
 	t.globPatternsMu.RLock()
 	defer t.globPatternsMu.RUnlock()
+	t.execsMu.RLock()
+	defer t.execsMu.RUnlock()
 	data := struct {
-		Handles   map[string]*File
-		Patterns  map[string]struct{}
-		Rotations map[string]string
-		Lines     map[string]string
-		Errors    map[string]string
-		Truncs    map[string]string
+		Handles     map[string]*File
+		Patterns    map[string]struct{}
+		Execs       map[string]*Exec
+		Retries     []retryStatus
+		LowPriority []string
+		Overloaded  bool
+		Rotations   map[string]string
+		Lines       map[string]string
+		Errors      map[string]string
+		Truncs      map[string]string
+		ExecRunning map[string]string
+		ExecStarts  map[string]string
+		ExecExits   map[string]string
+		ExecErrors  map[string]string
+		Paused      map[string]string
 	}{
 		t.handles,
 		t.globPatterns,
+		t.execs,
+		t.pendingRetries(),
+		t.lowPriority,
+		t.overloaded != nil && t.overloaded(),
+		make(map[string]string),
+		make(map[string]string),
+		make(map[string]string),
+		make(map[string]string),
+		make(map[string]string),
 		make(map[string]string),
 		make(map[string]string),
 		make(map[string]string),
@@ -361,6 +635,11 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 		{logRotations, data.Rotations},
 		{logTruncs, data.Truncs},
 		{lineCount, data.Lines},
+		{execRunning, data.ExecRunning},
+		{execStarts, data.ExecStarts},
+		{execExits, data.ExecExits},
+		{execErrors, data.ExecErrors},
+		{logReadsPaused, data.Paused},
 	} {
 		pair.v.Do(func(kv expvar.KeyValue) {
 			pair.m[kv.Key] = kv.Value.String()
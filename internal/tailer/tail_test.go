@@ -9,6 +9,8 @@ import (
 	"os/user"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/watcher"
+	"github.com/pkg/errors"
 )
 
 func makeTestTail(t *testing.T) (*Tailer, chan *logline.LogLine, *watcher.FakeWatcher, string, func()) {
@@ -353,6 +356,62 @@ func TestHandleLogRotate(t *testing.T) {
 	}
 }
 
+func TestHandleLogRotateDrain(t *testing.T) {
+	ta, lines, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	result := []*logline.LogLine{}
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	go func() {
+		for line := range lines {
+			result = append(result, line)
+			wg.Done()
+		}
+		close(done)
+	}()
+
+	if err := ta.TailPath(logfile); err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(2)
+	testutil.WriteString(t, f, "1\n")
+	w.InjectUpdate(logfile)
+	// Rotate with a dateext name, and keep writing to the renamed file as
+	// a writer does until it reopens the log.
+	if err := os.Rename(logfile, logfile+"-20191014"); err != nil {
+		t.Fatal(err)
+	}
+	f2 := testutil.TestOpenFile(t, logfile)
+	w.InjectCreate(logfile)
+	testutil.WriteString(t, f2, "2\n")
+	w.InjectUpdate(logfile)
+	wg.Wait()
+	wg.Add(1)
+	testutil.WriteString(t, f, "late\n")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+	w.Close()
+	<-done
+
+	expected := []*logline.LogLine{
+		{logfile, "1"},
+		{logfile, "2"},
+		{logfile, "late"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match expected:\n%s", diff)
+	}
+	if got := logRotationLinesRecovered.Get(logfile).String(); got != "1" {
+		t.Errorf("log_rotation_lines_recovered_total: got %s, want 1", got)
+	}
+}
+
 func TestHandleLogRotateSignalsWrong(t *testing.T) {
 	ta, lines, w, dir, cleanup := makeTestTail(t)
 	defer cleanup()
@@ -478,3 +537,213 @@ func TestTailExpireStaleHandles(t *testing.T) {
 	ta.handlesMu.RUnlock()
 	glog.Info("good")
 }
+
+func TestTailExec(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(lines, w, OneShot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := []*logline.LogLine{}
+	done := make(chan struct{})
+	go func() {
+		for line := range lines {
+			result = append(result, line)
+		}
+		close(done)
+	}()
+
+	command := "echo a b"
+	if err := ta.TailExec(command); err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	expected := []*logline.LogLine{
+		{command, "a b"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestTailExecNotFound(t *testing.T) {
+	ta, _, w, _, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	if err := ta.TailExec("/nonexistent/command"); err == nil {
+		t.Error("expected error for nonexistent command")
+	}
+}
+
+func TestTailBackPressure(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	var overloaded int32 = 1
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(lines, w, BackPressure(func() bool { return atomic.LoadInt32(&overloaded) == 1 }, filepath.Join(tmpDir, "low*")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lowlog := filepath.Join(tmpDir, "lowlog")
+	highlog := filepath.Join(tmpDir, "highlog")
+	low := testutil.TestOpenFile(t, lowlog)
+	high := testutil.TestOpenFile(t, highlog)
+	testutil.FatalIfErr(t, ta.TailPath(lowlog))
+	testutil.FatalIfErr(t, ta.TailPath(highlog))
+
+	testutil.WriteString(t, low, "low\n")
+	w.InjectUpdate(lowlog)
+	testutil.WriteString(t, high, "high\n")
+	w.InjectUpdate(highlog)
+
+	// The high priority log is read while overloaded, the low priority one is not.
+	if diff := testutil.Diff(&logline.LogLine{highlog, "high"}, <-lines); diff != "" {
+		t.Errorf("line didn't match:\n%s", diff)
+	}
+	ta.pausedMu.Lock()
+	_, ok := ta.paused[lowlog]
+	ta.pausedMu.Unlock()
+	if !ok {
+		t.Errorf("low priority log not paused: %v", ta.paused)
+	}
+
+	atomic.StoreInt32(&overloaded, 0)
+	select {
+	case line := <-lines:
+		if diff := testutil.Diff(&logline.LogLine{lowlog, "low"}, line); diff != "" {
+			t.Errorf("line didn't match:\n%s", diff)
+		}
+	case <-time.After(10 * pauseCheckInterval):
+		t.Error("low priority log not resumed")
+	}
+	if err := w.Close(); err != nil {
+		t.Log(err)
+	}
+}
+
+// flakyWatcher fails the first failures calls to Add with err.
+type flakyWatcher struct {
+	*watcher.FakeWatcher
+	mu       sync.Mutex
+	failures int
+	err      error
+}
+
+func (w *flakyWatcher) Add(name string, handle int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failures > 0 {
+		w.failures--
+		return w.err
+	}
+	return w.FakeWatcher.Add(name, handle)
+}
+
+func TestTailRetryTransientError(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := &flakyWatcher{FakeWatcher: watcher.NewFakeWatcher(), failures: 3, err: errors.Wrap(syscall.ENOSPC, "inotify_add_watch")}
+	lines := make(chan *logline.LogLine, 1)
+	fastRetries := func(t *Tailer) error {
+		t.retryMin = 10 * time.Millisecond
+		return nil
+	}
+	ta, err := New(lines, w, fastRetries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	// The first failure is retried in the background instead of returned.
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	if retries := ta.pendingRetries(); len(retries) != 1 || retries[0].Name != logfile {
+		t.Errorf("expected a pending retry for %q, got %v", logfile, retries)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !ta.hasHandle(logfile) {
+		if time.Now().After(deadline) {
+			t.Fatalf("log not tailed after retries: %v", ta.pendingRetries())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if retries := ta.pendingRetries(); len(retries) != 0 {
+		t.Errorf("unexpected pending retries: %v", retries)
+	}
+	if r := logRetryRecoveries.Get(logfile); r == nil || r.String() != "1" {
+		t.Errorf("expected one recovery of %q, got %v", logfile, r)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestTailNoRetryPermanentError(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := &flakyWatcher{FakeWatcher: watcher.NewFakeWatcher(), failures: 1, err: errors.New("permanent")}
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.TailPath(filepath.Join(tmpDir, "log")); err == nil {
+		t.Error("expected error")
+	}
+	if retries := ta.pendingRetries(); len(retries) != 0 {
+		t.Errorf("unexpected pending retries: %v", retries)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+var isTransientTests = []struct {
+	err      error
+	expected bool
+}{
+	{syscall.ENOSPC, true},
+	{syscall.EMFILE, true},
+	{syscall.ENFILE, true},
+	{&os.PathError{Op: "open", Path: "/log", Err: syscall.EMFILE}, true},
+	{errors.Wrap(os.NewSyscallError("inotify_add_watch", syscall.ENOSPC), "Failed to create a new watch"), true},
+	{syscall.ENOENT, false},
+	{&os.PathError{Op: "open", Path: "/log", Err: syscall.EACCES}, false},
+	{errors.New("no matches"), false},
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range isTransientTests {
+		if got := isTransient(tc.err); got != tc.expected {
+			t.Errorf("isTransient(%v): got %v, want %v", tc.err, got, tc.expected)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	ta := &Tailer{retryMin: time.Second, retryMax: 8 * time.Second}
+	for _, tc := range []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{10, 8 * time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			d := ta.retryDelay(tc.attempts)
+			if d < tc.max/2 || d > tc.max {
+				t.Errorf("retryDelay(%d): got %s, want between %s and %s", tc.attempts, d, tc.max/2, tc.max)
+			}
+		}
+	}
+}
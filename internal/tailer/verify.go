@@ -0,0 +1,125 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"expvar"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	// logVerifiedBytes counts the bytes of each log file checked by a
+	// shadow read
+	logVerifiedBytes = expvar.NewMap("log_verified_bytes_total")
+	// logVerifyMismatches counts the regions of each log file where the
+	// shadow read differed from the tailer's read
+	logVerifyMismatches = expvar.NewMap("log_verify_mismatches_total")
+)
+
+// verifier checks the reads of a File with a shadow read of each region of
+// the file read, through a second open file of its own, comparing the
+// checksums of the bytes and the count of lines in the region.
+type verifier struct {
+	shadow *os.File    // independent handle on the file being read, or nil if it couldn't be opened
+	start  int64       // offset of the start of the region being read
+	crc    hash.Hash32 // checksum of the bytes the tailer read in the region
+	lines  int         // number of lines the tailer sent in the region
+}
+
+// VerifyReads starts checking each region of a regular file read with a
+// shadow read, for qualifying the tailer under stress.
+func (f *File) VerifyReads() error {
+	if !f.regular {
+		return nil
+	}
+	start, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrapf(err, "can't verify reads of %q", f.Name)
+	}
+	f.v = &verifier{start: start, crc: crc32.NewIEEE()}
+	f.v.open(f)
+	return nil
+}
+
+// open opens the shadow handle on the file that f is reading, which must be
+// the same file, not one that has replaced it since.
+func (v *verifier) open(f *File) {
+	if v.shadow != nil {
+		v.shadow.Close()
+		v.shadow = nil
+	}
+	shadow, err := os.Open(f.Pathname)
+	if err != nil {
+		glog.Infof("%s: not verifying reads: %s", f.Name, err)
+		return
+	}
+	s1, err1 := f.file.Stat()
+	s2, err2 := shadow.Stat()
+	if err1 != nil || err2 != nil || !os.SameFile(s1, s2) {
+		glog.Infof("%s: not verifying reads, as the file was replaced while opening it again", f.Name)
+		shadow.Close()
+		return
+	}
+	v.shadow = shadow
+}
+
+// reset starts a new region at offset, discarding the region being read.
+func (v *verifier) reset(offset int64) {
+	v.start = offset
+	v.crc.Reset()
+	v.lines = 0
+}
+
+// rotated starts verifying the reads of the file that has replaced the one
+// f was reading, from its start.
+func (v *verifier) rotated(f *File) {
+	v.reset(0)
+	v.open(f)
+}
+
+// check compares the region of the file read since the last check with a
+// shadow read of it, and starts a new region at the current offset.
+func (v *verifier) check(f *File) {
+	end, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil || end <= v.start || v.shadow == nil {
+		return
+	}
+	crc := crc32.NewIEEE()
+	lines := 0
+	buf := make([]byte, 64*1024)
+	var n int64
+	for off := v.start; off < end; off += int64(len(buf)) {
+		chunk := buf
+		if end-off < int64(len(chunk)) {
+			chunk = chunk[:end-off]
+		}
+		m, err := v.shadow.ReadAt(chunk, off)
+		crc.Write(chunk[:m])
+		lines += bytes.Count(chunk[:m], []byte{'\n'})
+		n += int64(m)
+		if err != nil {
+			break
+		}
+	}
+	logVerifiedBytes.Add(f.Name, n)
+	if n != end-v.start || crc.Sum32() != v.crc.Sum32() || lines != v.lines {
+		logVerifyMismatches.Add(f.Name, 1)
+		glog.Warningf("%s: shadow read of bytes %d to %d found %d bytes, %d lines and checksum %08x, but the tailer read %d lines with checksum %08x",
+			f.Name, v.start, end, n, lines, crc.Sum32(), v.lines, v.crc.Sum32())
+	}
+	v.reset(end)
+}
+
+func (v *verifier) close() {
+	if v.shadow != nil {
+		v.shadow.Close()
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/code"
+)
+
+// arithmeticPolicy is what a program does on an arithmetic fault: a division
+// by zero, an integer overflow, or a negative observation of a histogram
+// whose buckets start at zero or above.
+type arithmeticPolicy int
+
+const (
+	// arithmeticSkip stops processing the line on a fault.
+	arithmeticSkip arithmeticPolicy = iota
+	// arithmeticClamp replaces the result of a fault with the nearest value
+	// in range, or zero for a division by zero, and carries on.
+	arithmeticClamp
+)
+
+var arithmeticPolicyNames = map[string]arithmeticPolicy{
+	"skip":  arithmeticSkip,
+	"clamp": arithmeticClamp,
+}
+
+// parseArithmeticPolicies parses a comma separated list of policies: a
+// policy name to set the default for all programs, or program=policy to set
+// the policy of one program, e.g. "skip,legacy.mtail=clamp".
+func parseArithmeticPolicies(spec string) (arithmeticPolicy, map[string]arithmeticPolicy, error) {
+	def := arithmeticSkip
+	byProgram := make(map[string]arithmeticPolicy)
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name := s
+		prog := ""
+		if i := strings.Index(s, "="); i >= 0 {
+			prog, name = s[:i], s[i+1:]
+		}
+		p, ok := arithmeticPolicyNames[name]
+		if !ok {
+			return def, nil, errors.Errorf("unknown arithmetic policy %q, expecting skip or clamp", name)
+		}
+		if prog == "" {
+			def = p
+		} else {
+			byProgram[prog] = p
+		}
+	}
+	return def, byProgram, nil
+}
+
+// intOp returns the result of the integer arithmetic instruction op on a and
+// b.  If the result is undefined or out of range, it returns an error, and
+// the result clamped to the range of an int64, or zero for a division by zero.
+func intOp(op code.Opcode, a, b int64) (int64, error) {
+	// clamp is the limit in the direction of a result that overflowed.
+	clamp := func(negative bool) int64 {
+		if negative {
+			return math.MinInt64
+		}
+		return math.MaxInt64
+	}
+	switch op {
+	case code.Iadd:
+		r := a + b
+		if (b > 0 && r < a) || (b < 0 && r > a) {
+			return clamp(b < 0), errors.Errorf("integer overflow in %d + %d", a, b)
+		}
+		return r, nil
+	case code.Isub:
+		r := a - b
+		if (b < 0 && r < a) || (b > 0 && r > a) {
+			return clamp(b > 0), errors.Errorf("integer overflow in %d - %d", a, b)
+		}
+		return r, nil
+	case code.Imul:
+		r := a * b
+		if a != 0 && (r/a != b || (a == -1 && b == math.MinInt64)) {
+			return clamp((a < 0) != (b < 0)), errors.Errorf("integer overflow in %d * %d", a, b)
+		}
+		return r, nil
+	case code.Idiv:
+		if b == 0 {
+			return 0, errors.Errorf("division by zero in %d / %d", a, b)
+		}
+		if a == math.MinInt64 && b == -1 {
+			return math.MaxInt64, errors.Errorf("integer overflow in %d / %d", a, b)
+		}
+		return a / b, nil
+	case code.Imod:
+		if b == 0 {
+			return 0, errors.Errorf("division by zero in %d %% %d", a, b)
+		}
+		if b == -1 {
+			return 0, nil
+		}
+		return a % b, nil
+	case code.Ipow:
+		// TODO(jaq): replace with type coercion
+		r := math.Pow(float64(a), float64(b))
+		if r >= math.MaxInt64 || r < math.MinInt64 {
+			return clamp(r < 0), errors.Errorf("integer overflow in %d ** %d", a, b)
+		}
+		return int64(r), nil
+	}
+	return 0, errors.Errorf("not an integer arithmetic instruction: %s", op)
+}
+
+// floatToInt returns the float x, already rounded to a whole number, as an
+// int.  If x is NaN or out of range, it returns an error, and x clamped to
+// the range of an int64, or zero for NaN.
+func floatToInt(x float64) (int64, error) {
+	switch {
+	case math.IsNaN(x):
+		return 0, errors.Errorf("can't convert %g to an int", x)
+	case x >= math.MaxInt64:
+		return math.MaxInt64, errors.Errorf("integer overflow converting %g to an int", x)
+	case x < math.MinInt64:
+		return math.MinInt64, errors.Errorf("integer overflow converting %g to an int", x)
+	}
+	return int64(x), nil
+}
+
+// negativeObservation returns true if value is a negative observation of the
+// histogram datum d, whose buckets don't go below zero.
+func (v *VM) negativeObservation(d datum.Datum, value float64) bool {
+	b, ok := d.(*datum.BucketsDatum)
+	return ok && value < 0 && b.LowestBound() >= 0
+}
+
+// arithmeticFault counts the arithmetic fault err in the program, and returns
+// true if the program carries on with the clamped result, or false if it
+// stops processing the line.
+func (v *VM) arithmeticFault(err error) bool {
+	arithmeticErrors.Add(v.name, 1)
+	glog.V(1).Infof("%s: %s", v.source(), err)
+	if v.arithmetic == arithmeticClamp {
+		return true
+	}
+	v.terminate = true
+	return false
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/code"
+)
+
+var intOpTests = []struct {
+	op       code.Opcode
+	a, b     int64
+	expected int64
+	fault    bool
+}{
+	{code.Iadd, 1, 2, 3, false},
+	{code.Iadd, math.MaxInt64, 1, math.MaxInt64, true},
+	{code.Iadd, math.MinInt64, -1, math.MinInt64, true},
+	{code.Isub, math.MinInt64, 1, math.MinInt64, true},
+	{code.Isub, math.MaxInt64, -1, math.MaxInt64, true},
+	{code.Isub, -1, math.MaxInt64, math.MinInt64, false},
+	{code.Imul, 3, -4, -12, false},
+	{code.Imul, math.MaxInt64, 2, math.MaxInt64, true},
+	{code.Imul, math.MaxInt64, -2, math.MinInt64, true},
+	{code.Imul, -1, math.MinInt64, math.MaxInt64, true},
+	{code.Idiv, 7, 2, 3, false},
+	{code.Idiv, 7, 0, 0, true},
+	{code.Idiv, math.MinInt64, -1, math.MaxInt64, true},
+	{code.Imod, 7, 2, 1, false},
+	{code.Imod, 7, 0, 0, true},
+	{code.Imod, math.MinInt64, -1, 0, false},
+	{code.Ipow, 2, 10, 1024, false},
+	{code.Ipow, 2, 63, math.MaxInt64, true},
+	{code.Ipow, -2, 63, math.MinInt64, false},
+	{code.Ipow, -3, 41, math.MinInt64, true},
+}
+
+func TestIntOp(t *testing.T) {
+	for _, tc := range intOpTests {
+		r, err := intOp(tc.op, tc.a, tc.b)
+		if (err != nil) != tc.fault {
+			t.Errorf("%s %d %d: fault is %v, expected %v", tc.op, tc.a, tc.b, err, tc.fault)
+		}
+		if r != tc.expected {
+			t.Errorf("%s %d %d: result is %d, expected %d", tc.op, tc.a, tc.b, r, tc.expected)
+		}
+	}
+}
+
+func TestParseArithmeticPolicies(t *testing.T) {
+	def, byProgram, err := parseArithmeticPolicies("clamp, legacy.mtail=skip,other.mtail=clamp")
+	testutil.FatalIfErr(t, err)
+	if def != arithmeticClamp {
+		t.Errorf("default policy is %v, expected clamp", def)
+	}
+	expected := map[string]arithmeticPolicy{"legacy.mtail": arithmeticSkip, "other.mtail": arithmeticClamp}
+	if diff := testutil.Diff(expected, byProgram); diff != "" {
+		t.Error(diff)
+	}
+	if _, _, err := parseArithmeticPolicies("skip,legacy.mtail=wrap"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestArithmeticPolicy(t *testing.T) {
+	for _, p := range []arithmeticPolicy{arithmeticSkip, arithmeticClamp} {
+		v := makeVM(code.Instr{code.Idiv, nil}, nil)
+		v.name = "arithmeticpolicy"
+		v.arithmetic = p
+		v.t.Push(int64(7))
+		v.t.Push(int64(0))
+		v.execute(v.t, v.prog[0])
+		if p == arithmeticClamp {
+			if v.terminate {
+				t.Error("clamp: expected the program to carry on")
+			}
+			if diff := testutil.Diff([]interface{}{int64(0)}, v.t.stack); diff != "" {
+				t.Errorf("clamp: %s", diff)
+			}
+		} else if !v.terminate {
+			t.Error("skip: expected the program to stop processing the line")
+		}
+	}
+	if diff := testutil.Diff("2", arithmeticErrors.Get("arithmeticpolicy").String()); diff != "" {
+		t.Errorf("arithmetic errors: %s", diff)
+	}
+}
+
+func TestNegativeObservation(t *testing.T) {
+	for _, p := range []arithmeticPolicy{arithmeticSkip, arithmeticClamp} {
+		m := metrics.NewMetric("h", "tst", metrics.Histogram, metrics.Buckets)
+		m.Buckets = []datum.Range{{Min: math.Inf(-1), Max: 0}, {Min: 0, Max: 10}, {Min: 10, Max: math.Inf(+1)}}
+		d, err := m.GetDatum()
+		testutil.FatalIfErr(t, err)
+		v := makeVM(code.Instr{code.Fset, nil}, nil)
+		v.arithmetic = p
+		v.t.time = time.Unix(37, 0)
+		v.t.Push(d)
+		v.t.Push(float64(-3))
+		v.execute(v.t, v.prog[0])
+		expected := uint64(0)
+		if p == arithmeticClamp {
+			expected = 1
+		}
+		if diff := testutil.Diff(expected, datum.GetBucketsCount(d)); diff != "" {
+			t.Errorf("policy %v: %s", p, diff)
+		}
+		if sum := datum.GetBucketsSum(d); sum != 0 {
+			t.Errorf("policy %v: sum is %g, expected 0", p, sum)
+		}
+	}
+}
@@ -180,6 +180,32 @@ func (n *UnaryExpr) SetType(t types.Type) {
 	n.typ = t
 }
 
+// TernaryExpr is a conditional expression, with the value of Truth if Cond
+// is true, and of Else otherwise.
+type TernaryExpr struct {
+	Cond, Truth, Else Node
+	Scope             *symbol.Scope // a pattern condition defines capture groups for the branches
+
+	typMu sync.RWMutex
+	typ   types.Type
+}
+
+func (n *TernaryExpr) Pos() *position.Position {
+	return MergePosition(n.Cond.Pos(), n.Else.Pos())
+}
+
+func (n *TernaryExpr) Type() types.Type {
+	n.typMu.RLock()
+	defer n.typMu.RUnlock()
+	return n.typ
+}
+
+func (n *TernaryExpr) SetType(t types.Type) {
+	n.typMu.Lock()
+	defer n.typMu.Unlock()
+	n.typ = t
+}
+
 type IndexedExpr struct {
 	Lhs, Index Node
 
@@ -207,10 +233,21 @@ type VarDecl struct {
 	P            position.Position
 	Name         string
 	Hidden       bool
+	Persist      bool // Hidden values survive a program reload.
+	Transient    bool // Hidden values are discarded on a program reload.
 	Keys         []string
+	Normalizers  map[string][]*Normalizer // Rewrites of the values of each key, in order.
 	Buckets      []float64
+	Quantiles    []float64
+	Expiry       time.Duration // Default expiry of each key's value.
+	HalfLife     time.Duration // Half-life of the observations of an ewma metric.
+	Interval     time.Duration // Interval over which a min, max or stddev metric aggregates its observations.
+	TopK         int64         // Number of label values a top-k metric tracks.
+	Limit        int64         // Most label values kept, evicting the least recently updated.
 	Kind         metrics.Kind
 	ExportedName string
+	Help         string // Description of the metric exported with it.
+	Unit         string // Base unit of the metric values, like seconds.
 	Symbol       *symbol.Symbol
 }
 
@@ -221,12 +258,29 @@ func (n *VarDecl) Pos() *position.Position {
 func (n *VarDecl) Type() types.Type {
 	if n.Kind == metrics.Histogram {
 		return types.Buckets
+	} else if n.Kind == metrics.Summary {
+		return types.Quantiles
+	} else if n.Kind == metrics.Unique {
+		return types.Distinct
 	} else if n.Symbol != nil {
 		return n.Symbol.Type
 	}
 	return types.Error
 }
 
+// Normalizer is a rewrite of the values of a key of a metric, like
+// `lowercase' or `max_len 64', applied each time the metric is indexed.
+type Normalizer struct {
+	P      position.Position
+	Name   string
+	Arg    int64
+	HasArg bool
+}
+
+func (n *Normalizer) Pos() *position.Position {
+	return &n.P
+}
+
 type StringLit struct {
 	P    position.Position
 	Text string
@@ -239,6 +293,31 @@ func (n *StringLit) Type() types.Type {
 	return types.String
 }
 
+// WildcardTerm is a `*' key of a del statement, matching any label value.
+type WildcardTerm struct {
+	P     position.Position
+	InDel bool // true if the wildcard is a key of a del statement
+
+	typMu sync.RWMutex
+	typ   types.Type
+}
+
+func (n *WildcardTerm) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *WildcardTerm) Type() types.Type {
+	n.typMu.RLock()
+	defer n.typMu.RUnlock()
+	return n.typ
+}
+
+func (n *WildcardTerm) SetType(t types.Type) {
+	n.typMu.Lock()
+	defer n.typMu.Unlock()
+	n.typ = t
+}
+
 type IntLit struct {
 	P position.Position
 	I int64
@@ -251,6 +330,18 @@ func (n *IntLit) Type() types.Type {
 	return types.Int
 }
 
+type BoolLit struct {
+	P position.Position
+	B bool
+}
+
+func (n *BoolLit) Pos() *position.Position {
+	return &n.P
+}
+func (n *BoolLit) Type() types.Type {
+	return types.Bool
+}
+
 type FloatLit struct {
 	P position.Position
 	F float64
@@ -265,9 +356,10 @@ func (n *FloatLit) Type() types.Type {
 
 // patternExprNode is the top of a pattern expression
 type PatternExpr struct {
-	Expr    Node
-	Pattern string // if not empty, the fully defined pattern after typecheck
-	Index   int    // reference to the compiled object offset after codegen
+	Expr           Node
+	Pattern        string // if not empty, the fully defined pattern after typecheck
+	SyslogPriority bool   // true if the pattern matches after a syslog priority, set by typecheck
+	Index          int    // reference to the compiled object offset after codegen
 }
 
 func (n *PatternExpr) Pos() *position.Position {
@@ -343,6 +435,210 @@ func (n *DecoStmt) Type() types.Type {
 	return types.None
 }
 
+// FuncDecl is the definition of a user-defined function.  Calls to the
+// function are inlined during code generation.
+type FuncDecl struct {
+	P      position.Position
+	Name   string
+	Params []*IdTerm // Formal parameters; their Symbols are set by the checker.
+	Block  Node
+	Symbol *symbol.Symbol
+	Scope  *symbol.Scope // The scope containing the parameters.
+
+	Returns types.Type // The type of the function's return value, or None.
+}
+
+func (n *FuncDecl) Pos() *position.Position {
+	return MergePosition(&n.P, n.Block.Pos())
+}
+
+func (n *FuncDecl) Type() types.Type {
+	return types.None
+}
+
+type FuncCall struct {
+	P    position.Position
+	Name string
+	Args Node
+	Decl *FuncDecl // Pointer to the declaration of the function this expression calls.
+
+	typMu sync.RWMutex
+	typ   types.Type
+}
+
+func (n *FuncCall) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *FuncCall) Type() types.Type {
+	n.typMu.RLock()
+	defer n.typMu.RUnlock()
+	return n.typ
+}
+
+func (n *FuncCall) SetType(t types.Type) {
+	n.typMu.Lock()
+	defer n.typMu.Unlock()
+	n.typ = t
+}
+
+type ReturnStmt struct {
+	P    position.Position
+	Expr Node // Optional return value.
+}
+
+func (n *ReturnStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *ReturnStmt) Type() types.Type {
+	return types.None
+}
+
+// SwitchStmt is a choice between blocks, by the value of an expression.
+type SwitchStmt struct {
+	P     position.Position
+	Expr  Node
+	Cases []*CaseClause
+}
+
+func (n *SwitchStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *SwitchStmt) Type() types.Type {
+	return types.None
+}
+
+// CaseClause is a block of a switch statement, executed when the switch value
+// equals one of the case values.  The default clause has no values.
+type CaseClause struct {
+	P      position.Position
+	Values Node // ExprList of the case values, or nil for the default clause.
+	Block  Node
+}
+
+func (n *CaseClause) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *CaseClause) Type() types.Type {
+	return types.None
+}
+
+// MapExpr maps the value of an expression to the value of the first case
+// whose pattern matches all of it, or to the value of the default case.
+type MapExpr struct {
+	P     position.Position
+	Expr  Node
+	Cases []*MapCase
+}
+
+func (n *MapExpr) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *MapExpr) Type() types.Type {
+	return types.String
+}
+
+// MapCase is a pattern and its value in a map expression.  The default case
+// has no pattern.
+type MapCase struct {
+	P       position.Position
+	Pattern string
+	Default bool
+	Value   string
+}
+
+func (n *MapCase) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *MapCase) Type() types.Type {
+	return types.String
+}
+
+// LookupDecl declares a table of strings by string key, read from a file.
+// The table is filled in by the compiler after parsing.
+type LookupDecl struct {
+	P      position.Position
+	Name   string
+	Path   string            // Path of the table file, relative to the declaring file.
+	Table  map[string]string // Contents of the table file.
+	Symbol *symbol.Symbol
+}
+
+func (n *LookupDecl) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *LookupDecl) Type() types.Type {
+	return types.None
+}
+
+// LookupExpr finds the string stored under a key in a lookup table.
+type LookupExpr struct {
+	P      position.Position
+	Name   string
+	Key    Node
+	Symbol *symbol.Symbol
+}
+
+func (n *LookupExpr) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *LookupExpr) Type() types.Type {
+	return types.String
+}
+
+// ImportStmt includes the statements of another program file.  The
+// statements are filled in by the compiler after parsing.
+type ImportStmt struct {
+	P     position.Position
+	Path  string // Path of the imported file, relative to the importing file.
+	Stmts []Node // Statements of the imported file.
+}
+
+func (n *ImportStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *ImportStmt) Type() types.Type {
+	return types.None
+}
+
+// NamespaceStmt prefixes the names of the metrics exported by the program
+// with Name and an underscore.
+type NamespaceStmt struct {
+	P    position.Position
+	Name string
+}
+
+func (n *NamespaceStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *NamespaceStmt) Type() types.Type {
+	return types.None
+}
+
+// TimezoneStmt sets the location of the times without a zone parsed by the
+// program, in place of the one set for all programs.
+type TimezoneStmt struct {
+	P    position.Position
+	Name string
+}
+
+func (n *TimezoneStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *TimezoneStmt) Type() types.Type {
+	return types.None
+}
+
 type NextStmt struct {
 	P position.Position
 }
@@ -367,6 +663,23 @@ func (n *OtherwiseStmt) Type() types.Type {
 	return types.None
 }
 
+// LetStmt declares a local variable, whose value is only kept while the
+// current line is processed.
+type LetStmt struct {
+	P      position.Position
+	Name   string
+	Expr   Node
+	Symbol *symbol.Symbol
+}
+
+func (n *LetStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *LetStmt) Type() types.Type {
+	return types.None
+}
+
 type DelStmt struct {
 	P      position.Position
 	N      Node
@@ -417,6 +730,21 @@ func (n *Error) Type() types.Type {
 	return types.Error
 }
 
+// SampleExpr is true for one in Rate lines, and is the condition of a sample
+// block.
+type SampleExpr struct {
+	P    position.Position
+	Rate int64
+}
+
+func (n *SampleExpr) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *SampleExpr) Type() types.Type {
+	return types.Bool
+}
+
 type StopStmt struct {
 	P position.Position
 }
@@ -57,6 +57,11 @@ func Walk(v Visitor, node Node) Node {
 	case *UnaryExpr:
 		n.Expr = Walk(v, n.Expr)
 
+	case *TernaryExpr:
+		n.Cond = Walk(v, n.Cond)
+		n.Truth = Walk(v, n.Truth)
+		n.Else = Walk(v, n.Else)
+
 	case *IndexedExpr:
 		n.Index = Walk(v, n.Index)
 		n.Lhs = Walk(v, n.Lhs)
@@ -67,6 +72,43 @@ func Walk(v Visitor, node Node) Node {
 	case *DecoStmt:
 		n.Block = Walk(v, n.Block)
 
+	case *FuncDecl:
+		n.Block = Walk(v, n.Block)
+
+	case *FuncCall:
+		if n.Args != nil {
+			n.Args = Walk(v, n.Args)
+		}
+
+	case *LetStmt:
+		n.Expr = Walk(v, n.Expr)
+
+	case *ReturnStmt:
+		if n.Expr != nil {
+			n.Expr = Walk(v, n.Expr)
+		}
+
+	case *SwitchStmt:
+		n.Expr = Walk(v, n.Expr)
+		for i, c := range n.Cases {
+			n.Cases[i] = Walk(v, c).(*CaseClause)
+		}
+
+	case *MapExpr:
+		n.Expr = Walk(v, n.Expr)
+
+	case *CaseClause:
+		if n.Values != nil {
+			n.Values = Walk(v, n.Values)
+		}
+		n.Block = Walk(v, n.Block)
+
+	case *ImportStmt:
+		n.Stmts = walknodelist(v, n.Stmts)
+
+	case *LookupExpr:
+		n.Key = Walk(v, n.Key)
+
 	case *ConvExpr:
 		n.N = Walk(v, n.N)
 
@@ -76,7 +118,7 @@ func Walk(v Visitor, node Node) Node {
 	case *PatternFragment:
 		n.Expr = Walk(v, n.Expr)
 
-	case *IdTerm, *CaprefTerm, *VarDecl, *StringLit, *IntLit, *FloatLit, *PatternLit, *NextStmt, *OtherwiseStmt, *DelStmt, *StopStmt:
+	case *IdTerm, *CaprefTerm, *VarDecl, *LookupDecl, *StringLit, *IntLit, *BoolLit, *FloatLit, *PatternLit, *NextStmt, *OtherwiseStmt, *DelStmt, *StopStmt, *SampleExpr, *WildcardTerm, *NamespaceStmt, *TimezoneStmt:
 		// These nodes are terminals, thus have no children to walk.
 
 	default:
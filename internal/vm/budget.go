@@ -0,0 +1,73 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/google/mtail/internal/vm/code"
+)
+
+var (
+	// progQuarantined is 1 for each program quarantined for running over its
+	// line budget too often.
+	progQuarantined = expvar.NewMap("prog_quarantined")
+)
+
+// lineBudget limits the work a program does on one line, so that a program
+// that is pathologically slow on some lines can't stall the others.
+type lineBudget struct {
+	instructions    int           // Most instructions run per line, if positive.
+	wallTime        time.Duration // Most time spent per line, if positive.
+	quarantineAfter int           // Lines over budget before the program is quarantined, if positive.
+}
+
+// overBudget returns true if the program has run over its budget on the
+// current line, after running n instructions since start.  The time is only
+// checked between instructions, so a single slow instruction, like a match
+// of a regular expression against a very long line, can't be interrupted
+// and runs to completion first.
+func (v *VM) overBudget(n int, start time.Time) bool {
+	b := v.budget
+	switch {
+	case b.instructions > 0 && n > b.instructions:
+		glog.Infof("%s: Runtime error: line budget of %d instructions exceeded", v.source(), b.instructions)
+	case b.wallTime > 0 && time.Since(start) > b.wallTime:
+		glog.Infof("%s: Runtime error: line budget of %s exceeded", v.source(), b.wallTime)
+	default:
+		return false
+	}
+	progRuntimeErrors.Add(v.name, 1)
+	v.overruns++
+	if b.quarantineAfter > 0 && v.overruns >= b.quarantineAfter {
+		glog.Warningf("Quarantining program %s after %d lines over its budget; it processes no more lines until it is reloaded", v.name, v.overruns)
+		v.quarantined = true
+		progQuarantined.Add(v.name, 1)
+	}
+	return true
+}
+
+// matchCost returns the instructions charged to the instruction budget for
+// running i, beyond the one every instruction costs.  A match can't be
+// interrupted once started, so it is charged the length of the text it
+// matches before it starts, as RE2 takes time linear in that length.
+func (v *VM) matchCost(t *thread, i code.Instr) int {
+	if v.budget.instructions <= 0 {
+		return 0
+	}
+	switch i.Opcode {
+	case code.Match, code.Pmatch:
+		return len(v.input.Line)
+	case code.Smatch:
+		if len(t.stack) > 0 {
+			if s, ok := t.stack[len(t.stack)-1].(string); ok {
+				return len(s)
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/codegen"
+)
+
+func TestLineBudget(t *testing.T) {
+	prog := `counter short
+counter long
+/^short$/ {
+  short++
+}
+/^long (\d+)$/ {
+  long += $1 + $1 + $1 + $1 + $1 + $1 + $1 + $1
+}
+`
+	v, err := Compile("budget.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.budget = lineBudget{instructions: 20, quarantineAfter: 2}
+	for _, line := range []string{"short", "long 1", "short", "long 2", "short"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	counts := make([]int64, 0, len(v.m))
+	for _, m := range v.m {
+		d, err := m.GetDatum()
+		testutil.FatalIfErr(t, err)
+		counts = append(counts, datum.GetInt(d))
+	}
+	// The long lines run over the budget, and the program is quarantined
+	// before the last short line.
+	if diff := testutil.Diff([]int64{2, 0}, counts); diff != "" {
+		t.Error(diff)
+	}
+	if !v.quarantined {
+		t.Error("expected the program to be quarantined")
+	}
+	if diff := testutil.Diff("2", progRuntimeErrors.Get("budget.mtail").String()); diff != "" {
+		t.Errorf("runtime errors: %s", diff)
+	}
+}
+
+func TestLineBudgetTime(t *testing.T) {
+	v, err := Compile("budget_time.mtail", strings.NewReader("counter c\n/x/ {\n  c++\n}\n"), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.budget = lineBudget{wallTime: time.Nanosecond}
+	v.processLine(logline.NewLogLine("log", "x"))
+	if v.quarantined {
+		t.Error("expected the program not to be quarantined")
+	}
+	if diff := testutil.Diff("1", progRuntimeErrors.Get("budget_time.mtail").String()); diff != "" {
+		t.Errorf("runtime errors: %s", diff)
+	}
+}
+
+func TestLineBudgetMatchCost(t *testing.T) {
+	v, err := Compile("budget_match.mtail", strings.NewReader("counter c\n/x$/ {\n  c++\n}\n"), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.budget = lineBudget{instructions: 100}
+	v.processLine(logline.NewLogLine("log", "x"))
+	// A match against a line longer than the budget is not started.
+	v.processLine(logline.NewLogLine("log", strings.Repeat("a", 200)+"x"))
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff(int64(1), datum.GetInt(d)); diff != "" {
+		t.Error(diff)
+	}
+	if diff := testutil.Diff("1", progRuntimeErrors.Get("budget_match.mtail").String()); diff != "" {
+		t.Errorf("runtime errors: %s", diff)
+	}
+}
@@ -5,6 +5,8 @@ package checker
 
 import (
 	"fmt"
+	"net"
+	"regexp"
 	"regexp/syntax"
 	"strings"
 	"time"
@@ -14,6 +16,7 @@ import (
 	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/errors"
 	"github.com/google/mtail/internal/vm/parser"
+	"github.com/google/mtail/internal/vm/position"
 	"github.com/google/mtail/internal/vm/symbol"
 	"github.com/google/mtail/internal/vm/types"
 )
@@ -24,20 +27,267 @@ type checker struct {
 
 	decoScopes []*symbol.Scope // A stack of scopes used for resolving symbols in decorated nodes
 
-	errors errors.ErrorList
+	unmatched []*symbol.Scope // A stack of the scopes of the conditions whose else blocks are being checked
+
+	funcs []*ast.FuncDecl // A stack of the functions being defined, for resolving return statements
+
+	indexedBuiltins  map[*ast.BuiltinExpr]bool     // Builtin calls that are indexed, the only place a list or map can be used
+	assignedBuiltins map[*ast.BuiltinExpr]ast.Node // The expression each builtin call that is assigned is assigned to
+
+	decls []*ast.VarDecl // The metrics declared, for checking their types once inferred
+
+	namespace *ast.NamespaceStmt // The namespace of the program, if any
+	timezone  *ast.TimezoneStmt  // The timezone of the program, if any
+
+	strict      bool // Set if warnings are errors.
+	strictTypes bool // Set if implicit conversions between Int and Float, and metrics of unknown type, are errors.
+
+	errors   errors.ErrorList
+	warnings errors.ErrorList // Warnings about the program, if not strict
 }
 
 // Check performs a semantic check of the astNode, and returns a potentially
 // modified astNode and either a list of errors found, or nil if the program is
 // semantically valid.  At the completion of Check, the symbol table and type
-// annotation are also complete.
-func Check(node ast.Node) (ast.Node, error) {
-	c := &checker{}
+// annotation are also complete.  If strict is set, warnings about the program
+// are errors too; otherwise they are logged.
+func Check(node ast.Node, strict bool, opts ...Option) (ast.Node, error) {
+	node, _, err := CheckWithWarnings(node, strict, opts...)
+	return node, err
+}
+
+// Option configures a check.
+type Option func(*checker)
+
+// StrictTypes makes implicit conversions between Int and Float compile
+// errors, so that each must be written with the int() or float() builtin,
+// and makes metrics whose type can't be inferred errors even if the check is
+// not strict.
+func StrictTypes() Option {
+	return func(c *checker) {
+		c.strictTypes = true
+	}
+}
+
+// CheckWithWarnings performs a semantic check of the astNode like Check, and
+// also returns the warnings about the program if strict is not set, so that
+// they can be shown while the program runs.
+func CheckWithWarnings(node ast.Node, strict bool, opts ...Option) (ast.Node, errors.ErrorList, error) {
+	c := &checker{indexedBuiltins: make(map[*ast.BuiltinExpr]bool), assignedBuiltins: make(map[*ast.BuiltinExpr]ast.Node), strict: strict}
+	for _, opt := range opts {
+		opt(c)
+	}
 	node = ast.Walk(c, node)
+	c.checkMetricTypes()
 	if len(c.errors) > 0 {
-		return node, c.errors
+		return node, c.warnings, c.errors
 	}
-	return node, nil
+	c.checkMetricWrites(node)
+	if len(c.errors) > 0 {
+		return node, c.warnings, c.errors
+	}
+	return node, c.warnings, nil
+}
+
+// warn reports a warning of the given class at pos, as an error if the
+// checker is strict.
+func (c *checker) warn(pos *position.Position, class, msg string) {
+	if c.strict {
+		c.errors.AddWarning(pos, class, msg)
+		return
+	}
+	c.warnings.AddWarning(pos, class, msg)
+	glog.Infof("%s: %s (%s warning)", pos, msg, class)
+}
+
+// checkMetricTypes warns about the metrics whose type couldn't be inferred
+// from their use, and so are exported as integers.  With strict types, they
+// are errors.
+func (c *checker) checkMetricTypes() {
+	// An error in an expression leaves the metrics it uses untyped.
+	failed := len(c.errors) > 0
+	for _, n := range c.decls {
+		if n.Symbol == nil || !n.Symbol.Used {
+			continue
+		}
+		t := n.Symbol.Type
+		if types.IsDimension(t) {
+			t = t.(*types.Operator).Args[len(t.(*types.Operator).Args)-1]
+		}
+		if !types.IsComplete(t) {
+			if c.strictTypes {
+				if failed {
+					continue
+				}
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't infer the type of metric `%s'.\n\tTry assigning it a value of the type it should have.", n.Name))
+				continue
+			}
+			c.warn(n.Pos(), errors.Type, fmt.Sprintf("Can't infer the type of metric `%s', so it is an Int", n.Name))
+		}
+	}
+}
+
+// implicitConversion reports whether the node n of type from can be converted
+// to the type to without a conversion builtin.  With strict types, a
+// conversion between Int and Float is an error, unless n is an integer
+// literal, which is converted exactly.
+func (c *checker) implicitConversion(n ast.Node, from, to types.Type) bool {
+	if !c.strictTypes {
+		return true
+	}
+	var builtin string
+	switch {
+	case types.Equals(from, types.Int) && types.Equals(to, types.Float):
+		if _, ok := n.(*ast.IntLit); ok {
+			return true
+		}
+		builtin = "float"
+	case types.Equals(from, types.Float) && types.Equals(to, types.Int):
+		builtin = "int"
+	default:
+		return true
+	}
+	c.errors.Add(n.Pos(), fmt.Sprintf("Implicit conversion of %s to %s.\n\tTry `%s(...)' to convert it explicitly.", from, to, builtin))
+	return false
+}
+
+// checkMetricWrites warns about the metrics that are read but never written,
+// and so always keep their initial value.
+func (c *checker) checkMetricWrites(node ast.Node) {
+	w := &writeFinder{written: make(map[*symbol.Symbol]bool)}
+	ast.Walk(w, node)
+	for _, n := range c.decls {
+		if n.Symbol == nil || !n.Symbol.Used || w.written[n.Symbol] {
+			continue
+		}
+		c.warn(n.Pos(), errors.Unwritten, fmt.Sprintf("Metric `%s' is read but never written", n.Name))
+	}
+}
+
+// writeFinder records the symbols of the variables assigned, incremented,
+// decremented or deleted in a program.
+type writeFinder struct {
+	written map[*symbol.Symbol]bool
+}
+
+func (w *writeFinder) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
+	if id, ok := n.(*ast.IdTerm); ok && id.Lvalue && id.Symbol != nil {
+		w.written[id.Symbol] = true
+	}
+	return w, n
+}
+
+func (w *writeFinder) VisitAfter(n ast.Node) ast.Node {
+	return n
+}
+
+// checkUnmatched warns about a reference to a capture group in the else block
+// of the condition that defines it, where the group has no value.
+func (c *checker) checkUnmatched(n *ast.CaprefTerm) {
+	for _, s := range c.unmatched {
+		if s.Symbols[n.Name] == n.Symbol {
+			c.warn(n.Pos(), errors.Unmatched, fmt.Sprintf("Capture group `$%s' is used in the else block of the condition that defines it, where it has no value", n.Name))
+			return
+		}
+	}
+}
+
+// checkReachable warns about a block of the conditional statement n that can
+// never run, because its condition is a constant or a pattern that can never
+// match.
+func (c *checker) checkReachable(n *ast.CondStmt) {
+	switch cond := n.Cond.(type) {
+	case *ast.BoolLit:
+		if !cond.B {
+			c.warn(cond.Pos(), errors.Unreachable, "Condition is always false, so this block is never run")
+		} else if n.Else != nil {
+			c.warn(cond.Pos(), errors.Unreachable, "Condition is always true, so the else block is never run")
+		}
+	case *ast.PatternExpr:
+		if neverMatches(cond.Pattern) {
+			c.warn(cond.Pos(), errors.Unreachable, fmt.Sprintf("Pattern /%s/ can never match, so this block is never run", cond.Pattern))
+		}
+	case *ast.BinaryExpr:
+		if pe, ok := cond.Rhs.(*ast.PatternExpr); ok && cond.Op == parser.MATCH && neverMatches(pe.Pattern) {
+			c.warn(pe.Pos(), errors.Unreachable, fmt.Sprintf("Pattern /%s/ can never match, so this block is never run", pe.Pattern))
+		}
+	}
+}
+
+// neverMatches returns true if the regular expression pattern can't match
+// any text, as when it needs text after the end of the line, like
+// /foo$bar/.
+func neverMatches(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	return noMatch(re.Simplify())
+}
+
+func noMatch(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return true
+	case syntax.OpCapture, syntax.OpPlus:
+		return noMatch(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min > 0 && noMatch(re.Sub[0])
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if !noMatch(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpConcat:
+		for i, sub := range re.Sub {
+			if noMatch(sub) {
+				return true
+			}
+			// Nothing is matched after the end of the text, or before its
+			// beginning.
+			if sub.Op == syntax.OpEndText && minLen(re.Sub[i+1:]...) > 0 {
+				return true
+			}
+			if sub.Op == syntax.OpBeginText && minLen(re.Sub[:i]...) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// minLen returns the fewest characters that the concatenation of the
+// regular expressions res can match.
+func minLen(res ...*syntax.Regexp) int {
+	l := 0
+	for _, re := range res {
+		switch re.Op {
+		case syntax.OpLiteral:
+			l += len(re.Rune)
+		case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+			l++
+		case syntax.OpCapture, syntax.OpPlus:
+			l += minLen(re.Sub[0])
+		case syntax.OpRepeat:
+			l += re.Min * minLen(re.Sub[0])
+		case syntax.OpConcat:
+			l += minLen(re.Sub...)
+		case syntax.OpAlternate:
+			m := minLen(re.Sub[0])
+			for _, sub := range re.Sub[1:] {
+				if s := minLen(sub); s < m {
+					m = s
+				}
+			}
+			l += m
+		}
+	}
+	return l
 }
 
 // VisitBefore performs most of the symbol table construction, so that symbols
@@ -51,9 +301,40 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		return c, n
 
 	case *ast.CondStmt:
+		// Capture groups of the condition are visible in its block and any
+		// conditions nested within, and in the else block, where they are
+		// unset because the condition didn't match.
 		n.Scope = symbol.NewScope(c.scope)
 		c.scope = n.Scope
-		return c, n
+		if n.Cond != nil {
+			n.Cond = ast.Walk(c, n.Cond)
+			c.checkReachable(n)
+		}
+		n.Truth = ast.Walk(c, n.Truth)
+		if n.Else != nil {
+			c.unmatched = append(c.unmatched, n.Scope)
+			n.Else = ast.Walk(c, n.Else)
+			c.unmatched = c.unmatched[:len(c.unmatched)-1]
+		}
+		c.checkSymbolUsage()
+		// Pop the scope.
+		c.scope = n.Scope.Parent
+		return nil, n
+
+	case *ast.TernaryExpr:
+		// As with conditional statements, the condition's capture groups
+		// are unset in the else branch.
+		n.Scope = symbol.NewScope(c.scope)
+		c.scope = n.Scope
+		n.Cond = ast.Walk(c, n.Cond)
+		n.Truth = ast.Walk(c, n.Truth)
+		c.unmatched = append(c.unmatched, n.Scope)
+		n.Else = ast.Walk(c, n.Else)
+		c.unmatched = c.unmatched[:len(c.unmatched)-1]
+		c.checkSymbolUsage()
+		// Pop the scope.
+		c.scope = n.Scope.Parent
+		return nil, c.VisitAfter(n)
 
 	case *ast.CaprefTerm:
 		if n.Symbol == nil {
@@ -69,6 +350,7 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			} else {
 				sym.Used = true
 				n.Symbol = sym
+				c.checkUnmatched(n)
 			}
 		}
 		return c, n
@@ -79,22 +361,76 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of metric `%s' previously declared at %s", n.Name, alt.Pos))
 			return nil, n
 		}
+		c.decls = append(c.decls, n)
+		c.checkNormalizers(n)
+		c.checkUnit(n)
 		var rType types.Type
 		switch n.Kind {
-		case metrics.Counter, metrics.Gauge, metrics.Timer, metrics.Histogram:
+		case metrics.Counter, metrics.Gauge, metrics.Timer, metrics.Histogram, metrics.Summary, metrics.Unique:
 			// TODO(jaq): This should be a numeric type, unless we want to
 			// enforce more specific rules like "Counter can only be Int."
 			rType = types.NewVariable()
 		case metrics.Text:
 			rType = types.String
+		case metrics.Bool:
+			rType = types.Bool
+		case metrics.EWMA, metrics.Min, metrics.Max, metrics.Stddev:
+			rType = types.Float
 		default:
 			c.errors.Add(n.Pos(), fmt.Sprintf("internal compiler error: unrecognised Kind %v for declNode %v", n.Kind, n))
 			return nil, n
 		}
+		if n.Kind == metrics.Text && !n.Hidden {
+			for _, k := range n.Keys {
+				if k == "value" {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Text metric `%s' can't have the dimension `value', which holds its text when exported to Prometheus.", n.Name))
+				}
+			}
+		}
 		if len(n.Buckets) > 0 && n.Kind != metrics.Histogram {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify buckets for non-histogram metric `%s'.", n.Name))
 			return nil, n
 		}
+		if len(n.Quantiles) > 0 && n.Kind != metrics.Summary {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify quantiles for non-summary metric `%s'.", n.Name))
+			return nil, n
+		}
+		if n.Kind == metrics.Summary && len(n.Quantiles) == 0 {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Summary metric `%s' needs at least one quantile.", n.Name))
+			return nil, n
+		}
+		for _, q := range n.Quantiles {
+			if q <= 0 || q >= 1 {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Quantile %g of summary metric `%s' is not between 0 and 1.", q, n.Name))
+				return nil, n
+			}
+		}
+		if n.HalfLife > 0 && n.Kind != metrics.EWMA {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify a half-life for non-ewma metric `%s'.", n.Name))
+			return nil, n
+		}
+		if n.Kind == metrics.EWMA && n.HalfLife <= 0 {
+			c.errors.Add(n.Pos(), fmt.Sprintf("EWMA metric `%s' needs a half-life, e.g. `halflife 1m'.", n.Name))
+			return nil, n
+		}
+		if n.Interval > 0 {
+			if _, ok := aggregateKinds[n.Kind]; !ok {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify an aggregation interval for metric `%s' that isn't a min, max or stddev metric.", n.Name))
+				return nil, n
+			}
+		}
+		if n.TopK > 0 && len(n.Keys) == 0 {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't track the top label values of metric `%s' with no keys.", n.Name))
+			return nil, n
+		}
+		if n.Limit > 0 && (len(n.Keys) == 0 || n.TopK > 0) {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't limit the label values of metric `%s' with no keys, or of a top-k metric.", n.Name))
+			return nil, n
+		}
+		if n.Expiry > 0 && len(n.Keys) == 0 {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify an expiry for metric `%s' with no keys.", n.Name))
+			return nil, n
+		}
 		if len(n.Keys) > 0 {
 			// One type per key
 			keyTypes := make([]types.Type, 0, len(n.Keys))
@@ -109,9 +445,41 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 		return c, n
 
+	case *ast.LetStmt:
+		// The local variable is declared after its value, which can't refer
+		// to it.
+		n.Expr = ast.Walk(c, n.Expr)
+		if m := c.scope.Lookup(n.Name, symbol.VarSymbol); m != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Local variable `%s' hides the metric declared at %s.", n.Name, m.Pos))
+			return nil, n
+		}
+		n.Symbol = symbol.NewSymbol(n.Name, symbol.LocalSymbol, n.Pos())
+		if alt := c.scope.Insert(n.Symbol); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of local variable `%s' previously declared at %s", n.Name, alt.Pos))
+			return nil, n
+		}
+		t := n.Expr.Type()
+		if types.IsErrorType(t) {
+			return nil, n
+		}
+		if types.Equals(t, types.None) || types.Equals(t, types.Pattern) {
+			c.errors.Add(n.Expr.Pos(), fmt.Sprintf("Can't set local variable `%s' to an expression of type %s.", n.Name, t))
+			return nil, n
+		}
+		n.Symbol.Type = t
+		return nil, n
+
 	case *ast.IdTerm:
 		if n.Symbol == nil {
-			if sym := c.scope.Lookup(n.Name, symbol.VarSymbol); sym != nil {
+			if sym := c.scope.Lookup(n.Name, symbol.ParamSymbol); sym != nil {
+				glog.V(2).Infof("found param %v", sym)
+				sym.Used = true
+				n.Symbol = sym
+			} else if sym := c.scope.Lookup(n.Name, symbol.LocalSymbol); sym != nil {
+				glog.V(2).Infof("found local %v", sym)
+				sym.Used = true
+				n.Symbol = sym
+			} else if sym := c.scope.Lookup(n.Name, symbol.VarSymbol); sym != nil {
 				glog.V(2).Infof("found sym %v", sym)
 				sym.Used = true
 				n.Symbol = sym
@@ -133,6 +501,26 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 		return c, n
 
+	case *ast.LookupDecl:
+		n.Symbol = symbol.NewSymbol(n.Name, symbol.LookupSymbol, n.Pos())
+		n.Symbol.Binding = n
+		if alt := c.scope.Insert(n.Symbol); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of lookup table `%s' previously declared at %s", n.Name, alt.Pos))
+			return nil, n
+		}
+		n.Symbol.Type = types.Map(types.String, types.String)
+		return c, n
+
+	case *ast.LookupExpr:
+		if sym := c.scope.Lookup(n.Name, symbol.LookupSymbol); sym != nil {
+			sym.Used = true
+			n.Symbol = sym
+		} else {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Lookup table `%s' not declared.\n\tTry adding `lookup %s from \"...\"' earlier in the program.", n.Name, n.Name))
+			return nil, n
+		}
+		return c, n
+
 	case *ast.DecoDecl:
 		n.Symbol = symbol.NewSymbol(n.Name, symbol.DecoSymbol, n.Pos())
 		n.Symbol.Binding = n
@@ -163,6 +551,99 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		c.scope = n.Scope
 		return c, n
 
+	case *ast.FuncDecl:
+		n.Symbol = symbol.NewSymbol(n.Name, symbol.FuncSymbol, n.Pos())
+		n.Symbol.Binding = n
+		if alt := c.scope.Insert(n.Symbol); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of function `%s' previously declared at %s", n.Name, alt.Pos))
+			return nil, n
+		}
+		// The parameters are declared in their own scope enclosing the
+		// function block.  Their types are inferred from the function body
+		// and the arguments of each call.
+		n.Scope = symbol.NewScope(c.scope)
+		for _, p := range n.Params {
+			p.Symbol = symbol.NewSymbol(p.Name, symbol.ParamSymbol, p.Pos())
+			p.Symbol.Type = types.NewVariable()
+			if alt := n.Scope.Insert(p.Symbol); alt != nil {
+				c.errors.Add(p.Pos(), fmt.Sprintf("Redeclaration of parameter `%s' previously declared at %s", p.Name, alt.Pos))
+				return nil, n
+			}
+		}
+		c.scope = n.Scope
+		c.funcs = append(c.funcs, n)
+		return c, n
+
+	case *ast.FuncCall:
+		sym := c.scope.Lookup(n.Name, symbol.FuncSymbol)
+		if sym == nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Function `%s' not defined.\n\tTry adding a definition `def %s() {}' earlier in the program.", n.Name, n.Name))
+			c.checkArgs(n)
+			return nil, n
+		}
+		if sym.Binding == nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Internal error: Function %q not bound to its definition.", n.Name))
+			n.SetType(types.Error)
+			return nil, n
+		}
+		sym.Used = true
+		n.Decl = sym.Binding.(*ast.FuncDecl)
+		// Calls are inlined, so they can't recurse.
+		for _, f := range c.funcs {
+			if f == n.Decl {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Recursive call to function `%s' is not allowed.", n.Name))
+				c.checkArgs(n)
+				return nil, n
+			}
+		}
+		return c, n
+
+	case *ast.BuiltinExpr:
+		args, ok := n.Args.(*ast.ExprList)
+		if !ok || len(args.Children) == 0 {
+			return c, n
+		}
+		if id := plainIdTerm(args.Children[0]); id != nil && n.Name == "subst" {
+			// A pattern constant on its own is a pattern expression.
+			if c.scope.Lookup(id.Name, symbol.PatternSymbol) != nil {
+				args.Children[0] = &ast.PatternExpr{Expr: id}
+			}
+		}
+		pe, ok := args.Children[0].(*ast.PatternExpr)
+		if !ok {
+			return c, n
+		}
+		if n.Name != "subst" {
+			c.errors.Add(pe.Pos(), fmt.Sprintf("call to `%s': can't use a pattern as an argument", n.Name))
+			n.SetType(types.Error)
+			return nil, n
+		}
+		// The pattern only describes the text to be replaced, so its capture
+		// groups are not defined in the rest of the block.
+		pe.Expr = ast.Walk(c, pe.Expr)
+		if c.evaluatePattern(pe) {
+			if _, err := syntax.Parse(pe.Pattern, syntax.Perl); err != nil {
+				c.errors.Add(pe.Pos(), err.Error())
+			}
+		}
+		for i, arg := range args.Children[1:] {
+			args.Children[i+1] = ast.Walk(c, arg)
+		}
+		n.Args = c.VisitAfter(args)
+		return nil, c.VisitAfter(n)
+
+	case *ast.IndexedExpr:
+		if b, ok := n.Lhs.(*ast.BuiltinExpr); ok {
+			c.indexedBuiltins[b] = true
+		}
+		return c, n
+
+	case *ast.BinaryExpr:
+		if b, ok := n.Rhs.(*ast.BuiltinExpr); ok && n.Op == parser.ASSIGN {
+			c.assignedBuiltins[b] = n.Lhs
+		}
+		return c, n
+
 	case *ast.PatternFragment:
 		id, ok := n.Id.(*ast.IdTerm)
 		if !ok {
@@ -179,9 +660,35 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		return c, n
 
 	case *ast.DelStmt:
+		if ie, ok := n.N.(*ast.IndexedExpr); ok {
+			if args, ok := ie.Index.(*ast.ExprList); ok {
+				for _, arg := range args.Children {
+					if w, ok := arg.(*ast.WildcardTerm); ok {
+						w.InDel = true
+					}
+				}
+			}
+		}
 		n.N = ast.Walk(c, n.N)
 		return c, n
 
+	case *ast.NamespaceStmt:
+		c.checkNamespace(n)
+		return nil, n
+
+	case *ast.TimezoneStmt:
+		c.checkTimezone(n)
+		return nil, n
+
+	case *ast.WildcardTerm:
+		if !n.InDel {
+			c.errors.Add(n.Pos(), "Wildcard `*' can only be a key of a `del' statement.")
+			n.SetType(types.Error)
+			return nil, n
+		}
+		n.SetType(types.NewVariable())
+		return nil, n
+
 	}
 	return c, node
 }
@@ -189,17 +696,26 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 // checkSymbolUsage emits errors if any eligible symbols in the current scope
 // are not marked as used.
 func (c *checker) checkSymbolUsage() {
+	// A named capture group is in the scope under its number too.
+	seen := make(map[*symbol.Symbol]struct{})
 	for _, sym := range c.scope.Symbols {
 		if !sym.Used {
-			// Users don't have control over the patterns given from decorators
-			// so this should never be an error; but it can be useful to know
-			// if a program is doing unnecessary work.
 			if sym.Kind == symbol.CaprefSymbol {
 				if sym.Addr == 0 {
 					// Don't warn about the zeroth capture group; it's not user-defined.
 					continue
 				}
-				glog.Infof("declaration of capture group reference `%s' at %s appears to be unused", sym.Name, sym.Pos)
+				if _, ok := seen[sym]; ok {
+					continue
+				}
+				seen[sym] = struct{}{}
+				// The capture groups of a decorator's pattern may be used by
+				// the blocks it decorates, which haven't been checked yet.
+				if len(c.decoScopes) > 0 {
+					glog.V(1).Infof("declaration of capture group reference `%s' at %s appears to be unused", sym.Name, sym.Pos)
+					continue
+				}
+				c.warn(sym.Pos, errors.Unused, fmt.Sprintf("Capture group `$%s' is never used", sym.Name))
 				continue
 			}
 			c.errors.Add(sym.Pos, fmt.Sprintf("Declaration of %s `%s' is never used", sym.Kind, sym.Name))
@@ -217,12 +733,6 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		c.scope = n.Scope.Parent
 		return n
 
-	case *ast.CondStmt:
-		c.checkSymbolUsage()
-		// Pop the scope.
-		c.scope = n.Scope.Parent
-		return n
-
 	case *ast.DecoStmt:
 		// Don't check symbol usage here because the decorator is only partially defined.
 		// Pop the scope.
@@ -240,6 +750,120 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		decoScope.CopyFrom(c.scope)
 		return n
 
+	case *ast.FuncDecl:
+		// Check for unused parameters, then pop the parameter scope.
+		c.checkSymbolUsage()
+		c.scope = n.Scope.Parent
+		c.funcs = c.funcs[:len(c.funcs)-1]
+		if n.Returns == nil {
+			// No return statements were seen.
+			n.Returns = types.None
+		}
+		return n
+
+	case *ast.SwitchStmt:
+		c.checkSwitch(n)
+		return n
+
+	case *ast.LookupExpr:
+		// Keys are strings, so numbers are converted to look them up.
+		t := n.Key.Type()
+		switch {
+		case types.IsErrorType(t), types.Equals(t, types.String):
+		case canConvert(t, types.String):
+			conv := &ast.ConvExpr{N: n.Key}
+			conv.SetType(types.String)
+			n.Key = conv
+		default:
+			if err := types.Unify(types.String, t); err != nil {
+				c.errors.Add(n.Key.Pos(), fmt.Sprintf("type mismatch: lookup table key has type %s, expecting String", t))
+			}
+		}
+		return n
+
+	case *ast.MapExpr:
+		c.checkMap(n)
+		return n
+
+	case *ast.ImportStmt:
+		// Imported files are shared between programs, so a program need
+		// not use everything declared in them.
+		for _, sym := range c.scope.Symbols {
+			if sym.Pos != nil && sym.Pos.Filename == n.Path {
+				sym.Used = true
+			}
+		}
+		return n
+
+	case *ast.ReturnStmt:
+		if len(c.funcs) == 0 {
+			c.errors.Add(n.Pos(), "Can't use `return' statement outside of a function.")
+			return n
+		}
+		f := c.funcs[len(c.funcs)-1]
+		var t types.Type = types.None
+		if n.Expr != nil {
+			t = n.Expr.Type()
+			if types.IsErrorType(t) {
+				return n
+			}
+		}
+		if f.Returns == nil {
+			f.Returns = t
+			return n
+		}
+		if err := types.Unify(f.Returns, t); err != nil || !types.Equals(f.Returns, t) {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Function `%s' returns %s here, but %s elsewhere.", f.Name, t, f.Returns))
+		}
+		return n
+
+	case *ast.FuncCall:
+		var args []ast.Node
+		if a, ok := n.Args.(*ast.ExprList); ok {
+			args = a.Children
+		}
+		if len(args) != len(n.Decl.Params) {
+			c.errors.Add(n.Pos(), fmt.Sprintf("call to `%s': expecting %d arguments, received %d", n.Name, len(n.Decl.Params), len(args)))
+			n.SetType(types.Error)
+			return n
+		}
+		for i, arg := range args {
+			argT := arg.Type()
+			if types.IsErrorType(argT) {
+				n.SetType(types.Error)
+				return n
+			}
+			paramT := n.Decl.Params[i].Symbol.Type
+			if err := types.Unify(paramT, argT); err != nil {
+				c.errors.Add(arg.Pos(), fmt.Sprintf("call to `%s': argument %d: %s", n.Name, i+1, err))
+				n.SetType(types.Error)
+				return n
+			}
+			if !types.Equals(paramT, argT) {
+				// Convert the argument to the parameter type inferred
+				// from the function body or an earlier call.
+				if !canConvert(argT, paramT) {
+					c.errors.Add(arg.Pos(), fmt.Sprintf("call to `%s': can't use %s as argument %d, expecting %s", n.Name, argT, i+1, paramT))
+					n.SetType(types.Error)
+					return n
+				}
+				if !c.implicitConversion(arg, argT, paramT) {
+					n.SetType(types.Error)
+					return n
+				}
+				conv := &ast.ConvExpr{N: arg}
+				conv.SetType(paramT)
+				args[i] = conv
+			}
+		}
+		if n.Decl.Returns == nil {
+			// Still checking the function body.
+			n.SetType(types.Error)
+			return n
+		}
+		n.SetType(n.Decl.Returns)
+		return n
+
 	case *ast.DecoDecl:
 		// Pop the scope off the list, and insert it into this node.
 		last := len(c.decoScopes) - 1
@@ -264,6 +888,21 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			return n
 		}
 		switch n.Op {
+		case parser.DIV, parser.MOD, parser.MUL, parser.MINUS, parser.PLUS, parser.POW, parser.LT, parser.GT, parser.LE, parser.GE, parser.EQ, parser.NE:
+			// An untyped builtin value used with a number is a number.
+			if isNumeric(rT) {
+				lT = untypedBuiltinToFloat(n.Lhs)
+			}
+			if isNumeric(lT) {
+				rT = untypedBuiltinToFloat(n.Rhs)
+			}
+		case parser.ASSIGN, parser.ADD_ASSIGN:
+			// An untyped builtin value stored in an untyped metric is a number.
+			if isVariable(lT) {
+				rT = untypedBuiltinToFloat(n.Rhs)
+			}
+		}
+		switch n.Op {
 		case parser.DIV, parser.MOD, parser.MUL, parser.MINUS, parser.PLUS, parser.POW:
 			// Numeric
 			// O ⊢ e1 : Tl, O ⊢ e2 : Tr
@@ -290,6 +929,10 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			}
 			// Implicit type conversion for non-comparisons, promoting each
 			// half to the return type of the op.
+			if !c.implicitConversion(n.Lhs, lT, rType) || !c.implicitConversion(n.Rhs, rT, rType) {
+				n.SetType(types.Error)
+				return n
+			}
 			if !types.Equals(rType, lT) {
 				conv := &ast.ConvExpr{N: n.Lhs}
 				conv.SetType(rType)
@@ -311,7 +954,14 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			err := types.Unify(exprType, astType)
 			if err != nil {
 				c.errors.Add(n.Pos(), err.Error())
-				c.errors.Add(n.Pos(), fmt.Sprintf("Integer types expected for bitwise op %q, got %s and %s", n.Op, lT, rT))
+				c.errors.Add(n.Pos(), fmt.Sprintf("Integer types expected for bitwise op `%s', got %s and %s", bitwiseOps[n.Op], lT, rT))
+				n.SetType(types.Error)
+				return n
+			}
+			// Unify promotes an Int to a Float, so check the operands are
+			// not Float.
+			if !types.Equals(types.LeastUpperBound(lT, rType), rType) || !types.Equals(types.LeastUpperBound(rT, rType), rType) {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Integer types expected for bitwise op `%s', got %s and %s", bitwiseOps[n.Op], lT, rT))
 				n.SetType(types.Error)
 				return n
 			}
@@ -338,6 +988,10 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 			// Promote types if the ast types are not the same as the expression type.
+			if !c.implicitConversion(n.Lhs, lT, t) || !c.implicitConversion(n.Rhs, rT, t) {
+				n.SetType(types.Error)
+				return n
+			}
 			if !types.Equals(t, lT) {
 				conv := &ast.ConvExpr{N: n.Lhs}
 				conv.SetType(t)
@@ -355,10 +1009,41 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			// O ⊢ e1 : Tl, O ⊢ e2 : Tr
 			// Tr <= Tl
 			// ⇒ O ⊢ e : Tl
+			if name, ok := localVariable(n.Lhs); ok {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't assign to local variable `%s'.\n\tTry declaring a new one with `let'.", name))
+				n.SetType(types.Error)
+				return n
+			}
 			glog.V(2).Infof("lt %q, rt %q", lT, rT)
+			// Bool metrics can only be set, and only to a condition.
+			if types.Equals(lT, types.Bool) {
+				if n.Op == parser.ADD_ASSIGN {
+					c.errors.Add(n.Pos(), "Can't add to a bool metric, only assign a condition to it.")
+					n.SetType(types.Error)
+					return n
+				}
+				if isVariable(rT) || !types.Equals(types.LeastUpperBound(types.Bool, rT), types.Bool) {
+					c.errors.Add(n.Pos(), fmt.Sprintf("type mismatch: can't assign %s to a bool metric, expecting a condition", rT))
+					n.SetType(types.Error)
+					return n
+				}
+			}
+			// EWMA, unique and aggregating metrics can only be set, as each
+			// value is an observation.
+			if _, d := c.metricDecl(n.Lhs); d != nil && n.Op == parser.ADD_ASSIGN {
+				if what, ok := observedKinds[d.Kind]; ok {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Can't add to %s, only assign an observation to it.", what))
+					n.SetType(types.Error)
+					return n
+				}
+			}
 			rType = lT
 			// TODO(jaq): the rT <= lT relationship is not correctly encoded here.
 			t := types.LeastUpperBound(lT, rT)
+			if !c.implicitConversion(n.Rhs, rT, t) || !c.implicitConversion(n.Lhs, lT, t) {
+				n.SetType(types.Error)
+				return n
+			}
 			err := types.Unify(rType, t)
 			if err != nil {
 				// Commented because these type mismatch errors appear to be unhelpful.
@@ -371,6 +1056,11 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				v.Lvalue = true
 			case *ast.IndexedExpr:
 				v.Lhs.(*ast.IdTerm).Lvalue = true
+				if sym := v.Lhs.(*ast.IdTerm).Symbol; sym != nil && sym.Kind == symbol.ParamSymbol {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Can't assign to function parameter `%s'.", sym.Name))
+					n.SetType(types.Error)
+					return n
+				}
 			}
 
 		case parser.CONCAT:
@@ -386,6 +1076,11 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			}
 
 		case parser.MATCH, parser.NOT_MATCH:
+			if pe, ok := n.Rhs.(*ast.PatternExpr); ok && pe.SyslogPriority {
+				c.errors.Add(n.Rhs.Pos(), "The syslog priority flag `p' can only be used in a pattern matched against the log line.")
+				n.SetType(types.Error)
+				return n
+			}
 			rType = types.Bool
 			exprType := types.Function(types.NewVariable(), types.Pattern, rType)
 			astType := types.Function(lT, rT, types.NewVariable())
@@ -405,6 +1100,46 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		n.SetType(rType)
 		return n
 
+	case *ast.TernaryExpr:
+		cT, tT, eT := n.Cond.Type(), n.Truth.Type(), n.Else.Type()
+		if types.IsErrorType(cT) || types.IsErrorType(tT) || types.IsErrorType(eT) {
+			n.SetType(types.Error)
+			return n
+		}
+		if err := types.Unify(types.Bool, cT); err != nil || !types.Equals(types.LeastUpperBound(types.Bool, cT), types.Bool) {
+			c.errors.Add(n.Cond.Pos(), fmt.Sprintf("type mismatch: ternary condition has type %s, expecting a condition", cT))
+			n.SetType(types.Error)
+			return n
+		}
+		// An untyped builtin value in one branch takes the type of the other,
+		// so that both are converted the same way once the type is known.
+		if isVariable(tT) || isVariable(eT) {
+			_ = types.Unify(tT, eT)
+		}
+		rType := types.LeastUpperBound(tT, eT)
+		if types.IsErrorType(rType) {
+			c.errors.Add(n.Pos(), fmt.Sprintf("type mismatch: %q and %q have no common type", tT, eT))
+			n.SetType(rType)
+			return n
+		}
+		// Promote the branches to the type of the expression.
+		if !c.implicitConversion(n.Truth, tT, rType) || !c.implicitConversion(n.Else, eT, rType) {
+			n.SetType(types.Error)
+			return n
+		}
+		if !types.Equals(rType, tT) {
+			conv := &ast.ConvExpr{N: n.Truth}
+			conv.SetType(rType)
+			n.Truth = conv
+		}
+		if !types.Equals(rType, eT) {
+			conv := &ast.ConvExpr{N: n.Else}
+			conv.SetType(rType)
+			n.Else = conv
+		}
+		n.SetType(rType)
+		return n
+
 	case *ast.UnaryExpr:
 		t := n.Expr.Type()
 		if types.IsErrorType(t) {
@@ -412,6 +1147,14 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			return n
 		}
 		switch n.Op {
+		case parser.LNOT:
+			// Only conditions can be negated.
+			if err := types.Unify(types.Bool, t); err != nil || !types.Equals(types.LeastUpperBound(types.Bool, t), types.Bool) {
+				c.errors.Add(n.Expr.Pos(), fmt.Sprintf("type mismatch: can't use `!' on %s, expecting a condition", t))
+				n.SetType(types.Error)
+				return n
+			}
+			n.SetType(types.Bool)
 		case parser.NOT:
 			rType := types.Int
 			err := types.Unify(rType, t)
@@ -423,6 +1166,23 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			}
 			n.SetType(rType)
 		case parser.INC, parser.DEC:
+			if name, ok := localVariable(n.Expr); ok {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't modify local variable `%s'.\n\tTry declaring a new one with `let'.", name))
+				n.SetType(types.Error)
+				return n
+			}
+			if types.Equals(t, types.Bool) {
+				c.errors.Add(n.Pos(), "Can't increment or decrement a bool metric, only assign a condition to it.")
+				n.SetType(types.Error)
+				return n
+			}
+			if _, d := c.metricDecl(n.Expr); d != nil {
+				if what, ok := observedKinds[d.Kind]; ok {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Can't increment or decrement %s, only assign an observation to it.", what))
+					n.SetType(types.Error)
+					return n
+				}
+			}
 			rType := types.Int
 			err := types.Unify(rType, t)
 			if err != nil {
@@ -437,6 +1197,11 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				v.Lvalue = true
 			case *ast.IndexedExpr:
 				v.Lhs.(*ast.IdTerm).Lvalue = true
+				if sym := v.Lhs.(*ast.IdTerm).Symbol; sym != nil && sym.Kind == symbol.ParamSymbol {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Can't modify function parameter `%s'.", sym.Name))
+					n.SetType(types.Error)
+					return n
+				}
 			}
 
 		default:
@@ -494,6 +1259,9 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				}
 				return n
 			}
+		case *ast.BuiltinExpr:
+			c.checkBuiltinIndex(n, v, argTypes)
+			return n
 		default:
 			c.errors.Add(n.Pos(), fmt.Sprintf("Index taken on unindexable expression"))
 			n.SetType(types.Error)
@@ -538,8 +1306,27 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		rType := types.NewVariable()
 		typs = append(typs, rType)
 
+		if conversionBuiltins[n.Name] && len(typs) != 2 {
+			pos := n.Pos()
+			if n.Args != nil {
+				pos = n.Args.Pos()
+			}
+			c.errors.Add(pos, fmt.Sprintf("call to `%s': expecting 1 argument, received %d", n.Name, len(typs)-1))
+			n.SetType(types.Error)
+			return n
+		}
+
 		fn := types.Function(typs...)
 		fresh := types.FreshType(types.Builtins[n.Name])
+		if n.Name == "strptime" && len(typs) > 3 {
+			// Any further arguments are more formats to try, in order.
+			args := make([]types.Type, len(typs))
+			for i := range args {
+				args[i] = types.String
+			}
+			args[len(args)-1] = types.Bool
+			fresh = types.Function(args...)
+		}
 		err := types.Unify(fresh, fn)
 		if err != nil {
 			c.errors.Add(n.Pos(), fmt.Sprintf("call to `%s': %s", n.Name, err))
@@ -548,11 +1335,129 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		}
 		n.SetType(rType)
 
+		if t := rType.Root(); (types.IsList(t) || types.IsMap(t)) && !c.indexedBuiltins[n] {
+			kind, example := "list", "[0]"
+			if types.IsMap(t) {
+				kind, example = "map", `["key"]`
+			}
+			c.errors.Add(n.Pos(), fmt.Sprintf("call to `%s': the %s returned must be indexed, e.g. `%s(...)%s'", n.Name, kind, n.Name, example))
+			n.SetType(types.Error)
+			return n
+		}
+
+		if n.Name == "subst" {
+			// The text to replace can be a pattern or a string.
+			args := n.Args.(*ast.ExprList).Children
+			if t := typs[0]; !types.IsErrorType(t) && !types.Equals(t, types.Pattern) && !types.Equals(t, types.String) {
+				if !canConvert(t, types.String) {
+					c.errors.Add(args[0].Pos(), fmt.Sprintf("call to `subst': expecting a pattern or String to replace, received %s", t))
+					n.SetType(types.Error)
+					return n
+				}
+				conv := &ast.ConvExpr{N: args[0]}
+				conv.SetType(types.String)
+				args[0] = conv
+			}
+		}
+
+		if conversionBuiltins[n.Name] && n.Name != "bool" {
+			// A float can be truncated to an int only when asked for.
+			from, to := typs[0].Root(), rType.Root()
+			if types.IsComplete(from) && !types.IsErrorType(from) && !types.Equals(from, to) && !canConvert(from, to) && !(types.Equals(from, types.Float) && types.Equals(to, types.Int)) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("call to `%s': can't convert %s to %s", n.Name, from, to))
+				n.SetType(types.Error)
+				return n
+			}
+		}
+
+		if n.Name == "abs" {
+			if t := rType.Root(); types.Equals(t, types.String) || types.Equals(t, types.Bool) {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("call to `abs': expecting a numeric value, received %s.", t))
+				n.SetType(types.Error)
+				return n
+			}
+		}
+
+		if n.Name == "getenv" {
+			// The environment is read once when the program is loaded, so
+			// the variable must be known then.
+			arg := n.Args.(*ast.ExprList).Children[0]
+			if _, ok := arg.(*ast.StringLit); !ok {
+				c.errors.Add(arg.Pos(), "call to `getenv': the variable name must be a string constant.")
+				n.SetType(types.Error)
+				return n
+			}
+		}
+
+		if n.Name == "rate" || n.Name == "delta" {
+			// The window is kept for the metric named by the first argument,
+			// so the argument must name a metric, not compute a value.
+			args := n.Args.(*ast.ExprList).Children
+			id, decl := c.metricDecl(args[0])
+			if decl == nil || (decl.Kind != metrics.Counter && decl.Kind != metrics.Gauge && decl.Kind != metrics.Timer) {
+				c.errors.Add(args[0].Pos(), fmt.Sprintf("call to `%s': expecting a counter, gauge or timer.", n.Name))
+				n.SetType(types.Error)
+				return n
+			}
+			if t := args[0].Type(); types.Equals(t, types.String) || types.Equals(t, types.Bool) {
+				c.errors.Add(args[0].Pos(), fmt.Sprintf("call to `%s': expecting a numeric metric, received %s.", n.Name, t))
+				n.SetType(types.Error)
+				return n
+			}
+			if w, ok := args[1].(*ast.IntLit); !ok || w.I <= 0 {
+				c.errors.Add(args[1].Pos(), fmt.Sprintf("call to `%s': the window must be a positive constant number of seconds.", n.Name))
+				n.SetType(types.Error)
+				return n
+			}
+			id.Lvalue = true
+		}
+
+		if n.Name == "movavg" {
+			// The average is kept for the gauge it is assigned to.
+			args := n.Args.(*ast.ExprList).Children
+			lhs, assigned := c.assignedBuiltins[n]
+			if _, decl := c.metricDecl(lhs); decl == nil || decl.Kind != metrics.Gauge {
+				pos := args[0].Pos()
+				if assigned {
+					pos = lhs.Pos()
+				}
+				c.errors.Add(pos, "call to `movavg': the average must be assigned to a gauge, e.g. `g = movavg(x, 5m)'.")
+				n.SetType(types.Error)
+				return n
+			}
+			if t := args[0].Type(); types.Equals(t, types.String) || types.Equals(t, types.Bool) {
+				c.errors.Add(args[0].Pos(), fmt.Sprintf("call to `movavg': expecting a numeric value, received %s.", t))
+				n.SetType(types.Error)
+				return n
+			}
+			if w, ok := args[1].(*ast.IntLit); !ok || w.I <= 0 {
+				c.errors.Add(args[1].Pos(), "call to `movavg': the window must be a positive constant number of seconds.")
+				n.SetType(types.Error)
+				return n
+			}
+		}
+
+		if n.Name == "cidrmatch" {
+			// A network given as a constant can be checked now rather than
+			// failing on every line.
+			if s, ok := n.Args.(*ast.ExprList).Children[0].(*ast.StringLit); ok {
+				if _, _, err := net.ParseCIDR(s.Text); err != nil {
+					c.errors.Add(s.Pos(), fmt.Sprintf("call to `cidrmatch': %s", err))
+					n.SetType(types.Error)
+					return n
+				}
+			}
+		}
+
 		if n.Name == "strptime" {
-			// Second argument to strptime is the format string.  If it is
-			// defined at compile time, we can verify it can be use as a format
-			// string by parsing itself.
-			if f, ok := n.Args.(*ast.ExprList).Children[1].(*ast.StringLit); ok {
+			// The arguments after the first are the format strings.  If they
+			// are defined at compile time, we can verify they can be used as a
+			// format string by parsing themselves.
+			for _, arg := range n.Args.(*ast.ExprList).Children[1:] {
+				f, ok := arg.(*ast.StringLit)
+				if !ok {
+					continue
+				}
 				// Layout strings can contain an underscore to indicate a digit
 				// field if the layout field can contain two digits; but they
 				// won't parse themselves.  Zulu Timezones in the layout need
@@ -571,14 +1476,12 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		return n
 
 	case *ast.PatternExpr:
-		// Evaluate the expression.
-		pe := &patternEvaluator{scope: c.scope, errors: &c.errors}
-		n = ast.Walk(pe, n).(*ast.PatternExpr)
-		if pe.pattern == "" {
-			return n
+		if c.evaluatePattern(n) {
+			c.checkRegex(n.Pattern, n)
+			if n.SyslogPriority {
+				c.declareSyslogCaprefs(n)
+			}
 		}
-		n.Pattern = pe.pattern
-		c.checkRegex(pe.pattern, n)
 		return n
 
 	case *ast.PatternFragment:
@@ -600,6 +1503,132 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 	return node
 }
 
+// namespaceRe matches the namespaces that make valid metric names.
+var namespaceRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// checkNamespace checks that the namespace n is a valid metric name, and the
+// only one, given at the top level of the program before any metric is
+// declared, so that it applies to all of them.
+func (c *checker) checkNamespace(n *ast.NamespaceStmt) {
+	switch {
+	case c.scope == nil || c.scope.Parent != nil:
+		c.errors.Add(n.Pos(), "Can't use `namespace' inside a block.\n\tTry moving it to the top of the program.")
+	case c.namespace != nil:
+		c.errors.Add(n.Pos(), fmt.Sprintf("Redefinition of the program's namespace, previously defined at %s", c.namespace.Pos()))
+	case len(c.decls) > 0:
+		c.errors.Add(n.Pos(), fmt.Sprintf("Namespace `%s' must come before the metric declarations.\n\tTry moving it above the declaration of `%s' at %s.", n.Name, c.decls[0].Name, c.decls[0].Pos()))
+	case !namespaceRe.MatchString(n.Name):
+		c.errors.Add(n.Pos(), fmt.Sprintf("Namespace `%s' is not a valid metric name prefix.\n\tUse only letters, digits, and underscores.", n.Name))
+	default:
+		c.namespace = n
+	}
+}
+
+// checkTimezone checks that the timezone n is a known location, and the only
+// one, given at the top level of the program.
+func (c *checker) checkTimezone(n *ast.TimezoneStmt) {
+	switch {
+	case c.scope == nil || c.scope.Parent != nil:
+		c.errors.Add(n.Pos(), "Can't use `timezone' inside a block.\n\tTry moving it to the top of the program.")
+	case c.timezone != nil:
+		c.errors.Add(n.Pos(), fmt.Sprintf("Redefinition of the program's timezone, previously defined at %s", c.timezone.Pos()))
+	default:
+		if _, err := time.LoadLocation(n.Name); err != nil || n.Name == "" {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Unknown timezone `%s'.\n\tTry a name from the IANA time zone database, like \"America/New_York\" or \"UTC\".", n.Name))
+			return
+		}
+		c.timezone = n
+	}
+}
+
+// checkArgs checks the arguments of a function call that can't be made, so
+// that errors in and uses of symbols by the arguments are still found.
+func (c *checker) checkArgs(n *ast.FuncCall) {
+	if n.Args != nil {
+		n.Args = ast.Walk(c, n.Args)
+	}
+	n.SetType(types.Error)
+}
+
+// checkSwitch checks that the case values of a switch statement are distinct
+// constants of one type, and converts the switch expression to that type.
+func (c *checker) checkSwitch(n *ast.SwitchStmt) {
+	var caseType types.Type
+	seen := make(map[interface{}]struct{})
+	hasDefault := false
+	for _, cc := range n.Cases {
+		if cc.Values == nil {
+			if hasDefault {
+				c.errors.Add(cc.Pos(), "Can't have more than one `default' clause in a switch statement.")
+			}
+			hasDefault = true
+			continue
+		}
+		for _, v := range cc.Values.(*ast.ExprList).Children {
+			var key interface{}
+			switch v := v.(type) {
+			case *ast.StringLit:
+				key = v.Text
+			case *ast.IntLit:
+				key = v.I
+			default:
+				c.errors.Add(v.Pos(), "Case values must be string or integer constants.")
+				continue
+			}
+			if caseType == nil {
+				caseType = v.Type()
+			} else if !types.Equals(caseType, v.Type()) {
+				c.errors.Add(v.Pos(), fmt.Sprintf("type mismatch: case value has type %s, expecting %s", v.Type(), caseType))
+				continue
+			}
+			if _, ok := seen[key]; ok {
+				c.errors.Add(v.Pos(), fmt.Sprintf("Duplicate case value %v in switch statement.", key))
+			}
+			seen[key] = struct{}{}
+		}
+	}
+	exprType := n.Expr.Type()
+	if caseType == nil || types.IsErrorType(exprType) {
+		return
+	}
+	if err := types.Unify(exprType, caseType); err == nil && types.Equals(exprType, caseType) {
+		return
+	}
+	if !canConvert(exprType, caseType) {
+		c.errors.Add(n.Expr.Pos(), fmt.Sprintf("type mismatch: can't switch on %s with %s case values", exprType, caseType))
+		return
+	}
+	if !c.implicitConversion(n.Expr, exprType, caseType) {
+		return
+	}
+	conv := &ast.ConvExpr{N: n.Expr}
+	conv.SetType(caseType)
+	n.Expr = conv
+}
+
+// conversionBuiltins are the builtins that convert their one argument to
+// another type.
+var conversionBuiltins = map[string]bool{
+	"bool":   true,
+	"int":    true,
+	"float":  true,
+	"string": true,
+}
+
+// canConvert returns true if a value of type from can be converted to type to
+// when passed as a function argument.
+func canConvert(from, to types.Type) bool {
+	switch {
+	case types.Equals(types.Int, from):
+		return types.Equals(types.Float, to) || types.Equals(types.String, to)
+	case types.Equals(types.Float, from):
+		return types.Equals(types.String, to)
+	case types.Equals(types.String, from):
+		return types.Equals(types.Int, to) || types.Equals(types.Float, to)
+	}
+	return false
+}
+
 // checkRegex is a helper method to compile and check a regular expression, and
 // to generate its capture groups as symbols.
 func (c *checker) checkRegex(pattern string, n ast.Node) {
@@ -618,6 +1647,11 @@ func (c *checker) checkRegex(pattern string, n ast.Node) {
 				// No return, let this loop collect all errors
 			}
 			if capref != "" {
+				if c.scope.Parent != nil {
+					if alt := c.scope.Parent.Lookup(capref, symbol.CaprefSymbol); alt != nil {
+						c.warn(n.Pos(), errors.Shadow, fmt.Sprintf("Capture group `$%s' hides the one declared at %s", capref, alt.Pos))
+					}
+				}
 				sym.Name = capref
 				if alt := c.scope.InsertAlias(sym, capref); alt != nil {
 					c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of capture group `%s' previously declared at %s", sym.Name, alt.Pos))
@@ -631,12 +1665,305 @@ func (c *checker) checkRegex(pattern string, n ast.Node) {
 	}
 }
 
+// syslogCaprefs are the capture groups defined by a pattern with the syslog
+// priority flag, in the order the VM appends them to the pattern's matches.
+var syslogCaprefs = []string{"syslog_severity", "syslog_facility"}
+
+// normalizerHasArg says whether each normalizer of metric keys takes a
+// number.
+var normalizerHasArg = map[string]bool{
+	"lowercase":   false,
+	"uppercase":   false,
+	"strip_query": false,
+	"max_len":     true,
+}
+
+// checkNormalizers checks the normalizers of the keys of the metric n.
+func (c *checker) checkNormalizers(n *ast.VarDecl) {
+	for _, k := range n.Keys {
+		for _, nz := range n.Normalizers[k] {
+			hasArg, ok := normalizerHasArg[nz.Name]
+			switch {
+			case !ok:
+				c.errors.Add(nz.Pos(), fmt.Sprintf("Unknown normalizer `%s' of key `%s'.\n\tTry one of lowercase, uppercase, strip_query or max_len.", nz.Name, k))
+			case hasArg && (!nz.HasArg || nz.Arg <= 0):
+				c.errors.Add(nz.Pos(), fmt.Sprintf("Normalizer `%s' of key `%s' needs a positive length, like `%s 64'.", nz.Name, k, nz.Name))
+			case !hasArg && nz.HasArg:
+				c.errors.Add(nz.Pos(), fmt.Sprintf("Normalizer `%s' of key `%s' takes no argument.", nz.Name, k))
+			}
+		}
+	}
+}
+
+// unitRe matches the names of units allowed by OpenMetrics.
+var unitRe = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// baseUnits gives the base unit to use in place of each common scaled or
+// abbreviated unit, as OpenMetrics expects metrics to be in base units.
+var baseUnits = map[string]string{
+	"nanoseconds":  "seconds",
+	"microseconds": "seconds",
+	"milliseconds": "seconds",
+	"minutes":      "seconds",
+	"hours":        "seconds",
+	"days":         "seconds",
+	"ns":           "seconds",
+	"us":           "seconds",
+	"ms":           "seconds",
+	"s":            "seconds",
+	"second":       "seconds",
+	"bits":         "bytes",
+	"kilobytes":    "bytes",
+	"megabytes":    "bytes",
+	"gigabytes":    "bytes",
+	"kb":           "bytes",
+	"mb":           "bytes",
+	"gb":           "bytes",
+	"byte":         "bytes",
+	"percent":      "ratio",
+	"kilometers":   "meters",
+	"millimeters":  "meters",
+	"milliamperes": "amperes",
+	"millivolts":   "volts",
+	"kilowatts":    "watts",
+	"kilograms":    "grams",
+	"fahrenheit":   "celsius",
+}
+
+// checkUnit checks that the unit of the metric n, if any, is a base unit of
+// a metric whose values can have one.
+func (c *checker) checkUnit(n *ast.VarDecl) {
+	if n.Unit == "" {
+		return
+	}
+	switch n.Kind {
+	case metrics.Text, metrics.Bool, metrics.Unique:
+		c.errors.Add(n.Pos(), fmt.Sprintf("A %s metric can't have a unit.", strings.ToLower(n.Kind.String())))
+		return
+	}
+	if base, ok := baseUnits[n.Unit]; ok {
+		c.errors.Add(n.Pos(), fmt.Sprintf("Unit `%s' of metric `%s' is not a base unit.\n\tTry `unit %s', and convert the values to %s.", n.Unit, n.Name, base, base))
+		return
+	}
+	if !unitRe.MatchString(n.Unit) {
+		c.errors.Add(n.Pos(), fmt.Sprintf("Unit `%s' of metric `%s' must be lowercase letters, digits and underscores.", n.Unit, n.Name))
+	}
+}
+
+// checkMap checks the value and cases of the map expression n.  Like the keys
+// of lookup tables, numbers are converted to strings to be matched.
+func (c *checker) checkMap(n *ast.MapExpr) {
+	t := n.Expr.Type()
+	switch {
+	case types.IsErrorType(t), types.Equals(t, types.String):
+	case canConvert(t, types.String):
+		conv := &ast.ConvExpr{N: n.Expr}
+		conv.SetType(types.String)
+		n.Expr = conv
+	default:
+		if err := types.Unify(types.String, t); err != nil {
+			c.errors.Add(n.Expr.Pos(), fmt.Sprintf("type mismatch: can't map a value of type %s, expecting String", t))
+		}
+	}
+	var def *ast.MapCase
+	for _, mc := range n.Cases {
+		if mc.Default {
+			if def != nil {
+				c.errors.Add(mc.Pos(), fmt.Sprintf("Duplicate default case of map expression, previously at %s", def.Pos()))
+			}
+			def = mc
+			continue
+		}
+		if _, err := syntax.Parse(mc.Pattern, syntax.Perl); err != nil {
+			c.errors.Add(mc.Pos(), err.Error())
+		}
+	}
+	if def == nil {
+		c.errors.Add(n.Pos(), "Map expression has no default case.\n\tTry adding `default: \"other\"' for the values no pattern matches.")
+	}
+}
+
+// declareSyslogCaprefs declares the capture groups holding the severity and
+// facility of the syslog priority matched before the pattern n, numbered
+// after the pattern's own groups.
+func (c *checker) declareSyslogCaprefs(n *ast.PatternExpr) {
+	reAst, err := syntax.Parse(n.Pattern, syntax.Perl)
+	if err != nil {
+		return
+	}
+	for i, name := range syslogCaprefs {
+		sym := symbol.NewSymbol(name, symbol.CaprefSymbol, n.Pos())
+		sym.Type = types.Int
+		sym.Binding = n
+		sym.Addr = reAst.MaxCap() + 1 + i
+		if alt := c.scope.Insert(sym); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of capture group `%s' previously declared at %s", sym.Name, alt.Pos))
+		}
+	}
+}
+
+// checkBuiltinIndex checks that the builtin call b, indexed by n, returns a
+// list or a map, and that it is indexed by a single key of the right type.
+func (c *checker) checkBuiltinIndex(n *ast.IndexedExpr, b *ast.BuiltinExpr, argTypes []types.Type) {
+	if types.IsErrorType(b.Type()) {
+		n.SetType(types.Error)
+		return
+	}
+	t, ok := b.Type().Root().(*types.Operator)
+	var kind string
+	var keyType, elemType types.Type
+	switch {
+	case ok && types.IsList(t):
+		kind, keyType, elemType = "list", types.Int, t.Args[0]
+	case ok && types.IsMap(t):
+		kind, keyType, elemType = "map", t.Args[0], t.Args[1]
+	default:
+		c.errors.Add(n.Pos(), fmt.Sprintf("Index taken on unindexable expression"))
+		n.SetType(types.Error)
+		return
+	}
+	if len(argTypes) != 1 {
+		c.errors.Add(n.Pos(), fmt.Sprintf("Too many keys for indexed expression: expecting 1, received %d.", len(argTypes)))
+		n.SetType(types.Error)
+		return
+	}
+	args := n.Index.(*ast.ExprList)
+	switch {
+	case types.Equals(keyType, argTypes[0]):
+	case canConvert(argTypes[0], keyType):
+		conv := &ast.ConvExpr{N: args.Children[0]}
+		conv.SetType(keyType)
+		args.Children[0] = conv
+	default:
+		c.errors.Add(n.Pos(), fmt.Sprintf("type mismatch: %s index has type %s, expecting %s", kind, argTypes[0], keyType))
+		n.SetType(types.Error)
+		return
+	}
+	n.SetType(elemType)
+}
+
+// untypedBuiltinToFloat binds the type of n to Float if n is a call to a
+// builtin like json(), or a ternary choosing between them, whose value's type
+// is only known from how it's used, and its type is not yet known.  JSON numbers may have fractional parts, so Float
+// is the type that fits them all.  It returns the type of n.
+func untypedBuiltinToFloat(n ast.Node) types.Type {
+	switch n.(type) {
+	case *ast.BuiltinExpr, *ast.TernaryExpr:
+		if isVariable(n.Type()) {
+			// Binding an unbound variable can't fail.
+			_ = types.Unify(n.Type(), types.Float)
+		}
+	}
+	return n.Type()
+}
+
+// isNumeric returns true if t is Int or Float.
+func isNumeric(t types.Type) bool {
+	return types.Equals(types.Int, t) || types.Equals(types.Float, t)
+}
+
+// isVariable returns true if t is a type variable that has not been bound to a
+// type.
+func isVariable(t types.Type) bool {
+	_, ok := t.Root().(*types.Variable)
+	return ok
+}
+
+// observedKinds names the kinds of metric whose values are observations,
+// which can only be assigned to and not added to.
+var observedKinds = map[metrics.Kind]string{
+	metrics.EWMA:   "an ewma metric",
+	metrics.Unique: "a unique metric",
+	metrics.Min:    "a min metric",
+	metrics.Max:    "a max metric",
+	metrics.Stddev: "a stddev metric",
+}
+
+// aggregateKinds are the kinds of metric that aggregate their observations
+// over an interval.
+var aggregateKinds = map[metrics.Kind]struct{}{
+	metrics.Min:    {},
+	metrics.Max:    {},
+	metrics.Stddev: {},
+}
+
+// bitwiseOps spells the bitwise operators in error messages.
+var bitwiseOps = map[int]string{
+	parser.SHL:    "<<",
+	parser.SHR:    ">>",
+	parser.BITAND: "&",
+	parser.BITOR:  "|",
+	parser.XOR:    "^",
+	parser.NOT:    "~",
+}
+
+// metricDecl returns the identifier and declaration of the metric named by n,
+// or one of its keys, or nil if n does not name a metric.
+func (c *checker) metricDecl(n ast.Node) (*ast.IdTerm, *ast.VarDecl) {
+	id := plainIdTerm(n)
+	if e, ok := n.(*ast.IndexedExpr); ok {
+		id = plainIdTerm(e.Lhs)
+	}
+	if id == nil || id.Symbol == nil {
+		return nil, nil
+	}
+	for _, d := range c.decls {
+		if d.Symbol == id.Symbol {
+			return id, d
+		}
+	}
+	return id, nil
+}
+
+// localVariable returns the name of the local variable n, with or without
+// index keys, and true if n is one.
+func localVariable(n ast.Node) (string, bool) {
+	if e, ok := n.(*ast.IndexedExpr); ok {
+		n = e.Lhs
+	}
+	if id, ok := n.(*ast.IdTerm); ok && id.Symbol != nil && id.Symbol.Kind == symbol.LocalSymbol {
+		return id.Name, true
+	}
+	return "", false
+}
+
+// plainIdTerm returns the identifier in n if n is only an identifier, with no
+// index keys, and nil otherwise.
+func plainIdTerm(n ast.Node) *ast.IdTerm {
+	switch v := n.(type) {
+	case *ast.IdTerm:
+		return v
+	case *ast.IndexedExpr:
+		if l, ok := v.Index.(*ast.ExprList); ok && len(l.Children) > 0 {
+			return nil
+		}
+		id, _ := v.Lhs.(*ast.IdTerm)
+		return id
+	}
+	return nil
+}
+
+// evaluatePattern concatenates the fragments of the pattern expression n into
+// its complete pattern.  It returns false if the pattern couldn't be
+// evaluated.
+func (c *checker) evaluatePattern(n *ast.PatternExpr) bool {
+	pe := &patternEvaluator{scope: c.scope, errors: &c.errors}
+	ast.Walk(pe, n)
+	if pe.pattern == "" {
+		return false
+	}
+	n.Pattern = pe.pattern
+	n.SyslogPriority = pe.syslogPriority
+	return true
+}
+
 // patternEvaluator is a helper that performs concatenation of pattern
 // fragments so that they can be compiled as whole regular expression patterns.
 type patternEvaluator struct {
-	scope   *symbol.Scope
-	errors  *errors.ErrorList
-	pattern string
+	scope          *symbol.Scope
+	errors         *errors.ErrorList
+	pattern        string
+	syslogPriority bool // set if a literal in the pattern has the `p' flag
 }
 
 func (p *patternEvaluator) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
@@ -648,7 +1975,8 @@ func (p *patternEvaluator) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		}
 		return p, v
 	case *ast.PatternLit:
-		p.pattern += v.Pattern
+		p.pattern += parser.ExpandPattern(v.Pattern)
+		p.syslogPriority = p.syslogPriority || parser.SyslogPriority(v.Pattern)
 		return p, v
 	case *ast.IdTerm:
 		// Already looked up sym, if still nil undefined.
@@ -656,12 +1984,13 @@ func (p *patternEvaluator) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			return nil, n
 		}
 		idPattern := v.Symbol.Binding.(*ast.PatternFragment).Pattern
+		idEvaluator := &patternEvaluator{scope: p.scope}
+		_ = ast.Walk(idEvaluator, v.Symbol.Binding.(*ast.PatternFragment))
 		if idPattern == "" {
-			idEvaluator := &patternEvaluator{scope: p.scope}
-			_ = ast.Walk(idEvaluator, v.Symbol.Binding.(*ast.PatternFragment))
 			idPattern = idEvaluator.pattern
 		}
 		p.pattern += idPattern
+		p.syslogPriority = p.syslogPriority || idEvaluator.syslogPriority
 		return p, v
 	}
 	return p, n
@@ -25,12 +25,156 @@ var checkerInvalidPrograms = []struct {
 		"/blurgh/ { $undef++\n }\n",
 		[]string{"undefined named capture group:1:12-17: Capture group `$undef' was not defined by a regular expression visible to this scope.", "\tTry using `(?P<undef>...)' to name the capture group."}},
 
+	{"getenv of variable",
+		`text region
+/(\w+)/ {
+  region = getenv($1)
+}
+`,
+		[]string{"getenv of variable:3:19-20: call to `getenv': the variable name must be a string constant."}},
+
+	{"split without index",
+		"counter c\nc = split(\"a\", \":\")\n",
+		[]string{"split without index:3:20: call to `split': the list returned must be indexed, e.g. `split(...)[0]'"}},
+
+	{"split index by float",
+		"counter c by k\n/(.*)/ {\n  c[split($1, \":\")[1.5]]++\n}\n",
+		[]string{"split index by float:3:20-23: type mismatch: list index has type Float, expecting Int"}},
+
+	{"split index two keys",
+		"counter c by k\n/(.*)/ {\n  c[split($1, \":\")[0, 1]]++\n}\n",
+		[]string{"split index two keys:3:20-24: Too many keys for indexed expression: expecting 1, received 2."}},
+
+	{"cidrmatch invalid network",
+		"counter c\n/(\\S+)/ {\n  cidrmatch(\"10.0.0.0/33\", $1) {\n    c++\n  }\n}\n",
+		[]string{"cidrmatch invalid network:3:13-25: call to `cidrmatch': invalid CIDR address: 10.0.0.0/33"}},
+
+	{"bitwise and of float",
+		"gauge g\n/(\\d+\\.\\d+)/ {\n  g = $1 & 4\n}\n",
+		[]string{"bitwise and of float:3:7-12: Integer types expected for bitwise op `&', got Float and Int"}},
+
+	{"abs of string",
+		"gauge g\n/(\\w+)/ {\n  g = abs($1)\n}\n",
+		[]string{"abs of string:3:11-12: call to `abs': expecting a numeric value, received String."}},
+
+	{"int of two arguments",
+		"gauge g\n/(\\d+)/ {\n  g = int($1, 2)\n}\n",
+		[]string{"int of two arguments:3:11-15: call to `int': expecting 1 argument, received 2"}},
+
+	{"float of nothing",
+		"gauge g\n/(\\d+)/ {\n  g = float()\n}\n",
+		[]string{"float of nothing:3:13: call to `float': expecting 1 argument, received 0"}},
+
+	{"float of bool",
+		"gauge g\n/(\\d+)/ {\n  g = float(true)\n}\n",
+		[]string{"float of bool:3:13-16: call to `float': can't convert Bool to Float"}},
+
+	{"csv without index",
+		"text t\n/.*/ {\n  t = csv($0)\n}\n",
+		[]string{"csv without index:4:14: call to `csv': the list returned must be indexed, e.g. `csv(...)[0]'"}},
+
+	{"logfmt without index",
+		"text t\n/.*/ {\n  t = logfmt($0)\n}\n",
+		[]string{"logfmt without index:4:17: call to `logfmt': the map returned must be indexed, e.g. `logfmt(...)[\"key\"]'"}},
+
+	{"logfmt index by bool",
+		"text t\n/.*/ {\n  t = logfmt($0)[1 < 2]\n}\n",
+		[]string{"logfmt index by bool:3:18-23: type mismatch: map index has type Bool, expecting String"}},
+
+	{"ternary of int",
+		"gauge g\n/./ {\n  g = 1 ? 2 : 3\n}\n",
+		[]string{"ternary of int:3:7: type mismatch: ternary condition has type Int, expecting a condition"}},
+
+	{"ternary no common type",
+		"text t\n/./ {\n  t = 1 < 2 ? \"a\" : 1 < 2\n}\n",
+		[]string{"ternary no common type:3:7-25: type mismatch: \"String\" and \"Bool\" have no common type"}},
+
+	{"bool metric assigned int",
+		"bool up\n/(\\d+)/ {\n  up = $1\n}\n",
+		[]string{"bool metric assigned int:3:3-9: type mismatch: can't assign Int to a bool metric, expecting a condition"}},
+
+	{"bool metric incremented",
+		"bool up\n/./ {\n  up++\n}\n",
+		[]string{"bool metric incremented:3:3-6: Can't increment or decrement a bool metric, only assign a condition to it."}},
+
+	{"bool metric added to",
+		"bool up\n/./ {\n  up += true\n}\n",
+		[]string{"bool metric added to:3:3-12: Can't add to a bool metric, only assign a condition to it."}},
+
+	{"ewma metric incremented",
+		"ewma depth halflife 1m\n/./ {\n  depth++\n}\n",
+		[]string{"ewma metric incremented:3:3-9: Can't increment or decrement an ewma metric, only assign an observation to it."}},
+
+	{"unique metric added to",
+		"unique clients\n/(\\S+)/ {\n  clients += $1\n}\n",
+		[]string{"unique metric added to:3:3-15: Can't add to a unique metric, only assign an observation to it."}},
+
+	{"ewma metric without half-life",
+		"ewma depth\n/(\\d+)/ {\n  depth = $1\n}\n",
+		[]string{"ewma metric without half-life:1:6-10: EWMA metric `depth' needs a half-life, e.g. `halflife 1m'."}},
+
+	{"limit without keys",
+		"hidden gauge start limit 10\n/./ {\n  start = 1\n}\n",
+		[]string{"limit without keys:1:14-18: Can't limit the label values of metric `start' with no keys, or of a top-k metric."}},
+	{"topk without keys",
+		"topk(5) requests\n/./ {\n  requests++\n}\n",
+		[]string{"topk without keys:1:9-16: Can't track the top label values of metric `requests' with no keys."}},
+
+	{"half-life on a gauge",
+		"gauge depth halflife 1m\n/(\\d+)/ {\n  depth = $1\n}\n",
+		[]string{"half-life on a gauge:1:7-11: Can't specify a half-life for non-ewma metric `depth'."}},
+
+	{"max metric incremented",
+		"max depth\n/./ {\n  depth++\n}\n",
+		[]string{"max metric incremented:3:3-9: Can't increment or decrement a max metric, only assign an observation to it."}},
+
+	{"interval on a gauge",
+		"gauge depth interval 1m\n/(\\d+)/ {\n  depth = $1\n}\n",
+		[]string{"interval on a gauge:1:7-11: Can't specify an aggregation interval for metric `depth' that isn't a min, max or stddev metric."}},
+
+	{"syslog priority in a match expression",
+		"counter c\n/(?P<x>.*)/ {\n  $x =~ /(?p)a/ {\n    c++\n  }\n}\n",
+		[]string{"syslog priority in a match expression:3:9-15: The syslog priority flag `p' can only be used in a pattern matched against the log line."}},
+
+	{"syslog capture groups without the flag",
+		"counter c by s\n/sshd/ {\n  c[$syslog_severity]++\n}\n",
+		[]string{"syslog capture groups without the flag:3:5-20: Capture group `$syslog_severity' was not defined by a regular expression visible to this scope.",
+			"\tTry using `(?P<syslog_severity>...)' to name the capture group."}},
+
+	{"logical not of int",
+		"!1 {\n}\n",
+		[]string{"logical not of int:1:2: type mismatch: can't use `!' on Int, expecting a condition"}},
+
 	{"out of bounds capref",
 		"/(blyurg)/ { $2++ \n}\n",
 		[]string{"out of bounds capref:1:14-15: Capture group `$2' was not defined by a regular expression " +
 			"visible to this scope.", "\tCheck that there are at least 2 pairs of parentheses."},
 	},
 
+	{"switch non-constant case",
+		"counter c\n/(\\w+) (\\w+)/ {\n  switch $1 {\n    case $2 {\n      c++\n    }\n  }\n}\n",
+		[]string{"switch non-constant case:4:10-11: Case values must be string or integer constants."}},
+
+	{"switch duplicate case",
+		"counter c\n/(\\w+)/ {\n  switch $1 {\n    case \"a\", \"a\" {\n      c++\n    }\n  }\n}\n",
+		[]string{"switch duplicate case:4:15-17: Duplicate case value a in switch statement."}},
+
+	{"switch mixed case types",
+		"counter c\n/(\\w+)/ {\n  switch $1 {\n    case \"a\" {\n      c++\n    }\n    case 1 {\n      c++\n    }\n  }\n}\n",
+		[]string{"switch mixed case types:7:10: type mismatch: case value has type Int, expecting String"}},
+
+	{"switch multiple defaults",
+		"counter c\n/(\\w+)/ {\n  switch $1 {\n    default {\n      c++\n    }\n    default {\n      c++\n    }\n  }\n}\n",
+		[]string{"switch multiple defaults:7:5-11: Can't have more than one `default' clause in a switch statement."}},
+
+	{"pattern argument to builtin",
+		"len(/foo/, 1)\n",
+		[]string{"pattern argument to builtin:1:5-9: call to `len': can't use a pattern as an argument"}},
+
+	{"subst of bool",
+		"subst(1 < 2, \"a\", \"b\")\n",
+		[]string{"subst of bool:1:7-11: call to `subst': expecting a pattern or String to replace, received Bool"}},
+
 	{"undefined decorator",
 		"@foo {}\n",
 		[]string{"undefined decorator:1:1-4: Decorator `foo' not defined.", "\tTry adding a definition `def foo {}' earlier in the program."}},
@@ -103,7 +247,7 @@ counter bar by a, b
 	  timestamp()
 	}
 	`,
-		[]string{"builtin parameter mismatch:2:13: call to `strptime': type mismatch; expected String→String→None received incomplete type"}},
+		[]string{"builtin parameter mismatch:2:13: call to `strptime': type mismatch; expected String→String→Bool received incomplete type"}},
 
 	{"bad strptime format",
 		`strptime("2017-10-16 06:50:25", "2017-10-16 06:50:25")
@@ -111,6 +255,12 @@ counter bar by a, b
 		[]string{
 			"bad strptime format:1:33-53: invalid time format string \"2017-10-16 06:50:25\"", "\tRefer to the documentation at https://golang.org/pkg/time/#pkg-constants for advice."}},
 
+	{"bad strptime fallback format",
+		`strptime("2017-10-16 06:50:25", "2006-01-02 15:04:05", "2017-10-16")
+`,
+		[]string{
+			"bad strptime fallback format:1:56-67: invalid time format string \"2017-10-16\"", "\tRefer to the documentation at https://golang.org/pkg/time/#pkg-constants for advice."}},
+
 	{"undefined const regex",
 		"/foo / + X + / bar/ {}\n",
 		[]string{"undefined const regex:1:10: Identifier `X' not declared.", "\tTry adding `const X /.../' earlier in the program."}},
@@ -161,12 +311,457 @@ const ID /bar/
 }`,
 		[]string{"def with two nexts:6:5-8: Can't use `next' statement twice in a decorator."}},
 
+	{"undefined function",
+		`f()
+`,
+		[]string{"undefined function:1:1: Function `f' not defined.", "\tTry adding a definition `def f() {}' earlier in the program."}},
+	{"function without usage",
+		`def f() {
+}`,
+		[]string{"function without usage:1:1-3: Declaration of function `f' is never used"}},
+	{"unused parameter",
+		`def f(x) {
+}
+f(1)
+`,
+		[]string{"unused parameter:1:7: Declaration of parameter `x' is never used"}},
+	{"text metric value dimension",
+		`text version by host, value
+/(?P<v>\S+)/ {
+  version["a", "b"] = $v
+}
+`,
+		[]string{"text metric value dimension:1:6-12: Text metric `version' can't have the dimension `value', which holds its text when exported to Prometheus."}},
+	{"map errors",
+		`text class
+/(?P<code>\d+)/ {
+  class = map $code { "2..": "ok", "(": "bad" }
+  class = map $code { default: "a", default: "b" }
+}
+`,
+		[]string{"map errors:3:11-13: Map expression has no default case.", "\tTry adding `default: \"other\"' for the values no pattern matches.",
+			"map errors:3:36-38: error parsing regexp: missing closing ): `(`",
+			"map errors:4:37-43: Duplicate default case of map expression, previously at map errors:4:23-29"}},
+	{"bad normalizers",
+		`counter c by path normalize lowercase 3, squash, max_len, max_len -1
+/(?P<path>\S+)/ {
+  c[$path]++
+}
+`,
+		[]string{"bad normalizers:1:29-37: Normalizer `lowercase' of key `path' takes no argument.",
+			"bad normalizers:1:42-47: Unknown normalizer `squash' of key `path'.", "\tTry one of lowercase, uppercase, strip_query or max_len.",
+			"bad normalizers:1:50-56: Normalizer `max_len' of key `path' needs a positive length, like `max_len 64'.",
+			"bad normalizers:1:59-65: Normalizer `max_len' of key `path' needs a positive length, like `max_len 64'."}},
+	{"bad units",
+		`gauge latency unit milliseconds
+counter sent unit Bytes
+text version unit seconds
+/x/ {
+  latency = 1
+  sent++
+  version = "1"
+}
+`,
+		[]string{"bad units:1:7-13: Unit `milliseconds' of metric `latency' is not a base unit.", "\tTry `unit seconds', and convert the values to seconds.",
+			"bad units:2:9-12: Unit `Bytes' of metric `sent' must be lowercase letters, digits and underscores.",
+			"bad units:3:6-12: A text metric can't have a unit."}},
+	{"namespace errors",
+		`namespace "web-2"
+counter c
+namespace "api"
+/x/ {
+  c++
+  namespace "api"
+}
+`,
+		[]string{"namespace errors:1:1-9: Namespace `web-2' is not a valid metric name prefix.", "\tUse only letters, digits, and underscores.",
+			"namespace errors:3:1-9: Namespace `api' must come before the metric declarations.", "\tTry moving it above the declaration of `c' at namespace errors:2:9.",
+			"namespace errors:6:3-11: Can't use `namespace' inside a block.", "\tTry moving it to the top of the program."}},
+	{"timezone errors",
+		`timezone "Mars/Olympus_Mons"
+timezone "UTC"
+timezone "America/New_York"
+/x/ {
+  timezone "UTC"
+}
+`,
+		[]string{"timezone errors:1:1-8: Unknown timezone `Mars/Olympus_Mons'.", "\tTry a name from the IANA time zone database, like \"America/New_York\" or \"UTC\".",
+			"timezone errors:3:1-8: Redefinition of the program's timezone, previously defined at timezone errors:2:1-8",
+			"timezone errors:5:3-10: Can't use `timezone' inside a block.", "\tTry moving it to the top of the program."}},
+	{"namespace redefinition",
+		`namespace "web"
+namespace "api"
+`,
+		[]string{"namespace redefinition:2:1-9: Redefinition of the program's namespace, previously defined at namespace redefinition:1:1-9"}},
+	{"assignment to local",
+		`gauge g
+/(?P<n>\d+)/ {
+  let x = $n
+  x = 2
+  x++
+  g = x
+}
+`,
+		[]string{"assignment to local:4:3-7: Can't assign to local variable `x'.", "\tTry declaring a new one with `let'.",
+			"assignment to local:5:3-5: Can't modify local variable `x'.", "\tTry declaring a new one with `let'."}},
+	{"local out of scope",
+		`gauge g
+/(?P<n>\d+)/ {
+  g = x
+  let x = x + 1
+}
+g = x
+`,
+		[]string{"local out of scope:3:7: Identifier `x' not declared.", "\tTry adding `counter x' to the top of the program.",
+			"local out of scope:4:11: Identifier `x' not declared.", "\tTry adding `counter x' to the top of the program.",
+			"local out of scope:4:7: Declaration of local variable `x' is never used",
+			"local out of scope:6:5: Identifier `x' not declared.", "\tTry adding `counter x' to the top of the program."}},
+	{"local hides metric",
+		`counter foo
+/x/ {
+  let foo = 1
+  foo++
+}
+`,
+		[]string{"local hides metric:3:7-9: Local variable `foo' hides the metric declared at local hides metric:1:9-11."}},
+	{"wildcard outside del",
+		`counter foo by bar
+/x/ {
+  foo[*]++
+}
+`,
+		[]string{"wildcard outside del:3:7: Wildcard `*' can only be a key of a `del' statement."}},
+	{"wrong number of arguments",
+		`def f(x) {
+  return x
+}
+f(1, 2)
+`,
+		[]string{"wrong number of arguments:4:1: call to `f': expecting 1 arguments, received 2"}},
+	{"recursive function",
+		`def f(x) {
+  return f(x)
+}
+f(1)
+`,
+		[]string{"recursive function:2:10: Recursive call to function `f' is not allowed."}},
+	{"return outside function",
+		`return 1
+`,
+		[]string{"return outside function:1:1-6: Can't use `return' statement outside of a function."}},
+	{"mismatched return types",
+		`def f(x) {
+  x > 0 {
+    return "positive"
+  }
+  return 0
+}
+f(1)
+`,
+		[]string{"mismatched return types:5:3-8: Function `f' returns Int here, but String elsewhere."}},
+	{"assign to parameter",
+		`def f(x) {
+  x = 1
+  return x
+}
+f(1)
+`,
+		[]string{"assign to parameter:2:3-7: Can't assign to function parameter `x'."}},
+
 	{"counter with buckets",
 		`counter foo buckets 1, 2, 3
 /(\d)/ {
 foo = $1
 }`,
 		[]string{"counter with buckets:1:9-11: Can't specify buckets for non-histogram metric `foo'."}},
+
+	{"counter with quantiles",
+		`counter foo quantiles 0.5
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"counter with quantiles:1:9-11: Can't specify quantiles for non-summary metric `foo'."}},
+
+	{"summary without quantiles",
+		`summary foo
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"summary without quantiles:1:9-11: Summary metric `foo' needs at least one quantile."}},
+
+	{"expiry without keys",
+		`hidden persist gauge foo after 1h
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"expiry without keys:1:22-24: Can't specify an expiry for metric `foo' with no keys."}},
+
+	{"rate of an expression",
+		`counter a
+gauge r
+/(\d+)/ {
+  a++
+  r = rate($1 + 1, 60)
+}`,
+		[]string{"rate of an expression:5:12-17: call to `rate': expecting a counter, gauge or timer."}},
+
+	{"delta window not constant",
+		`counter a
+gauge d
+/(\d+)/ {
+  d = delta(a, $1)
+}`,
+		[]string{"delta window not constant:4:16-17: call to `delta': the window must be a positive constant number of seconds."}},
+
+	{"movavg not assigned to a gauge",
+		`counter c
+/(\d+)/ {
+  c = movavg($1, 5m)
+}`,
+		[]string{"movavg not assigned to a gauge:3:3: call to `movavg': the average must be assigned to a gauge, e.g. `g = movavg(x, 5m)'."}},
+
+	{"ttl without keys",
+		`counter requests ttl 24h
+// {
+requests++
+}`,
+		[]string{"ttl without keys:1:9-16: Can't specify an expiry for metric `requests' with no keys."}},
+
+	{"undeclared lookup table",
+		`counter c by service
+/(?P<host>\S+)/ {
+  c[lookup[services][$host]]++
+}`,
+		[]string{"undeclared lookup table:3:12-19: Lookup table `services' not declared.", "\tTry adding `lookup services from \"...\"' earlier in the program."}},
+
+	{"unused lookup table",
+		`lookup services from "services.csv"
+`,
+		[]string{"unused lookup table:1:8-15: Declaration of lookup table `services' is never used"}},
+
+	{"lookup table redeclared",
+		`lookup services from "services.csv"
+lookup services from "other.csv"
+counter c by service
+/(?P<host>\S+)/ {
+  c[lookup[services][$host]]++
+}`,
+		[]string{"lookup table redeclared:2:8-15: Redeclaration of lookup table `services' previously declared at lookup table redeclared:1:8-15"}},
+
+	{"summary quantile out of range",
+		`summary foo quantiles 0.5, 1
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"summary quantile out of range:1:9-11: Quantile 1 of summary metric `foo' is not between 0 and 1."}},
+}
+
+var checkerStrictPrograms = []struct {
+	name    string
+	program string
+	errors  []string
+}{
+	{"unused capture groups",
+		`counter c by host
+/(?P<host>\w+) (\d+) (?P<user>\w+)/ {
+  c[$host]++
+}
+`,
+		[]string{
+			"unused capture groups:2:1-35: Capture group `$2' is never used (unused warning)",
+			"unused capture groups:2:1-35: Capture group `$user' is never used (unused warning)"}},
+
+	{"unused decorator capture group",
+		`counter c by host
+def syslog {
+  /(?P<host>\w+) (?P<pid>\d+)/ {
+    next
+  }
+}
+@syslog {
+  c[$host]++
+}
+`,
+		nil},
+
+	{"shadowed capture group",
+		`counter c by host
+/^(?P<host>\w+) / {
+  / (?P<host>\w+)$/ {
+    c[$host]++
+  }
+}
+`,
+		[]string{
+			"shadowed capture group:2:1-17: Capture group `$host' is never used (unused warning)",
+			"shadowed capture group:3:3-19: Capture group `$host' hides the one declared at shadowed capture group:2:1-17 (shadow warning)"}},
+
+	{"metric type not inferred",
+		`gauge g
+/x/ {
+  g = g
+}
+`,
+		[]string{"metric type not inferred:1:7: Can't infer the type of metric `g', so it is an Int (type warning)"}},
+
+	{"metric never written",
+		`counter requests
+gauge last_requests
+/x/ {
+  requests++
+  last_requests > 0 {
+    requests++
+  }
+}
+`,
+		[]string{"metric never written:2:7-19: Metric `last_requests' is read but never written (unwritten warning)"}},
+
+	{"unreachable blocks",
+		`counter c
+/foo$bar/ {
+  c++
+}
+/x/ {
+  false {
+    c++
+  }
+  true {
+    c++
+  } else {
+    c++
+  }
+  $0 =~ /^a^b/ {
+    c++
+  }
+  /(?:a$|b)c/ {
+    c++
+  }
+}
+`,
+		[]string{
+			"unreachable blocks:2:1-9: Pattern /foo$bar/ can never match, so this block is never run (unreachable warning)",
+			"unreachable blocks:6:3-7: Condition is always false, so this block is never run (unreachable warning)",
+			"unreachable blocks:9:3-6: Condition is always true, so the else block is never run (unreachable warning)",
+			"unreachable blocks:14:9-14: Pattern /^a^b/ can never match, so this block is never run (unreachable warning)"}},
+
+	{"capture group in else block",
+		`counter c by host
+/(?P<host>\w+)/ {
+} else {
+  c[$host]++
+}
+`,
+		[]string{"capture group in else block:4:5-9: Capture group `$host' is used in the else block of the condition that defines it, where it has no value (unmatched warning)"}},
+
+	{"capture group in ternary else",
+		`text host
+host = /(?P<host>\w+)/ ? "named" : $host
+`,
+		[]string{"capture group in ternary else:2:36-40: Capture group `$host' is used in the else block of the condition that defines it, where it has no value (unmatched warning)"}},
+
+	{"outer capture group in else block",
+		`counter c by host
+/^(?P<host>\w+) / {
+  / (?P<user>\w+)$/ {
+    c[$user]++
+  } else {
+    c[$host]++
+  }
+}
+`,
+		nil},
+}
+
+func TestCheckStrictPrograms(t *testing.T) {
+	for _, tc := range checkerStrictPrograms {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ast, err := parser.Parse(tc.name, strings.NewReader(tc.program))
+			testutil.FatalIfErr(t, err)
+			// Warnings are only errors in strict mode.
+			if _, err := checker.Check(ast, false); err != nil {
+				t.Fatalf("check failed when not strict: %s", err)
+			}
+			ast, err = parser.Parse(tc.name, strings.NewReader(tc.program))
+			testutil.FatalIfErr(t, err)
+			_, err = checker.Check(ast, true)
+			var got []string
+			if err != nil {
+				got = strings.Split(err.Error(), "\n")
+			}
+			if diff := testutil.Diff(tc.errors, got, cmpopts.SortSlices(func(x, y string) bool { return x < y })); diff != "" {
+				t.Errorf("Diff %s", diff)
+			}
+		})
+	}
+}
+
+var checkerStrictTypesPrograms = []struct {
+	name    string
+	program string
+	errors  []string
+}{
+	{"implicit conversions",
+		`gauge latency
+gauge ratio
+counter requests
+/(\d+) (\d+\.\d+)/ {
+  latency = $2 * $1
+  ratio = $1 > $2 ? $1 : $2
+  requests++
+  requests = $2
+}
+`,
+		[]string{
+			"implicit conversions:5:18-19: Implicit conversion of Int to Float.",
+			"\tTry `float(...)' to convert it explicitly.",
+			"implicit conversions:6:11-12: Implicit conversion of Int to Float.",
+			"\tTry `float(...)' to convert it explicitly.",
+			"implicit conversions:8:3-10: Implicit conversion of Int to Float.",
+			"\tTry `float(...)' to convert it explicitly."}},
+
+	{"explicit conversions",
+		`gauge latency
+counter requests
+/(\d+) (\d+\.\d+)/ {
+  latency = $2 * float($1) + 1
+  requests += int($2)
+}
+`,
+		nil},
+
+	{"metric type not inferred",
+		`counter c by host
+/(?P<host>\S+)/ {
+  c[$host] = c[$host]
+}
+`,
+		[]string{"metric type not inferred:1:9: Can't infer the type of metric `c'.", "\tTry assigning it a value of the type it should have."}},
+}
+
+func TestCheckStrictTypesPrograms(t *testing.T) {
+	for _, tc := range checkerStrictTypesPrograms {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ast, err := parser.Parse(tc.name, strings.NewReader(tc.program))
+			testutil.FatalIfErr(t, err)
+			if _, err := checker.Check(ast, false); err != nil {
+				t.Fatalf("check failed without strict types: %s", err)
+			}
+			ast, err = parser.Parse(tc.name, strings.NewReader(tc.program))
+			testutil.FatalIfErr(t, err)
+			_, err = checker.Check(ast, false, checker.StrictTypes())
+			var got []string
+			if err != nil {
+				got = strings.Split(err.Error(), "\n")
+			}
+			if diff := testutil.Diff(tc.errors, got, cmpopts.SortSlices(func(x, y string) bool { return x < y })); diff != "" {
+				t.Errorf("Diff %s", diff)
+			}
+		})
+	}
 }
 
 func TestCheckInvalidPrograms(t *testing.T) {
@@ -178,7 +773,7 @@ func TestCheckInvalidPrograms(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			ast, err = checker.Check(ast)
+			ast, err = checker.Check(ast, false)
 			if err == nil {
 				s := parser.Sexp{}
 				s.EmitTypes = true
@@ -205,6 +800,14 @@ var checkerValidPrograms = []struct {
 	name    string
 	program string
 }{
+	{"syslog priority",
+		`counter events by severity, facility
+const SSHD /(?p)sshd: (\w+)/
+/^/ + SSHD {
+  events[$syslog_severity, $syslog_facility]++
+}
+`,
+	},
 	{"capture group",
 		`counter foo
 /(.*)/ {
@@ -272,8 +875,212 @@ var checkerValidPrograms = []struct {
 (0) || (1 && 3) {
 }`},
 
+	{"split index", `
+counter c by shell
+/(.*)/ {
+  c[split($1, ":")[-1]]++
+}
+`},
+
+	{"split index string capref", `
+gauge g
+/(\d+) (.*)/ {
+  g = int(split($2, ",")[$1])
+}
+`},
+
+	{"cidrmatch", `
+counter c by network
+/(?P<ip>\S+) (?P<net>\S+)/ {
+  cidrmatch("192.168.0.0/16", $ip) {
+    c["lan"]++
+  }
+  c[cidrmatch($net, $ip) ? "local" : "remote"]++
+}
+`},
+
+	{"geoip", `
+counter c by country
+gauge asn
+/(?P<ip>\S+)/ {
+  c[geoip_country($ip)]++
+  asn = geoip_asn($ip)
+}
+`},
+
+	{"free-spacing pattern", `
+counter c by method
+const METHOD /(?xi) (?P<method>
+  get | post    # the common ones
+)/
+/^/ + METHOD + / \S+/ {
+  c[$method]++
+}
+`},
+
+	{"rate and delta", `
+counter requests_total by method
+gauge requests_per_second by method
+gauge bytes_last_minute
+counter bytes_total
+/(?P<method>\w+) (?P<bytes>\d+)/ {
+  requests_total[$method]++
+  requests_per_second[$method] = rate(requests_total[$method], 60)
+  bytes_total += $bytes
+  bytes_last_minute = delta(bytes_total, 60)
+}
+`},
+
+	{"movavg", `
+gauge latency_avg by path
+/(?P<path>\S+) (?P<latency>\d+\.\d+)/ {
+  latency_avg[$path] = movavg($latency, 5m)
+}
+`},
+
+	{"getfilename", `
+counter lines_total by file
+counter errors_total
+/.*/ {
+  lines_total[getfilename()]++
+}
+getfilename() =~ /error/ {
+  errors_total++
+}
+`},
+
+	{"hostname", `
+counter c by host
+/x/ {
+  c[hostname()]++
+}
+shorthostname() == "web1" {
+  c["web1"]++
+}
+`},
+
+	{"getenv", `
+counter c by region
+/(\w+)/ {
+  c[getenv("REGION")]++
+}
+getenv("ENV") == "prod" {
+  c["prod"]++
+}
+`},
+
+	{"lookup table", `
+lookup services from "services.json"
+counter c by service
+gauge port
+/(?P<host>\S+) (?P<port>\d+)/ {
+  c[lookup[services][$host]]++
+  port = lookup[services][$port]
+}
+`},
+
+	{"csv index", `
+counter c by status
+gauge g
+/^.*$/ {
+  c[csv($0)[2]]++
+  g = int(csv($0)[-1])
+}
+`},
+
+	{"logfmt index", `
+counter c by level
+gauge g
+/.*/ {
+  c[logfmt($0)["level"]]++
+  g = int(logfmt($0)["duration_ms"])
+}
+`},
+
+	{"json", `
+counter requests by method
+counter bytes_total
+gauge latency
+/^{.*}$/ {
+  requests[json($0, "req.method")]++
+  json($0, "latency_ms") > 100 {
+    latency = json($0, "latency_ms")
+  }
+  bytes_total += json($0, "bytes")
+  json($0, "level") == "error" {
+  }
+}
+`},
+
+	{"logical not", `
+!/foo/ || !(1 > 0) {
+}`},
+
+	{"bool metric", `
+bool up by service
+counter restarts_total
+/(?P<service>\w+) (?P<event>started|stopped)/ {
+  $event == "started" && !up[$service] {
+    restarts_total++
+  }
+  up[$service] = $event =~ /started/
+}
+/shutdown/ {
+  up["all"] = false
+}
+`},
+
+	{"ewma metric", `
+ewma queue_depth by queue halflife 30s
+/(?P<queue>\w+) depth (?P<depth>\d+)/ {
+  queue_depth[$queue] = $depth
+}
+`},
+
+	{"aggregating metrics", `
+min latency_min by path interval 10s
+max latency_max by path
+stddev latency_stddev
+/(?P<path>\S+) (?P<latency>\d+)ms/ {
+  latency_min[$path] = $latency
+  latency_max[$path] = $latency
+  latency_stddev = $latency
+}
+`},
+
+	{"ternary", `
+counter c by class
+gauge g
+counter bytes_total
+/(?P<status>\d+) (?P<size>\d+)/ {
+  c[$status >= 500 ? "error" : "ok"]++
+  g = $status == 200 ? $size : 0.5
+  bytes_total += /^{/ ? json($0, "bytes") : json($0, "size")
+}
+`},
+
 	{"strptime format", `
 strptime("2006-01-02 15:04:05", "2006-01-02 15:04:05")
+`},
+
+	{"strptime failure branch", `
+counter timestamp_parse_errors
+/^(?P<ts>\S+) / {
+  !strptime($ts, "2006-01-02T15:04:05Z07:00") {
+    !strptime($ts, "02/Jan/2006:15:04:05") {
+      timestamp_parse_errors++
+    }
+  }
+}
+`},
+
+	{"strptime fallback formats", `
+counter timestamp_parse_errors
+/^(?P<ts>\S+ \S+) / {
+  !strptime($ts, "02/Jan/2006:15:04:05 -0700", "2006-01-02T15:04:05Z07:00") {
+    timestamp_parse_errors++
+  }
+}
 `},
 
 	{"string concat", `
@@ -339,6 +1146,63 @@ def decorator {
     a++
   }
 }
+`},
+	{"captures in nested conditions", `
+counter c by host, user
+gauge g
+/^(?P<host>\w+) (?P<n>\d+)/ {
+  / (?P<user>\w+)$/ {
+    $user == "root" {
+      c[$host, $user]++
+    } else {
+      g = $n + 1
+    }
+  } else {
+    c[$host, "unknown"]++
+  }
+}
+`},
+	{"captures across decorators", `
+counter c by host, user
+def syslog {
+  /^(?P<host>\w+) / {
+    next
+  }
+}
+def user {
+  / (?P<user>\w+)$/ {
+    next
+  }
+}
+/^(?P<prefix>\w)/ {
+  @syslog {
+    @user {
+      c[$prefix + $host, $user]++
+    }
+  }
+}
+`},
+	{"function with parameters", `
+counter c by class
+def class(code) {
+  code >= 500 {
+    return "error"
+  }
+  return "ok"
+}
+/(\d+) (\w+)/ {
+  c[class($1)]++
+  c[class($2)]++
+}
+`},
+	{"function without return", `
+counter c
+def count() {
+  c++
+}
+/foo/ {
+  count()
+}
 `},
 	{"concat with add_assign", `
 text foo
@@ -360,6 +1224,12 @@ stop
 
 	{"declare histogram", `
 histogram foo buckets 1, 2, 3
+/(\d+)/ {
+  foo = $1
+}`},
+
+	{"declare summary", `
+summary foo quantiles 0.5, 0.99
 /(\d+)/ {
   foo = $1
 }`},
@@ -374,7 +1244,7 @@ func TestCheckValidPrograms(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			ast, err = checker.Check(ast)
+			ast, err = checker.Check(ast, false)
 			s := parser.Sexp{}
 			s.EmitTypes = true
 			t.Log("Typed AST:\n" + s.Dump(ast))
@@ -418,7 +1288,7 @@ func TestCheckTypeExpressions(t *testing.T) {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
-			ast, err := checker.Check(tc.expr)
+			ast, err := checker.Check(tc.expr, false)
 			if err != nil {
 				t.Fatalf("check error: %s", err)
 			}
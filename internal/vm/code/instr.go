@@ -4,13 +4,59 @@
 // Package code contains the bytecode instructions for the mtail virtual machine.
 package code
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type Instr struct {
 	Opcode  Opcode
 	Operand interface{}
 }
 
+// JumpTable is the operand of a Jtab instruction.  It maps each string or
+// int64 value to the program offset to jump to, with the Default offset for
+// values not in the table.
+type JumpTable struct {
+	Targets map[interface{}]int
+	Default int
+}
+
+// ValueMap is the operand of a Vmap instruction.  It maps a string to the
+// value of the first of the regular expressions at the program's Regexps
+// indexes that matches it, or to Default if none does.
+type ValueMap struct {
+	Regexps []int
+	Values  []string
+	Default string
+}
+
+// Normalizer is a rewrite of a label value in the operand of a Normalize
+// instruction: "lowercase", "uppercase", "strip_query", or "max_len" to Arg
+// characters.
+type Normalizer struct {
+	Name string
+	Arg  int
+}
+
+// KeyMatch is the operand of a Delmatch instruction.  Globs has an entry for
+// each key, true if the key is a glob pattern in which `*' matches any run of
+// characters, and false if it must equal the label value.  Expire is set if
+// the matching datums are to expire, after the duration under the keys on the
+// stack, instead of being removed.
+type KeyMatch struct {
+	Globs  []bool
+	Expire bool
+}
+
+// Aggregate is the operand of an Aset instruction.  It names the statistic,
+// "min", "max" or "stddev", of the observations of a metric in each
+// Interval that the metric holds.
+type Aggregate struct {
+	Stat     string
+	Interval time.Duration
+}
+
 // debug print for instructions
 func (i Instr) String() string {
 	return fmt.Sprintf("{%s %v}", opNames[i.Opcode], i.Operand)
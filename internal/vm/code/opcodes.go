@@ -7,49 +7,84 @@ package code
 type Opcode int
 
 const (
-	Bad        Opcode = iota // Invalid instruction, indicates a bug in the generator.
-	Stop                     // Stop the program, ending processing of this input.
-	Match                    // Match a regular expression against input, and set the match register.
-	Smatch                   // Match a regular expression against top of stack, and set the match register.
-	Cmp                      // Compare two values on the stack and set the match register.
-	Jnm                      // Jump if no match.
-	Jm                       // Jump if match.
-	Jmp                      // Unconditional jump
-	Inc                      // Increment a variable value
-	Dec                      // Decrement a variable value
-	Strptime                 // Parse into the timestamp register
-	Timestamp                // Return value of timestamp register onto TOS.
-	Settime                  // Set timestamp register to value at TOS.
-	Push                     // Push operand onto stack
-	Capref                   // Push capture group reference at operand onto stack
-	Str                      // Push string constant at operand onto stack
-	Sset                     // Set a string variable value.
-	Iset                     // Set a variable value
-	Iadd                     // Add top values on stack and push to stack
-	Isub                     // Subtract top value from second top value on stack, and push to stack.
-	Imul                     // Multiply top values on stack and push to stack
-	Idiv                     // Divide top value into second top on stack, and push
-	Imod                     // Integer divide top value into second top on stack, and push remainder
-	Ipow                     // Put second TOS to power of TOS, and push.
-	And                      // Bitwise AND the 2 at top of stack, and push result
-	Or                       // Bitwise OR the 2 at top of stack, and push result
-	Xor                      // Bitwise XOR the 2 at top of stack, and push result
-	Neg                      // Bitwise NOT the top of stack, and push result
-	Not                      // Boolean NOT the top of stack, and push result
-	Shl                      // Shift TOS left, push result
-	Shr                      // Shift TOS right, push result
-	Mload                    // Load metric at operand onto top of stack
-	Dload                    // Pop `operand` keys and metric off stack, and push datum at metric[key,...] onto stack.
-	Iget                     // Pop a datum off the stack, and push its integer value back on the stack.
-	Fget                     // Pop a datum off the stack, and push its float value back on the stack.
-	Sget                     // Pop a datum off the stack, and push its string value back on the stack.
-	Tolower                  // Convert the string at the top of the stack to lowercase.
-	Length                   // Compute the length of a string.
-	Cat                      // string concatenation
-	Setmatched               // Set "matched" flag
-	Otherwise                // Only match if "matched" flag is false.
-	Del                      // Pop `operand` keys and metric off stack, and remove the datum at metric[key,...] from memory
-	Expire                   // Set the expiry duration of a datum, perfoming the same as del but after the expiry time passes.
+	Bad          Opcode = iota // Invalid instruction, indicates a bug in the generator.
+	Stop                       // Stop the program, ending processing of this input.
+	Match                      // Match a regular expression against input, and set the match register.
+	Smatch                     // Match a regular expression against top of stack, and set the match register.
+	Pmatch                     // Match a regular expression against input after its syslog priority, and set the match register.
+	Cmp                        // Compare two values on the stack and set the match register.
+	Jnm                        // Jump if no match.
+	Jm                         // Jump if match.
+	Jmp                        // Unconditional jump
+	Inc                        // Increment a variable value
+	Dec                        // Decrement a variable value
+	Strptime                   // Parse into the timestamp register, and push whether the time parsed.
+	Rfc3339                    // Parse an RFC 3339 timestamp into the timestamp register, and push whether it parsed.
+	Timestamp                  // Return value of timestamp register onto TOS.
+	Settime                    // Set timestamp register to value at TOS.
+	SettimeMs                  // Set timestamp register to value at TOS, in milliseconds.
+	SettimeNs                  // Set timestamp register to value at TOS, in nanoseconds.
+	Rate                       // Push the rate per second of change of a datum over a sliding window.
+	Delta                      // Push the change of a datum over a sliding window.
+	Movavg                     // Push the average of the values observed for the datum below over a sliding window.
+	Duration                   // Parse the duration string at the top of the stack, and push its number of seconds.
+	Floor                      // Pop a number, and push the greatest integer less than or equal to it.
+	Ceil                       // Pop a number, and push the least integer greater than or equal to it.
+	Round                      // Pop a number, and push the nearest integer, rounding half away from zero.
+	Abs                        // Pop a number, and push its absolute value.
+	Log                        // Pop a number, and push its natural logarithm.
+	Hour                       // Pop a timestamp, and push its hour of the day.
+	Weekday                    // Pop a timestamp, and push its day of the week, from 0 for Sunday.
+	Strftime                   // Pop a layout and a timestamp, and push the timestamp formatted with the layout.
+	Push                       // Push operand onto stack
+	Capref                     // Push capture group reference at operand onto stack
+	Str                        // Push string constant at operand onto stack
+	Sset                       // Set a string variable value.
+	Iset                       // Set a variable value
+	Bset                       // Pop a flap counter, a condition, and a bool metric, and set the metric to 1 or 0, counting a flap if it changes.
+	Eset                       // Pop an observation and an ewma metric, and blend the observation into the metric with the half-life at operand.
+	Aset                       // Pop an observation and an aggregating metric, and set the metric to the statistic at operand of the observations in the current interval.
+	Iadd                       // Add top values on stack and push to stack
+	Isub                       // Subtract top value from second top value on stack, and push to stack.
+	Imul                       // Multiply top values on stack and push to stack
+	Idiv                       // Divide top value into second top on stack, and push
+	Imod                       // Integer divide top value into second top on stack, and push remainder
+	Ipow                       // Put second TOS to power of TOS, and push.
+	And                        // Bitwise AND the 2 at top of stack, and push result
+	Or                         // Bitwise OR the 2 at top of stack, and push result
+	Xor                        // Bitwise XOR the 2 at top of stack, and push result
+	Neg                        // Bitwise NOT the top of stack, and push result
+	Not                        // Boolean NOT the top of stack, and push result
+	Shl                        // Shift TOS left, push result
+	Shr                        // Shift TOS right, push result
+	Mload                      // Load metric at operand onto top of stack
+	Dload                      // Pop `operand` keys and metric off stack, and push datum at metric[key,...] onto stack.
+	Dpeek                      // Like dload, but push a new datum that is not stored if metric[key,...] has none.
+	Iget                       // Pop a datum off the stack, and push its integer value back on the stack.
+	Fget                       // Pop a datum off the stack, and push its float value back on the stack.
+	Sget                       // Pop a datum off the stack, and push its string value back on the stack.
+	Tolower                    // Convert the string at the top of the stack to lowercase.
+	Toupper                    // Convert the string at the top of the stack to uppercase.
+	Trim                       // Remove leading and trailing whitespace from the string at the top of the stack.
+	Substr                     // Pop a length, start offset, and string, and push the substring.
+	Subst                      // Pop a string, replacement, and old string, and push the string with each old string replaced.
+	Rsubst                     // Pop a string and replacement, and push the string with each match of the regex at operand replaced.
+	Split                      // Pop a delimiter and a string, and push the list of substrings between each delimiter.
+	Lindex                     // Pop an index and a list, and push the string at that index of the list.
+	Logfmt                     // Pop a string, and push the map of the logfmt key=value pairs in it.
+	Mindex                     // Pop a key and a map, and push the string stored under that key.
+	Json                       // Pop a path and a JSON document, and push the value found at that path as a string.
+	Csv                        // Pop a string, and push the list of its comma separated fields.
+	Cidrmatch                  // Pop an IP address and a CIDR network, and push whether the network contains the address.
+	GeoipCountry               // Pop an IP address, and push its country code from the GeoIP database.
+	Lookup                     // Pop a key, and push the string stored under it in the lookup table at operand.
+	GeoipAsn                   // Pop an IP address, and push its autonomous system number from the GeoIP database.
+	Length                     // Compute the length of a string.
+	Cat                        // string concatenation
+	Setmatched                 // Set "matched" flag
+	Otherwise                  // Only match if "matched" flag is false.
+	Del                        // Pop `operand` keys and metric off stack, and remove the datum at metric[key,...] from memory
+	Expire                     // Set the expiry duration of a datum, perfoming the same as del but after the expiry time passes.
 
 	// Floating point ops
 	Fadd
@@ -68,72 +103,138 @@ const (
 	S2f // string to float
 	I2s // int to string
 	F2s // float to string
+	F2i // float to int, truncating
 
 	// Typed comparisons, behave the same as cmp but do no conversion.
 	Icmp // integer compare
 	Fcmp // floating point compare
 	Scmp // string compare
 
+	Forward // Send the input line to the forward target.
+
+	// Function parameters
+	Lload  // Push the local variable at operand onto the stack.
+	Lstore // Pop the top of stack into the local variable at operand.
+
+	Jtab // Pop the top of stack and jump to its target in the JumpTable operand.
+	Vmap // Pop a string, and push its value in the ValueMap operand.
+
+	Normalize // Pop a label value, and push it rewritten by each Normalizer in operand.
+
+	Delmatch // Pop the keys and metric of a KeyMatch operand, and remove or expire each datum whose label values they match.
+
+	Sample // Push whether the line is one of the one in operand lines sampled by this instruction.
+
+	// Saving the "matched" flag around inlined function calls
+	Getmatched // Push the "matched" flag.
+	Popmatched // Pop the top of stack into the "matched" flag.
+
 	lastOpcode
 )
 
 var opNames = map[Opcode]string{
-	Stop:        "stop",
-	Match:       "match",
-	Smatch:      "smatch",
-	Cmp:         "cmp",
-	Jnm:         "jnm",
-	Jm:          "jm",
-	Jmp:         "jmp",
-	Inc:         "inc",
-	Strptime:    "strptime",
-	Timestamp:   "timestamp",
-	Settime:     "settime",
-	Push:        "push",
-	Capref:      "capref",
-	Str:         "str",
-	Sset:        "sset",
-	Iset:        "iset",
-	Iadd:        "iadd",
-	Isub:        "isub",
-	Imul:        "imul",
-	Idiv:        "idiv",
-	Imod:        "imod",
-	Ipow:        "ipow",
-	Shl:         "shl",
-	Shr:         "shr",
-	And:         "and",
-	Or:          "or",
-	Xor:         "xor",
-	Not:         "not",
-	Neg:         "neg",
-	Mload:       "mload",
-	Dload:       "dload",
-	Iget:        "iget",
-	Fget:        "fget",
-	Sget:        "sget",
-	Tolower:     "tolower",
-	Length:      "length",
-	Cat:         "cat",
-	Setmatched:  "setmatched",
-	Otherwise:   "otherwise",
-	Del:         "del",
-	Fadd:        "fadd",
-	Fsub:        "fsub",
-	Fmul:        "fmul",
-	Fdiv:        "fdiv",
-	Fmod:        "fmod",
-	Fpow:        "fpow",
-	Fset:        "fset",
-	Getfilename: "getfilename",
-	I2f:         "i2f",
-	S2i:         "s2i",
-	S2f:         "s2f",
-	I2s:         "i2s",
-	F2s:         "f2s",
-	Icmp:        "icmp",
-	Fcmp:        "fcmp",
-	Scmp:        "scmp",
+	Stop:         "stop",
+	Match:        "match",
+	Smatch:       "smatch",
+	Pmatch:       "pmatch",
+	Cmp:          "cmp",
+	Jnm:          "jnm",
+	Jm:           "jm",
+	Jmp:          "jmp",
+	Inc:          "inc",
+	Strptime:     "strptime",
+	Rfc3339:      "rfc3339",
+	Timestamp:    "timestamp",
+	Settime:      "settime",
+	SettimeMs:    "settime_ms",
+	SettimeNs:    "settime_ns",
+	Rate:         "rate",
+	Delta:        "delta",
+	Movavg:       "movavg",
+	Duration:     "duration",
+	Floor:        "floor",
+	Ceil:         "ceil",
+	Round:        "round",
+	Abs:          "abs",
+	Log:          "log",
+	Hour:         "hour",
+	Weekday:      "weekday",
+	Strftime:     "strftime",
+	Push:         "push",
+	Capref:       "capref",
+	Str:          "str",
+	Sset:         "sset",
+	Iset:         "iset",
+	Bset:         "bset",
+	Eset:         "eset",
+	Aset:         "aset",
+	Iadd:         "iadd",
+	Isub:         "isub",
+	Imul:         "imul",
+	Idiv:         "idiv",
+	Imod:         "imod",
+	Ipow:         "ipow",
+	Shl:          "shl",
+	Shr:          "shr",
+	And:          "and",
+	Or:           "or",
+	Xor:          "xor",
+	Not:          "not",
+	Neg:          "neg",
+	Mload:        "mload",
+	Dload:        "dload",
+	Dpeek:        "dpeek",
+	Iget:         "iget",
+	Fget:         "fget",
+	Sget:         "sget",
+	Tolower:      "tolower",
+	Toupper:      "toupper",
+	Trim:         "trim",
+	Substr:       "substr",
+	Subst:        "subst",
+	Rsubst:       "rsubst",
+	Split:        "split",
+	Lindex:       "lindex",
+	Logfmt:       "logfmt",
+	Mindex:       "mindex",
+	Json:         "json",
+	Csv:          "csv",
+	Cidrmatch:    "cidrmatch",
+	GeoipCountry: "geoip_country",
+	GeoipAsn:     "geoip_asn",
+	Lookup:       "lookup",
+	Length:       "length",
+	Cat:          "cat",
+	Setmatched:   "setmatched",
+	Otherwise:    "otherwise",
+	Del:          "del",
+	Fadd:         "fadd",
+	Fsub:         "fsub",
+	Fmul:         "fmul",
+	Fdiv:         "fdiv",
+	Fmod:         "fmod",
+	Fpow:         "fpow",
+	Fset:         "fset",
+	Getfilename:  "getfilename",
+	I2f:          "i2f",
+	S2i:          "s2i",
+	S2f:          "s2f",
+	I2s:          "i2s",
+	F2s:          "f2s",
+	F2i:          "f2i",
+	Icmp:         "icmp",
+	Fcmp:         "fcmp",
+	Scmp:         "scmp",
+	Forward:      "forward",
+	Lload:        "lload",
+	Lstore:       "lstore",
+	Jtab:         "jtab",
+	Vmap:         "vmap",
+	Normalize:    "normalize",
+	Delmatch:     "delmatch",
+	Sample:       "sample",
+	Getmatched:   "getmatched",
+	Popmatched:   "popmatched",
 }
 
 func (o Opcode) String() string {
@@ -6,7 +6,10 @@ package codegen
 import (
 	"fmt"
 	"math"
+	"os"
 	"regexp"
+	"regexp/syntax"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -31,14 +34,43 @@ type codegen struct {
 
 	l     []int           // Label table for recording jump destinations.
 	decos []*ast.DecoStmt // Decorator stack to unwind when entering decorated blocks.
+
+	returns []int // Stack of labels to jump to on return from an inlined function call.
+	locals  int   // Number of local variable slots allocated to function parameters and local variables.
+
+	flaps     map[*symbol.Symbol]int            // Address of the flap counter of each bool metric.
+	halfLives map[*symbol.Symbol]time.Duration  // Half-life of each ewma metric.
+	aggs      map[*symbol.Symbol]code.Aggregate // Statistic and interval of each min, max or stddev metric.
+
+	normalizers map[*symbol.Symbol][][]code.Normalizer // Normalizers of each key of the metrics with any.
+
+	namespace string // Prefix of the names of the exported metrics, if any.
+
+	condDepth int // Number of condition blocks enclosing the current node.
+
+	sampleRate int64 // Product of the rates of the sample blocks enclosing the current node, or zero if none.
+
+	stmt *position.Position // Position of the statement being generated, recorded with each instruction.
+
+	re RegexOptions // Options for compiling the program's regular expressions.
+}
+
+// RegexOptions select the semantics of the regular expressions in a program.
+// The zero value is the default RE2 syntax and leftmost-first matching.
+type RegexOptions struct {
+	Longest        bool `json:"longest"`          // Use leftmost-longest matching.
+	POSIX          bool `json:"posix"`            // Restrict the syntax to POSIX ERE, with leftmost-longest matching.
+	MaxProgramSize int  `json:"max_program_size"` // Limit each expression to this many instructions, if positive.
 }
 
-// CodeGen is the function that compiles the program to bytecode and data.
-func CodeGen(name string, n ast.Node) (*object.Object, error) {
-	c := &codegen{name: name}
+// CodeGen is the function that compiles the program to bytecode and data,
+// with its regular expressions compiled with the options re.
+func CodeGen(name string, n ast.Node, re RegexOptions) (*object.Object, error) {
+	c := &codegen{name: name, re: re}
 	_ = ast.Walk(c, n)
 	c.writeJumps()
 	if len(c.errors) > 0 {
+		ReleaseRegexps(c.obj.Regexps)
 		return nil, c.errors
 	}
 	return &c.obj, nil
@@ -49,8 +81,45 @@ func (c *codegen) errorf(pos *position.Position, format string, args ...interfac
 	c.errors.Add(pos, e)
 }
 
+// compileRegex compiles the pattern of the node n with the program's regular
+// expression options, recording any error against n.  Identical expressions
+// are shared with other programs through the regex cache.
+func (c *codegen) compileRegex(pattern string, n ast.Node) *regexp.Regexp {
+	re, err := acquireRegex(pattern, c.re.POSIX, c.re.Longest || c.re.POSIX)
+	if err != nil {
+		c.errors.Add(n.Pos(), err.Error())
+		return nil
+	}
+	if c.re.MaxProgramSize > 0 {
+		flags := syntax.Perl
+		if c.re.POSIX {
+			flags = syntax.POSIX
+		}
+		release := func() { ReleaseRegexps([]*regexp.Regexp{re}) }
+		reAst, err := syntax.Parse(pattern, flags)
+		if err != nil {
+			release()
+			c.errorf(n.Pos(), "%s", err)
+			return nil
+		}
+		prog, err := syntax.Compile(reAst.Simplify())
+		if err != nil {
+			release()
+			c.errorf(n.Pos(), "%s", err)
+			return nil
+		}
+		if len(prog.Inst) > c.re.MaxProgramSize {
+			release()
+			c.errors.Add(n.Pos(), fmt.Sprintf("Regular expression compiles to %d instructions, more than the limit of %d.", len(prog.Inst), c.re.MaxProgramSize))
+			return nil
+		}
+	}
+	return re
+}
+
 func (c *codegen) emit(i code.Instr) {
 	c.obj.Program = append(c.obj.Program, i)
+	c.obj.Lines = append(c.obj.Lines, c.stmt)
 }
 
 // newLabel creates a new label to jump to
@@ -72,6 +141,14 @@ func (c *codegen) pc() int {
 
 func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	switch n := node.(type) {
+	case *ast.StmtList:
+		outer := c.stmt
+		for i, child := range n.Children {
+			c.stmt = child.Pos()
+			n.Children[i] = ast.Walk(c, child)
+		}
+		c.stmt = outer
+		return nil, n
 
 	case *ast.VarDecl:
 		var name string
@@ -80,6 +157,10 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		} else {
 			name = n.Name
 		}
+		name = metrics.NameWithUnit(name, n.Unit, n.Kind)
+		if c.namespace != "" && !n.Hidden {
+			name = c.namespace + "_" + name
+		}
 		// If the Type is not in the map, then default to metrics.Int.  This is
 		// a hack for metrics that no type can be inferred, retaining
 		// historical behaviour.
@@ -95,6 +176,10 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			dtyp = metrics.String
 		case types.Equals(types.Buckets, t):
 			dtyp = metrics.Buckets
+		case types.Equals(types.Quantiles, t):
+			dtyp = metrics.Quantiles
+		case types.Equals(types.Distinct, t):
+			dtyp = metrics.Distinct
 		default:
 			if !types.IsComplete(t) {
 				glog.Infof("Incomplete type %v for %#v", t, n)
@@ -103,6 +188,11 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 		m := metrics.NewMetric(name, c.name, n.Kind, dtyp, n.Keys...)
 		m.SetSource(n.Pos().String())
+		m.Expiry = n.Expiry
+		m.TopK = int(n.TopK)
+		m.Limit = int(n.Limit)
+		m.Help = n.Help
+		m.Unit = n.Unit
 		// Scalar counters can be initialized to zero.  Dimensioned counters we
 		// don't know the values of the labels yet.  Gauges and Timers we can't
 		// assume start at zero.
@@ -126,18 +216,15 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 
 		if n.Kind == metrics.Histogram {
-			if len(n.Buckets) < 2 {
-				c.errorf(n.Pos(), "a histogram need at least two boundaries")
-				return nil, n
-			}
-			if n.Buckets[0] >= n.Buckets[1] {
-				c.errorf(n.Pos(), "buckets boundaries must be sorted")
+			if len(n.Buckets) < 1 {
+				c.errorf(n.Pos(), "a histogram need at least one boundary")
 				return nil, n
 			}
 
-			m.Buckets = append(m.Buckets, datum.Range{n.Buckets[0], n.Buckets[1]})
-			min := n.Buckets[1]
-			for _, max := range n.Buckets[2:] {
+			// The lowest bucket collects all observations below the first
+			// boundary, so that each boundary is the upper bound of a bucket.
+			min := math.Inf(-1)
+			for _, max := range n.Buckets {
 				if max <= min {
 					c.errorf(n.Pos(), "buckets boundaries must be sorted")
 					return nil, n
@@ -157,22 +244,100 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			}
 		}
 
+		if n.Kind == metrics.Summary {
+			m.Quantiles = append(m.Quantiles, n.Quantiles...)
+			if len(n.Keys) == 0 {
+				// Calling GetDatum here causes the storage to be allocated.
+				_, err := m.GetDatum()
+				if err != nil {
+					c.errorf(n.Pos(), "%s", err)
+					return nil, n
+				}
+			}
+		}
+
 		m.Hidden = n.Hidden
+		m.Persist = n.Persist
 		n.Symbol.Binding = m
 		n.Symbol.Addr = len(c.obj.Metrics)
 		c.obj.Metrics = append(c.obj.Metrics, m)
+
+		if n.Kind == metrics.Bool {
+			// Each change of value is counted in a companion counter with
+			// the same keys.
+			f := metrics.NewMetric(name+"_flaps_total", c.name, metrics.Counter, metrics.Int, n.Keys...)
+			f.SetSource(n.Pos().String())
+			f.Hidden = n.Hidden
+			f.Persist = n.Persist
+			f.Expiry = n.Expiry
+			if c.flaps == nil {
+				c.flaps = make(map[*symbol.Symbol]int)
+			}
+			c.flaps[n.Symbol] = len(c.obj.Metrics)
+			c.obj.Metrics = append(c.obj.Metrics, f)
+		}
+
+		if n.Kind == metrics.EWMA {
+			if c.halfLives == nil {
+				c.halfLives = make(map[*symbol.Symbol]time.Duration)
+			}
+			c.halfLives[n.Symbol] = n.HalfLife
+		}
+
+		if stat, ok := aggregateStats[n.Kind]; ok {
+			if c.aggs == nil {
+				c.aggs = make(map[*symbol.Symbol]code.Aggregate)
+			}
+			interval := n.Interval
+			if interval <= 0 {
+				interval = defaultAggregationInterval
+			}
+			c.aggs[n.Symbol] = code.Aggregate{Stat: stat, Interval: interval}
+		}
+
+		if len(n.Normalizers) > 0 {
+			if c.normalizers == nil {
+				c.normalizers = make(map[*symbol.Symbol][][]code.Normalizer)
+			}
+			keys := make([][]code.Normalizer, len(n.Keys))
+			for i, k := range n.Keys {
+				for _, nz := range n.Normalizers[k] {
+					keys[i] = append(keys[i], code.Normalizer{Name: nz.Name, Arg: int(nz.Arg)})
+				}
+			}
+			c.normalizers[n.Symbol] = keys
+		}
 		return nil, n
 
 	case *ast.CondStmt:
 		lElse := c.newLabel()
 		lEnd := c.newLabel()
 		if n.Cond != nil {
+			c.stmt = n.Cond.Pos()
 			n.Cond = ast.Walk(c, n.Cond)
 			c.emit(code.Instr{code.Jnm, lElse})
+			if c.condDepth == 0 {
+				if c.obj.Conditions == nil {
+					c.obj.Conditions = make(map[int]int)
+				}
+				c.obj.Conditions[c.pc()+1] = n.Cond.Pos().Line + 1
+			}
 		}
 		// Set matched flag false for children.
 		c.emit(code.Instr{code.Setmatched, false})
+		c.condDepth++
+		rate := c.sampleRate
+		if s, ok := n.Cond.(*ast.SampleExpr); ok {
+			// Increments in the block are scaled up to estimate the
+			// lines not sampled.
+			if c.sampleRate == 0 {
+				c.sampleRate = 1
+			}
+			c.sampleRate *= s.Rate
+		}
 		n.Truth = ast.Walk(c, n.Truth)
+		c.sampleRate = rate
+		c.condDepth--
 		// Re-set matched flag to true for rest of current block.
 		c.emit(code.Instr{code.Setmatched, true})
 		if n.Else != nil {
@@ -185,16 +350,115 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		c.setLabel(lEnd)
 		return nil, n
 
+	case *ast.SwitchStmt:
+		lEnd := c.newLabel()
+		n.Expr = ast.Walk(c, n.Expr)
+		jt := &code.JumpTable{Targets: make(map[interface{}]int), Default: lEnd}
+		c.emit(code.Instr{code.Jtab, jt})
+		for _, cc := range n.Cases {
+			lCase := c.newLabel()
+			if cc.Values == nil {
+				jt.Default = lCase
+			} else {
+				for _, v := range cc.Values.(*ast.ExprList).Children {
+					switch v := v.(type) {
+					case *ast.StringLit:
+						jt.Targets[v.Text] = lCase
+					case *ast.IntLit:
+						jt.Targets[v.I] = lCase
+					}
+				}
+			}
+			c.setLabel(lCase)
+			// Set matched flag false for children.
+			c.emit(code.Instr{code.Setmatched, false})
+			cc.Block = ast.Walk(c, cc.Block)
+			// Re-set matched flag to true for rest of current block.
+			c.emit(code.Instr{code.Setmatched, true})
+			c.emit(code.Instr{code.Jmp, lEnd})
+		}
+		c.setLabel(lEnd)
+		return nil, n
+
+	case *ast.MapExpr:
+		// Each pattern must match all of the value.
+		n.Expr = ast.Walk(c, n.Expr)
+		vmap := &code.ValueMap{}
+		for _, mc := range n.Cases {
+			if mc.Default {
+				vmap.Default = mc.Value
+				continue
+			}
+			re := c.compileRegex("^(?:"+mc.Pattern+")$", mc)
+			if re == nil {
+				return nil, n
+			}
+			c.obj.Regexps = append(c.obj.Regexps, re)
+			vmap.Regexps = append(vmap.Regexps, len(c.obj.Regexps)-1)
+			vmap.Values = append(vmap.Values, mc.Value)
+		}
+		c.emit(code.Instr{code.Vmap, vmap})
+		return nil, n
+
+	case *ast.BuiltinExpr:
+		switch n.Name {
+		case "getenv", "hostname", "shorthostname":
+			// The environment and hostname are read when the program is
+			// loaded, and the value is a constant string thereafter.
+			var s string
+			switch n.Name {
+			case "getenv":
+				s = os.Getenv(n.Args.(*ast.ExprList).Children[0].(*ast.StringLit).Text)
+			default:
+				h, err := os.Hostname()
+				if err != nil {
+					c.errorf(n.Pos(), "Can't get the hostname: %s", err)
+					return nil, n
+				}
+				if n.Name == "shorthostname" {
+					h = strings.SplitN(h, ".", 2)[0]
+				}
+				s = h
+			}
+			c.obj.Strings = append(c.obj.Strings, s)
+			c.emit(code.Instr{code.Str, len(c.obj.Strings) - 1})
+			return nil, n
+		}
+		if n.Name != "subst" {
+			break
+		}
+		args := n.Args.(*ast.ExprList).Children
+		pe, ok := args[0].(*ast.PatternExpr)
+		if !ok {
+			break
+		}
+		// The pattern is used to replace text in the last argument, not
+		// matched against the line.
+		re := c.compileRegex(pe.Pattern, pe)
+		if re == nil {
+			return nil, n
+		}
+		c.obj.Regexps = append(c.obj.Regexps, re)
+		pe.Index = len(c.obj.Regexps) - 1
+		for _, arg := range args[1:] {
+			ast.Walk(c, arg)
+		}
+		c.emit(code.Instr{code.Rsubst, pe.Index})
+		return nil, n
+
 	case *ast.PatternExpr:
-		re, err := regexp.Compile(n.Pattern)
-		if err != nil {
-			c.errorf(n.Pos(), "%s", err)
+		re := c.compileRegex(n.Pattern, n)
+		if re == nil {
 			return nil, n
 		}
 		c.obj.Regexps = append(c.obj.Regexps, re)
 		// Store the location of this regular expression in the patterNode
 		n.Index = len(c.obj.Regexps) - 1
-		c.emit(code.Instr{code.Match, n.Index})
+		if n.SyslogPriority {
+			c.emit(code.Instr{code.Pmatch, n.Index})
+		} else {
+			c.emit(code.Instr{code.Match, n.Index})
+		}
 
 	case *ast.StringLit:
 		c.obj.Strings = append(c.obj.Strings, n.Text)
@@ -206,10 +470,20 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.FloatLit:
 		c.emit(code.Instr{code.Push, n.F})
 
+	case *ast.BoolLit:
+		c.emit(code.Instr{code.Push, n.B})
+
+	case *ast.SampleExpr:
+		c.emit(code.Instr{code.Sample, n.Rate})
+
 	case *ast.StopStmt:
 		c.emit(code.Instr{code.Stop, nil})
 
 	case *ast.IdTerm:
+		if n.Symbol != nil && (n.Symbol.Kind == symbol.ParamSymbol || n.Symbol.Kind == symbol.LocalSymbol) {
+			c.emit(code.Instr{code.Lload, n.Symbol.Addr})
+			break
+		}
 		if n.Symbol == nil || n.Symbol.Kind != symbol.VarSymbol {
 			break
 		}
@@ -219,7 +493,13 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 		c.emit(code.Instr{code.Mload, n.Symbol.Addr})
 		m := n.Symbol.Binding.(*metrics.Metric)
-		c.emit(code.Instr{code.Dload, len(m.Keys)})
+		if m.Limit > 0 && !n.Lvalue {
+			// Reading a key that a limited metric doesn't have mustn't
+			// evict one it does.
+			c.emit(code.Instr{code.Dpeek, len(m.Keys)})
+		} else {
+			c.emit(code.Instr{code.Dload, len(m.Keys)})
+		}
 
 		if !n.Lvalue {
 			t := n.Type()
@@ -235,6 +515,11 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 				c.emit(code.Instr{code.Iget, nil})
 			case types.Equals(t, types.String):
 				c.emit(code.Instr{code.Sget, nil})
+			case types.Equals(t, types.Bool):
+				// Bool metrics are stored as 0 or 1.
+				c.emit(code.Instr{code.Iget, nil})
+				c.emit(code.Instr{code.Push, int64(1)})
+				c.emit(code.Instr{code.Icmp, 0})
 			default:
 				c.errorf(n.Pos(), "invalid type for get %q in %#v", n.Type(), n)
 			}
@@ -258,14 +543,32 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 
 	case *ast.IndexedExpr:
+		if _, ok := n.Lhs.(*ast.BuiltinExpr); ok {
+			// Index into the list or map returned by the builtin.
+			ast.Walk(c, n.Lhs)
+			ast.Walk(c, n.Index)
+			if types.IsMap(n.Lhs.Type().Root()) {
+				c.emit(code.Instr{Opcode: code.Mindex})
+			} else {
+				c.emit(code.Instr{Opcode: code.Lindex})
+			}
+			return nil, n
+		}
+		var normalizers [][]code.Normalizer
+		if id, ok := n.Lhs.(*ast.IdTerm); ok && id.Symbol != nil {
+			normalizers = c.normalizers[id.Symbol]
+		}
 		if args, ok := n.Index.(*ast.ExprList); ok {
-			for _, arg := range args.Children {
+			for i, arg := range args.Children {
 				_ = ast.Walk(c, arg)
 				if types.Equals(arg.Type(), types.Float) {
 					c.emit(code.Instr{code.F2s, nil})
 				} else if types.Equals(arg.Type(), types.Int) {
 					c.emit(code.Instr{code.I2s, nil})
 				}
+				if i < len(normalizers) && len(normalizers[i]) > 0 {
+					c.emit(code.Instr{code.Normalize, normalizers[i]})
+				}
 			}
 		}
 		ast.Walk(c, n.Lhs)
@@ -275,6 +578,11 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		// Do nothing, defs are inlined.
 		return nil, n
 
+	case *ast.LookupDecl:
+		n.Symbol.Addr = len(c.obj.Lookups)
+		c.obj.Lookups = append(c.obj.Lookups, n.Table)
+		return nil, n
+
 	case *ast.DecoStmt:
 		// Put the current block on the stack
 		c.decos = append(c.decos, n)
@@ -287,6 +595,82 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		c.decos = c.decos[:len(c.decos)-1]
 		return nil, n
 
+	case *ast.FuncDecl:
+		// Do nothing, function calls are inlined.
+		return nil, n
+
+	case *ast.FuncCall:
+		if n.Decl == nil {
+			c.errorf(n.Pos(), "No definition found for function %q", n.Name)
+			return nil, n
+		}
+		if n.Args != nil {
+			ast.Walk(c, n.Args)
+		}
+		// Give each parameter a new local variable for this call, and pop
+		// the arguments into them.
+		for i := len(n.Decl.Params) - 1; i >= 0; i-- {
+			p := n.Decl.Params[i]
+			p.Symbol.Addr = c.locals
+			c.locals++
+			c.emit(code.Instr{code.Lstore, p.Symbol.Addr})
+		}
+		// The function body is a block of its own, so its conditions must
+		// not change the caller's matched flag, even when it returns from
+		// inside one.
+		saved := -1
+		if setsMatched(n.Decl.Block) {
+			saved = c.locals
+			c.locals++
+			c.emit(code.Instr{Opcode: code.Getmatched})
+			c.emit(code.Instr{code.Lstore, saved})
+			c.emit(code.Instr{code.Setmatched, false})
+		}
+		lReturn := c.newLabel()
+		c.returns = append(c.returns, lReturn)
+		ast.Walk(c, n.Decl.Block)
+		c.returns = c.returns[:len(c.returns)-1]
+		// Falling off the end of the function returns the zero value of the return type.
+		switch {
+		case types.Equals(n.Decl.Returns, types.None):
+		case types.Equals(n.Decl.Returns, types.Int):
+			c.emit(code.Instr{code.Push, int64(0)})
+		case types.Equals(n.Decl.Returns, types.Float):
+			c.emit(code.Instr{code.Push, float64(0)})
+		case types.Equals(n.Decl.Returns, types.String):
+			c.obj.Strings = append(c.obj.Strings, "")
+			c.emit(code.Instr{code.Str, len(c.obj.Strings) - 1})
+		case types.Equals(n.Decl.Returns, types.Bool):
+			c.emit(code.Instr{code.Push, false})
+		default:
+			c.errorf(n.Pos(), "invalid return type %q for function %q", n.Decl.Returns, n.Name)
+			return nil, n
+		}
+		c.setLabel(lReturn)
+		if saved >= 0 {
+			c.emit(code.Instr{code.Lload, saved})
+			c.emit(code.Instr{Opcode: code.Popmatched})
+		}
+		return nil, n
+
+	case *ast.LetStmt:
+		ast.Walk(c, n.Expr)
+		n.Symbol.Addr = c.locals
+		c.locals++
+		c.emit(code.Instr{code.Lstore, n.Symbol.Addr})
+		return nil, n
+
+	case *ast.ReturnStmt:
+		if len(c.returns) == 0 {
+			c.errorf(n.Pos(), "return outside of a function")
+			return nil, n
+		}
+		if n.Expr != nil {
+			ast.Walk(c, n.Expr)
+		}
+		c.emit(code.Instr{code.Jmp, c.returns[len(c.returns)-1]})
+		return nil, n
+
 	case *ast.NextStmt:
 		// Visit the 'next' block on the decorated block stack
 		deco := c.decos[len(c.decos)-1]
@@ -307,6 +691,36 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		if n.Expiry > 0 {
 			c.obj.Program[pc].Opcode = code.Expire
 		}
+		if globs, ok := keyGlobs(n.N.(*ast.IndexedExpr)); ok {
+			c.obj.Program[pc] = code.Instr{code.Delmatch, code.KeyMatch{Globs: globs, Expire: n.Expiry > 0}}
+		}
+
+	case *ast.NamespaceStmt:
+		c.namespace = n.Name
+
+	case *ast.TimezoneStmt:
+		loc, err := time.LoadLocation(n.Name)
+		if err != nil {
+			c.errorf(n.Pos(), "%s", err)
+			return nil, n
+		}
+		c.obj.Location = loc
+
+	case *ast.WildcardTerm:
+		c.obj.Strings = append(c.obj.Strings, "*")
+		c.emit(code.Instr{code.Str, len(c.obj.Strings) - 1})
+
+	case *ast.TernaryExpr:
+		lElse := c.newLabel()
+		lEnd := c.newLabel()
+		n.Cond = ast.Walk(c, n.Cond)
+		c.emit(code.Instr{code.Jnm, lElse})
+		n.Truth = ast.Walk(c, n.Truth)
+		c.emit(code.Instr{code.Jmp, lEnd})
+		c.setLabel(lElse)
+		n.Else = ast.Walk(c, n.Else)
+		c.setLabel(lEnd)
+		return nil, n
 
 	case *ast.BinaryExpr:
 		switch n.Op {
@@ -338,6 +752,31 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.setLabel(lEnd)
 			return nil, n
 
+		case parser.ASSIGN:
+			if f, ok := c.flaps[lvalueSymbol(n.Lhs)]; ok {
+				// Load the flap counter datum after the bool metric datum
+				// and the condition, by walking the lhs again and loading
+				// the flap counter in place of the bool metric.
+				ast.Walk(c, n.Lhs)
+				ast.Walk(c, n.Rhs)
+				ast.Walk(c, n.Lhs)
+				c.obj.Program[c.pc()-1].Operand = f
+				c.emit(code.Instr{code.Bset, nil})
+				return nil, n
+			}
+			if h, ok := c.halfLives[lvalueSymbol(n.Lhs)]; ok {
+				ast.Walk(c, n.Lhs)
+				ast.Walk(c, n.Rhs)
+				c.emit(code.Instr{code.Eset, h})
+				return nil, n
+			}
+			if a, ok := c.aggs[lvalueSymbol(n.Lhs)]; ok {
+				ast.Walk(c, n.Lhs)
+				ast.Walk(c, n.Rhs)
+				c.emit(code.Instr{code.Aset, a})
+				return nil, n
+			}
+
 		case parser.ADD_ASSIGN:
 			if !types.Equals(n.Type(), types.Int) {
 				// Double-emit the lhs so that it can be assigned to
@@ -387,13 +826,41 @@ func getOpcodeForType(op int, opT types.Type) (code.Opcode, error) {
 }
 
 var builtin = map[string]code.Opcode{
-	"getfilename": code.Getfilename,
-	"len":         code.Length,
-	"settime":     code.Settime,
-	"strptime":    code.Strptime,
-	"strtol":      code.S2i,
-	"timestamp":   code.Timestamp,
-	"tolower":     code.Tolower,
+	"cidrmatch":     code.Cidrmatch,
+	"geoip_asn":     code.GeoipAsn,
+	"geoip_country": code.GeoipCountry,
+	"csv":           code.Csv,
+	"delta":         code.Delta,
+	"forward":       code.Forward,
+	"getfilename":   code.Getfilename,
+	"json":          code.Json,
+	"len":           code.Length,
+	"logfmt":        code.Logfmt,
+	"movavg":        code.Movavg,
+	"duration":      code.Duration,
+	"floor":         code.Floor,
+	"ceil":          code.Ceil,
+	"round":         code.Round,
+	"abs":           code.Abs,
+	"pow":           code.Fpow,
+	"log":           code.Log,
+	"hour":          code.Hour,
+	"weekday":       code.Weekday,
+	"strftime":      code.Strftime,
+	"rate":          code.Rate,
+	"rfc3339":       code.Rfc3339,
+	"settime":       code.Settime,
+	"settime_ms":    code.SettimeMs,
+	"settime_ns":    code.SettimeNs,
+	"split":         code.Split,
+	"strptime":      code.Strptime,
+	"strtol":        code.S2i,
+	"subst":         code.Subst,
+	"substr":        code.Substr,
+	"timestamp":     code.Timestamp,
+	"tolower":       code.Tolower,
+	"toupper":       code.Toupper,
+	"trim":          code.Trim,
 }
 
 func (c *codegen) VisitAfter(node ast.Node) ast.Node {
@@ -418,17 +885,42 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 
+		case "hex":
+			// hex(x) is strtol(x, 16), which allows a 0x prefix.
+			c.emit(code.Instr{code.Push, int64(16)})
+			c.emit(code.Instr{code.S2i, 2})
+
+		case "json":
+			c.emit(code.Instr{builtin[n.Name], arglen})
+			// The value is found as a string, and converted to the type
+			// inferred from where it is used.
+			if types.Equals(types.Int, n.Type()) {
+				c.emit(code.Instr{code.S2i, nil})
+			} else if types.Equals(types.Float, n.Type()) {
+				c.emit(code.Instr{code.S2f, nil})
+			}
+
 		default:
 			c.emit(code.Instr{builtin[n.Name], arglen})
 		}
 	case *ast.UnaryExpr:
 		switch n.Op {
-		case parser.INC:
-			c.emit(code.Instr{Opcode: code.Inc})
-		case parser.DEC:
-			c.emit(code.Instr{Opcode: code.Dec})
+		case parser.INC, parser.DEC:
+			op := code.Inc
+			if n.Op == parser.DEC {
+				op = code.Dec
+			}
+			if c.sampleRate > 1 {
+				// When operand is not nil, the delta is on the stack.
+				c.emit(code.Instr{code.Push, c.sampleRate})
+				c.emit(code.Instr{op, 0})
+			} else {
+				c.emit(code.Instr{Opcode: op})
+			}
 		case parser.NOT:
 			c.emit(code.Instr{Opcode: code.Neg})
+		case parser.LNOT:
+			c.emit(code.Instr{Opcode: code.Not})
 		}
 	case *ast.BinaryExpr:
 		switch n.Op {
@@ -458,13 +950,13 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 				jumpOp = code.Jm
 			}
 			cmpOp := code.Cmp
-			if types.Equals(n.Lhs.Type(), n.Rhs.Type()) {
-				switch n.Lhs.Type() {
-				case types.Float:
+			if t := n.Lhs.Type(); types.Equals(t, n.Rhs.Type()) {
+				switch {
+				case types.Equals(types.Float, t):
 					cmpOp = code.Fcmp
-				case types.Int:
+				case types.Equals(types.Int, t):
 					cmpOp = code.Icmp
-				case types.String:
+				case types.Equals(types.String, t):
 					cmpOp = code.Scmp
 				default:
 					cmpOp = code.Cmp
@@ -481,8 +973,16 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 			// When operand is not nil, inc pops the delta from the stack.
 			switch {
 			case types.Equals(n.Type(), types.Int):
+				if c.sampleRate > 1 {
+					c.emit(code.Instr{code.Push, c.sampleRate})
+					c.emit(code.Instr{Opcode: code.Imul})
+				}
 				c.emit(code.Instr{code.Inc, 0})
 			case types.Equals(n.Type(), types.Float), types.Equals(n.Type(), types.String):
+				if c.sampleRate > 1 && types.Equals(n.Type(), types.Float) {
+					c.emit(code.Instr{code.Push, float64(c.sampleRate)})
+					c.emit(code.Instr{Opcode: code.Fmul})
+				}
 				// Already walked the lhs and rhs of this expression
 				opcode, err := getOpcodeForType(parser.PLUS, n.Type())
 				if err != nil {
@@ -540,6 +1040,9 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 			c.errorf(n.Pos(), "internal error: %s on node %v", err.Error(), n)
 			return n
 		}
+
+	case *ast.LookupExpr:
+		c.emit(code.Instr{code.Lookup, n.Symbol.Addr})
 	}
 	return node
 }
@@ -557,6 +1060,9 @@ func (c *codegen) emitConversion(inType, outType types.Type) error {
 		c.emit(code.Instr{Opcode: code.F2s})
 	case types.Equals(types.Int, inType) && types.Equals(types.String, outType):
 		c.emit(code.Instr{Opcode: code.I2s})
+	case types.Equals(types.Float, inType) && types.Equals(types.Int, outType):
+		// Only by an explicit int(), as the checker never truncates floats.
+		c.emit(code.Instr{Opcode: code.F2i})
 	case types.Equals(types.Pattern, inType) && types.Equals(types.Bool, outType):
 		// nothing, pattern is implicit bool
 	case types.Equals(inType, outType):
@@ -567,6 +1073,29 @@ func (c *codegen) emitConversion(inType, outType types.Type) error {
 	return nil
 }
 
+// defaultAggregationInterval is the interval over which min, max and stddev
+// metrics aggregate their observations if their declaration doesn't set one.
+const defaultAggregationInterval = time.Minute
+
+// aggregateStats names the statistic held by each kind of aggregating metric.
+var aggregateStats = map[metrics.Kind]string{
+	metrics.Min:    "min",
+	metrics.Max:    "max",
+	metrics.Stddev: "stddev",
+}
+
+// lvalueSymbol returns the symbol of the metric assigned to by the lhs n, or
+// nil if n isn't a metric.
+func lvalueSymbol(n ast.Node) *symbol.Symbol {
+	if v, ok := n.(*ast.IndexedExpr); ok {
+		n = v.Lhs
+	}
+	if v, ok := n.(*ast.IdTerm); ok {
+		return v.Symbol
+	}
+	return nil
+}
+
 func (c *codegen) writeJumps() {
 	for j, i := range c.obj.Program {
 		switch i.Opcode {
@@ -582,6 +1111,61 @@ func (c *codegen) writeJumps() {
 				continue
 			}
 			c.obj.Program[j].Operand = c.l[index]
+
+		case code.Jtab:
+			jt := i.Operand.(*code.JumpTable)
+			for k, index := range jt.Targets {
+				jt.Targets[k] = c.l[index]
+			}
+			jt.Default = c.l[jt.Default]
+		}
+	}
+}
+
+// setsMatched returns true if the function body n reads or changes the matched
+// flag, with a conditional, switch or otherwise statement.
+func setsMatched(n ast.Node) bool {
+	f := &matchedFinder{}
+	ast.Walk(f, n)
+	return f.found
+}
+
+// matchedFinder records whether a tree contains a statement that reads or
+// changes the matched flag.
+type matchedFinder struct {
+	found bool
+}
+
+func (f *matchedFinder) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
+	switch n.(type) {
+	case *ast.CondStmt, *ast.SwitchStmt, *ast.OtherwiseStmt:
+		f.found = true
+	}
+	return f, n
+}
+
+func (f *matchedFinder) VisitAfter(n ast.Node) ast.Node {
+	return n
+}
+
+// keyGlobs returns which keys of the del statement index n are glob patterns:
+// wildcards, and string constants containing a `*'.  It returns false if none
+// are.
+func keyGlobs(n *ast.IndexedExpr) ([]bool, bool) {
+	args, ok := n.Index.(*ast.ExprList)
+	if !ok {
+		return nil, false
+	}
+	globs := make([]bool, len(args.Children))
+	any := false
+	for i, arg := range args.Children {
+		switch v := arg.(type) {
+		case *ast.WildcardTerm:
+			globs[i] = true
+		case *ast.StringLit:
+			globs[i] = strings.Contains(v.Text, "*")
 		}
+		any = any || globs[i]
 	}
+	return globs, any
 }
@@ -4,6 +4,7 @@
 package codegen_test
 
 import (
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/google/mtail/internal/vm/checker"
 	"github.com/google/mtail/internal/vm/code"
 	"github.com/google/mtail/internal/vm/codegen"
+	"github.com/google/mtail/internal/vm/object"
 	"github.com/google/mtail/internal/vm/parser"
 )
 
@@ -41,6 +43,20 @@ var testCodeGenPrograms = []struct {
 			{code.Dload, 0},
 			{code.Inc, nil},
 			{code.Setmatched, true}}},
+	{"syslog priority",
+		"counter c by severity\n/(?p)sshd/ { c[$syslog_severity]++\n }\n",
+		[]code.Instr{
+			{code.Pmatch, 0},
+			{code.Jnm, 11},
+			{code.Setmatched, false},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.S2i, nil},
+			{code.I2s, nil},
+			{code.Mload, 0},
+			{code.Dload, 1},
+			{code.Inc, nil},
+			{code.Setmatched, true}}},
 	{"strptime and capref",
 		"counter foo\n" +
 			"/(.*)/ { strptime($1, \"2006-01-02T15:04:05\")\n" +
@@ -73,6 +89,29 @@ var testCodeGenPrograms = []struct {
 			{code.Dload, 0},
 			{code.Inc, nil},
 			{code.Setmatched, true}}},
+	{"strptime failure branch",
+		"counter errors\n" +
+			"/(.*)/ {\n" +
+			"  !strptime($1, \"2006-01-02T15:04:05\") {\n" +
+			"    errors++\n" +
+			"  }\n" +
+			"}\n",
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 15},
+			{code.Setmatched, false},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.Str, 0},
+			{code.Strptime, 2},
+			{code.Not, nil},
+			{code.Jnm, 14},
+			{code.Setmatched, false},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Inc, nil},
+			{code.Setmatched, true},
+			{code.Setmatched, true}}},
 	{"inc by and set",
 		"counter foo\ncounter bar\n" +
 			"/([0-9]+)/ {\n" +
@@ -115,6 +154,104 @@ var testCodeGenPrograms = []struct {
 			{code.Dload, 0},
 			{code.Inc, nil},
 			{code.Setmatched, true}}},
+	{"logical not",
+		"counter foo\n" +
+			"!/a/ {\n" +
+			"  foo++\n" +
+			"}\n",
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Not, nil},
+			{code.Jnm, 8},
+			{code.Setmatched, false},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Inc, nil},
+			{code.Setmatched, true}}},
+	{"ternary",
+		"gauge foo\n" +
+			"/(\\d+)/ {\n" +
+			"  foo = $1 > 1 ? 2 : 0.5\n" +
+			"}\n",
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 21},
+			{code.Setmatched, false},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.S2i, nil},
+			{code.Push, int64(1)},
+			{code.Icmp, 1},
+			{code.Jnm, 13},
+			{code.Push, true},
+			{code.Jmp, 14},
+			{code.Push, false},
+			{code.Jnm, 18},
+			{code.Push, int64(2)},
+			{code.I2f, nil},
+			{code.Jmp, 19},
+			{code.Push, 0.5},
+			{code.Fset, nil},
+			{code.Setmatched, true}}},
+	{"bool metric",
+		"bool up by s\n" +
+			"/(\\w+)/ {\n" +
+			"  up[$1] = true\n" +
+			"}\n",
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 14},
+			{code.Setmatched, false},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.Mload, 0},
+			{code.Dload, 1},
+			{code.Push, true},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.Mload, 1},
+			{code.Dload, 1},
+			{code.Bset, nil},
+			{code.Setmatched, true}}},
+	{"logical precedence",
+		"counter foo\n" +
+			"/a/ || 1 > 0 && 2 > 1 {\n" +
+			"  foo++\n" +
+			"}\n",
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jm, 24},
+			{code.Push, int64(1)},
+			{code.Push, int64(0)},
+			{code.Icmp, 1},
+			{code.Jnm, 8},
+			{code.Push, true},
+			{code.Jmp, 9},
+			{code.Push, false},
+			{code.Jnm, 20},
+			{code.Push, int64(2)},
+			{code.Push, int64(1)},
+			{code.Icmp, 1},
+			{code.Jnm, 16},
+			{code.Push, true},
+			{code.Jmp, 17},
+			{code.Push, false},
+			{code.Jnm, 20},
+			{code.Push, true},
+			{code.Jmp, 21},
+			{code.Push, false},
+			{code.Jm, 24},
+			{code.Push, false},
+			{code.Jmp, 25},
+			{code.Push, true},
+			{code.Jnm, 31},
+			{code.Setmatched, false},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Inc, nil},
+			{code.Setmatched, true}}},
 	{"cond expr lt",
 		"counter foo\n" +
 			"1 < 0 {\n" +
@@ -266,7 +403,7 @@ var testCodeGenPrograms = []struct {
 			{code.Str, 0},
 			{code.Length, 1},
 			{code.Push, int64(0)},
-			{code.Cmp, 1},
+			{code.Icmp, 1},
 			{code.Jnm, 7},
 			{code.Push, true},
 			{code.Jmp, 8},
@@ -294,6 +431,36 @@ var testCodeGenPrograms = []struct {
 			{code.Push, int64(1)},
 			{code.Push, int64(20)},
 			{code.Shr, nil}}},
+	{"bitwise comparison", `
+counter c
+/(\d+)/ {
+  $1 & 4 != 0 {
+    c++
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 21},
+			{code.Setmatched, false},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.S2i, nil},
+			{code.Push, int64(4)},
+			{code.And, nil},
+			{code.Push, int64(0)},
+			{code.Icmp, 0},
+			{code.Jm, 13},
+			{code.Push, true},
+			{code.Jmp, 14},
+			{code.Push, false},
+			{code.Jnm, 20},
+			{code.Setmatched, false},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Inc, nil},
+			{code.Setmatched, true},
+			{code.Setmatched, true}}},
 	{"pow", `
 /(\d+) (\d+)/ {
 $1 ** $2
@@ -327,6 +494,28 @@ strtol("deadbeef", 16)
 			{code.Str, 0},
 			{code.Push, int64(16)},
 			{code.S2i, 2}}},
+	{"int of float", `
+gauge g
+/(\d+)/ {
+  g = int(float($1) / 2)
+}
+`,
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 15},
+			{code.Setmatched, false},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.S2i, nil},
+			{code.I2f, nil},
+			{code.Push, int64(2)},
+			{code.I2f, nil},
+			{code.Fdiv, nil},
+			{code.F2i, nil},
+			{code.Iset, nil},
+			{code.Setmatched, true}}},
 	{"float", `
 20.0
 `,
@@ -374,6 +563,67 @@ counter bar
 			{code.Inc, nil},
 		},
 	},
+	{"switch",
+		`counter get
+counter other
+/(\w+)/ {
+  switch $1 {
+    case "GET", "HEAD" {
+      get++
+    }
+    default {
+      other++
+    }
+  }
+}`,
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 19},
+			{code.Setmatched, false},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.Jtab, &code.JumpTable{Targets: map[interface{}]int{"GET": 6, "HEAD": 6}, Default: 12}},
+			{code.Setmatched, false},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Inc, nil},
+			{code.Setmatched, true},
+			{code.Jmp, 18},
+			{code.Setmatched, false},
+			{code.Mload, 1},
+			{code.Dload, 0},
+			{code.Inc, nil},
+			{code.Setmatched, true},
+			{code.Jmp, 18},
+			{code.Setmatched, true},
+		},
+	},
+	{"cond elif",
+		`counter foo
+counter bar
+/a/ {
+  foo++
+} elif /b/ {
+  bar++
+}`,
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 8},
+			{code.Setmatched, false},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Inc, nil},
+			{code.Setmatched, true},
+			{code.Jmp, 15},
+			{code.Match, 1},
+			{code.Jnm, 15},
+			{code.Setmatched, false},
+			{code.Mload, 1},
+			{code.Dload, 0},
+			{code.Inc, nil},
+			{code.Setmatched, true},
+		},
+	},
 	{"mod",
 		`
 3 % 1
@@ -445,6 +695,186 @@ getfilename()
 		},
 	},
 
+	{"toupper trim", `
+toupper(trim(" a "))
+`,
+		[]code.Instr{
+			{code.Str, 0},
+			{code.Trim, 1},
+			{code.Toupper, 1},
+		},
+	},
+
+	{"subst pattern", `
+subst(/a+/, "b", "caat")
+`,
+		[]code.Instr{
+			{code.Str, 0},
+			{code.Str, 1},
+			{code.Rsubst, 0},
+		},
+	},
+
+	{"subst pattern constant", `
+const A /a+/
+subst(A, "b", "caat")
+`,
+		[]code.Instr{
+			{code.Str, 0},
+			{code.Str, 1},
+			{code.Rsubst, 0},
+		},
+	},
+
+	{"subst string substr", `
+substr(subst("a", "b", "caat"), 1, 2)
+`,
+		[]code.Instr{
+			{code.Str, 0},
+			{code.Str, 1},
+			{code.Str, 2},
+			{code.Subst, 3},
+			{code.Push, int64(1)},
+			{code.Push, int64(2)},
+			{code.Substr, 3},
+		},
+	},
+
+	{"split index", `
+counter c by user
+/(.*)/ {
+  c[split($1, ":")[0]]++
+}
+`,
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 13},
+			{code.Setmatched, false},
+			{code.Push, 0},
+			{code.Capref, 1},
+			{code.Str, 0},
+			{code.Split, 2},
+			{code.Push, int64(0)},
+			{code.Lindex, nil},
+			{code.Mload, 0},
+			{code.Dload, 1},
+			{code.Inc, nil},
+			{code.Setmatched, true},
+		},
+	},
+
+	{"logfmt index", `
+counter c by level
+/.*/ {
+  c[logfmt($0)["level"]]++
+}
+`,
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 12},
+			{code.Setmatched, false},
+			{code.Push, 0},
+			{code.Capref, 0},
+			{code.Logfmt, 1},
+			{code.Str, 0},
+			{code.Mindex, nil},
+			{code.Mload, 0},
+			{code.Dload, 1},
+			{code.Inc, nil},
+			{code.Setmatched, true},
+		},
+	},
+
+	{"json typed by use", `
+counter c by method
+gauge g
+/.*/ {
+  c[json($0, "method")]++
+  json($0, "ms") > 100 {
+    g = json($0, "ms")
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0},
+			{code.Jnm, 34},
+			{code.Setmatched, false},
+			{code.Push, 0},
+			{code.Capref, 0},
+			{code.Str, 0},
+			{code.Json, 2},
+			{code.Mload, 0},
+			{code.Dload, 1},
+			{code.Inc, nil},
+			{code.Push, 0},
+			{code.Capref, 0},
+			{code.Str, 1},
+			{code.Json, 2},
+			{code.S2f, nil},
+			{code.Push, int64(100)},
+			{code.I2f, nil},
+			{code.Fcmp, 1},
+			{code.Jnm, 21},
+			{code.Push, true},
+			{code.Jmp, 22},
+			{code.Push, false},
+			{code.Jnm, 33},
+			{code.Setmatched, false},
+			{code.Mload, 1},
+			{code.Dload, 0},
+			{code.Push, 0},
+			{code.Capref, 0},
+			{code.Str, 2},
+			{code.Json, 2},
+			{code.S2f, nil},
+			{code.Fset, nil},
+			{code.Setmatched, true},
+			{code.Setmatched, true},
+		},
+	},
+
+	{"forward", `
+forward()
+`,
+		[]code.Instr{
+			{code.Forward, 0},
+		},
+	},
+
+	{"function call", `
+counter c
+def add(x) {
+  c += x
+}
+add(2)
+`,
+		[]code.Instr{
+			{code.Push, int64(2)},
+			{code.Lstore, 0},
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Lload, 0},
+			{code.Inc, 0},
+		},
+	},
+
+	{"function return", `
+counter c
+def one() {
+  return 1
+}
+c = one()
+`,
+		[]code.Instr{
+			{code.Mload, 0},
+			{code.Dload, 0},
+			{code.Push, int64(1)},
+			{code.Jmp, 5},
+			{code.Push, int64(0)},
+			{code.Iset, nil},
+		},
+	},
+
 	{"dimensioned counter",
 		`counter c by a,b,c
 /(\d) (\d) (\d)/ {
@@ -821,6 +1251,31 @@ counter i
 		{code.Settime, 1},
 		{code.Setmatched, true},
 	}},
+	{"settime_ms", `
+/"ts":(\d+)/ {
+  settime_ms($1)
+}`, []code.Instr{
+		{code.Match, 0},
+		{code.Jnm, 8},
+		{code.Setmatched, false},
+		{code.Push, 0},
+		{code.Capref, 1},
+		{code.S2i, nil},
+		{code.SettimeMs, 1},
+		{code.Setmatched, true},
+	}},
+	{"rfc3339", `
+/^(\S+) / {
+  rfc3339($1)
+}`, []code.Instr{
+		{code.Match, 0},
+		{code.Jnm, 7},
+		{code.Setmatched, false},
+		{code.Push, 0},
+		{code.Capref, 1},
+		{code.Rfc3339, 1},
+		{code.Setmatched, true},
+	}},
 	{"cast to self", `
 /(\d+)/ {
 settime(int($1))
@@ -834,6 +1289,39 @@ settime(int($1))
 		{code.Settime, 1},
 		{code.Setmatched, true},
 	}},
+	{"lookup table", `
+lookup services from "services.csv"
+counter c by service
+/(\d+)/ {
+  c[lookup[services][$1]]++
+}`, []code.Instr{
+		{code.Match, 0},
+		{code.Jnm, 12},
+		{code.Setmatched, false},
+		{code.Push, 0},
+		{code.Capref, 1},
+		{code.S2i, nil},
+		{code.I2s, nil},
+		{code.Lookup, 0},
+		{code.Mload, 0},
+		{code.Dload, 1},
+		{code.Inc, nil},
+		{code.Setmatched, true},
+	}},
+	{"getenv", `
+counter c by region
+// {
+  c[getenv("REGION")]++
+}`, []code.Instr{
+		{code.Match, 0},
+		{code.Jnm, 8},
+		{code.Setmatched, false},
+		{code.Str, 0},
+		{code.Mload, 0},
+		{code.Dload, 1},
+		{code.Inc, nil},
+		{code.Setmatched, true},
+	}},
 	{"stop", `
 stop
 `, []code.Instr{
@@ -850,6 +1338,28 @@ stop
 		{code.Stop, nil},
 		{code.Setmatched, true},
 	}},
+	{"sample", `
+counter c
+sample 1/10 {
+  c++
+  c += 2
+}
+`, []code.Instr{
+		{code.Sample, int64(10)},
+		{code.Jnm, 14},
+		{code.Setmatched, false},
+		{code.Mload, 0},
+		{code.Dload, 0},
+		{code.Push, int64(10)},
+		{code.Inc, 0},
+		{code.Mload, 0},
+		{code.Dload, 0},
+		{code.Push, int64(2)},
+		{code.Push, int64(10)},
+		{code.Imul, nil},
+		{code.Inc, 0},
+		{code.Setmatched, true},
+	}},
 }
 
 func TestCodegen(t *testing.T) {
@@ -861,14 +1371,14 @@ func TestCodegen(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Parse error: %s", err)
 			}
-			ast, err = checker.Check(ast)
+			ast, err = checker.Check(ast, false)
 			s := parser.Sexp{}
 			s.EmitTypes = true
 			t.Log("Typed AST:\n" + s.Dump(ast))
 			if err != nil {
 				t.Fatalf("Check error: %s", err)
 			}
-			obj, err := codegen.CodeGen(tc.name, ast)
+			obj, err := codegen.CodeGen(tc.name, ast, codegen.RegexOptions{})
 			if err != nil {
 				t.Fatalf("Codegen error:\n%s", err)
 			}
@@ -880,3 +1390,134 @@ func TestCodegen(t *testing.T) {
 		})
 	}
 }
+
+func TestCodegenGetenv(t *testing.T) {
+	testutil.FatalIfErr(t, os.Setenv("MTAIL_TEST_REGION", "antarctica"))
+	defer os.Unsetenv("MTAIL_TEST_REGION")
+	ast, err := parser.Parse("getenv", strings.NewReader("text region\nregion = getenv(\"MTAIL_TEST_REGION\") + getenv(\"MTAIL_TEST_UNSET\")\n"))
+	testutil.FatalIfErr(t, err)
+	ast, err = checker.Check(ast, false)
+	testutil.FatalIfErr(t, err)
+	obj, err := codegen.CodeGen("getenv", ast, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	// The environment is read when the program is compiled.
+	if diff := testutil.Diff([]string{"antarctica", ""}, obj.Strings); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCodegenHostname(t *testing.T) {
+	hostname, err := os.Hostname()
+	testutil.FatalIfErr(t, err)
+	ast, err := parser.Parse("hostname", strings.NewReader("counter c by host, short\n// {\n  c[hostname(), shorthostname()]++\n}\n"))
+	testutil.FatalIfErr(t, err)
+	ast, err = checker.Check(ast, false)
+	testutil.FatalIfErr(t, err)
+	obj, err := codegen.CodeGen("hostname", ast, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff([]string{hostname, strings.SplitN(hostname, ".", 2)[0]}, obj.Strings); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCodegenNamespace(t *testing.T) {
+	ast, err := parser.Parse("namespace", strings.NewReader("namespace \"nginx\"\ncounter requests_total\ncounter errors as \"errors_total\"\nhidden counter seen\n/x/ {\n  requests_total++\n  errors++\n  seen++\n}\n"))
+	testutil.FatalIfErr(t, err)
+	ast, err = checker.Check(ast, false)
+	testutil.FatalIfErr(t, err)
+	obj, err := codegen.CodeGen("namespace", ast, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	var names []string
+	for _, m := range obj.Metrics {
+		names = append(names, m.Name)
+	}
+	if diff := testutil.Diff([]string{"nginx_requests_total", "nginx_errors_total", "seen"}, names); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCodegenUnit(t *testing.T) {
+	ast, err := parser.Parse("unit", strings.NewReader("namespace \"web\"\ngauge latency unit seconds\ngauge request_seconds unit seconds\ncounter sent_total unit bytes\ncounter received unit bytes\nhistogram size as \"body_size\" unit bytes buckets 1, 10\n/x/ {\n  latency = 1\n  request_seconds = 1\n  sent_total++\n  received++\n  size = 1\n}\n"))
+	testutil.FatalIfErr(t, err)
+	ast, err = checker.Check(ast, false)
+	testutil.FatalIfErr(t, err)
+	obj, err := codegen.CodeGen("unit", ast, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	var names []string
+	for _, m := range obj.Metrics {
+		names = append(names, m.Name+" "+m.Unit)
+	}
+	expected := []string{"web_latency_seconds seconds", "web_request_seconds seconds", "web_sent_bytes_total bytes", "web_received_bytes bytes", "web_body_size_bytes bytes"}
+	if diff := testutil.Diff(expected, names); diff != "" {
+		t.Error(diff)
+	}
+}
+
+var regexOptionsTests = []struct {
+	name     string
+	source   string
+	re       codegen.RegexOptions
+	expected string // the match of the program's regexp in "aab", if it compiles
+}{
+	{"leftmost first", "/a+|a+b/ {}\n", codegen.RegexOptions{}, "aa"},
+	{"longest", "/a+|a+b/ {}\n", codegen.RegexOptions{Longest: true}, "aab"},
+	{"posix", "/a+|a+b/ {}\n", codegen.RegexOptions{POSIX: true}, "aab"},
+	{"posix syntax", "/\\d+/ {}\n", codegen.RegexOptions{POSIX: true}, ""},
+	{"within size limit", "/a+b/ {}\n", codegen.RegexOptions{MaxProgramSize: 10}, "aab"},
+	{"over size limit", "/a{5}b/ {}\n", codegen.RegexOptions{MaxProgramSize: 5}, ""},
+}
+
+func TestCodegenRegexOptions(t *testing.T) {
+	for _, tc := range regexOptionsTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ast, err := parser.Parse(tc.name, strings.NewReader(tc.source))
+			testutil.FatalIfErr(t, err)
+			ast, err = checker.Check(ast, false)
+			testutil.FatalIfErr(t, err)
+			obj, err := codegen.CodeGen(tc.name, ast, tc.re)
+			if tc.expected == "" {
+				if err == nil {
+					t.Fatal("expected a compile error")
+				}
+				return
+			}
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, obj.Regexps[0].FindString("aab")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestCodegenRegexCache(t *testing.T) {
+	compile := func(name string, re codegen.RegexOptions) *object.Object {
+		ast, err := parser.Parse(name, strings.NewReader("counter c\n/shared pattern/ {\n  c++\n}\n"))
+		testutil.FatalIfErr(t, err)
+		ast, err = checker.Check(ast, false)
+		testutil.FatalIfErr(t, err)
+		obj, err := codegen.CodeGen(name, ast, re)
+		testutil.FatalIfErr(t, err)
+		return obj
+	}
+	a := compile("a", codegen.RegexOptions{})
+	b := compile("b", codegen.RegexOptions{})
+	if a.Regexps[0] != b.Regexps[0] {
+		t.Error("expected programs with the same pattern to share the compiled expression")
+	}
+	c := compile("c", codegen.RegexOptions{Longest: true})
+	if c.Regexps[0] == a.Regexps[0] {
+		t.Error("expected a different compiled expression for different options")
+	}
+	codegen.ReleaseRegexps(c.Regexps)
+	codegen.ReleaseRegexps(a.Regexps)
+	d := compile("d", codegen.RegexOptions{})
+	if d.Regexps[0] != b.Regexps[0] {
+		t.Error("expected the expression to stay cached while a program holds it")
+	}
+	codegen.ReleaseRegexps(b.Regexps)
+	codegen.ReleaseRegexps(d.Regexps)
+	if e := compile("e", codegen.RegexOptions{}); e.Regexps[0] == b.Regexps[0] {
+		t.Error("expected the expression to be compiled again once released by all programs")
+	}
+}
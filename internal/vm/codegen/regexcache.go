@@ -0,0 +1,99 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package codegen
+
+import (
+	"expvar"
+	"regexp"
+	"sync"
+)
+
+var (
+	// regexCacheEntries counts the distinct compiled regular expressions
+	// held by the cache.
+	regexCacheEntries = expvar.NewInt("regex_cache_entries")
+	// regexCacheHits counts the regular expressions shared from the cache
+	// instead of being compiled.
+	regexCacheHits = expvar.NewInt("regex_cache_hits_total")
+)
+
+// regexKey identifies a compiled regular expression by its pattern and the
+// options it is compiled with.
+type regexKey struct {
+	pattern string
+	posix   bool
+	longest bool
+}
+
+type regexEntry struct {
+	key  regexKey
+	re   *regexp.Regexp
+	refs int // Number of compiled programs using re.
+}
+
+// regexCache holds the compiled regular expressions of all the programs in
+// the process, so that programs using the same pattern share one compiled
+// expression.  A regexp.Regexp is safe for concurrent use, and is not
+// modified after it is added to the cache.
+var regexCache = struct {
+	sync.Mutex
+	byKey    map[regexKey]*regexEntry
+	byRegexp map[*regexp.Regexp]*regexEntry
+}{
+	byKey:    make(map[regexKey]*regexEntry),
+	byRegexp: make(map[*regexp.Regexp]*regexEntry),
+}
+
+// acquireRegex returns the compiled regular expression for pattern with the
+// given options, compiling it if no program already holds it, and adds a
+// reference to it.
+func acquireRegex(pattern string, posix, longest bool) (*regexp.Regexp, error) {
+	key := regexKey{pattern, posix, longest}
+	regexCache.Lock()
+	defer regexCache.Unlock()
+	if e, ok := regexCache.byKey[key]; ok {
+		e.refs++
+		regexCacheHits.Add(1)
+		return e.re, nil
+	}
+	var re *regexp.Regexp
+	var err error
+	if posix {
+		re, err = regexp.CompilePOSIX(pattern)
+	} else {
+		re, err = regexp.Compile(pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if longest {
+		re.Longest()
+	}
+	e := &regexEntry{key: key, re: re, refs: 1}
+	regexCache.byKey[key] = e
+	regexCache.byRegexp[re] = e
+	regexCacheEntries.Add(1)
+	return re, nil
+}
+
+// ReleaseRegexps drops a reference to each of the regular expressions of a
+// compiled program, such as when the program is unloaded, and removes those
+// that no program holds any more from the cache.  Expressions that did not
+// come from the cache are ignored.
+func ReleaseRegexps(res []*regexp.Regexp) {
+	regexCache.Lock()
+	defer regexCache.Unlock()
+	for _, re := range res {
+		e, ok := regexCache.byRegexp[re]
+		if !ok {
+			continue
+		}
+		e.refs--
+		if e.refs == 0 {
+			delete(regexCache.byKey, e.key)
+			delete(regexCache.byRegexp, re)
+			regexCacheEntries.Add(-1)
+		}
+	}
+}
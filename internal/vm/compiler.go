@@ -4,32 +4,46 @@
 package vm
 
 import (
+	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/checker"
 	"github.com/google/mtail/internal/vm/codegen"
+	"github.com/google/mtail/internal/vm/errors"
+	"github.com/google/mtail/internal/vm/gogen"
 	"github.com/google/mtail/internal/vm/parser"
 )
 
 // Compile compiles a program from the input into a virtual machine or a list
 // of compile errors.  It takes the program's name and the metric store as
-// additional arguments to build the virtual machine.
-func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location) (*VM, error) {
+// additional arguments to build the virtual machine.  If the name is a
+// pathname, files imported by the program are found relative to its
+// directory.  If strict is set, warnings about the program are compile errors.
+// The program's regular expressions are compiled with the options re, and it
+// is checked with the checker options opts.
+func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location, strict bool, re codegen.RegexOptions, opts ...checker.Option) (*VM, error) {
+	dir := filepath.Dir(name)
 	name = filepath.Base(name)
 
 	ast, err := parser.Parse(name, input)
 	if err != nil {
 		return nil, err
 	}
+	if _, err = resolveImports(ast, filepath.Join(dir, name)); err != nil {
+		return nil, err
+	}
 	if emitAst {
 		s := parser.Sexp{}
 		glog.Infof("%s AST:\n%s", name, s.Dump(ast))
 	}
 
-	if ast, err = checker.Check(ast); err != nil {
+	ast, warnings, err := checker.CheckWithWarnings(ast, strict, opts...)
+	if err != nil {
 		return nil, err
 	}
 	if emitAstTypes {
@@ -38,11 +52,168 @@ func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, sysl
 		glog.Infof("%s AST with Type Annotation:\n%s", name, s.Dump(ast))
 	}
 
-	obj, err := codegen.CodeGen(name, ast)
+	obj, err := codegen.CodeGen(name, ast, re)
 	if err != nil {
 		return nil, err
 	}
 
 	vm := New(name, obj, syslogUseCurrentYear, loc)
+	if len(warnings) > 0 {
+		vm.warnings = warnings
+	}
 	return vm, nil
 }
+
+// CompileGo compiles a program from the input into the source of a
+// standalone Go program that implements it, with the experimental Go code
+// generator.  Imports are resolved as by Compile, and if strict is set,
+// warnings about the program are compile errors.  It is checked with the
+// checker options opts.
+func CompileGo(name string, input io.Reader, strict bool, opts ...checker.Option) ([]byte, error) {
+	dir := filepath.Dir(name)
+	name = filepath.Base(name)
+
+	ast, err := parser.Parse(name, input)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = resolveImports(ast, filepath.Join(dir, name)); err != nil {
+		return nil, err
+	}
+	if ast, err = checker.Check(ast, strict, opts...); err != nil {
+		return nil, err
+	}
+	return gogen.Generate(name, ast)
+}
+
+// resolveImports parses the files imported by the program rooted at n, read
+// from pathname, and attaches their statements to each import statement.
+// Each file is imported at most once per program, so shared files can import
+// each other.  The lookup tables declared in each file are loaded too.  It
+// returns the absolute paths of all the files the program depends on,
+// including any that could not be imported or loaded.
+func resolveImports(n ast.Node, pathname string) ([]string, error) {
+	path, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil, err
+	}
+	r := &importResolver{seen: make(map[string]struct{})}
+	r.resolve(n, filepath.Dir(path), []string{path})
+	if len(r.errors) > 0 {
+		return r.deps, r.errors
+	}
+	return r.deps, nil
+}
+
+type importResolver struct {
+	seen   map[string]struct{} // absolute paths of files already imported
+	deps   []string
+	errors errors.ErrorList
+}
+
+// resolve imports the files named by the top level import statements of n.
+// The stack holds the absolute paths of the files being imported, to detect
+// cycles.
+func (r *importResolver) resolve(n ast.Node, dir string, stack []string) {
+	f := &importFinder{}
+	ast.Walk(f, n)
+	for _, s := range f.nested {
+		r.errors.Add(s.Pos(), "Imports are only allowed at the top level of a program.")
+	}
+	for _, d := range f.lookups {
+		// Lookup tables can be shared outside the program directory.
+		path := d.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if !contains(r.deps, path) {
+			r.deps = append(r.deps, path)
+		}
+		table, err := loadLookupTable(path)
+		if err != nil {
+			r.errors.Add(d.Pos(), fmt.Sprintf("Can't load lookup table %q: %s", d.Path, err))
+			continue
+		}
+		d.Table = table
+	}
+	for _, s := range f.imports {
+		if filepath.IsAbs(s.Path) {
+			r.errors.Add(s.Pos(), fmt.Sprintf("Import path %q must be relative to the importing file.", s.Path))
+			continue
+		}
+		path, err := filepath.Abs(filepath.Join(dir, s.Path))
+		if err != nil {
+			r.errors.Add(s.Pos(), err.Error())
+			continue
+		}
+		if contains(stack, path) {
+			r.errors.Add(s.Pos(), fmt.Sprintf("Import of %q creates a cycle.", s.Path))
+			continue
+		}
+		if _, ok := r.seen[path]; ok {
+			continue
+		}
+		r.seen[path] = struct{}{}
+		r.deps = append(r.deps, path)
+		f, err := os.Open(path)
+		if err != nil {
+			r.errors.Add(s.Pos(), fmt.Sprintf("Can't import %q: %s", s.Path, err))
+			continue
+		}
+		root, err := parser.Parse(s.Path, f)
+		if cerr := f.Close(); cerr != nil {
+			glog.Info(cerr)
+		}
+		if err != nil {
+			if el, ok := err.(errors.ErrorList); ok {
+				r.errors.Append(el)
+			} else {
+				r.errors.Add(s.Pos(), err.Error())
+			}
+			continue
+		}
+		r.resolve(root, filepath.Dir(path), append(stack, path))
+		s.Stmts = root.(*ast.StmtList).Children
+	}
+}
+
+func contains(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// importFinder collects the import statements in a program, separating out
+// those that are not at the top level, and the lookup table declarations.
+type importFinder struct {
+	depth   int
+	imports []*ast.ImportStmt
+	nested  []*ast.ImportStmt
+	lookups []*ast.LookupDecl
+}
+
+func (f *importFinder) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
+	switch n := n.(type) {
+	case *ast.StmtList:
+		f.depth++
+	case *ast.ImportStmt:
+		if f.depth > 1 {
+			f.nested = append(f.nested, n)
+		} else {
+			f.imports = append(f.imports, n)
+		}
+	case *ast.LookupDecl:
+		f.lookups = append(f.lookups, n)
+	}
+	return f, n
+}
+
+func (f *importFinder) VisitAfter(n ast.Node) ast.Node {
+	if _, ok := n.(*ast.StmtList); ok {
+		f.depth--
+	}
+	return n
+}
@@ -4,15 +4,20 @@
 package vm_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/vm"
+	"github.com/google/mtail/internal/vm/codegen"
 )
 
 func TestCompileParserError(t *testing.T) {
 	r := strings.NewReader("bad program")
-	_, err := vm.Compile("test", r, true, true, true, nil)
+	_, err := vm.Compile("test", r, true, true, true, nil, false, codegen.RegexOptions{})
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
@@ -22,7 +27,7 @@ func TestCompileCheckerError(t *testing.T) {
 	r := strings.NewReader(`// {
 i++
 }`)
-	_, err := vm.Compile("test", r, true, true, true, nil)
+	_, err := vm.Compile("test", r, true, true, true, nil, false, codegen.RegexOptions{})
 	if err == nil {
 		t.Error("expected error, got nil")
 	}
@@ -33,8 +38,124 @@ func TestCompileCodegen(t *testing.T) {
 // {
   i++
 }`)
-	_, err := vm.Compile("test", r, true, true, true, nil)
+	_, err := vm.Compile("test", r, true, true, true, nil, false, codegen.RegexOptions{})
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestCompileImport(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	// Not everything declared in an imported file need be used.
+	writeFile(t, filepath.Join(tmpDir, "common.mtail"), `const PREFIX /^\w+ /
+def syslog {
+  /(?P<host>\w+) / {
+    next
+  }
+}
+def double(x) {
+  return x * 2
+}
+counter unused
+`)
+	writeFile(t, filepath.Join(tmpDir, "lib", "more.mtail"), `import "../common.mtail"
+`)
+	writeFile(t, filepath.Join(tmpDir, "prog.mtail"), `import "common.mtail"
+import "lib/more.mtail"
+counter c
+/^/ + PREFIX + /(\d+)/ {
+  c += double($1)
+}
+`)
+	f, err := os.Open(filepath.Join(tmpDir, "prog.mtail"))
+	testutil.FatalIfErr(t, err)
+	defer f.Close()
+	if _, err := vm.Compile(filepath.Join(tmpDir, "prog.mtail"), f, false, false, true, nil, false, codegen.RegexOptions{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileLookup(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	writeFile(t, filepath.Join(tmpDir, "services.csv"), "www.example.com,web\n")
+	writeFile(t, filepath.Join(tmpDir, "lib", "ports.json"), `{"80": "http"}`)
+	writeFile(t, filepath.Join(tmpDir, "lib", "common.mtail"), `lookup ports from "ports.json"
+`)
+	writeFile(t, filepath.Join(tmpDir, "prog.mtail"), `import "lib/common.mtail"
+lookup services from "services.csv"
+counter c by service, proto
+/(?P<host>\S+) (?P<port>\d+)/ {
+  c[lookup[services][$host], lookup[ports][$port]]++
+}
+`)
+	f, err := os.Open(filepath.Join(tmpDir, "prog.mtail"))
+	testutil.FatalIfErr(t, err)
+	defer f.Close()
+	if _, err := vm.Compile(filepath.Join(tmpDir, "prog.mtail"), f, false, false, true, nil, false, codegen.RegexOptions{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileImportErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		files   map[string]string
+		program string
+		err     string
+	}{
+		{"missing",
+			nil,
+			"import \"missing.mtail\"\n",
+			"prog.mtail:1:1-6: Can't import \"missing.mtail\""},
+		{"cycle",
+			map[string]string{"a.mtail": "import \"prog.mtail\"\n"},
+			"import \"a.mtail\"\n",
+			"a.mtail:1:1-6: Import of \"prog.mtail\" creates a cycle."},
+		{"nested",
+			map[string]string{"a.mtail": "\n"},
+			"// {\n  import \"a.mtail\"\n}\n",
+			"prog.mtail:2:3-8: Imports are only allowed at the top level of a program."},
+		{"absolute",
+			nil,
+			"import \"/etc/a.mtail\"\n",
+			"prog.mtail:1:1-6: Import path \"/etc/a.mtail\" must be relative to the importing file."},
+		{"error in import",
+			map[string]string{"a.mtail": "i++\n"},
+			"import \"a.mtail\"\n",
+			"a.mtail:1:1: Identifier `i' not declared."},
+		{"missing lookup table",
+			nil,
+			"lookup services from \"services.csv\"\n",
+			"prog.mtail:1:8-15: Can't load lookup table \"services.csv\""},
+		{"invalid lookup table",
+			map[string]string{"services.json": "[]"},
+			"lookup services from \"services.json\"\n",
+			"prog.mtail:1:8-15: Can't load lookup table \"services.json\": expecting a JSON object"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+			for name, contents := range tc.files {
+				writeFile(t, filepath.Join(tmpDir, name), contents)
+			}
+			_, err := vm.Compile(filepath.Join(tmpDir, "prog.mtail"), strings.NewReader(tc.program), false, false, true, nil, false, codegen.RegexOptions{})
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error %q doesn't contain %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, name, contents string) {
+	t.Helper()
+	testutil.FatalIfErr(t, os.MkdirAll(filepath.Dir(name), 0700))
+	testutil.FatalIfErr(t, ioutil.WriteFile(name, []byte(contents), 0600))
+}
@@ -0,0 +1,25 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+)
+
+// parseCSV splits a line of comma separated values into its fields, as
+// described in RFC 4180.  Fields may be double quoted to include commas, and a
+// quote in a quoted field is written twice.  Quotes in unquoted fields are kept
+// as they are, so that loosely quoted logs can still be parsed.
+func parseCSV(s string) ([]string, error) {
+	r := csv.NewReader(strings.NewReader(s))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	fields, err := r.Read()
+	if err == io.EOF {
+		return []string{}, nil
+	}
+	return fields, err
+}
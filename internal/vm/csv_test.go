@@ -0,0 +1,54 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var parseCSVTests = []struct {
+	name     string
+	line     string
+	expected []string
+}{
+	{"empty",
+		"",
+		[]string{}},
+	{"simple",
+		"a,b,c",
+		[]string{"a", "b", "c"}},
+	{"empty fields",
+		",a,,",
+		[]string{"", "a", "", ""}},
+	{"quoted comma",
+		`1.2.3.4,"GET /a,b HTTP/1.1",200`,
+		[]string{"1.2.3.4", "GET /a,b HTTP/1.1", "200"}},
+	{"escaped quote",
+		`"say ""hi""",x`,
+		[]string{`say "hi"`, "x"}},
+	{"spaces kept",
+		" a , b ",
+		[]string{" a ", " b "}},
+	{"bare quote",
+		`a"b,c`,
+		[]string{`a"b`, "c"}},
+	{"unterminated quote",
+		`a,"b,c`,
+		[]string{"a", "b,c"}},
+}
+
+func TestParseCSV(t *testing.T) {
+	for _, tc := range parseCSVTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fields, err := parseCSV(tc.line)
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, fields); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -11,21 +11,48 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Classes of warning, about programs that compile but probably don't do what
+// was intended.  Warnings are only compile errors in strict mode.
+const (
+	Unused      = "unused"      // A capture group is never used.
+	Shadow      = "shadow"      // A capture group hides another of the same name.
+	Type        = "type"        // The type of a metric can't be inferred.
+	Unwritten   = "unwritten"   // A metric is read but never written.
+	Unreachable = "unreachable" // A block can never run.
+	Unmatched   = "unmatched"   // A capture group is used where its pattern didn't match.
+)
+
 type compileError struct {
-	pos position.Position
-	msg string
+	pos   position.Position
+	msg   string
+	class string // Set if this is a warning.
 }
 
 func (e compileError) Error() string {
+	if e.class != "" {
+		return e.pos.String() + ": " + e.msg + " (" + e.class + " warning)"
+	}
 	return e.pos.String() + ": " + e.msg
 }
 
+// Class returns the class of warning that this error is, or the empty string
+// if it is not a warning.
+func (e compileError) Class() string {
+	return e.class
+}
+
 // ErrorList contains a list of compile errors.
 type ErrorList []*compileError
 
 // Add appends an error at a position to the list of errors.
 func (p *ErrorList) Add(pos *position.Position, msg string) {
-	*p = append(*p, &compileError{*pos, msg})
+	*p = append(*p, &compileError{pos: *pos, msg: msg})
+}
+
+// AddWarning appends a warning of the given class at a position to the list
+// of errors.
+func (p *ErrorList) AddWarning(pos *position.Position, class, msg string) {
+	*p = append(*p, &compileError{*pos, msg, class})
 }
 
 // Append puts an ErrorList on the end of this ErrorList.
@@ -8,13 +8,15 @@ package vm
 import (
 	"bytes"
 	"flag"
+
+	"github.com/google/mtail/internal/vm/codegen"
 )
 
 func Fuzz(data []byte) int {
 	flag.Set("logtostderr", "true")
 	flag.Set("v", "2")
 	flag.Parse()
-	if _, err := Compile("fuzz", bytes.NewReader(data), true, true, false, nil); err != nil {
+	if _, err := Compile("fuzz", bytes.NewReader(data), true, true, false, nil, false, codegen.RegexOptions{}); err != nil {
 		return 0
 	}
 	return 1
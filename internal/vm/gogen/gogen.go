@@ -0,0 +1,457 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package gogen is an experimental backend for the mtail compiler that emits
+// the source of a standalone Go program instead of bytecode.  The generated
+// program reads log lines from the files named on its command line, or
+// standard input if none are, and writes the metrics in the Prometheus text
+// format to standard output when the input is exhausted.
+//
+// Only a subset of the language is supported: counters and gauges, with or
+// without keys; conditions on a regular expression; increments, additions
+// and assignments of constants and capture groups; and stop.  Any other
+// construct is a compile error.
+package gogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/vm/ast"
+	"github.com/google/mtail/internal/vm/errors"
+	"github.com/google/mtail/internal/vm/parser"
+	"github.com/google/mtail/internal/vm/symbol"
+	"github.com/google/mtail/internal/vm/types"
+)
+
+// generator represents the Go source generator.
+type generator struct {
+	name string // Name of the program.
+
+	errors errors.ErrorList // Any compile errors detected are accumulated here.
+
+	regexps []string                    // Patterns of the program's regular expressions, by index.
+	matches map[*ast.PatternExpr]string // Name of the submatch slice of each pattern condition.
+	metrics map[*symbol.Symbol]string   // Name of the variable holding each metric.
+	decls   []string                    // Declarations of the metric variables, in program order.
+	body    bytes.Buffer                // Body of the line processing function.
+	temps   int                         // Number of temporary variables allocated.
+
+	namespace string // Prefix of the names of the exported metrics, if any.
+}
+
+// Generate returns the formatted source of a Go program that implements the
+// checked program n, or a list of compile errors for the constructs that it
+// does not support.
+func Generate(name string, n ast.Node) ([]byte, error) {
+	g := &generator{
+		name:    name,
+		matches: make(map[*ast.PatternExpr]string),
+		metrics: make(map[*symbol.Symbol]string),
+	}
+	g.stmt(n)
+	if len(g.errors) > 0 {
+		return nil, g.errors
+	}
+	return format.Source(g.source())
+}
+
+func (g *generator) unsupported(n ast.Node, what string) {
+	g.errors.Add(n.Pos(), fmt.Sprintf("%s is not supported by the Go code generator.", what))
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.body, format, args...)
+}
+
+func (g *generator) temp(prefix string) string {
+	g.temps++
+	return fmt.Sprintf("%s%d", prefix, g.temps)
+}
+
+// stmt emits the code for the statement n.
+func (g *generator) stmt(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.StmtList:
+		for _, child := range n.Children {
+			g.stmt(child)
+		}
+
+	case *ast.ImportStmt:
+		for _, child := range n.Stmts {
+			g.stmt(child)
+		}
+
+	case *ast.NamespaceStmt:
+		g.namespace = n.Name
+
+	case *ast.TimezoneStmt:
+		// Nothing; the generated code doesn't parse times.
+
+	case *ast.VarDecl:
+		g.varDecl(n)
+
+	case *ast.CondStmt:
+		pe, ok := n.Cond.(*ast.PatternExpr)
+		if !ok {
+			g.unsupported(n.Cond, "A condition that is not a regular expression")
+			return
+		}
+		if pe.SyslogPriority {
+			g.unsupported(pe, "A pattern with the syslog priority flag")
+			return
+		}
+		if _, err := regexp.Compile(pe.Pattern); err != nil {
+			g.errors.Add(pe.Pos(), err.Error())
+			return
+		}
+		m := g.temp("m")
+		g.matches[pe] = m
+		g.printf("if %s := re%d.FindStringSubmatch(line); %s != nil {\n", m, len(g.regexps), m)
+		g.regexps = append(g.regexps, pe.Pattern)
+		g.stmt(n.Truth)
+		if n.Else != nil {
+			g.printf("} else {\n")
+			g.stmt(n.Else)
+		}
+		g.printf("}\n")
+
+	case *ast.UnaryExpr:
+		switch n.Op {
+		case parser.INC:
+			g.update(n.Expr, "add", "1")
+		case parser.DEC:
+			g.update(n.Expr, "add", "-1")
+		default:
+			g.unsupported(n, fmt.Sprintf("The %s operator", parser.Kind(n.Op)))
+		}
+
+	case *ast.BinaryExpr:
+		switch n.Op {
+		case parser.ADD_ASSIGN:
+			if v, ok := g.value(n.Rhs); ok {
+				g.update(n.Lhs, "add", v)
+			}
+		case parser.ASSIGN:
+			if v, ok := g.value(n.Rhs); ok {
+				g.update(n.Lhs, "set", v)
+			}
+		default:
+			g.unsupported(n, fmt.Sprintf("The %s operator in a statement", parser.Kind(n.Op)))
+		}
+
+	case *ast.StopStmt:
+		g.printf("return\n")
+
+	default:
+		g.unsupported(n, fmt.Sprintf("The %s statement", strings.TrimPrefix(fmt.Sprintf("%T", n), "*ast.")))
+	}
+}
+
+// varDecl declares the variable holding the metric declared by n.
+func (g *generator) varDecl(n *ast.VarDecl) {
+	// The symbol is recorded without a variable if the declaration is
+	// unsupported, so its uses are not errors too.
+	g.metrics[n.Symbol] = ""
+	if n.Kind != metrics.Counter && n.Kind != metrics.Gauge {
+		g.unsupported(n, fmt.Sprintf("A %s", strings.ToLower(n.Kind.String())))
+		return
+	}
+	if n.Expiry > 0 {
+		g.unsupported(n, "A limit on the age of a metric's values")
+		return
+	}
+	if n.Limit > 0 {
+		g.unsupported(n, "A limit on the number of a metric's values")
+		return
+	}
+	name := n.Name
+	if n.ExportedName != "" {
+		name = n.ExportedName
+	}
+	name = metrics.NameWithUnit(name, n.Unit, n.Kind)
+	if g.namespace != "" && !n.Hidden {
+		name = g.namespace + "_" + name
+	}
+	v := g.temp("metric")
+	g.metrics[n.Symbol] = v
+	g.decls = append(g.decls, fmt.Sprintf("%s = &metric{name: %q, kind: %q, keys: %#v, hidden: %t, values: make(map[string]float64)}",
+		v, name, strings.ToLower(n.Kind.String()), n.Keys, n.Hidden))
+}
+
+// update emits a call to the method of the metric named by the lvalue n,
+// with the value v.
+func (g *generator) update(n ast.Node, method, v string) {
+	var id *ast.IdTerm
+	var keys []string
+	switch n := n.(type) {
+	case *ast.IdTerm:
+		id = n
+	case *ast.IndexedExpr:
+		lhs, ok := n.Lhs.(*ast.IdTerm)
+		args, ok2 := n.Index.(*ast.ExprList)
+		if !ok || !ok2 {
+			g.unsupported(n, "An index expression that is not on a metric")
+			return
+		}
+		id = lhs
+		for _, arg := range args.Children {
+			k, ok := g.key(arg)
+			if !ok {
+				return
+			}
+			keys = append(keys, k)
+		}
+	default:
+		g.unsupported(n, "An assignment to an expression that is not a metric")
+		return
+	}
+	m, ok := g.metrics[id.Symbol]
+	if !ok {
+		g.unsupported(id, fmt.Sprintf("The variable %q", id.Name))
+		return
+	}
+	if m == "" {
+		return
+	}
+	g.printf("%s.%s(%s)\n", m, method, strings.Join(append([]string{v}, keys...), ", "))
+}
+
+// capref returns the expression for the text of the capture group n.
+func (g *generator) capref(n *ast.CaprefTerm) (string, bool) {
+	var m string
+	if n.Symbol != nil {
+		if pe, ok := n.Symbol.Binding.(*ast.PatternExpr); ok {
+			m = g.matches[pe]
+		}
+	}
+	if m == "" {
+		g.unsupported(n, fmt.Sprintf("The capture group reference $%s", n.Name))
+		return "", false
+	}
+	return fmt.Sprintf("%s[%d]", m, n.Symbol.Addr), true
+}
+
+// key returns the expression for the string value of the metric key n.
+func (g *generator) key(n ast.Node) (string, bool) {
+	switch n := n.(type) {
+	case *ast.StringLit:
+		return strconv.Quote(n.Text), true
+	case *ast.IntLit:
+		return strconv.Quote(strconv.FormatInt(n.I, 10)), true
+	case *ast.CaprefTerm:
+		s, ok := g.capref(n)
+		if !ok {
+			return "", false
+		}
+		switch {
+		case types.Equals(n.Type(), types.Int):
+			// Formatting the parsed number drops leading zeroes, as the VM does.
+			t := g.temp("k")
+			g.printf("%s, ok := intKey(%s)\nif !ok {\nreturn\n}\n", t, s)
+			return t, true
+		case types.Equals(n.Type(), types.String):
+			return s, true
+		}
+		g.unsupported(n, fmt.Sprintf("A metric key of type %s", n.Type()))
+		return "", false
+	case *ast.ConvExpr:
+		return g.key(n.N)
+	}
+	g.unsupported(n, fmt.Sprintf("The expression %s as a metric key", strings.TrimPrefix(fmt.Sprintf("%T", n), "*ast.")))
+	return "", false
+}
+
+// value returns the float64 expression for the value of n.
+func (g *generator) value(n ast.Node) (string, bool) {
+	switch n := n.(type) {
+	case *ast.IntLit:
+		return strconv.FormatInt(n.I, 10), true
+	case *ast.FloatLit:
+		return strconv.FormatFloat(n.F, 'g', -1, 64), true
+	case *ast.CaprefTerm:
+		s, ok := g.capref(n)
+		if !ok {
+			return "", false
+		}
+		parse := ""
+		switch {
+		case types.Equals(n.Type(), types.Int):
+			parse = "parseInt"
+		case types.Equals(n.Type(), types.Float):
+			parse = "parseFloat"
+		default:
+			g.unsupported(n, fmt.Sprintf("A value of type %s", n.Type()))
+			return "", false
+		}
+		// A capture group that is not a number ends processing of the line,
+		// like a runtime error in the VM.
+		t := g.temp("v")
+		g.printf("%s, ok := %s(%s)\nif !ok {\nreturn\n}\n", t, parse, s)
+		return t, true
+	case *ast.ConvExpr:
+		return g.value(n.N)
+	case *ast.BinaryExpr:
+		var op string
+		switch n.Op {
+		case parser.PLUS:
+			op = "+"
+		case parser.MINUS:
+			op = "-"
+		case parser.MUL:
+			op = "*"
+		default:
+			g.unsupported(n, fmt.Sprintf("The %s operator", parser.Kind(n.Op)))
+			return "", false
+		}
+		l, ok := g.value(n.Lhs)
+		if !ok {
+			return "", false
+		}
+		r, ok := g.value(n.Rhs)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("(%s %s %s)", l, op, r), true
+	}
+	g.unsupported(n, fmt.Sprintf("The expression %s", strings.TrimPrefix(fmt.Sprintf("%T", n), "*ast.")))
+	return "", false
+}
+
+// source returns the unformatted source of the generated program.
+func (g *generator) source() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by mtail from %s. DO NOT EDIT.\n\n", g.name)
+	fmt.Fprintf(&b, "package main\n\n%s\n", header)
+	fmt.Fprintf(&b, "const progName = %q\n\n", g.name)
+	b.WriteString("var (\n")
+	for i, re := range g.regexps {
+		fmt.Fprintf(&b, "re%d = regexp.MustCompile(%s)\n", i, strconv.Quote(re))
+	}
+	for _, d := range g.decls {
+		b.WriteString(d + "\n")
+	}
+	b.WriteString(")\n\n")
+	b.WriteString("func metricList() []*metric {\nreturn []*metric{")
+	var names []string
+	for _, d := range g.decls {
+		names = append(names, d[:strings.Index(d, " ")])
+	}
+	b.WriteString(strings.Join(names, ", "))
+	b.WriteString("}\n}\n\n")
+	b.WriteString("func processLine(line string) {\n")
+	b.Write(g.body.Bytes())
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// header is the part of the generated program that is the same for every
+// mtail program.
+const header = `import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metric holds the values of a metric, by the joined values of its keys.
+type metric struct {
+	name   string
+	kind   string
+	keys   []string
+	hidden bool
+	values map[string]float64
+}
+
+func (m *metric) add(v float64, keys ...string) {
+	m.values[strings.Join(keys, "\x00")] += v
+}
+
+func (m *metric) set(v float64, keys ...string) {
+	m.values[strings.Join(keys, "\x00")] = v
+}
+
+func (m *metric) write(w io.Writer) {
+	if m.hidden {
+		return
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	var ks []string
+	for k := range m.values {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		labels := []string{fmt.Sprintf("prog=%q", progName)}
+		if len(m.keys) > 0 {
+			for i, v := range strings.Split(k, "\x00") {
+				labels = append(labels, fmt.Sprintf("%s=%q", m.keys[i], v))
+			}
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", m.name, strings.Join(labels, ","), strconv.FormatFloat(m.values[k], 'f', -1, 64))
+	}
+}
+
+func parseInt(s string) (float64, bool) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	return float64(i), err == nil
+}
+
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+func intKey(s string) (string, bool) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	return strconv.FormatInt(i, 10), err == nil
+}
+
+func process(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		processLine(s.Text())
+	}
+	return s.Err()
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		if err := process(os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for _, name := range os.Args[1:] {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = process(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	for _, m := range metricList() {
+		m.write(w)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+`
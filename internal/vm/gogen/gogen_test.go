@@ -0,0 +1,100 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package gogen_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/checker"
+	"github.com/google/mtail/internal/vm/gogen"
+	"github.com/google/mtail/internal/vm/parser"
+)
+
+var generateTests = []struct {
+	name     string
+	source   string
+	expected []string // fragments of the generated source
+}{
+	{"line count",
+		"counter line_count\n/$/ { line_count++\n}\n",
+		[]string{
+			`re0     = regexp.MustCompile("$")`,
+			`metric1 = &metric{name: "line_count", kind: "counter", keys: []string(nil), hidden: false, values: make(map[string]float64)}`,
+			"if m2 := re0.FindStringSubmatch(line); m2 != nil {\n\t\tmetric1.add(1)\n\t}",
+		}},
+	{"keys and values",
+		`counter bytes by method as "http_bytes"
+gauge size
+/(?P<method>\w+) (?P<size>\d+)/ {
+  bytes[$method] += $size
+  size = $2 * 2
+}
+`,
+		[]string{
+			`name: "http_bytes", kind: "counter", keys: []string{"method"}`,
+			"v4, ok := parseInt(m3[2])\n\t\tif !ok {\n\t\t\treturn\n\t\t}\n\t\tmetric1.add(v4, m3[1])",
+			"metric2.set((v5 * 2))",
+		}},
+	{"else and stop",
+		"counter a\ncounter b\n/a/ {\n  a++\n  stop\n} else {\n  b++\n}\n",
+		[]string{
+			"metric1.add(1)\n\t\treturn\n\t} else {\n\t\tmetric2.add(1)\n\t}",
+		}},
+}
+
+func TestGenerate(t *testing.T) {
+	for _, tc := range generateTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ast, err := parser.Parse(tc.name, strings.NewReader(tc.source))
+			testutil.FatalIfErr(t, err)
+			ast, err = checker.Check(ast, false)
+			testutil.FatalIfErr(t, err)
+			src, err := gogen.Generate(tc.name, ast)
+			testutil.FatalIfErr(t, err)
+			for _, e := range tc.expected {
+				if !strings.Contains(string(src), e) {
+					t.Errorf("expected %q in generated source:\n%s", e, src)
+				}
+			}
+		})
+	}
+}
+
+var generateErrorTests = []struct {
+	name   string
+	source string
+	errors []string
+}{
+	{"histogram",
+		"histogram h buckets 1, 2\n/(\\d+)/ {\n  h = $1\n}\n",
+		[]string{"histogram:1:11: A histogram is not supported by the Go code generator."}},
+	{"relational condition",
+		"counter a\n1 < 2 {\n  a++\n}\n",
+		[]string{"relational condition:2:1-5: A condition that is not a regular expression is not supported by the Go code generator."}},
+	{"builtin",
+		"counter a by f\n// {\n  a[getfilename()]++\n}\n",
+		[]string{"builtin:3:17: The expression BuiltinExpr as a metric key is not supported by the Go code generator."}},
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for _, tc := range generateErrorTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ast, err := parser.Parse(tc.name, strings.NewReader(tc.source))
+			testutil.FatalIfErr(t, err)
+			ast, err = checker.Check(ast, false)
+			testutil.FatalIfErr(t, err)
+			_, err = gogen.Generate(tc.name, ast)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if diff := testutil.Diff(tc.errors, strings.Split(err.Error(), "\n")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
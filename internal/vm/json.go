@@ -0,0 +1,78 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// decodeJSON parses the JSON document in s.  Numbers are kept as json.Number
+// so that integers are not rounded through float64.
+func decodeJSON(s string) (interface{}, error) {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// lookupJSON returns the value at path in the decoded JSON document v, or nil
+// if there is none.  The path is a sequence of object member names separated
+// by dots, and array indexes in brackets, like "a.b[0].c".
+func lookupJSON(v interface{}, path string) interface{} {
+	for path != "" && v != nil {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil
+			}
+			i, err := strconv.Atoi(path[1:end])
+			a, ok := v.([]interface{})
+			if err != nil || !ok || i < 0 || i >= len(a) {
+				return nil
+			}
+			v, path = a[i], path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v, path = m[path[:end]], path[end:]
+		}
+	}
+	return v
+}
+
+// jsonString formats the decoded JSON value v as the string pushed by the
+// json builtin.  Strings and numbers are returned as their text, so that the
+// program can convert them to the type it expects.  Missing values and nulls
+// are the empty string, and objects and arrays are reencoded as JSON.
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var lookupJSONTests = []struct {
+	name     string
+	doc      string
+	path     string
+	expected string
+}{
+	{"top level string",
+		`{"a": "x"}`, "a", "x"},
+	{"nested",
+		`{"a": {"b": [{"c": 3}, {"c": 4}]}}`, "a.b[1].c", "4"},
+	{"large integer",
+		`{"id": 9007199254740993}`, "id", "9007199254740993"},
+	{"float",
+		`{"t": 0.25}`, "t", "0.25"},
+	{"bool",
+		`{"ok": true}`, "ok", "true"},
+	{"null",
+		`{"a": null}`, "a", ""},
+	{"object",
+		`{"a": {"b": 1}}`, "a", `{"b":1}`},
+	{"top level array",
+		`[1, 2]`, "[0]", "1"},
+	{"missing member",
+		`{"a": {}}`, "a.b.c", ""},
+	{"index out of range",
+		`{"a": [1]}`, "a[1]", ""},
+	{"index of object",
+		`{"a": {"0": 1}}`, "a[0]", ""},
+	{"bad index",
+		`{"a": [1]}`, "a[x]", ""},
+	{"unterminated index",
+		`{"a": [1]}`, "a[0", ""},
+	{"empty path",
+		`"x"`, "", "x"},
+}
+
+func TestLookupJSON(t *testing.T) {
+	for _, tc := range lookupJSONTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := decodeJSON(tc.doc)
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, jsonString(lookupJSON(v, tc.path))); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONInvalid(t *testing.T) {
+	if _, err := decodeJSON("not json"); err == nil {
+		t.Error("expected error")
+	}
+}
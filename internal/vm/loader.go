@@ -11,13 +11,17 @@ package vm
 // of mtail programs.
 
 import (
+	"bytes"
+	"encoding/json"
 	"expvar"
+	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +31,9 @@ import (
 
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/vm/checker"
+	"github.com/google/mtail/internal/vm/codegen"
+	"github.com/google/mtail/internal/vm/parser"
 	"github.com/google/mtail/internal/watcher"
 )
 
@@ -38,52 +45,190 @@ var (
 	// ProgLoadErrors counts the number of program load errors.
 	ProgLoadErrors    = expvar.NewMap("prog_load_errors")
 	progRuntimeErrors = expvar.NewMap("prog_runtime_errors")
+	// strptimeErrors counts the times that failed to parse in strptime(), per program.
+	strptimeErrors = expvar.NewMap("prog_strptime_errors_total")
+	// forwardUnconfigured counts the lines passed to forward() when no forward target is configured.
+	forwardUnconfigured = expvar.NewMap("prog_forward_unconfigured_total")
+	// conditionMatches counts the lines matched by each top-level condition, per program and source line.
+	conditionMatches = expvar.NewMap("prog_condition_matches_total")
+	// arithmeticErrors counts the divisions by zero, integer overflows, and negative histogram observations, per program.
+	arithmeticErrors = expvar.NewMap("prog_arithmetic_errors_total")
+	// geoipUnconfigured counts the calls to geoip_country() and geoip_asn() when no GeoIP database is configured.
+	geoipUnconfigured = expvar.NewMap("prog_geoip_unconfigured_total")
+	// progCompileSeconds is the time taken to compile each program when it was last loaded.
+	progCompileSeconds = expvar.NewMap("prog_compile_seconds")
+	// progInstructions is the number of bytecode instructions of each program.
+	progInstructions = expvar.NewMap("prog_bytecode_instructions")
+	// progRegexps is the number of regular expressions compiled for each program.
+	progRegexps = expvar.NewMap("prog_regexps")
 )
 
 const (
 	fileExt = ".mtail"
+	// ProgramQueueSize is the number of lines that can be waiting for each
+	// program before the dispatch of new lines blocks.
+	ProgramQueueSize = 1000
 )
 
-// LoadAllPrograms loads all programs in a directory and starts watching the
-// directory for filesystem changes.  Any compile errors are stored for later retrieival.
-// This function returns an error if an internal error occurs.
+// LoadAllPrograms loads all programs in the program paths, each a directory
+// or a single program, and starts watching them for filesystem changes.  Any
+// compile errors are stored for later retrieival.  Programs are named by their
+// filename, and a program in a later path overrides the programs of the same
+// name in the paths before it.  This function returns an error if an internal
+// error occurs.
 func (l *Loader) LoadAllPrograms() error {
-	s, err := os.Stat(l.programPath)
+	var files []string
+	for _, programPath := range strings.Split(l.programPath, ",") {
+		f, err := l.listPrograms(programPath)
+		if err != nil {
+			return err
+		}
+		files = append(files, f...)
+	}
+	// The files imported by each program were found while listing them, so
+	// that they are not loaded as programs themselves.
+	var programs []string
+	for _, programPath := range files {
+		if len(l.dependents(programPath)) > 0 {
+			glog.V(1).Infof("Not loading %s as a program because it is imported.", programPath)
+			continue
+		}
+		programs = append(programs, programPath)
+	}
+	for _, programPath := range l.overridePrograms(programs) {
+		if err := l.LoadProgram(programPath); err != nil {
+			if l.errorsAbort {
+				return err
+			}
+			glog.Warning(err)
+		}
+	}
+	return nil
+}
+
+// listPrograms starts watching programPath, and returns the files in it if it
+// is a directory, after scanning them for imports, or else programPath.
+func (l *Loader) listPrograms(programPath string) ([]string, error) {
+	s, err := os.Stat(programPath)
 	if err != nil {
-		return errors.Wrapf(err, "failed to stat %q", l.programPath)
+		return nil, errors.Wrapf(err, "failed to stat %q", programPath)
+	}
+	if err = l.w.Add(programPath, l.eventsHandle); err != nil {
+		glog.Infof("Failed to add watch on %q but continuing: %s", programPath, err)
 	}
-	if err = l.w.Add(l.programPath, l.eventsHandle); err != nil {
-		glog.Infof("Failed to add watch on %q but continuing: %s", l.programPath, err)
+	if !s.IsDir() {
+		return []string{programPath}, nil
 	}
-	switch {
-	case s.IsDir():
-		fis, rerr := ioutil.ReadDir(l.programPath)
-		if rerr != nil {
-			return errors.Wrapf(rerr, "Failed to list programs in %q", l.programPath)
+	fis, err := ioutil.ReadDir(programPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to list programs in %q", programPath)
+	}
+	var files []string
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
 		}
+		file := path.Join(programPath, fi.Name())
+		l.scanImports(file)
+		files = append(files, file)
+	}
+	return files, nil
+}
 
-		for _, fi := range fis {
-			if fi.IsDir() {
-				continue
-			}
-			err = l.LoadProgram(path.Join(l.programPath, fi.Name()))
-			if err != nil {
-				if l.errorsAbort {
-					return err
-				}
-				glog.Warning(err)
-			}
+// programPaths returns the absolute paths of the program paths, in order of
+// increasing precedence.
+func (l *Loader) programPaths() []string {
+	var paths []string
+	for _, programPath := range strings.Split(l.programPath, ",") {
+		if programPath == "" {
+			continue
 		}
-	default:
-		err = l.LoadProgram(l.programPath)
+		absPath, err := filepath.Abs(programPath)
 		if err != nil {
-			if l.errorsAbort {
-				return err
+			glog.V(1).Infof("Failed to canonicalize program path %q: %s", programPath, err)
+			continue
+		}
+		paths = append(paths, absPath)
+	}
+	return paths
+}
+
+// precedence returns the position in the program paths of the path, or of the
+// directory, that the program file at absPath was loaded from, or -1 if it is
+// in none of them.  When a program is in several paths, the last one wins.
+func (l *Loader) precedence(absPath string) int {
+	paths := l.programPaths()
+	for i := len(paths) - 1; i >= 0; i-- {
+		if paths[i] == absPath || paths[i] == filepath.Dir(absPath) {
+			return i
+		}
+	}
+	return -1
+}
+
+// overridePrograms returns the programs, without those overridden by a
+// program of the same name in a later program path.
+func (l *Loader) overridePrograms(programs []string) []string {
+	byName := make(map[string]string)
+	for _, programPath := range programs {
+		name := filepath.Base(programPath)
+		if prev, ok := byName[name]; ok && prev != programPath {
+			glog.Infof("Program %s overrides %s.", programPath, prev)
+		}
+		byName[name] = programPath
+	}
+	var r []string
+	for _, programPath := range programs {
+		if byName[filepath.Base(programPath)] == programPath {
+			r = append(r, programPath)
+		}
+	}
+	return r
+}
+
+// overridden returns the program of the given name with the highest
+// precedence in the program paths other than the file at absPath, or the
+// empty string if there is none.
+func (l *Loader) overridden(name, absPath string) string {
+	paths := l.programPaths()
+	for i := len(paths) - 1; i >= 0; i-- {
+		for _, file := range []string{paths[i], filepath.Join(paths[i], name)} {
+			if file == absPath || filepath.Base(file) != name {
+				continue
+			}
+			if s, err := os.Stat(file); err == nil && !s.IsDir() {
+				return file
 			}
-			glog.Warning(err)
 		}
 	}
-	return nil
+	return ""
+}
+
+// CheckPrograms compiles the programs at programPath without running them,
+// and returns the result of compiling each program, by program name.
+func CheckPrograms(programPath string) (map[string]error, error) {
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader(programPath, metrics.NewStore(), lines, w, func(l *Loader) error {
+		l.compileOnly = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = l.LoadAllPrograms()
+	close(lines)
+	<-l.VMsDone
+	if err != nil {
+		return nil, err
+	}
+	l.programErrorMu.RLock()
+	defer l.programErrorMu.RUnlock()
+	r := make(map[string]error, len(l.programErrors))
+	for name, err := range l.programErrors {
+		r[name] = err
+	}
+	return r, nil
 }
 
 // LoadProgram loads or reloads a program from the full pathname programPath.  The name of
@@ -94,23 +239,59 @@ func (l *Loader) LoadProgram(programPath string) error {
 		glog.V(2).Infof("Skipping %s because it is a hidden file.", programPath)
 		return nil
 	}
+	// A change to an imported file or lookup table reloads the programs that
+	// depend on it.
+	if dependents := l.dependents(programPath); len(dependents) > 0 {
+		for _, dependent := range dependents {
+			glog.Infof("Reloading %s because it depends on %s", dependent, programPath)
+			if err := l.LoadProgram(dependent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	if filepath.Ext(name) != fileExt {
 		glog.V(2).Infof("Skipping %s due to file extension.", programPath)
 		return nil
 	}
-	f, err := os.OpenFile(programPath, os.O_RDONLY, 0600)
+	b, err := ioutil.ReadFile(programPath)
 	if err != nil {
 		ProgLoadErrors.Add(name, 1)
 		return errors.Wrapf(err, "Failed to read program %q", programPath)
 	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			glog.Warning(err)
-		}
-	}()
+	absPath, err := filepath.Abs(programPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to canonicalize program path %q", programPath)
+	}
 	l.programErrorMu.Lock()
 	defer l.programErrorMu.Unlock()
-	l.programErrors[name] = l.CompileAndRun(name, f)
+	if owner, ok := l.programFiles[name]; ok && owner != absPath {
+		switch p, ownerP := l.precedence(absPath), l.precedence(owner); {
+		case p < 0 || p == ownerP:
+			ProgLoadErrors.Add(name, 1)
+			return errors.Errorf("Not loading %s, as the program %s is already loaded from %s.", absPath, name, owner)
+		case p < ownerP:
+			glog.V(1).Infof("Not loading %s, as it is overridden by %s.", absPath, owner)
+			return nil
+		}
+		glog.Infof("Program %s overrides %s.", absPath, owner)
+	}
+	l.programFiles[name] = absPath
+	deps := l.programDeps(programPath, bytes.NewReader(b))
+	l.imports[absPath] = deps
+	for _, dep := range deps {
+		if _, ok := l.imports[dep]; ok {
+			// The imported file was previously loaded as a program.
+			l.unloadImported(dep)
+		}
+		// Files in the program directory are already watched.
+		if filepath.Dir(dep) != filepath.Dir(absPath) {
+			if err := l.w.Add(dep, l.eventsHandle); err != nil {
+				glog.V(1).Infof("Failed to add watch on import %q: %s", dep, err)
+			}
+		}
+	}
+	l.programErrors[name] = l.CompileAndRun(programPath, bytes.NewReader(b))
 	if l.programErrors[name] != nil {
 		if l.errorsAbort {
 			return l.programErrors[name]
@@ -126,9 +307,11 @@ const loaderTemplate = `
 <tr>
 <th>program name</th>
 <th>errors</th>
+<th>warnings</th>
 <th>load errors</th>
 <th>load successes</th>
 <th>runtime errors</th>
+<th>queued lines</th>
 </tr>
 <tr>
 {{range $name, $errors := $.Errors}}
@@ -140,9 +323,11 @@ const loaderTemplate = `
 No compile errors
 {{end}}
 </td>
+<td>{{index $.Warnings $name}}</td>
 <td>{{index $.Loaderrors $name}}</td>
 <td>{{index $.Loadsuccess $name}}</td>
 <td>{{index $.RuntimeErrors $name}}</td>
+<td>{{index $.Queued $name}}</td>
 </tr>
 {{end}}
 </table>
@@ -158,15 +343,27 @@ func (l *Loader) WriteStatusHTML(w io.Writer) error {
 	defer l.programErrorMu.RUnlock()
 	data := struct {
 		Errors        map[string]error
+		Warnings      map[string]error
 		Loaderrors    map[string]string
 		Loadsuccess   map[string]string
 		RuntimeErrors map[string]string
+		Queued        map[string]int
 	}{
 		l.programErrors,
+		make(map[string]error),
 		make(map[string]string),
 		make(map[string]string),
 		make(map[string]string),
+		make(map[string]int),
+	}
+	l.handleMu.RLock()
+	for name, h := range l.handles {
+		data.Queued[name] = len(h.lines)
+		if h.vm.warnings != nil {
+			data.Warnings[name] = h.vm.warnings
+		}
 	}
+	l.handleMu.RUnlock()
 	for name := range l.programErrors {
 		if ProgLoadErrors.Get(name) != nil {
 			data.Loaderrors[name] = ProgLoadErrors.Get(name).String()
@@ -181,35 +378,159 @@ func (l *Loader) WriteStatusHTML(w io.Writer) error {
 	return t.Execute(w, data)
 }
 
+// scanImports records the files imported by the program at programPath.
+func (l *Loader) scanImports(programPath string) {
+	name := filepath.Base(programPath)
+	if strings.HasPrefix(name, ".") || filepath.Ext(name) != fileExt {
+		return
+	}
+	b, err := ioutil.ReadFile(programPath)
+	if err != nil {
+		glog.V(1).Info(err)
+		return
+	}
+	absPath, err := filepath.Abs(programPath)
+	if err != nil {
+		glog.V(1).Info(err)
+		return
+	}
+	l.programErrorMu.Lock()
+	defer l.programErrorMu.Unlock()
+	l.imports[absPath] = l.programDeps(programPath, bytes.NewReader(b))
+}
+
+// programDeps returns the absolute paths of the files the program read from
+// input depends on: the files it imports, and the regex manifest, so that a
+// change to the manifest reloads the program.
+func (l *Loader) programDeps(programPath string, input io.Reader) []string {
+	deps := programImports(programPath, input)
+	if l.regexManifest != "" {
+		if path, err := filepath.Abs(l.regexManifest); err == nil {
+			deps = append(deps, path)
+		}
+	}
+	return deps
+}
+
+// programImports returns the absolute paths of the files imported by the
+// program read from input, including those that can't be imported.
+func programImports(programPath string, input io.Reader) []string {
+	root, err := parser.Parse(filepath.Base(programPath), input)
+	if err != nil {
+		return nil
+	}
+	deps, _ := resolveImports(root, programPath)
+	return deps
+}
+
+// dependents returns the pathnames of the programs that import the file at
+// pathname.
+func (l *Loader) dependents(pathname string) []string {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil
+	}
+	l.programErrorMu.RLock()
+	defer l.programErrorMu.RUnlock()
+	var r []string
+	for program, deps := range l.imports {
+		if contains(deps, absPath) {
+			r = append(r, program)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+// unloadImported stops the program at pathname, because it is imported by
+// another program.  programErrorMu must be held.
+func (l *Loader) unloadImported(pathname string) {
+	name := filepath.Base(pathname)
+	delete(l.imports, pathname)
+	delete(l.programErrors, name)
+	l.handleMu.Lock()
+	defer l.handleMu.Unlock()
+	if handle, ok := l.handles[name]; ok {
+		handle.stop()
+		delete(l.handles, name)
+		glog.Infof("Stopped %s because it is imported by another program", name)
+	}
+}
+
 // CompileAndRun compiles a program read from the input, starting execution if
-// it succeeds.  If an existing virtual machine of the same name already
-// exists, the previous virtual machine is terminated and the new loaded over
-// it.  If the new program fails to compile, any existing virtual machine with
-// the same name remains running.
-func (l *Loader) CompileAndRun(name string, input io.Reader) error {
-	glog.V(2).Infof("CompileAndRun %s", name)
-	v, errs := Compile(name, input, l.dumpAst, l.dumpAstTypes, l.syslogUseCurrentYear, l.overrideLocation)
+// it succeeds.  The program's name is the basename of pathname, and files it
+// imports are found relative to the directory of pathname.  If an existing
+// virtual machine of the same name already exists, the previous virtual
+// machine is terminated and the new loaded over it.  If the new program fails
+// to compile, any existing virtual machine with the same name remains
+// running.
+func (l *Loader) CompileAndRun(pathname string, input io.Reader) error {
+	glog.V(2).Infof("CompileAndRun %s", pathname)
+	name := filepath.Base(pathname)
+	re, err := l.regexOptions(name)
+	if err != nil {
+		ProgLoadErrors.Add(name, 1)
+		return err
+	}
+	start := time.Now()
+	var opts []checker.Option
+	if l.strictTypes {
+		opts = append(opts, checker.StrictTypes())
+	}
+	v, errs := Compile(pathname, input, l.dumpAst, l.dumpAstTypes, l.syslogUseCurrentYear, l.overrideLocation, l.strict, re, opts...)
+	elapsed := time.Since(start)
 	if errs != nil {
 		ProgLoadErrors.Add(name, 1)
-		return errors.Errorf("compile failed for %s:\n%s", name, errs)
+		return &compileFailure{name, errs}
 	}
 	if v == nil {
 		ProgLoadErrors.Add(name, 1)
 		return errors.Errorf("Internal error: Compilation failed for %s: No program returned, but no errors.", name)
 	}
+	recordProgramSize(name, v, elapsed)
 
 	if l.dumpBytecode {
 		glog.Info("Dumping program objects and bytecode\n", v.DumpByteCode(name))
 	}
+	v.forwarder = l.forwarder
+	v.geoip = l.geoip
+	if l.countConditionMatches {
+		v.countConditionMatches()
+	}
+	if l.countUnmatchedLines {
+		v.reportMatches(l.lineDone)
+	}
+	v.arithmetic = l.arithmetic
+	if p, ok := l.programArithmetic[name]; ok {
+		v.arithmetic = p
+	}
+	v.overflow = l.overflow
+	if p, ok := l.programOverflow[name]; ok {
+		v.overflow = p
+	}
+	v.budget = l.budget
 
+	if l.uniqueMetricNames {
+		if err := l.metricNameCollisions(name, v.m); err != nil {
+			ProgLoadErrors.Add(name, 1)
+			codegen.ReleaseRegexps(v.re)
+			return err
+		}
+	}
+
+	reload := l.reload
+	if p, ok := l.programReload[name]; ok {
+		reload = p
+	}
 	// Load the metrics from the compilation into the global metric storage for export.
 	for _, m := range v.m {
 		if !m.Hidden {
 			if l.omitMetricSource {
 				m.Source = ""
 			}
-			err := l.ms.Add(m)
+			err := l.ms.AddWithPolicy(m, reload)
 			if err != nil {
+				codegen.ReleaseRegexps(v.re)
 				return err
 			}
 		}
@@ -219,6 +540,7 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 	glog.Infof("Loaded program %s", name)
 
 	if l.compileOnly {
+		codegen.ReleaseRegexps(v.re)
 		return nil
 	}
 
@@ -228,12 +550,17 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 	// Stop any previous VM.
 	if handle, ok := l.handles[name]; ok {
 		glog.Infof("END OF LINE, %s", name)
-		close(handle.lines)
-		<-handle.done
+		handle.stop()
 		glog.Infof("Stopped %s", name)
+		if handle.vm != nil {
+			v.carryPersistent(handle.vm, reload == metrics.ReloadKeep)
+		}
 	}
 
-	l.handles[name] = &vmHandle{make(chan *logline.LogLine), make(chan struct{})}
+	l.handles[name] = &vmHandle{make(chan *logline.LogLine, ProgramQueueSize), make(chan struct{}), v}
+	// The program is no longer quarantined once it has been replaced; a
+	// failed reload leaves the quarantined one running.
+	progQuarantined.Delete(name)
 	nameCode := nameToCode(name)
 	glog.Infof("Program %s has goroutine marker 0x%x", name, nameCode)
 	started := make(chan struct{})
@@ -244,6 +571,68 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 	return nil
 }
 
+// recordProgramSize exports the compile time, and the number of instructions
+// and regular expressions, of the program v called name, so that programs
+// that are expensive to run can be found before they are.
+func recordProgramSize(name string, v *VM, elapsed time.Duration) {
+	seconds := new(expvar.Float)
+	seconds.Set(elapsed.Seconds())
+	progCompileSeconds.Set(name, seconds)
+	instructions := new(expvar.Int)
+	instructions.Set(int64(len(v.prog)))
+	progInstructions.Set(name, instructions)
+	regexps := new(expvar.Int)
+	regexps.Set(int64(len(v.re)))
+	progRegexps.Set(name, regexps)
+}
+
+// metricNameCollisions returns an error listing the metrics in ms, of the
+// program called name, that another running program exports.
+func (l *Loader) metricNameCollisions(name string, ms []*metrics.Metric) error {
+	running := make(map[string]bool)
+	l.handleMu.RLock()
+	for prog := range l.handles {
+		running[prog] = prog != name
+	}
+	l.handleMu.RUnlock()
+	var collisions []string
+	l.ms.RLock()
+	for _, m := range ms {
+		if m.Hidden {
+			continue
+		}
+		for _, other := range l.ms.Metrics[m.Name] {
+			if running[other.Program] {
+				collisions = append(collisions, fmt.Sprintf("%s, also exported by %s", m.Name, other.Program))
+				break
+			}
+		}
+	}
+	l.ms.RUnlock()
+	if len(collisions) > 0 {
+		return errors.Errorf("Program %s exports metrics with the same names as other programs:\n\t%s", name, strings.Join(collisions, "\n\t"))
+	}
+	return nil
+}
+
+// regexOptions returns the regular expression options for the program called
+// name from the regex manifest, which is read again each time so that
+// changing it takes effect when the programs are reloaded.
+func (l *Loader) regexOptions(name string) (codegen.RegexOptions, error) {
+	if l.regexManifest == "" {
+		return codegen.RegexOptions{}, nil
+	}
+	b, err := ioutil.ReadFile(l.regexManifest)
+	if err != nil {
+		return codegen.RegexOptions{}, errors.Wrap(err, "can't read regex manifest")
+	}
+	var manifest map[string]codegen.RegexOptions
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return codegen.RegexOptions{}, errors.Wrapf(err, "can't parse regex manifest %q", l.regexManifest)
+	}
+	return manifest[name], nil
+}
+
 func nameToCode(name string) uint32 {
 	return uint32(name[0])<<24 | uint32(name[1])<<16 | uint32(name[2])<<8 | uint32(name[3])
 }
@@ -255,27 +644,48 @@ func nameToCode(name string) uint32 {
 type Loader struct {
 	ms          *metrics.Store  // pointer to metrics.Store to pass to compiler
 	w           watcher.Watcher // watches for program changes
-	programPath string          // Path that contains mtail programs.
+	programPath string          // Paths of mtail programs or directories containing them, separated by commas.
 
 	eventsHandle int // record the handle with which to add programs to the watcher
 
 	handleMu sync.RWMutex         // guards accesses to handles
 	handles  map[string]*vmHandle // map of program names to virtual machines
 
-	programErrorMu sync.RWMutex     // guards access to programErrors
-	programErrors  map[string]error // errors from the last compile attempt of the program
+	dispatchMu sync.Mutex                       // guards accesses to dispatched
+	dispatched map[*logline.LogLine]*dispatched // lines sent to the programs and not yet processed by all of them
+
+	programErrorMu sync.RWMutex        // guards access to programErrors
+	programErrors  map[string]error    // errors from the last compile attempt of the program
+	programFiles   map[string]string   // absolute path of the file of each program, by program name
+	imports        map[string][]string // absolute paths of the files imported by each program, by absolute program path
 
 	watcherDone chan struct{} // Synchronise shutdown of the watcher processEvents goroutine
 	VMsDone     chan struct{} // Notify mtail when all running VMs are shutdown.
 
-	overrideLocation     *time.Location // Instructs the vm to override the timezone with the specified zone.
-	compileOnly          bool           // Only compile programs and report errors, do not load VMs.
-	errorsAbort          bool           // Compiler errors abort the loader.
-	dumpAst              bool           // print the AST after parse
-	dumpAstTypes         bool           // print the AST after type check
-	dumpBytecode         bool           // Instructs the loader to dump to stdout the compiled program after compilation.
-	syslogUseCurrentYear bool           // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
-	omitMetricSource     bool
+	overrideLocation      *time.Location // Instructs the vm to override the timezone with the specified zone.
+	compileOnly           bool           // Only compile programs and report errors, do not load VMs.
+	strict                bool           // Warnings about programs are compile errors.
+	strictTypes           bool           // Implicit conversions between ints and floats, and metrics of unknown type, are compile errors.
+	regexManifest         string         // Path of the JSON file of regular expression options for each program.
+	errorsAbort           bool           // Compiler errors abort the loader.
+	dumpAst               bool           // print the AST after parse
+	dumpAstTypes          bool           // print the AST after type check
+	dumpBytecode          bool           // Instructs the loader to dump to stdout the compiled program after compilation.
+	syslogUseCurrentYear  bool           // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
+	omitMetricSource      bool
+	uniqueMetricNames     bool                            // Programs can't export metrics of the same name as other programs.
+	countConditionMatches bool                            // Count the lines matched by each top-level condition of the programs.
+	countUnmatchedLines   bool                            // Count the lines that no program matched, in lines_dropped_total.
+	arithmetic            arithmeticPolicy                // What programs do on arithmetic faults.
+	programArithmetic     map[string]arithmeticPolicy     // What each program named does on arithmetic faults, if not the default.
+	overflow              overflowPolicy                  // What programs do when an int metric overflows.
+	programOverflow       map[string]overflowPolicy       // What each program named does when an int metric overflows, if not the default.
+	budget                lineBudget                      // Limits of the work programs do on each line.
+	reload                metrics.ReloadPolicy            // What happens to the values of metrics when a program is reloaded.
+	programReload         map[string]metrics.ReloadPolicy // The reload policy of each program named, if not the default.
+	forwarder             Forwarder                       // Destination of lines passed to forward() in programs.
+	geoip                 GeoIP                           // Database used by geoip_country() and geoip_asn() in programs.
+	filter                LineFilter                      // Filters applied to lines before they are passed to the programs.
 }
 
 // OverrideLocation sets the timezone location for the VM.
@@ -292,6 +702,30 @@ func CompileOnly(l *Loader) error {
 	return ErrorsAbort(l)
 }
 
+// Strict sets the Loader to fail to compile programs with warnings.
+func Strict(l *Loader) error {
+	l.strict = true
+	return nil
+}
+
+// StrictTypes sets the Loader to fail to compile programs that convert
+// between ints and floats implicitly, or have metrics whose type can't be
+// inferred.
+func StrictTypes(l *Loader) error {
+	l.strictTypes = true
+	return nil
+}
+
+// RegexManifest sets the path of a JSON file of the regular expression
+// options used to compile each program, keyed by program filename.  Programs
+// are reloaded when it changes.
+func RegexManifest(path string) func(*Loader) error {
+	return func(l *Loader) error {
+		l.regexManifest = path
+		return nil
+	}
+}
+
 // ErrorsAbort sets the Loader to abort the Loader on compile errors.
 func ErrorsAbort(l *Loader) error {
 	l.errorsAbort = true
@@ -328,6 +762,146 @@ func OmitMetricSource(l *Loader) error {
 	return nil
 }
 
+// UniqueMetricNames instructs the Loader to fail to load a program that
+// exports a metric of the same name as another running program, for when the
+// metrics are exported without the program label to tell them apart.
+func UniqueMetricNames(l *Loader) error {
+	l.uniqueMetricNames = true
+	return nil
+}
+
+// CountConditionMatches instructs the Loader to count the lines matched by each
+// top-level condition of the programs, by program and source line.
+func CountConditionMatches(l *Loader) error {
+	l.countConditionMatches = true
+	return nil
+}
+
+// CountUnmatchedLines instructs the Loader to count the lines that none of the
+// programs matched, in lines_dropped_total.  Each line is then tracked until
+// all the programs have processed it.
+func CountUnmatchedLines(l *Loader) error {
+	l.countUnmatchedLines = true
+	return nil
+}
+
+// ArithmeticPolicies sets what programs do on a division by zero, an integer
+// overflow, or a negative observation of a histogram, from a comma separated
+// list of policies: skip to stop processing the line, or clamp to carry on
+// with the nearest value in range.  A policy given as program=policy applies
+// to that program only, e.g. "skip,legacy.mtail=clamp".
+func ArithmeticPolicies(spec string) func(*Loader) error {
+	return func(l *Loader) error {
+		var err error
+		l.arithmetic, l.programArithmetic, err = parseArithmeticPolicies(spec)
+		return err
+	}
+}
+
+// CounterOverflowPolicies sets what programs do when an int metric is
+// incremented past the largest int, from a comma separated list of policies:
+// wrap to start again from zero, which is seen as a counter reset, saturate to
+// stay at the largest int, or float to carry on counting as a float.  A policy
+// given as program=policy applies to that program only, e.g.
+// "wrap,proxy.mtail=float".
+func CounterOverflowPolicies(spec string) func(*Loader) error {
+	return func(l *Loader) error {
+		var err error
+		l.overflow, l.programOverflow, err = parseOverflowPolicies(spec)
+		return err
+	}
+}
+
+// LineBudget limits the work each program does on a line to at most
+// instructions bytecode instructions and wallTime, either unlimited if zero.
+// A program over its budget stops processing the line, which is counted in
+// prog_runtime_errors, and after quarantineAfter such lines, if positive, it
+// processes no more lines until it is reloaded.
+func LineBudget(instructions int, wallTime time.Duration, quarantineAfter int) func(*Loader) error {
+	return func(l *Loader) error {
+		if instructions < 0 || wallTime < 0 || quarantineAfter < 0 {
+			return errors.New("line budget can't be negative")
+		}
+		l.budget = lineBudget{instructions, wallTime, quarantineAfter}
+		return nil
+	}
+}
+
+// reloadPolicyNames are the names of the metric reload policies.
+var reloadPolicyNames = map[string]metrics.ReloadPolicy{
+	"source": metrics.ReloadBySource,
+	"keep":   metrics.ReloadKeep,
+	"clear":  metrics.ReloadClear,
+}
+
+// ReloadPolicies sets what happens to the values of the metrics of a program
+// when it is reloaded, from a comma separated list of policies: source to
+// keep them unless the type, keys, or line of a metric's declaration changed,
+// keep to keep them unless the type or keys changed, also for hidden metrics
+// that aren't persistent, or clear to start every exported metric from zero.
+// A policy given as program=policy applies to that program only, e.g.
+// "keep,test.mtail=clear".
+func ReloadPolicies(spec string) func(*Loader) error {
+	return func(l *Loader) error {
+		var err error
+		l.reload, l.programReload, err = parseReloadPolicies(spec)
+		return err
+	}
+}
+
+// parseReloadPolicies parses a comma separated list of reload policies, in
+// the form of those of parseArithmeticPolicies.
+func parseReloadPolicies(spec string) (metrics.ReloadPolicy, map[string]metrics.ReloadPolicy, error) {
+	def := metrics.ReloadBySource
+	byProgram := make(map[string]metrics.ReloadPolicy)
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name := s
+		prog := ""
+		if i := strings.Index(s, "="); i >= 0 {
+			prog, name = s[:i], s[i+1:]
+		}
+		p, ok := reloadPolicyNames[name]
+		if !ok {
+			return def, nil, errors.Errorf("unknown reload policy %q, expecting source, keep or clear", name)
+		}
+		if prog == "" {
+			def = p
+		} else {
+			byProgram[prog] = p
+		}
+	}
+	return def, byProgram, nil
+}
+
+// ForwardTo sets the destination of lines passed to forward() in programs.
+func ForwardTo(f Forwarder) func(*Loader) error {
+	return func(l *Loader) error {
+		l.forwarder = f
+		return nil
+	}
+}
+
+// FilterLines sets the Loader to pass lines through f before passing them to
+// the programs.
+func FilterLines(f LineFilter) func(*Loader) error {
+	return func(l *Loader) error {
+		l.filter = f
+		return nil
+	}
+}
+
+// GeoIPDatabase sets the database used by geoip_country() and geoip_asn() in programs.
+func GeoIPDatabase(g GeoIP) func(*Loader) error {
+	return func(l *Loader) error {
+		l.geoip = g
+		return nil
+	}
+}
+
 // NewLoader creates a new program loader that reads programs from programPath.
 func NewLoader(programPath string, store *metrics.Store, lines <-chan *logline.LogLine, w watcher.Watcher, options ...func(*Loader) error) (*Loader, error) {
 	if store == nil || lines == nil {
@@ -338,7 +912,10 @@ func NewLoader(programPath string, store *metrics.Store, lines <-chan *logline.L
 		w:             w,
 		programPath:   programPath,
 		handles:       make(map[string]*vmHandle),
+		dispatched:    make(map[*logline.LogLine]*dispatched),
 		programErrors: make(map[string]error),
+		programFiles:  make(map[string]string),
+		imports:       make(map[string][]string),
 		watcherDone:   make(chan struct{}),
 		VMsDone:       make(chan struct{}),
 	}
@@ -362,9 +939,80 @@ func (l *Loader) SetOption(options ...func(*Loader) error) error {
 	return nil
 }
 
+// compileFailure is the error returned when the program called name fails to
+// compile.  Its cause is the list of compile errors.
+type compileFailure struct {
+	name string
+	errs error
+}
+
+func (e *compileFailure) Error() string {
+	return fmt.Sprintf("compile failed for %s:\n%s", e.name, e.errs)
+}
+
+func (e *compileFailure) Cause() error {
+	return e.errs
+}
+
 type vmHandle struct {
 	lines chan *logline.LogLine
 	done  chan struct{}
+	vm    *VM // the program running on lines, for carrying over its persistent state
+}
+
+// stop closes the handle's lines channel, waits for its program to finish,
+// and releases the program's shared regular expressions.
+func (h *vmHandle) stop() {
+	close(h.lines)
+	<-h.done
+	if h.vm != nil {
+		codegen.ReleaseRegexps(h.vm.re)
+	}
+}
+
+// QueueDepth returns the number of lines waiting to be processed by the most
+// backed up program.
+func (l *Loader) QueueDepth() int {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	depth := 0
+	for _, h := range l.handles {
+		if n := len(h.lines); n > depth {
+			depth = n
+		}
+	}
+	return depth
+}
+
+// dispatched is the progress of the programs a line was sent to.
+type dispatched struct {
+	pending int  // number of programs yet to process the line
+	matched bool // whether a top-level condition of any program matched the line
+}
+
+// lineDone records that a program has processed line, and whether one of its
+// top-level conditions matched it.  Once all the programs it was sent to have
+// processed it, a line that none of them matched is counted by the "program"
+// stage in lines_dropped_total.  It is only called when counting unmatched
+// lines.
+func (l *Loader) lineDone(line *logline.LogLine, matched bool) {
+	l.dispatchMu.Lock()
+	d, ok := l.dispatched[line]
+	if !ok {
+		l.dispatchMu.Unlock()
+		return
+	}
+	d.matched = d.matched || matched
+	d.pending--
+	if d.pending > 0 {
+		l.dispatchMu.Unlock()
+		return
+	}
+	delete(l.dispatched, line)
+	l.dispatchMu.Unlock()
+	if !d.matched {
+		logline.Drop("program", "no_match")
+	}
 }
 
 // processEvents manages program lifecycle triggered by events from the
@@ -402,11 +1050,27 @@ func (l *Loader) processLines(lines <-chan *logline.LogLine) {
 	defer close(l.VMsDone)
 
 	// Copy all input LogLines to each VM's LogLine input channel.
-	for logline := range lines {
+	for line := range lines {
 		LineCount.Add(1)
+		if l.filter != nil {
+			var ok bool
+			if line, ok = l.filter.Filter(line); !ok {
+				continue
+			}
+		}
 		l.handleMu.RLock()
+		if len(l.handles) == 0 {
+			l.handleMu.RUnlock()
+			logline.Drop("dispatch", "no_programs")
+			continue
+		}
+		if l.countUnmatchedLines {
+			l.dispatchMu.Lock()
+			l.dispatched[line] = &dispatched{pending: len(l.handles)}
+			l.dispatchMu.Unlock()
+		}
 		for prog := range l.handles {
-			l.handles[prog].lines <- logline
+			l.handles[prog].lines <- line
 		}
 		l.handleMu.RUnlock()
 	}
@@ -422,8 +1086,7 @@ func (l *Loader) processLines(lines <-chan *logline.LogLine) {
 	glog.Info("Closing VM lines channels.")
 	for prog := range l.handles {
 		// Close the per-VM lines channel, and wait for it to signal it's done.
-		close(l.handles[prog].lines)
-		<-l.handles[prog].done
+		l.handles[prog].stop()
 		delete(l.handles, prog)
 	}
 }
@@ -434,12 +1097,44 @@ func (l *Loader) UnloadProgram(pathname string) {
 	if err := l.w.Remove(pathname); err != nil {
 		glog.V(2).Infof("Remove watch on %s failed: %s", pathname, err)
 	}
+	// Removing an imported file reloads the programs that import it, which
+	// will then fail to compile.
+	if dependents := l.dependents(pathname); len(dependents) > 0 {
+		for _, dependent := range dependents {
+			if err := l.LoadProgram(dependent); err != nil {
+				glog.Info(err)
+			}
+		}
+		return
+	}
 	name := filepath.Base(pathname)
+	if absPath, err := filepath.Abs(pathname); err == nil {
+		l.programErrorMu.Lock()
+		delete(l.imports, absPath)
+		owner, ok := l.programFiles[name]
+		if ok && owner == absPath {
+			delete(l.programFiles, name)
+		}
+		l.programErrorMu.Unlock()
+		if ok && owner != absPath {
+			// Another file of the same name is the program loaded.
+			return
+		}
+		// The program it overrode in an earlier path takes its place.
+		if ok {
+			if prev := l.overridden(name, absPath); prev != "" {
+				glog.Infof("Loading %s in place of %s.", prev, absPath)
+				if err := l.LoadProgram(prev); err != nil {
+					glog.Info(err)
+				}
+				return
+			}
+		}
+	}
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
 	if handle, ok := l.handles[name]; ok {
-		close(handle.lines)
-		<-handle.done
+		handle.stop()
 		delete(l.handles, name)
 	}
 }
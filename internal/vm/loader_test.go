@@ -4,6 +4,7 @@
 package vm
 
 import (
+	"expvar"
 	"os"
 	"path"
 	"strings"
@@ -26,7 +27,7 @@ func TestNewLoader(t *testing.T) {
 	}
 	done := make(chan struct{})
 	outLines := make(chan *logline.LogLine)
-	handle := &vmHandle{outLines, done}
+	handle := &vmHandle{outLines, done, nil}
 	l.handleMu.Lock()
 	l.handles["test"] = handle
 	l.handleMu.Unlock()
@@ -39,6 +40,94 @@ func TestNewLoader(t *testing.T) {
 	<-outLines
 }
 
+func TestQueueDepth(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	inLines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, inLines, w)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if d := l.QueueDepth(); d != 0 {
+		t.Errorf("QueueDepth with no programs: got %d, want 0", d)
+	}
+	l.handleMu.Lock()
+	l.handles["idle"] = &vmHandle{make(chan *logline.LogLine, 5), make(chan struct{}), nil}
+	l.handles["busy"] = &vmHandle{make(chan *logline.LogLine, 5), make(chan struct{}), nil}
+	l.handles["busy"].lines <- logline.NewLogLine("log", "a")
+	l.handles["busy"].lines <- logline.NewLogLine("log", "b")
+	l.handleMu.Unlock()
+	if d := l.QueueDepth(); d != 2 {
+		t.Errorf("QueueDepth: got %d, want 2", d)
+	}
+}
+
+// noMatchDrops returns the number of lines dropped because no program
+// matched them.
+func noMatchDrops() int64 {
+	if reasons, ok := expvar.Get("lines_dropped_total").(*expvar.Map).Get("program").(*expvar.Map); ok {
+		if n, ok := reasons.Get("no_match").(*expvar.Int); ok {
+			return n.Value()
+		}
+	}
+	return 0
+}
+
+func TestLineDone(t *testing.T) {
+	l := &Loader{dispatched: make(map[*logline.LogLine]*dispatched)}
+	unmatched := logline.NewLogLine("log", "a")
+	matched := logline.NewLogLine("log", "b")
+	l.dispatched[unmatched] = &dispatched{pending: 2}
+	l.dispatched[matched] = &dispatched{pending: 2}
+
+	before := noMatchDrops()
+	l.lineDone(unmatched, false)
+	l.lineDone(matched, true)
+	if n := noMatchDrops() - before; n != 0 {
+		t.Errorf("drops counted before all programs processed the lines: %d", n)
+	}
+	l.lineDone(unmatched, false)
+	l.lineDone(matched, false)
+	if n := noMatchDrops() - before; n != 1 {
+		t.Errorf("expected 1 line dropped, received %d", n)
+	}
+	if len(l.dispatched) != 0 {
+		t.Errorf("lines still dispatched: %v", l.dispatched)
+	}
+}
+
+func TestCountUnmatchedLines(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []func(*Loader) error
+		expected int64
+	}{
+		{"off", nil, 0},
+		{"on", []func(*Loader) error{CountUnmatchedLines}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := make(chan *logline.LogLine)
+			l, err := NewLoader("", metrics.NewStore(), lines, watcher.NewFakeWatcher(), tc.opts...)
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, l.CompileAndRun("Test", strings.NewReader("/^match/ {}\n")))
+			l.handleMu.RLock()
+			done := l.handles["Test"].done
+			l.handleMu.RUnlock()
+			before := noMatchDrops()
+			lines <- logline.NewLogLine("log", "match")
+			lines <- logline.NewLogLine("log", "other")
+			close(lines)
+			<-done
+			if n := noMatchDrops() - before; n != tc.expected {
+				t.Errorf("expected %d lines dropped, received %d", tc.expected, n)
+			}
+			if len(l.dispatched) != 0 {
+				t.Errorf("lines still dispatched: %v", l.dispatched)
+			}
+		})
+	}
+}
+
 func TestCompileAndRun(t *testing.T) {
 	var testProgram = "/$/ {}\n"
 	store := metrics.NewStore()
@@ -201,3 +290,315 @@ func TestLoadProg(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadProgramPaths(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	for _, name := range []string{"a/web.mtail", "a/db.mtail", "b/web.mtail", "c/mail.mtail"} {
+		testutil.FatalIfErr(t, os.MkdirAll(path.Join(tmpDir, path.Dir(name)), 0755))
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		testutil.WriteString(t, f, testProgram)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	l, err := NewLoader(path.Join(tmpDir, "a")+","+path.Join(tmpDir, "c"), store, lines, w)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+	l.handleMu.RLock()
+	loaded := len(l.handles)
+	l.handleMu.RUnlock()
+	if loaded != 3 {
+		t.Errorf("expected 3 programs loaded, received %d", loaded)
+	}
+
+	// A program of the same name in a directory not in the paths isn't
+	// loaded over the first, and removing it doesn't unload the first.
+	if err := l.LoadProgram(path.Join(tmpDir, "b/web.mtail")); err == nil {
+		t.Error("expected error loading a program of the same name from another directory")
+	}
+	l.UnloadProgram(path.Join(tmpDir, "b/web.mtail"))
+	l.handleMu.RLock()
+	_, ok := l.handles["web.mtail"]
+	l.handleMu.RUnlock()
+	if !ok {
+		t.Error("web.mtail unloaded by the removal of another file of the same name")
+	}
+
+	// A program in a later path overrides the one of the same name in an
+	// earlier path.
+	l, err = NewLoader(path.Join(tmpDir, "a")+","+path.Join(tmpDir, "b"), metrics.NewStore(), lines, w)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+	owner := func() string {
+		l.programErrorMu.RLock()
+		defer l.programErrorMu.RUnlock()
+		return l.programFiles["web.mtail"]
+	}
+	if o := owner(); o != path.Join(tmpDir, "b/web.mtail") {
+		t.Errorf("web.mtail loaded from %q, expected the override", o)
+	}
+	// Changes to the overridden program are ignored.
+	testutil.FatalIfErr(t, l.LoadProgram(path.Join(tmpDir, "a/web.mtail")))
+	if o := owner(); o != path.Join(tmpDir, "b/web.mtail") {
+		t.Errorf("web.mtail loaded from %q, expected the override", o)
+	}
+	// Removing the override loads the overridden program again.
+	testutil.FatalIfErr(t, os.Remove(path.Join(tmpDir, "b/web.mtail")))
+	l.UnloadProgram(path.Join(tmpDir, "b/web.mtail"))
+	if o := owner(); o != path.Join(tmpDir, "a/web.mtail") {
+		t.Errorf("web.mtail loaded from %q after removing the override", o)
+	}
+	l.handleMu.RLock()
+	_, ok = l.handles["web.mtail"]
+	l.handleMu.RUnlock()
+	if !ok {
+		t.Error("web.mtail not running after removing the override")
+	}
+	// Adding it back overrides it again.
+	f := testutil.TestOpenFile(t, path.Join(tmpDir, "b/web.mtail"))
+	testutil.WriteString(t, f, testProgram)
+	testutil.FatalIfErr(t, f.Close())
+	testutil.FatalIfErr(t, l.LoadProgram(path.Join(tmpDir, "b/web.mtail")))
+	if o := owner(); o != path.Join(tmpDir, "b/web.mtail") {
+		t.Errorf("web.mtail loaded from %q, expected the override", o)
+	}
+}
+
+func TestStatusWarnings(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	l, err := NewLoader(tmpDir, store, lines, w)
+	testutil.FatalIfErr(t, err)
+	f := testutil.TestOpenFile(t, path.Join(tmpDir, "warn.mtail"))
+	_, err = f.WriteString("counter c\n/(\\d+)/ {\n  c++\n}\n")
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.LoadProgram(path.Join(tmpDir, "warn.mtail")))
+	var b strings.Builder
+	testutil.FatalIfErr(t, l.WriteStatusHTML(&b))
+	if !strings.Contains(b.String(), "Capture group `$1&#39; is never used (unused warning)") {
+		t.Errorf("warning not shown in status:\n%s", b.String())
+	}
+	close(lines)
+	<-l.VMsDone
+}
+
+func TestUniqueMetricNames(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, w, UniqueMetricNames)
+	testutil.FatalIfErr(t, err)
+	prog := "counter requests\n/x/ {\n  requests++\n}\n"
+	testutil.FatalIfErr(t, l.CompileAndRun("web.mtail", strings.NewReader(prog)))
+	// Reloading the program is not a collision.
+	testutil.FatalIfErr(t, l.CompileAndRun("web.mtail", strings.NewReader(prog)))
+	err = l.CompileAndRun("api.mtail", strings.NewReader(prog))
+	if err == nil || !strings.Contains(err.Error(), "requests, also exported by web.mtail") {
+		t.Errorf("expected a metric name collision, received %v", err)
+	}
+}
+
+func TestFailedReloadStaysQuarantined(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, w, UniqueMetricNames)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("web.mtail", strings.NewReader("counter requests\n/x/ {\n  requests++\n}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("runaway.mtail", strings.NewReader("counter slow\n/x/ {\n  slow++\n}\n")))
+	// As if the running program had been quarantined by its line budget.
+	progQuarantined.Add("runaway.mtail", 1)
+	if err := l.CompileAndRun("runaway.mtail", strings.NewReader("counter requests\n/x/ {\n  requests++\n}\n")); err == nil {
+		t.Fatal("expected a metric name collision")
+	}
+	if diff := testutil.Diff("1", progQuarantined.Get("runaway.mtail").String()); diff != "" {
+		t.Errorf("quarantined after failed reload: %s", diff)
+	}
+	testutil.FatalIfErr(t, l.CompileAndRun("runaway.mtail", strings.NewReader("counter fast\n/x/ {\n  fast++\n}\n")))
+	if q := progQuarantined.Get("runaway.mtail"); q != nil {
+		t.Errorf("still quarantined after reload: %s", q)
+	}
+}
+
+func TestParseReloadPolicies(t *testing.T) {
+	def, byProgram, err := parseReloadPolicies("keep, test.mtail=clear")
+	testutil.FatalIfErr(t, err)
+	if def != metrics.ReloadKeep {
+		t.Errorf("default policy is %v, expected keep", def)
+	}
+	if diff := testutil.Diff(map[string]metrics.ReloadPolicy{"test.mtail": metrics.ReloadClear}, byProgram); diff != "" {
+		t.Error(diff)
+	}
+	if _, _, err := parseReloadPolicies("reset"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestProgramSizeMetrics(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, w, CompileOnly)
+	testutil.FatalIfErr(t, err)
+	prog := "counter a\ncounter b\n/x/ {\n  a++\n}\n/y/ {\n  b++\n}\n"
+	testutil.FatalIfErr(t, l.CompileAndRun("size.mtail", strings.NewReader(prog)))
+	if diff := testutil.Diff("2", progRegexps.Get("size.mtail").String()); diff != "" {
+		t.Error(diff)
+	}
+	if n, ok := progInstructions.Get("size.mtail").(*expvar.Int); !ok || n.Value() == 0 {
+		t.Errorf("no instructions recorded: %v", progInstructions.Get("size.mtail"))
+	}
+	if _, ok := progCompileSeconds.Get("size.mtail").(*expvar.Float); !ok {
+		t.Errorf("no compile time recorded: %v", progCompileSeconds.Get("size.mtail"))
+	}
+}
+
+func TestLoadImports(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	for name, contents := range map[string]string{
+		"common.mtail": "def double(x) {\n  return x * 2\n}\n",
+		"prog.mtail":   "import \"common.mtail\"\ncounter c\n/(\\d+)/ {\n  c += double($1)\n}\n",
+	} {
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		testutil.WriteString(t, f, contents)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	l, err := NewLoader(tmpDir, store, lines, w)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+
+	programs := func() []string {
+		l.handleMu.RLock()
+		defer l.handleMu.RUnlock()
+		r := make([]string, 0)
+		for program := range l.handles {
+			r = append(r, program)
+		}
+		return r
+	}
+	// The imported file is not loaded as a program itself.
+	if diff := testutil.Diff([]string{"prog.mtail"}, programs()); diff != "" {
+		t.Errorf("loaded programs don't match:\n%s", diff)
+	}
+
+	// Loading the imported file reloads the program that imports it.
+	loads := ProgLoads.Get("prog.mtail").String()
+	testutil.FatalIfErr(t, l.LoadProgram(path.Join(tmpDir, "common.mtail")))
+	if ProgLoads.Get("prog.mtail").String() == loads {
+		t.Errorf("prog.mtail not reloaded, still %s loads", loads)
+	}
+	if diff := testutil.Diff([]string{"prog.mtail"}, programs()); diff != "" {
+		t.Errorf("loaded programs don't match:\n%s", diff)
+	}
+
+	w.Close()
+	<-l.watcherDone
+	close(lines)
+}
+
+func TestLoadLookupTableReload(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	for name, contents := range map[string]string{
+		"services.csv": "www.example.com,web\n",
+		"prog.mtail":   "lookup services from \"services.csv\"\ncounter c by service\n/(\\S+)/ {\n  c[lookup[services][$1]]++\n}\n",
+	} {
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		testutil.WriteString(t, f, contents)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	l, err := NewLoader(tmpDir, store, lines, w)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+
+	// Changing the table reloads the program that uses it.
+	loads := ProgLoads.Get("prog.mtail").String()
+	testutil.FatalIfErr(t, l.LoadProgram(path.Join(tmpDir, "services.csv")))
+	if ProgLoads.Get("prog.mtail").String() == loads {
+		t.Errorf("prog.mtail not reloaded, still %s loads", loads)
+	}
+
+	w.Close()
+	<-l.watcherDone
+	close(lines)
+}
+
+func TestRegexManifestReload(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	manifest := path.Join(tmpDir, "regex.json")
+	writeFile := func(name, contents string) {
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		testutil.WriteString(t, f, contents)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	writeFile("regex.json", `{"prog.mtail": {"max_program_size": 5}}`)
+	writeFile("prog.mtail", "counter c\n/a{5}b/ {\n  c++\n}\n")
+	l, err := NewLoader(tmpDir, store, lines, w, RegexManifest(manifest))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+	if l.programErrors["prog.mtail"] == nil {
+		t.Error("expected prog.mtail to be over the size limit")
+	}
+
+	// Changing the manifest reloads the programs.
+	testutil.FatalIfErr(t, os.Truncate(manifest, 0))
+	writeFile("regex.json", `{"prog.mtail": {"longest": true}}`)
+	testutil.FatalIfErr(t, l.LoadProgram(manifest))
+	if err := l.programErrors["prog.mtail"]; err != nil {
+		t.Errorf("prog.mtail: unexpected error %s", err)
+	}
+
+	w.Close()
+	<-l.watcherDone
+	close(lines)
+}
+
+func TestCheckPrograms(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	for name, contents := range map[string]string{
+		"good.mtail": testProgram,
+		"bad.mtail":  "i++\n",
+	} {
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		testutil.WriteString(t, f, contents)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	r, err := CheckPrograms(tmpDir)
+	testutil.FatalIfErr(t, err)
+	if len(r) != 2 {
+		t.Fatalf("expected results for 2 programs, got %v", r)
+	}
+	if r["good.mtail"] != nil {
+		t.Errorf("good.mtail: unexpected error %s", r["good.mtail"])
+	}
+	if r["bad.mtail"] == nil {
+		t.Error("bad.mtail: expected error")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+)
+
+// parseLogfmt parses the key=value pairs in a logfmt formatted line, as
+// written by Heroku and go-kit.  Values may be double quoted, in which case
+// backslash escapes a quote or another backslash.  A key with no value has the
+// value "".  If a key is repeated, the last value is kept.  Malformed input is
+// parsed as well as possible rather than rejected.
+func parseLogfmt(s string) map[string]string {
+	m := make(map[string]string)
+	i := 0
+	for i < len(s) {
+		// Skip whitespace and stray equals signs between pairs.
+		for i < len(s) && (s[i] <= ' ' || s[i] == '=') {
+			i++
+		}
+		start := i
+		for i < len(s) && s[i] > ' ' && s[i] != '=' {
+			i++
+		}
+		if i == start {
+			break
+		}
+		key := s[start:i]
+		if i >= len(s) || s[i] != '=' {
+			m[key] = ""
+			continue
+		}
+		i++
+		if i < len(s) && s[i] == '"' {
+			var value strings.Builder
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					switch s[i] {
+					case 'n':
+						value.WriteByte('\n')
+						continue
+					case 't':
+						value.WriteByte('\t')
+						continue
+					}
+				}
+				value.WriteByte(s[i])
+			}
+			// Skip the closing quote.
+			i++
+			m[key] = value.String()
+			continue
+		}
+		start = i
+		for i < len(s) && s[i] > ' ' {
+			i++
+		}
+		m[key] = s[start:i]
+	}
+	return m
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var parseLogfmtTests = []struct {
+	name     string
+	line     string
+	expected map[string]string
+}{
+	{"empty",
+		"",
+		map[string]string{}},
+	{"simple",
+		"level=info msg=started port=8080",
+		map[string]string{"level": "info", "msg": "started", "port": "8080"}},
+	{"quoted",
+		`msg="request done" path=/ err="said \"no\"\tok"`,
+		map[string]string{"msg": "request done", "path": "/", "err": "said \"no\"\tok"}},
+	{"empty values",
+		`a= b="" c`,
+		map[string]string{"a": "", "b": "", "c": ""}},
+	{"repeated key",
+		"a=1 a=2",
+		map[string]string{"a": "2"}},
+	{"extra whitespace",
+		"  a=1 \t b=2  ",
+		map[string]string{"a": "1", "b": "2"}},
+	{"unterminated quote",
+		`a="x y`,
+		map[string]string{"a": "x y"}},
+	{"stray equals",
+		"=x a=b=c",
+		map[string]string{"x": "", "a": "b=c"}},
+}
+
+func TestParseLogfmt(t *testing.T) {
+	for _, tc := range parseLogfmtTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := testutil.Diff(tc.expected, parseLogfmt(tc.line)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// loadLookupTable reads the table of strings by key in the file at path.  A
+// CSV file holds a key and its value in the first two fields of each record,
+// with no header, and lines starting with # are comments.  A JSON file holds
+// an object, whose members are the keys; values that aren't strings are kept
+// as JSON text, like the json builtin returns them.
+func loadLookupTable(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	table := make(map[string]string)
+	switch filepath.Ext(path) {
+	case ".csv":
+		r := csv.NewReader(bytes.NewReader(b))
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		for n := 1; ; n++ {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(record) < 2 {
+				return nil, errors.Errorf("record %d has no value for key %q", n, record[0])
+			}
+			table[record[0]] = record[1]
+		}
+	case ".json":
+		v, err := decodeJSON(string(b))
+		if err != nil {
+			return nil, err
+		}
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("expecting a JSON object of keys and values")
+		}
+		for k, v := range o {
+			table[k] = jsonString(v)
+		}
+	default:
+		return nil, errors.Errorf("unknown format %q, expecting .csv or .json", filepath.Ext(path))
+	}
+	return table, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var loadLookupTableTests = []struct {
+	name     string
+	file     string
+	contents string
+	expected map[string]string
+}{
+	{"csv",
+		"services.csv",
+		"# vhost,service\nwww.example.com,web\napi.example.com, \"api, v2\",extra\n",
+		map[string]string{"www.example.com": "web", "api.example.com": "api, v2"}},
+	{"empty csv",
+		"empty.csv",
+		"",
+		map[string]string{}},
+	{"json",
+		"services.json",
+		`{"www.example.com": "web", "8080": 2, "nested": {"a": true}}`,
+		map[string]string{"www.example.com": "web", "8080": "2", "nested": `{"a":true}`}},
+}
+
+func TestLoadLookupTable(t *testing.T) {
+	dir, rmdir := testutil.TestTempDir(t)
+	defer rmdir()
+	for _, tc := range loadLookupTableTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.file)
+			testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte(tc.contents), 0600))
+			table, err := loadLookupTable(path)
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, table); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestLoadLookupTableErrors(t *testing.T) {
+	dir, rmdir := testutil.TestTempDir(t)
+	defer rmdir()
+	for file, contents := range map[string]string{
+		"no value.csv":   "a,b\nc\n",
+		"bad quote.csv":  "a,\"b\n",
+		"array.json":     `["a", "b"]`,
+		"invalid.json":   `{"a": `,
+		"services.txt":   "a b\n",
+		"not there.json": "",
+	} {
+		path := filepath.Join(dir, file)
+		if file != "not there.json" {
+			testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte(contents), 0600))
+		}
+		if _, err := loadLookupTable(path); err == nil {
+			t.Errorf("%s: expected error", file)
+		}
+	}
+}
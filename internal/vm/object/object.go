@@ -5,15 +5,23 @@ package object
 
 import (
 	"regexp"
+	"time"
 
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/position"
 )
 
 // Object is the data and bytecode resulting from compiled program source.
 type Object struct {
-	Program []code.Instr      // The program bytecode.
-	Strings []string          // Static strings.
-	Regexps []*regexp.Regexp  // Static regular expressions.
-	Metrics []*metrics.Metric // Metrics accessible to this program.
+	Program []code.Instr         // The program bytecode.
+	Lines   []*position.Position // Source position of the statement each instruction was generated from, by address.
+	Strings []string             // Static strings.
+	Regexps []*regexp.Regexp     // Static regular expressions.
+	Metrics []*metrics.Metric    // Metrics accessible to this program.
+	Lookups []map[string]string  // Lookup tables.
+
+	Location *time.Location // Location of the times without a zone, if the program sets one.
+
+	Conditions map[int]int // Source line of each top-level condition, by the address of the first instruction of the block it guards.
 }
@@ -0,0 +1,100 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"math"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+var (
+	// counterOverflows counts the increments of int metrics past the largest
+	// int, per program.
+	counterOverflows = expvar.NewMap("counter_overflows_total")
+)
+
+// overflowPolicy is what a program does when an int metric is incremented
+// past the largest int, as byte counters on busy servers can be.
+type overflowPolicy int
+
+const (
+	// overflowWrap starts the metric again from zero with what is left of
+	// the increment, which is seen as a counter reset.
+	overflowWrap overflowPolicy = iota
+	// overflowSaturate leaves the metric at the largest int.
+	overflowSaturate
+	// overflowFloat makes the value a float, which carries on counting with
+	// less precision.
+	overflowFloat
+)
+
+var overflowPolicyNames = map[string]overflowPolicy{
+	"wrap":     overflowWrap,
+	"saturate": overflowSaturate,
+	"float":    overflowFloat,
+}
+
+// parseOverflowPolicies parses a comma separated list of overflow policies,
+// in the form of those of parseArithmeticPolicies.
+func parseOverflowPolicies(spec string) (overflowPolicy, map[string]overflowPolicy, error) {
+	def := overflowWrap
+	byProgram := make(map[string]overflowPolicy)
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name := s
+		prog := ""
+		if i := strings.Index(s, "="); i >= 0 {
+			prog, name = s[:i], s[i+1:]
+		}
+		p, ok := overflowPolicyNames[name]
+		if !ok {
+			return def, nil, errors.Errorf("unknown counter overflow policy %q, expecting wrap, saturate or float", name)
+		}
+		if prog == "" {
+			def = p
+		} else {
+			byProgram[prog] = p
+		}
+	}
+	return def, byProgram, nil
+}
+
+// incInt increments the int datum d by delta at the time of the thread t,
+// handling an overflow by the program's overflow policy.
+func (v *VM) incInt(t *thread, d datum.Datum, delta int64) {
+	i, ok := d.(*datum.IntDatum)
+	if !ok || delta <= 0 || i.Get() <= math.MaxInt64-delta {
+		datum.IncIntBy(d, delta, t.time)
+		return
+	}
+	counterOverflows.Add(v.name, 1)
+	old := i.Get()
+	switch v.overflow {
+	case overflowSaturate:
+		glog.V(1).Infof("%s: counter overflow in %d + %d, saturating", v.source(), old, delta)
+		i.Set(math.MaxInt64, t.time)
+	case overflowFloat:
+		glog.V(1).Infof("%s: counter overflow in %d + %d, promoting to float", v.source(), old, delta)
+		f := datum.MakeFloat(float64(old)+float64(delta), t.time)
+		for _, m := range v.m {
+			if m.ReplaceDatum(d, f) {
+				return
+			}
+		}
+		// Not stored in a metric, so there is nothing to promote.
+		i.Set(math.MaxInt64, t.time)
+	default:
+		glog.V(1).Infof("%s: counter overflow in %d + %d, wrapping to zero", v.source(), old, delta)
+		i.Set(delta-(math.MaxInt64-old)-1, t.time)
+	}
+}
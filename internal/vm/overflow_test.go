@@ -0,0 +1,69 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/code"
+)
+
+func TestParseOverflowPolicies(t *testing.T) {
+	def, byProgram, err := parseOverflowPolicies("saturate, proxy.mtail=float,other.mtail=wrap")
+	testutil.FatalIfErr(t, err)
+	if def != overflowSaturate {
+		t.Errorf("default policy is %v, expected saturate", def)
+	}
+	expected := map[string]overflowPolicy{"proxy.mtail": overflowFloat, "other.mtail": overflowWrap}
+	if diff := testutil.Diff(expected, byProgram); diff != "" {
+		t.Error(diff)
+	}
+	if _, _, err := parseOverflowPolicies("wrap,proxy.mtail=clamp"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+var counterOverflowTests = []struct {
+	policy       overflowPolicy
+	expectedType datum.Type
+	expected     string
+}{
+	{overflowWrap, datum.Int, "4"},
+	{overflowSaturate, datum.Int, "9223372036854775807"},
+	{overflowFloat, datum.Float, "9.223372036854776e+18"},
+}
+
+func TestCounterOverflow(t *testing.T) {
+	for _, tc := range counterOverflowTests {
+		m := metrics.NewMetric("bytes_total", "tst", metrics.Counter, metrics.Int)
+		d, err := m.GetDatum()
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, math.MaxInt64, time.Unix(0, 0))
+		v := makeVM(code.Instr{code.Inc, 0}, []*metrics.Metric{m})
+		v.name = "counteroverflow"
+		v.overflow = tc.policy
+		v.t.time = time.Unix(37, 0)
+		v.t.Push(d)
+		v.t.Push(int64(5))
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Errorf("policy %v: expected the program to carry on", tc.policy)
+		}
+		d, err = m.GetDatum()
+		testutil.FatalIfErr(t, err)
+		if d.Type() != tc.expectedType || d.ValueString() != tc.expected {
+			t.Errorf("policy %v: value is %s of type %v, expected %s of type %v", tc.policy, d.ValueString(), d.Type(), tc.expected, tc.expectedType)
+		}
+		// Later increments carry on from the new value.
+		datum.IncIntBy(d, 1, time.Unix(38, 0))
+	}
+	if diff := testutil.Diff("3", counterOverflows.Get("counteroverflow").String()); diff != "" {
+		t.Errorf("counter overflows: %s", diff)
+	}
+}
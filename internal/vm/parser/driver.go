@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -51,6 +52,7 @@ type parser struct {
 	l      *Lexer
 	t      Token             // Most recently lexed token.
 	pos    position.Position // Optionally contains the position of the start of a production
+	macros map[string]*macro // Pattern constants with parameters, by name
 }
 
 func newParser(name string, input io.Reader) *parser {
@@ -76,7 +78,11 @@ func (p *parser) Lex(lval *mtailSymType) int {
 		return INVALID
 	case INTLITERAL:
 		var err error
-		lval.intVal, err = strconv.ParseInt(p.t.Spelling, 10, 64)
+		base := 10
+		if strings.ContainsAny(p.t.Spelling, "xXoO") {
+			base = 0
+		}
+		lval.intVal, err = strconv.ParseInt(p.t.Spelling, base, 64)
 		if err != nil {
 			p.Error(fmt.Sprintf("bad number '%s': %s", p.t.Spelling, err))
 			return INVALID
@@ -95,7 +101,7 @@ func (p *parser) Lex(lval *mtailSymType) int {
 			p.Error(fmt.Sprintf("%s", err))
 			return INVALID
 		}
-	case LT, GT, LE, GE, NE, EQ, SHL, SHR, BITAND, BITOR, AND, OR, XOR, NOT, INC, DEC, DIV, MUL, MINUS, PLUS, ASSIGN, ADD_ASSIGN, POW, MOD, CONCAT, MATCH, NOT_MATCH:
+	case LT, GT, LE, GE, NE, EQ, SHL, SHR, BITAND, BITOR, AND, OR, XOR, NOT, LNOT, INC, DEC, DIV, MUL, MINUS, PLUS, ASSIGN, ADD_ASSIGN, POW, MOD, CONCAT, MATCH, NOT_MATCH:
 		lval.op = int(p.t.Kind)
 	default:
 		lval.text = p.t.Spelling
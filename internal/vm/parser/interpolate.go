@@ -0,0 +1,76 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/mtail/internal/vm/ast"
+	"github.com/google/mtail/internal/vm/position"
+)
+
+// interpolate returns the string literal text s at pos as an expression.  Each
+// `${name}' or `${1}' in s is a reference to a capture group, and the literal
+// is the concatenation of its text and the captured values, so that
+// "${host}:${port}" is the same as "" + $host + ":" + $port.  An escaped `\${'
+// is the text `${'.  A literal with no references is an ast.StringLit.
+func interpolate(pos position.Position, s string) (ast.Node, error) {
+	if !strings.Contains(s, "${") {
+		return &ast.StringLit{P: pos, Text: s}, nil
+	}
+	var n ast.Node
+	add := func(m ast.Node) {
+		if n == nil {
+			n = m
+			return
+		}
+		n = &ast.BinaryExpr{Lhs: n, Rhs: m, Op: PLUS}
+	}
+	var text strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], `\${`):
+			text.WriteString("${")
+			i += 2
+		case strings.HasPrefix(s[i:], "${"):
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated capture group reference in string %q.", s)
+			}
+			name := s[i+2 : i+end]
+			if !isCaprefName(name) {
+				return nil, fmt.Errorf("Invalid capture group reference `${%s}' in string %q.", name, s)
+			}
+			// Always start with a string, so that the references are
+			// concatenated, not added, if they are numbers.
+			if text.Len() > 0 || n == nil {
+				add(&ast.StringLit{P: pos, Text: text.String()})
+				text.Reset()
+			}
+			named := strings.IndexFunc(name, func(r rune) bool { return !isDigit(r) }) >= 0
+			add(&ast.CaprefTerm{P: pos, Name: name, IsNamed: named})
+			i += end
+		default:
+			text.WriteByte(s[i])
+		}
+	}
+	if text.Len() > 0 {
+		add(&ast.StringLit{P: pos, Text: text.String()})
+	}
+	return n, nil
+}
+
+// isCaprefName reports whether s is the name or number of a capture group.
+func isCaprefName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !isAlnum(r) && r != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/ast"
+	"github.com/google/mtail/internal/vm/position"
+)
+
+var interpolateTests = []struct {
+	name     string
+	text     string
+	expected string // unparsed expression
+}{
+	{"no references",
+		`host:port`,
+		`"host:port"`},
+	{"named references",
+		`${host}:${port}`,
+		`"" + $host + ":" + $port`},
+	{"positional reference",
+		`id-${1}`,
+		`"id-" + $1`},
+	{"adjacent references",
+		`${a}${b}/`,
+		`"" + $a + $b + "/"`},
+	{"escaped reference",
+		`\${a}${b}`,
+		`"\${a}" + $b`},
+	{"dollar without brace",
+		`$a costs $${b}`,
+		`"$a costs $" + $b`},
+}
+
+func TestInterpolate(t *testing.T) {
+	for _, tc := range interpolateTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := interpolate(position.Position{}, tc.text)
+			testutil.FatalIfErr(t, err)
+			u := Unparser{}
+			ast.Walk(&u, n)
+			if diff := testutil.Diff(tc.expected, u.line.String()); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestInterpolateErrors(t *testing.T) {
+	for _, text := range []string{`${host`, `${}`, `${a b}`, `${a-b}`} {
+		if _, err := interpolate(position.Position{}, text); err == nil {
+			t.Errorf("%q: expected error", text)
+		}
+	}
+}
@@ -19,36 +19,100 @@ import (
 var keywords = map[string]Kind{
 	"after":     AFTER,
 	"as":        AS,
+	"bool":      BOOL,
 	"buckets":   BUCKETS,
 	"by":        BY,
+	"case":      CASE,
 	"const":     CONST,
 	"counter":   COUNTER,
 	"def":       DEF,
+	"default":   DEFAULT,
 	"del":       DEL,
+	"elif":      ELIF,
 	"else":      ELSE,
+	"ewma":      EWMA,
+	"false":     FALSE,
+	"from":      FROM,
 	"gauge":     GAUGE,
+	"halflife":  HALFLIFE,
+	"help":      HELP,
 	"hidden":    HIDDEN,
 	"histogram": HISTOGRAM,
+	"import":    IMPORT,
+	"interval":  INTERVAL,
+	"let":       LET,
+	"limit":     LIMIT,
+	"lookup":    LOOKUP,
+	"map":       MAP,
+	"namespace": NAMESPACE,
+	"max":       MAX,
+	"min":       MIN,
 	"next":      NEXT,
+	"normalize": NORMALIZE,
 	"otherwise": OTHERWISE,
+	"persist":   PERSIST,
+	"quantiles": QUANTILES,
+	"return":    RETURN,
+	"sample":    SAMPLE,
+	"stddev":    STDDEV,
 	"stop":      STOP,
+	"summary":   SUMMARY,
+	"switch":    SWITCH,
 	"text":      TEXT,
 	"timer":     TIMER,
+	"topk":      TOPK,
+	"transient": TRANSIENT,
+	"true":      TRUE,
+	"timezone":  TIMEZONE,
+	"ttl":       TTL,
+	"unique":    UNIQUE,
+	"unit":      UNIT,
 }
 
 // List of builtin functions.  Keep this list sorted!
 var builtins = []string{
-	"bool",
+	"abs",
+	"ceil",
+	"cidrmatch",
+	"csv",
+	"delta",
+	"duration",
 	"float",
+	"floor",
+	"forward",
+	"geoip_asn",
+	"geoip_country",
+	"getenv",
 	"getfilename",
+	"hex",
+	"hostname",
+	"hour",
 	"int",
+	"json",
 	"len",
+	"log",
+	"logfmt",
+	"movavg",
+	"pow",
+	"rate",
+	"rfc3339",
+	"round",
 	"settime",
+	"settime_ms",
+	"settime_ns",
+	"shorthostname",
+	"split",
+	"strftime",
 	"string",
 	"strptime",
 	"strtol",
+	"subst",
+	"substr",
 	"timestamp",
 	"tolower",
+	"toupper",
+	"trim",
+	"weekday",
 }
 
 // A stateFn represents each state the scanner can be in.
@@ -123,6 +187,13 @@ func (l *Lexer) next() rune {
 	return l.rune
 }
 
+// peek returns the next rune in the input without consuming it.
+func (l *Lexer) peek() rune {
+	r := l.next()
+	l.backup()
+	return r
+}
+
 // backup indicates that we haven't yet dealt with the next rune. Use when
 // terminating tokens on unknown runes.
 func (l *Lexer) backup() {
@@ -219,6 +290,12 @@ func lexProg(l *Lexer) stateFn {
 	case r == ',':
 		l.accept()
 		l.emit(COMMA)
+	case r == '?':
+		l.accept()
+		l.emit(QUESTION)
+	case r == ':':
+		l.accept()
+		l.emit(COLON)
 	case r == '-':
 		l.accept()
 		switch r = l.next(); {
@@ -305,7 +382,7 @@ func lexProg(l *Lexer) stateFn {
 			l.emit(NOT_MATCH)
 		default:
 			l.backup()
-			return l.errorf("Unexpected input: %q", r)
+			l.emit(LNOT)
 		}
 	case r == '/':
 		l.accept()
@@ -390,6 +467,30 @@ func lexNumeric(l *Lexer) stateFn {
 		l.accept()
 		r = l.next()
 	}
+	if (r == 'x' || r == 'X') && strings.TrimPrefix(l.text.String(), "-") == "0" {
+		// A hexadecimal integer, like 0x1f.
+		l.accept()
+		r = l.next()
+		for isHexDigit(r) {
+			l.accept()
+			r = l.next()
+		}
+		l.backup()
+		l.emit(Kind(INTLITERAL))
+		return lexProg
+	}
+	if (r == 'o' || r == 'O') && strings.TrimPrefix(l.text.String(), "-") == "0" {
+		// An octal integer, like 0o755.
+		l.accept()
+		r = l.next()
+		for '0' <= r && r <= '7' {
+			l.accept()
+			r = l.next()
+		}
+		l.backup()
+		l.emit(Kind(INTLITERAL))
+		return lexProg
+	}
 	if r != '.' && r != 'E' && r != 'e' && !isDurationSuffix(r) {
 		l.backup()
 		l.emit(Kind(INTLITERAL))
@@ -527,6 +628,9 @@ Loop:
 		l.emit(r)
 	} else if r := sort.SearchStrings(builtins, l.text.String()); r >= 0 && r < len(builtins) && builtins[r] == l.text.String() {
 		l.emit(BUILTIN)
+	} else if l.peek() == '(' {
+		// An identifier immediately followed by a parenthesis names a function.
+		l.emit(FUNC_NAME)
 	} else {
 		l.emit(ID)
 	}
@@ -535,7 +639,7 @@ Loop:
 }
 
 // Lex a regular expression pattern. The text of the regular expression does
-// not include the '/' quotes.
+// not include the '/' quotes.  A free-spacing pattern may span lines.
 func lexRegex(l *Lexer) stateFn {
 	// Exit regex mode when leaving this function.
 	defer func() {
@@ -556,8 +660,13 @@ Loop:
 				break
 			}
 			fallthrough
-		case eof, '\n':
+		case eof:
 			return l.errorf("Unterminated regular expression: \"/%s\"", l.text.String())
+		case '\n':
+			if !freeSpacing(l.text.String()) {
+				return l.errorf("Unterminated regular expression: \"/%s\"", l.text.String())
+			}
+			l.accept()
 		case '/':
 			l.backup() // Backup trailing slash on successful parse
 			break Loop
@@ -565,7 +674,23 @@ Loop:
 			l.accept()
 		}
 	}
-	l.emit(REGEX)
+	// Flags after the trailing slash are the same as a leading flag group,
+	// so they are added to the text of the regex before it is emitted.
+	text := l.text.String()
+	pos := position.Position{l.name, l.line, l.startcol, l.col - 1}
+	l.text.Reset()
+	l.startcol = l.col
+	l.next()
+	l.accept() // Trailing slash
+	var flags strings.Builder
+	for r := l.next(); strings.ContainsRune(trailingFlags, r); r = l.next() {
+		flags.WriteRune(r)
+		l.skip()
+	}
+	l.backup()
+	glog.V(2).Infof("Emitting %v spelled %q at %v", REGEX, text, pos)
+	l.tokens <- Token{REGEX, addFlags(text, flags.String()), pos}
+	l.emit(DIV)
 	return lexProg
 }
 
@@ -604,6 +729,11 @@ func isDigit(r rune) bool {
 	return unicode.IsDigit(r)
 }
 
+// isHexDigit reports whether r is a hexadecimal digit.
+func isHexDigit(r rune) bool {
+	return isDigit(r) || ('a' <= r && r <= 'f') || ('A' <= r && r <= 'F')
+}
+
 // isSpace reports whether r is whitespace.
 func isSpace(r rune) bool {
 	return unicode.IsSpace(r)
@@ -29,7 +29,7 @@ var lexerTests = []lexerTest{
 		{EOF, "", position.Position{"comment", 0, 9, 9}}}},
 	{"comment not at col 1", "  # comment", []Token{
 		{EOF, "", position.Position{"comment not at col 1", 0, 11, 11}}}},
-	{"punctuation", "{}()[],", []Token{
+	{"punctuation", "{}()[],?:", []Token{
 		{LCURLY, "{", position.Position{"punctuation", 0, 0, 0}},
 		{RCURLY, "}", position.Position{"punctuation", 0, 1, 1}},
 		{LPAREN, "(", position.Position{"punctuation", 0, 2, 2}},
@@ -37,7 +37,9 @@ var lexerTests = []lexerTest{
 		{LSQUARE, "[", position.Position{"punctuation", 0, 4, 4}},
 		{RSQUARE, "]", position.Position{"punctuation", 0, 5, 5}},
 		{COMMA, ",", position.Position{"punctuation", 0, 6, 6}},
-		{EOF, "", position.Position{"punctuation", 0, 7, 7}}}},
+		{QUESTION, "?", position.Position{"punctuation", 0, 7, 7}},
+		{COLON, ":", position.Position{"punctuation", 0, 8, 8}},
+		{EOF, "", position.Position{"punctuation", 0, 9, 9}}}},
 	{"operators", "- + = ++ += < > <= >= == != * / << >> & | ^ ~ ** % || && =~ !~ --", []Token{
 		{MINUS, "-", position.Position{"operators", 0, 0, 0}},
 		{PLUS, "+", position.Position{"operators", 0, 2, 2}},
@@ -66,8 +68,12 @@ var lexerTests = []lexerTest{
 		{NOT_MATCH, "!~", position.Position{"operators", 0, 60, 61}},
 		{DEC, "--", position.Position{"operators", 0, 63, 64}},
 		{EOF, "", position.Position{"operators", 0, 65, 65}}}},
+	{"logical not", "!a", []Token{
+		{LNOT, "!", position.Position{"logical not", 0, 0, 0}},
+		{ID, "a", position.Position{"logical not", 0, 1, 1}},
+		{EOF, "", position.Position{"logical not", 0, 2, 2}}}},
 	{"keywords",
-		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\nafter\nstop\nhistogram\nbuckets\n", []Token{
+		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\nafter\nstop\nhistogram\nbuckets\nsummary\nquantiles\nreturn\nimport\nelif\nswitch\ncase\ndefault\nbool\ntrue\nfalse\npersist\ntransient\nlookup\nfrom\nttl\newma\nhalflife\ntopk\nunique\nmin\nmax\nstddev\ninterval\nsample\n", []Token{
 			{COUNTER, "counter", position.Position{"keywords", 0, 0, 6}},
 			{NL, "\n", position.Position{"keywords", 1, 7, -1}},
 			{GAUGE, "gauge", position.Position{"keywords", 1, 0, 4}},
@@ -102,9 +108,70 @@ var lexerTests = []lexerTest{
 			{NL, "\n", position.Position{"keywords", 16, 9, -1}},
 			{BUCKETS, "buckets", position.Position{"keywords", 16, 0, 6}},
 			{NL, "\n", position.Position{"keywords", 17, 7, -1}},
-			{EOF, "", position.Position{"keywords", 17, 0, 0}}}},
+			{SUMMARY, "summary", position.Position{"keywords", 17, 0, 6}},
+			{NL, "\n", position.Position{"keywords", 18, 7, -1}},
+			{QUANTILES, "quantiles", position.Position{"keywords", 18, 0, 8}},
+			{NL, "\n", position.Position{"keywords", 19, 9, -1}},
+			{RETURN, "return", position.Position{"keywords", 19, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 20, 6, -1}},
+			{IMPORT, "import", position.Position{"keywords", 20, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 21, 6, -1}},
+			{ELIF, "elif", position.Position{"keywords", 21, 0, 3}},
+			{NL, "\n", position.Position{"keywords", 22, 4, -1}},
+			{SWITCH, "switch", position.Position{"keywords", 22, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 23, 6, -1}},
+			{CASE, "case", position.Position{"keywords", 23, 0, 3}},
+			{NL, "\n", position.Position{"keywords", 24, 4, -1}},
+			{DEFAULT, "default", position.Position{"keywords", 24, 0, 6}},
+			{NL, "\n", position.Position{"keywords", 25, 7, -1}},
+			{BOOL, "bool", position.Position{"keywords", 25, 0, 3}},
+			{NL, "\n", position.Position{"keywords", 26, 4, -1}},
+			{TRUE, "true", position.Position{"keywords", 26, 0, 3}},
+			{NL, "\n", position.Position{"keywords", 27, 4, -1}},
+			{FALSE, "false", position.Position{"keywords", 27, 0, 4}},
+			{NL, "\n", position.Position{"keywords", 28, 5, -1}},
+			{PERSIST, "persist", position.Position{"keywords", 28, 0, 6}},
+			{NL, "\n", position.Position{"keywords", 29, 7, -1}},
+			{TRANSIENT, "transient", position.Position{"keywords", 29, 0, 8}},
+			{NL, "\n", position.Position{"keywords", 30, 9, -1}},
+			{LOOKUP, "lookup", position.Position{"keywords", 30, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 31, 6, -1}},
+			{FROM, "from", position.Position{"keywords", 31, 0, 3}},
+			{NL, "\n", position.Position{"keywords", 32, 4, -1}},
+			{TTL, "ttl", position.Position{"keywords", 32, 0, 2}},
+			{NL, "\n", position.Position{"keywords", 33, 3, -1}},
+			{EWMA, "ewma", position.Position{"keywords", 33, 0, 3}},
+			{NL, "\n", position.Position{"keywords", 34, 4, -1}},
+			{HALFLIFE, "halflife", position.Position{"keywords", 34, 0, 7}},
+			{NL, "\n", position.Position{"keywords", 35, 8, -1}},
+			{TOPK, "topk", position.Position{"keywords", 35, 0, 3}},
+			{NL, "\n", position.Position{"keywords", 36, 4, -1}},
+			{UNIQUE, "unique", position.Position{"keywords", 36, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 37, 6, -1}},
+			{MIN, "min", position.Position{"keywords", 37, 0, 2}},
+			{NL, "\n", position.Position{"keywords", 38, 3, -1}},
+			{MAX, "max", position.Position{"keywords", 38, 0, 2}},
+			{NL, "\n", position.Position{"keywords", 39, 3, -1}},
+			{STDDEV, "stddev", position.Position{"keywords", 39, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 40, 6, -1}},
+			{INTERVAL, "interval", position.Position{"keywords", 40, 0, 7}},
+			{NL, "\n", position.Position{"keywords", 41, 8, -1}},
+			{SAMPLE, "sample", position.Position{"keywords", 41, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 42, 6, -1}},
+			{EOF, "", position.Position{"keywords", 42, 0, 0}}}},
+	{"function names",
+		"foo(bar) foo (bar)", []Token{
+			{FUNC_NAME, "foo", position.Position{"function names", 0, 0, 2}},
+			{LPAREN, "(", position.Position{"function names", 0, 3, 3}},
+			{ID, "bar", position.Position{"function names", 0, 4, 6}},
+			{RPAREN, ")", position.Position{"function names", 0, 7, 7}},
+			{ID, "foo", position.Position{"function names", 0, 9, 11}},
+			{LPAREN, "(", position.Position{"function names", 0, 13, 13}},
+			{ID, "bar", position.Position{"function names", 0, 14, 16}},
+			{RPAREN, ")", position.Position{"function names", 0, 17, 17}},
+			{EOF, "", position.Position{"function names", 0, 18, 18}}}},
 	{"builtins",
-		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\nint\nbool\nfloat\nstring\n", []Token{
+		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\nint\nforward\nfloat\nstring\ntoupper\ntrim\nsubst\nsubstr\nsplit\nlogfmt\njson\ncsv\ncidrmatch\ngeoip_country\ngeoip_asn\ngetenv\nhostname\nshorthostname\nsettime_ms\nsettime_ns\nrfc3339\nrate\ndelta\nmovavg\nduration\n", []Token{
 			{BUILTIN, "strptime", position.Position{"builtins", 0, 0, 7}},
 			{NL, "\n", position.Position{"builtins", 1, 8, -1}},
 			{BUILTIN, "timestamp", position.Position{"builtins", 1, 0, 8}},
@@ -121,13 +188,55 @@ var lexerTests = []lexerTest{
 			{NL, "\n", position.Position{"builtins", 7, 11, -1}},
 			{BUILTIN, "int", position.Position{"builtins", 7, 0, 2}},
 			{NL, "\n", position.Position{"builtins", 8, 3, -1}},
-			{BUILTIN, "bool", position.Position{"builtins", 8, 0, 3}},
-			{NL, "\n", position.Position{"builtins", 9, 4, -1}},
+			{BUILTIN, "forward", position.Position{"builtins", 8, 0, 6}},
+			{NL, "\n", position.Position{"builtins", 9, 7, -1}},
 			{BUILTIN, "float", position.Position{"builtins", 9, 0, 4}},
 			{NL, "\n", position.Position{"builtins", 10, 5, -1}},
 			{BUILTIN, "string", position.Position{"builtins", 10, 0, 5}},
 			{NL, "\n", position.Position{"builtins", 11, 6, -1}},
-			{EOF, "", position.Position{"builtins", 11, 0, 0}}}},
+			{BUILTIN, "toupper", position.Position{"builtins", 11, 0, 6}},
+			{NL, "\n", position.Position{"builtins", 12, 7, -1}},
+			{BUILTIN, "trim", position.Position{"builtins", 12, 0, 3}},
+			{NL, "\n", position.Position{"builtins", 13, 4, -1}},
+			{BUILTIN, "subst", position.Position{"builtins", 13, 0, 4}},
+			{NL, "\n", position.Position{"builtins", 14, 5, -1}},
+			{BUILTIN, "substr", position.Position{"builtins", 14, 0, 5}},
+			{NL, "\n", position.Position{"builtins", 15, 6, -1}},
+			{BUILTIN, "split", position.Position{"builtins", 15, 0, 4}},
+			{NL, "\n", position.Position{"builtins", 16, 5, -1}},
+			{BUILTIN, "logfmt", position.Position{"builtins", 16, 0, 5}},
+			{NL, "\n", position.Position{"builtins", 17, 6, -1}},
+			{BUILTIN, "json", position.Position{"builtins", 17, 0, 3}},
+			{NL, "\n", position.Position{"builtins", 18, 4, -1}},
+			{BUILTIN, "csv", position.Position{"builtins", 18, 0, 2}},
+			{NL, "\n", position.Position{"builtins", 19, 3, -1}},
+			{BUILTIN, "cidrmatch", position.Position{"builtins", 19, 0, 8}},
+			{NL, "\n", position.Position{"builtins", 20, 9, -1}},
+			{BUILTIN, "geoip_country", position.Position{"builtins", 20, 0, 12}},
+			{NL, "\n", position.Position{"builtins", 21, 13, -1}},
+			{BUILTIN, "geoip_asn", position.Position{"builtins", 21, 0, 8}},
+			{NL, "\n", position.Position{"builtins", 22, 9, -1}},
+			{BUILTIN, "getenv", position.Position{"builtins", 22, 0, 5}},
+			{NL, "\n", position.Position{"builtins", 23, 6, -1}},
+			{BUILTIN, "hostname", position.Position{"builtins", 23, 0, 7}},
+			{NL, "\n", position.Position{"builtins", 24, 8, -1}},
+			{BUILTIN, "shorthostname", position.Position{"builtins", 24, 0, 12}},
+			{NL, "\n", position.Position{"builtins", 25, 13, -1}},
+			{BUILTIN, "settime_ms", position.Position{"builtins", 25, 0, 9}},
+			{NL, "\n", position.Position{"builtins", 26, 10, -1}},
+			{BUILTIN, "settime_ns", position.Position{"builtins", 26, 0, 9}},
+			{NL, "\n", position.Position{"builtins", 27, 10, -1}},
+			{BUILTIN, "rfc3339", position.Position{"builtins", 27, 0, 6}},
+			{NL, "\n", position.Position{"builtins", 28, 7, -1}},
+			{BUILTIN, "rate", position.Position{"builtins", 28, 0, 3}},
+			{NL, "\n", position.Position{"builtins", 29, 4, -1}},
+			{BUILTIN, "delta", position.Position{"builtins", 29, 0, 4}},
+			{NL, "\n", position.Position{"builtins", 30, 5, -1}},
+			{BUILTIN, "movavg", position.Position{"builtins", 30, 0, 5}},
+			{NL, "\n", position.Position{"builtins", 31, 6, -1}},
+			{BUILTIN, "duration", position.Position{"builtins", 31, 0, 7}},
+			{NL, "\n", position.Position{"builtins", 32, 8, -1}},
+			{EOF, "", position.Position{"builtins", 32, 0, 0}}}},
 	{"numbers", "1 23 3.14 1.61.1 -1 -1.0 1h 0d 3d -1.5h 15m 24h0m0s 1e3 1e-3 .11 123.456e7", []Token{
 		{INTLITERAL, "1", position.Position{"numbers", 0, 0, 0}},
 		{INTLITERAL, "23", position.Position{"numbers", 0, 2, 3}},
@@ -148,6 +257,24 @@ var lexerTests = []lexerTest{
 		{FLOATLITERAL, "123.456e7", position.Position{"numbers", 0, 65, 73}},
 		{EOF, "", position.Position{"numbers", 0, 74, 74}},
 	}},
+	{"hex numbers", "0x1f 0XFF -0x10", []Token{
+		{INTLITERAL, "0x1f", position.Position{"hex numbers", 0, 0, 3}},
+		{INTLITERAL, "0XFF", position.Position{"hex numbers", 0, 5, 8}},
+		{INTLITERAL, "-0x10", position.Position{"hex numbers", 0, 10, 14}},
+		{EOF, "", position.Position{"hex numbers", 0, 15, 15}},
+	}},
+	{"octal numbers", "0o755 -0O17", []Token{
+		{INTLITERAL, "0o755", position.Position{"octal numbers", 0, 0, 4}},
+		{INTLITERAL, "-0O17", position.Position{"octal numbers", 0, 6, 10}},
+		{EOF, "", position.Position{"octal numbers", 0, 11, 11}},
+	}},
+	{"let", "let x = 1", []Token{
+		{LET, "let", position.Position{"let", 0, 0, 2}},
+		{ID, "x", position.Position{"let", 0, 4, 4}},
+		{ASSIGN, "=", position.Position{"let", 0, 6, 6}},
+		{INTLITERAL, "1", position.Position{"let", 0, 8, 8}},
+		{EOF, "", position.Position{"let", 0, 9, 9}},
+	}},
 	{"identifier", "a be foo\nquux line_count", []Token{
 		{ID, "a", position.Position{"identifier", 0, 0, 0}},
 		{ID, "be", position.Position{"identifier", 0, 2, 3}},
@@ -161,11 +288,27 @@ var lexerTests = []lexerTest{
 		{REGEX, "asdf", position.Position{"regex", 0, 1, 4}},
 		{DIV, "/", position.Position{"regex", 0, 5, 5}},
 		{EOF, "", position.Position{"regex", 0, 6, 6}}}},
+	{"regex with flags", "/asdf/is {", []Token{
+		{DIV, "/", position.Position{"regex with flags", 0, 0, 0}},
+		{REGEX, "(?is)asdf", position.Position{"regex with flags", 0, 1, 4}},
+		{DIV, "/", position.Position{"regex with flags", 0, 5, 7}},
+		{LCURLY, "{", position.Position{"regex with flags", 0, 9, 9}},
+		{EOF, "", position.Position{"regex with flags", 0, 10, 10}}}},
+	{"regex with flags and flag group", "/(?x) a/i", []Token{
+		{DIV, "/", position.Position{"regex with flags and flag group", 0, 0, 0}},
+		{REGEX, "(?xi) a", position.Position{"regex with flags and flag group", 0, 1, 6}},
+		{DIV, "/", position.Position{"regex with flags and flag group", 0, 7, 8}},
+		{EOF, "", position.Position{"regex with flags and flag group", 0, 9, 9}}}},
 	{"regex with escape", `/asdf\//`, []Token{
 		{DIV, "/", position.Position{"regex with escape", 0, 0, 0}},
 		{REGEX, `asdf/`, position.Position{"regex with escape", 0, 1, 6}},
 		{DIV, "/", position.Position{"regex with escape", 0, 7, 7}},
 		{EOF, "", position.Position{"regex with escape", 0, 8, 8}}}},
+	{"free-spacing regex", "/(?x)a # b\n c/", []Token{
+		{DIV, "/", position.Position{"free-spacing regex", 0, 0, 0}},
+		{REGEX, "(?x)a # b\n c", position.Position{"free-spacing regex", 1, 1, 1}},
+		{DIV, "/", position.Position{"free-spacing regex", 1, 2, 2}},
+		{EOF, "", position.Position{"free-spacing regex", 1, 3, 3}}}},
 	{"regex with escape and special char", `/foo\d\//`, []Token{
 		{DIV, "/", position.Position{"regex with escape and special char", 0, 0, 0}},
 		{REGEX, `foo\d/`, position.Position{"regex with escape and special char", 0, 1, 7}},
@@ -222,8 +365,8 @@ var lexerTests = []lexerTest{
 			{ID, "foo", position.Position{"linecount", 3, 0, 2}},
 			{EOF, "", position.Position{"linecount", 3, 3, 3}}}},
 	// errors
-	{"unexpected char", "?", []Token{
-		{INVALID, "Unexpected input: '?'", position.Position{"unexpected char", 0, 0, 0}},
+	{"unexpected char", "`", []Token{
+		{INVALID, "Unexpected input: '`'", position.Position{"unexpected char", 0, 0, 0}},
 		{EOF, "", position.Position{"unexpected char", 0, 1, 1}}}},
 	{"unterminated regex", "/foo\n", []Token{
 		{DIV, "/", position.Position{"unterminated regex", 0, 0, 0}},
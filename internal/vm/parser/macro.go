@@ -0,0 +1,113 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/mtail/internal/vm/ast"
+	"github.com/google/mtail/internal/vm/position"
+)
+
+// macro is a pattern constant with parameters, like `const IPPORT(p) /.../',
+// whose pattern refers to its parameters as `${p}'.
+type macro struct {
+	pos    position.Position
+	params []string
+	body   ast.Node // concatenation of pattern literals and constants
+}
+
+// macroParamRef matches a reference to a parameter in the pattern of a macro.
+var macroParamRef = regexp.MustCompile(`\$\{(\w*)\}`)
+
+// defineMacro records the macro named by call, with the parameters params and
+// the pattern body, to be expanded where it is called later in the program.
+func (p *parser) defineMacro(call *ast.FuncCall, params *ast.ExprList, body ast.Node) {
+	if m, ok := p.macros[call.Name]; ok {
+		p.ErrorP(fmt.Sprintf("Redefinition of pattern constant `%s' previously defined at %s", call.Name, &m.pos), call.Pos())
+		return
+	}
+	m := &macro{pos: call.P, body: body}
+	defined := map[string]bool{}
+	for _, param := range params.Children {
+		name := param.(*ast.IdTerm).Name
+		if defined[name] {
+			p.ErrorP(fmt.Sprintf("Duplicate parameter `%s' of pattern constant `%s'.", name, call.Name), param.Pos())
+		}
+		defined[name] = true
+		m.params = append(m.params, name)
+	}
+	walkPatternLits(body, func(lit *ast.PatternLit) {
+		for _, ref := range macroParamRef.FindAllStringSubmatch(lit.Pattern, -1) {
+			if !defined[ref[1]] {
+				p.ErrorP(fmt.Sprintf("Pattern constant `%s' has no parameter `%s'.", call.Name, ref[1]), lit.Pos())
+			}
+		}
+	})
+	if p.macros == nil {
+		p.macros = make(map[string]*macro)
+	}
+	p.macros[call.Name] = m
+}
+
+// expandMacro returns the pattern of the macro named by call, with its
+// parameters replaced by the string arguments in args, or false if no macro
+// of that name is defined.
+func (p *parser) expandMacro(call *ast.FuncCall, args *ast.ExprList) (ast.Node, bool) {
+	m, ok := p.macros[call.Name]
+	if !ok {
+		return nil, false
+	}
+	if len(args.Children) != len(m.params) {
+		p.ErrorP(fmt.Sprintf("Wrong number of arguments to pattern constant `%s': expected %d, received %d.", call.Name, len(m.params), len(args.Children)), call.Pos())
+		return &ast.PatternLit{P: call.P}, true
+	}
+	var oldnew []string
+	for i, arg := range args.Children {
+		s, ok := arg.(*ast.StringLit)
+		if !ok {
+			p.ErrorP(fmt.Sprintf("Arguments to pattern constant `%s' must be strings.", call.Name), arg.Pos())
+			return &ast.PatternLit{P: call.P}, true
+		}
+		oldnew = append(oldnew, "${"+m.params[i]+"}", s.Text)
+	}
+	return expandPattern(m.body, call.P, strings.NewReplacer(oldnew...)), true
+}
+
+// mustExpandMacro returns the expansion of the macro named by call, like
+// expandMacro, and reports an error if it is not defined.
+func (p *parser) mustExpandMacro(call *ast.FuncCall, args *ast.ExprList) ast.Node {
+	if m, ok := p.expandMacro(call, args); ok {
+		return m
+	}
+	p.ErrorP(fmt.Sprintf("Pattern constant `%s' not defined.\n\tTry adding `const %s(...) /.../' earlier in the program.", call.Name, call.Name), call.Pos())
+	return &ast.PatternLit{P: call.P}
+}
+
+// expandPattern returns a copy of the pattern n at pos, with the parameters
+// in its literals replaced.
+func expandPattern(n ast.Node, pos position.Position, r *strings.Replacer) ast.Node {
+	switch v := n.(type) {
+	case *ast.BinaryExpr:
+		return &ast.BinaryExpr{Lhs: expandPattern(v.Lhs, pos, r), Rhs: expandPattern(v.Rhs, pos, r), Op: v.Op}
+	case *ast.PatternLit:
+		return &ast.PatternLit{P: pos, Pattern: r.Replace(v.Pattern)}
+	case *ast.IdTerm:
+		return &ast.IdTerm{P: pos, Name: v.Name}
+	}
+	return n
+}
+
+// walkPatternLits calls f on each pattern literal in the pattern n.
+func walkPatternLits(n ast.Node, f func(*ast.PatternLit)) {
+	switch v := n.(type) {
+	case *ast.BinaryExpr:
+		walkPatternLits(v.Lhs, f)
+		walkPatternLits(v.Rhs, f)
+	case *ast.PatternLit:
+		f(v)
+	}
+}
@@ -18,17 +18,18 @@ import (
 
 //line parser.y:18
 type mtailSymType struct {
-	yys      int
-	intVal   int64
-	floatVal float64
-	floats   []float64
-	op       int
-	text     string
-	texts    []string
-	flag     bool
-	n        ast.Node
-	kind     metrics.Kind
-	duration time.Duration
+	yys         int
+	intVal      int64
+	floatVal    float64
+	floats      []float64
+	op          int
+	text        string
+	texts       []string
+	n           ast.Node
+	kind        metrics.Kind
+	duration    time.Duration
+	normalizer  *ast.Normalizer
+	normalizers []*ast.Normalizer
 }
 
 const INVALID = 57346
@@ -37,63 +38,100 @@ const GAUGE = 57348
 const TIMER = 57349
 const TEXT = 57350
 const HISTOGRAM = 57351
-const AFTER = 57352
-const AS = 57353
-const BY = 57354
-const CONST = 57355
-const HIDDEN = 57356
-const DEF = 57357
-const DEL = 57358
-const NEXT = 57359
-const OTHERWISE = 57360
-const ELSE = 57361
-const STOP = 57362
-const BUCKETS = 57363
-const BUILTIN = 57364
-const REGEX = 57365
-const STRING = 57366
-const CAPREF = 57367
-const CAPREF_NAMED = 57368
-const ID = 57369
-const DECO = 57370
-const INTLITERAL = 57371
-const FLOATLITERAL = 57372
-const DURATIONLITERAL = 57373
-const INC = 57374
-const DEC = 57375
-const DIV = 57376
-const MOD = 57377
-const MUL = 57378
-const MINUS = 57379
-const PLUS = 57380
-const POW = 57381
-const SHL = 57382
-const SHR = 57383
-const LT = 57384
-const GT = 57385
-const LE = 57386
-const GE = 57387
-const EQ = 57388
-const NE = 57389
-const BITAND = 57390
-const XOR = 57391
-const BITOR = 57392
-const NOT = 57393
-const AND = 57394
-const OR = 57395
-const ADD_ASSIGN = 57396
-const ASSIGN = 57397
-const CONCAT = 57398
-const MATCH = 57399
-const NOT_MATCH = 57400
-const LCURLY = 57401
-const RCURLY = 57402
-const LPAREN = 57403
-const RPAREN = 57404
-const LSQUARE = 57405
-const RSQUARE = 57406
-const COMMA = 57407
-const NL = 57408
+const SUMMARY = 57352
+const BOOL = 57353
+const EWMA = 57354
+const TOPK = 57355
+const UNIQUE = 57356
+const MIN = 57357
+const MAX = 57358
+const STDDEV = 57359
+const TRUE = 57360
+const FALSE = 57361
+const AFTER = 57362
+const AS = 57363
+const BY = 57364
+const CONST = 57365
+const HIDDEN = 57366
+const PERSIST = 57367
+const TRANSIENT = 57368
+const LOOKUP = 57369
+const FROM = 57370
+const DEF = 57371
+const DEL = 57372
+const NEXT = 57373
+const OTHERWISE = 57374
+const ELSE = 57375
+const STOP = 57376
+const BUCKETS = 57377
+const QUANTILES = 57378
+const RETURN = 57379
+const IMPORT = 57380
+const ELIF = 57381
+const SWITCH = 57382
+const CASE = 57383
+const DEFAULT = 57384
+const TTL = 57385
+const HALFLIFE = 57386
+const INTERVAL = 57387
+const SAMPLE = 57388
+const LET = 57389
+const MAP = 57390
+const NORMALIZE = 57391
+const NAMESPACE = 57392
+const HELP = 57393
+const UNIT = 57394
+const TIMEZONE = 57395
+const LIMIT = 57396
+const BUILTIN = 57397
+const REGEX = 57398
+const STRING = 57399
+const CAPREF = 57400
+const CAPREF_NAMED = 57401
+const ID = 57402
+const FUNC_NAME = 57403
+const DECO = 57404
+const INTLITERAL = 57405
+const FLOATLITERAL = 57406
+const DURATIONLITERAL = 57407
+const INC = 57408
+const DEC = 57409
+const DIV = 57410
+const MOD = 57411
+const MUL = 57412
+const MINUS = 57413
+const PLUS = 57414
+const POW = 57415
+const SHL = 57416
+const SHR = 57417
+const LT = 57418
+const GT = 57419
+const LE = 57420
+const GE = 57421
+const EQ = 57422
+const NE = 57423
+const BITAND = 57424
+const XOR = 57425
+const BITOR = 57426
+const NOT = 57427
+const AND = 57428
+const OR = 57429
+const LNOT = 57430
+const ADD_ASSIGN = 57431
+const ASSIGN = 57432
+const CONCAT = 57433
+const MATCH = 57434
+const NOT_MATCH = 57435
+const LCURLY = 57436
+const RCURLY = 57437
+const LPAREN = 57438
+const RPAREN = 57439
+const LSQUARE = 57440
+const RSQUARE = 57441
+const COMMA = 57442
+const QUESTION = 57443
+const COLON = 57444
+const NL = 57445
 
 var mtailToknames = [...]string{
 	"$end",
@@ -105,11 +143,25 @@ var mtailToknames = [...]string{
 	"TIMER",
 	"TEXT",
 	"HISTOGRAM",
+	"SUMMARY",
+	"BOOL",
+	"EWMA",
+	"TOPK",
+	"UNIQUE",
+	"MIN",
+	"MAX",
+	"STDDEV",
+	"TRUE",
+	"FALSE",
 	"AFTER",
 	"AS",
 	"BY",
 	"CONST",
 	"HIDDEN",
+	"PERSIST",
+	"TRANSIENT",
+	"LOOKUP",
+	"FROM",
 	"DEF",
 	"DEL",
 	"NEXT",
@@ -117,12 +169,32 @@ var mtailToknames = [...]string{
 	"ELSE",
 	"STOP",
 	"BUCKETS",
+	"QUANTILES",
+	"RETURN",
+	"IMPORT",
+	"ELIF",
+	"SWITCH",
+	"CASE",
+	"DEFAULT",
+	"TTL",
+	"HALFLIFE",
+	"INTERVAL",
+	"SAMPLE",
+	"LET",
+	"MAP",
+	"NORMALIZE",
+	"NAMESPACE",
+	"HELP",
+	"UNIT",
+	"TIMEZONE",
+	"LIMIT",
 	"BUILTIN",
 	"REGEX",
 	"STRING",
 	"CAPREF",
 	"CAPREF_NAMED",
 	"ID",
+	"FUNC_NAME",
 	"DECO",
 	"INTLITERAL",
 	"FLOATLITERAL",
@@ -149,6 +221,7 @@ var mtailToknames = [...]string{
 	"NOT",
 	"AND",
 	"OR",
+	"LNOT",
 	"ADD_ASSIGN",
 	"ASSIGN",
 	"CONCAT",
@@ -161,6 +234,8 @@ var mtailToknames = [...]string{
 	"LSQUARE",
 	"RSQUARE",
 	"COMMA",
+	"QUESTION",
+	"COLON",
 	"NL",
 }
 var mtailStatenames = [...]string{}
@@ -169,7 +244,7 @@ const mtailEofCode = 1
 const mtailErrCode = 2
 const mtailInitialStackSize = 16
 
-//line parser.y:650
+//line parser.y:1217
 
 //  tokenpos returns the position of the current token.
 func tokenpos(mtaillex mtailLexer) position.Position {
@@ -189,148 +264,277 @@ var mtailExca = [...]int{
 	-2, 0,
 	-1, 2,
 	1, 1,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
-	-1, 106,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
+	-2, 206,
 }
 
 const mtailPrivate = 57344
 
-const mtailLast = 231
+const mtailLast = 829
 
 var mtailAct = [...]int{
 
-	158, 21, 124, 64, 44, 28, 27, 43, 42, 26,
-	41, 29, 47, 89, 22, 14, 19, 122, 154, 46,
-	25, 153, 152, 153, 85, 105, 53, 168, 52, 32,
-	167, 35, 33, 34, 45, 13, 37, 38, 127, 28,
-	27, 86, 49, 93, 11, 24, 2, 20, 10, 15,
-	84, 12, 88, 32, 165, 35, 33, 34, 45, 60,
-	37, 38, 50, 51, 30, 77, 78, 142, 36, 49,
-	17, 104, 80, 79, 160, 113, 32, 159, 35, 33,
-	34, 45, 40, 37, 38, 50, 51, 123, 123, 82,
-	83, 133, 36, 66, 68, 67, 106, 16, 70, 71,
-	72, 73, 74, 75, 126, 40, 131, 87, 27, 28,
-	27, 102, 99, 100, 98, 36, 130, 101, 45, 132,
-	19, 146, 27, 27, 114, 141, 112, 145, 144, 151,
-	150, 149, 156, 155, 147, 148, 143, 115, 96, 95,
-	161, 116, 91, 92, 61, 140, 91, 92, 117, 171,
-	170, 118, 119, 120, 103, 166, 121, 62, 111, 164,
-	163, 13, 110, 60, 39, 109, 128, 1, 169, 129,
-	11, 24, 162, 20, 10, 15, 136, 12, 90, 32,
-	76, 35, 33, 34, 45, 63, 37, 38, 32, 97,
-	35, 33, 34, 45, 94, 37, 38, 138, 137, 55,
-	56, 57, 58, 59, 48, 65, 81, 139, 40, 69,
-	18, 157, 134, 135, 54, 108, 9, 40, 36, 8,
-	7, 107, 6, 16, 31, 23, 5, 36, 125, 4,
-	3,
+	119, 85, 170, 57, 52, 50, 168, 251, 211, 78,
+	210, 240, 232, 81, 61, 65, 55, 77, 54, 92,
+	76, 114, 51, 60, 53, 89, 90, 35, 255, 83,
+	113, 155, 57, 30, 22, 84, 323, 124, 125, 126,
+	127, 128, 129, 87, 120, 340, 341, 171, 342, 269,
+	268, 322, 267, 91, 87, 353, 347, 57, 87, 204,
+	299, 88, 277, 110, 355, 276, 27, 88, 86, 303,
+	57, 57, 86, 276, 354, 288, 276, 276, 137, 136,
+	346, 144, 334, 276, 296, 297, 302, 297, 300, 317,
+	172, 53, 292, 290, 319, 276, 97, 318, 165, 335,
+	289, 316, 156, 276, 152, 57, 275, 336, 117, 276,
+	203, 314, 225, 82, 116, 150, 259, 191, 228, 313,
+	265, 122, 166, 153, 209, 151, 214, 96, 212, 88,
+	87, 87, 87, 215, 216, 217, 199, 88, 266, 229,
+	2, 218, 139, 140, 131, 130, 116, 208, 121, 219,
+	307, 149, 220, 133, 135, 134, 212, 212, 26, 212,
+	230, 221, 223, 231, 227, 192, 193, 137, 224, 234,
+	57, 57, 306, 57, 57, 236, 233, 124, 125, 126,
+	127, 128, 129, 162, 163, 161, 147, 148, 164, 159,
+	158, 262, 102, 142, 143, 53, 207, 271, 264, 249,
+	237, 235, 332, 331, 30, 22, 257, 256, 305, 248,
+	57, 272, 260, 261, 247, 273, 57, 57, 258, 283,
+	279, 280, 246, 301, 245, 194, 190, 242, 154, 173,
+	286, 212, 274, 278, 291, 282, 287, 298, 285, 82,
+	284, 281, 142, 143, 294, 82, 79, 244, 103, 196,
+	198, 253, 95, 295, 252, 94, 206, 105, 359, 104,
+	270, 254, 243, 202, 201, 101, 200, 263, 326, 106,
+	167, 205, 107, 57, 169, 233, 169, 310, 308, 304,
+	312, 108, 212, 195, 58, 311, 1, 102, 37, 38,
+	39, 40, 41, 42, 100, 44, 212, 48, 45, 46,
+	47, 315, 328, 239, 241, 327, 181, 325, 180, 333,
+	330, 324, 329, 57, 141, 138, 160, 343, 118, 212,
+	212, 157, 132, 146, 344, 345, 123, 250, 348, 57,
+	174, 197, 176, 349, 321, 320, 350, 293, 70, 17,
+	24, 352, 339, 338, 212, 337, 309, 15, 13, 351,
+	356, 12, 11, 357, 31, 10, 358, 9, 93, 57,
+	16, 64, 115, 360, 21, 37, 38, 39, 40, 41,
+	42, 43, 44, 28, 48, 45, 46, 47, 74, 75,
+	14, 8, 7, 19, 29, 6, 62, 32, 36, 5,
+	33, 18, 23, 4, 20, 3, 0, 49, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 34, 80, 0,
+	0, 0, 182, 187, 186, 63, 0, 68, 66, 67,
+	82, 79, 0, 71, 72, 73, 0, 188, 189, 0,
+	0, 0, 0, 0, 0, 183, 184, 185, 0, 0,
+	0, 175, 0, 177, 178, 59, 179, 0, 56, 0,
+	0, 0, 0, 0, 0, 238, 69, 0, 0, 0,
+	0, 0, 0, 25, 21, 37, 38, 39, 40, 41,
+	42, 43, 44, 28, 48, 45, 46, 47, 74, 75,
+	0, 0, 0, 19, 29, 0, 0, 32, 0, 0,
+	33, 18, 23, 0, 20, 0, 0, 49, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 34, 80, 0,
+	0, 0, 0, 0, 0, 63, 0, 68, 66, 67,
+	82, 79, 111, 71, 72, 73, 0, 0, 0, 74,
+	75, 0, 0, 0, 0, 0, 111, 0, 112, 0,
+	0, 0, 0, 74, 75, 59, 0, 0, 56, 0,
+	0, 0, 112, 0, 0, 0, 69, 0, 0, 80,
+	0, 0, 0, 25, 0, 0, 63, 0, 68, 66,
+	67, 82, 79, 80, 71, 72, 73, 0, 0, 0,
+	63, 0, 68, 66, 67, 82, 79, 0, 71, 72,
+	73, 0, 0, 111, 0, 213, 59, 0, 0, 56,
+	74, 75, 0, 0, 0, 0, 0, 69, 0, 112,
+	59, 0, 111, 145, 109, 0, 0, 0, 0, 74,
+	75, 69, 226, 0, 0, 0, 0, 0, 112, 0,
+	80, 0, 0, 0, 0, 0, 0, 63, 0, 68,
+	66, 67, 82, 79, 0, 71, 72, 73, 0, 80,
+	0, 0, 213, 0, 0, 0, 63, 0, 68, 66,
+	67, 82, 79, 0, 71, 72, 73, 59, 111, 0,
+	145, 213, 0, 0, 0, 74, 75, 0, 69, 222,
+	0, 0, 0, 0, 112, 0, 59, 111, 0, 145,
+	0, 0, 0, 0, 74, 75, 0, 69, 0, 0,
+	0, 0, 0, 112, 0, 80, 0, 0, 0, 0,
+	0, 0, 63, 0, 68, 66, 67, 82, 79, 0,
+	71, 72, 73, 0, 80, 0, 0, 0, 0, 0,
+	0, 63, 0, 68, 66, 67, 82, 79, 0, 71,
+	72, 73, 59, 111, 0, 56, 0, 0, 0, 0,
+	74, 75, 0, 69, 0, 0, 0, 0, 0, 112,
+	0, 59, 0, 0, 145, 0, 0, 0, 0, 0,
+	0, 0, 69, 0, 0, 0, 0, 0, 0, 0,
+	80, 0, 0, 0, 0, 0, 0, 63, 0, 68,
+	66, 67, 82, 79, 0, 71, 72, 73, 37, 38,
+	39, 40, 41, 42, 100, 44, 0, 48, 45, 46,
+	47, 0, 0, 0, 0, 0, 0, 0, 98, 99,
+	0, 0, 0, 0, 0, 0, 0, 0, 69,
 }
 var mtailPact = [...]int{
 
-	-1000, -1000, 157, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, 91, -1000, -1000, 10, -17, -1000, -40, 194, 129,
-	7, 45, -1000, -1000, -1000, 56, -1000, 8, 18, 49,
-	12, -39, -20, -1000, -1000, -1000, 54, -1000, -1000, 110,
-	54, 101, -1000, -1000, 78, -1000, -1000, 135, -41, -1000,
-	-1000, -1000, -1000, -1000, 138, -1000, -1000, -1000, -1000, -1000,
-	-1000, 99, -17, 114, -1000, -41, -1000, -1000, -1000, -41,
-	-1000, -1000, -1000, -1000, -1000, -1000, -41, -1000, -1000, -41,
-	-41, -41, -1000, -1000, -41, 54, 166, -24, 33, 25,
-	-1000, -1000, -1000, -1000, -41, -1000, -1000, -41, -1000, -1000,
-	-1000, -1000, 12, -17, 54, -1000, 31, 186, -1000, -1000,
-	-1000, 122, -17, -1000, 36, 54, 54, 7, 54, 54,
-	54, 91, -42, 45, -1000, -1000, -44, -1000, 54, 54,
-	-1000, 45, -1000, -1000, -1000, -1000, -1000, 50, 116, 130,
-	20, -1000, -1000, 56, 49, -1000, -1000, 33, 33, 101,
-	-1000, -1000, -1000, 54, -1000, 78, -1000, -35, -1000, -1000,
-	-1000, -1000, -38, -1000, -1000, -1000, 45, 50, 120, -1000,
-	-1000, -1000,
+	-1000, -1000, 460, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, 185,
+	-1000, -1000, -33, 35, 35, -1000, -50, 195, 31, 793,
+	219, 511, 48, 732, 179, 62, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, 25, -1000, -1000, -1000, -1000, -1000, -1000,
+	101, -1000, -1000, 55, 71, -1000, 657, 50, 127, 676,
+	112, 79, 17, 29, 5, 27, -1000, -1000, -1000, 657,
+	657, -1000, -1000, -1000, -1000, -1000, 118, -1000, -1000, -1000,
+	-1000, 115, -1000, -1000, 26, 237, -56, -56, -1000, -1000,
+	-1000, -1000, 392, -1000, -1000, -1000, 163, 195, 283, 283,
+	-1000, 162, -1000, 189, 657, 209, 207, 206, 35, -1000,
+	-44, 25, 16, 124, -1000, 243, 196, -1000, 176, -1000,
+	57, -56, 601, -56, -1000, -1000, -1000, -1000, -1000, -1000,
+	-56, -56, -56, -1000, -1000, -1000, -1000, -1000, -56, -1000,
+	-1000, -1000, -1000, -1000, -1000, 676, -56, -1000, -1000, -56,
+	601, 582, 14, 525, 21, -29, 45, -56, -1000, -1000,
+	-56, -1000, -1000, -1000, -1000, 79, 179, 35, -1000, 657,
+	657, -1000, 657, 360, -1000, 167, -1000, 205, 187, 161,
+	-1000, -1000, 157, 149, 144, 134, 194, 204, 143, 143,
+	19, 392, 195, 195, 123, 211, 35, 24, -1000, 44,
+	-51, -53, -54, -1000, -1000, 203, -1000, 132, -56, 657,
+	9, -1000, -39, -1000, 676, 657, 657, 676, 732, 676,
+	185, -24, -1000, 3, -7, 601, -1000, -5, -1000, -1000,
+	676, 676, -13, -1000, -1000, 43, -42, 62, -1000, -12,
+	-1000, 160, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-14, -1000, -1000, -1000, -1000, -31, -1000, -1000, -31, 195,
+	392, 392, 145, 104, -1000, 53, -1000, -1000, -1000, -1000,
+	-1000, -1000, 657, 101, -1000, -1000, 601, -56, 71, -1000,
+	-1000, 112, -1000, -1000, 118, -1000, -1000, 23, -1000, 13,
+	601, 2, -1000, -6, 115, -1000, -1000, 179, 235, -56,
+	167, -1000, 194, 139, 392, -1000, -1000, 35, -15, 4,
+	-55, -1000, 657, 601, 601, -17, -1000, -1000, -1000, -1000,
+	-1000, -46, -1000, -1000, 79, -1000, 35, -1000, 657, -1000,
+	-1000, -1000, -1000, -1000, 35, -1000, -1000, -1000, 601, 35,
+	-1000, -1000, -1000, -47, -23, -35, -1000, -56, -1000, -1000,
+	-1000, -27, -1000, -56, -1000, -1000, 201, -1000, 657, -1000,
+	-1000,
 }
 var mtailPgo = [...]int{
 
-	0, 46, 230, 17, 12, 229, 226, 70, 3, 4,
-	10, 164, 2, 225, 20, 11, 1, 15, 224, 7,
-	64, 9, 222, 221, 220, 219, 8, 14, 216, 215,
-	214, 213, 0, 212, 211, 210, 209, 206, 205, 204,
-	194, 189, 180, 178, 176, 172, 167, 71, 13, 158,
+	0, 140, 395, 10, 1, 393, 389, 158, 0, 13,
+	20, 284, 21, 388, 5, 23, 18, 4, 8, 31,
+	27, 386, 9, 14, 16, 385, 19, 382, 381, 17,
+	22, 380, 362, 361, 360, 358, 357, 355, 354, 12,
+	15, 352, 351, 348, 6, 347, 346, 345, 343, 342,
+	340, 339, 338, 337, 335, 334, 66, 332, 7, 331,
+	330, 327, 326, 323, 322, 321, 316, 315, 314, 308,
+	306, 28, 11, 304, 303, 286, 30, 2, 283,
 }
 var mtailR1 = [...]int{
 
-	0, 46, 1, 1, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 2, 5, 5, 5, 6, 6, 4,
-	7, 13, 13, 13, 17, 17, 17, 17, 39, 39,
-	16, 16, 38, 38, 38, 14, 14, 36, 36, 36,
-	36, 36, 36, 15, 15, 37, 37, 10, 10, 27,
-	27, 27, 42, 42, 21, 20, 20, 20, 40, 40,
-	9, 9, 41, 41, 41, 41, 12, 12, 11, 11,
-	43, 43, 8, 8, 8, 8, 8, 8, 8, 8,
-	8, 18, 18, 19, 3, 3, 26, 22, 35, 35,
-	23, 23, 23, 23, 29, 29, 30, 30, 30, 30,
-	30, 33, 34, 34, 31, 44, 45, 45, 45, 45,
-	24, 25, 28, 28, 32, 32, 48, 49, 47, 47,
+	0, 75, 1, 1, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 5, 5, 5, 5, 5, 50, 44,
+	44, 44, 6, 6, 4, 7, 13, 13, 13, 17,
+	17, 19, 19, 20, 20, 20, 20, 14, 14, 16,
+	16, 64, 64, 64, 62, 62, 62, 62, 62, 62,
+	15, 15, 63, 63, 10, 10, 30, 30, 30, 30,
+	67, 67, 24, 23, 23, 23, 23, 65, 65, 9,
+	9, 66, 66, 66, 66, 12, 12, 12, 11, 11,
+	68, 68, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 21, 21, 22, 3, 3, 18, 18, 18, 29,
+	25, 25, 25, 25, 25, 26, 26, 26, 26, 26,
+	26, 26, 26, 26, 26, 26, 26, 26, 35, 35,
+	56, 56, 56, 56, 56, 56, 56, 56, 56, 56,
+	56, 56, 60, 61, 61, 74, 74, 72, 72, 73,
+	57, 69, 70, 71, 71, 71, 71, 27, 36, 36,
+	39, 39, 59, 59, 40, 45, 46, 46, 46, 47,
+	47, 48, 49, 52, 53, 53, 53, 53, 54, 55,
+	55, 41, 42, 43, 31, 32, 33, 37, 37, 38,
+	28, 51, 34, 34, 58, 58, 76, 78, 77, 77,
 }
 var mtailR2 = [...]int{
 
 	0, 1, 0, 2, 1, 1, 1, 1, 1, 1,
-	1, 3, 1, 1, 4, 2, 2, 1, 2, 3,
-	1, 1, 4, 4, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 4, 1, 1, 1,
-	1, 1, 1, 1, 4, 1, 1, 1, 4, 1,
-	4, 4, 1, 1, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 1, 2, 1, 2,
-	1, 1, 1, 3, 4, 1, 1, 1, 3, 1,
-	1, 1, 4, 1, 1, 3, 5, 3, 0, 1,
-	2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
-	1, 2, 1, 3, 2, 2, 1, 1, 3, 3,
-	4, 3, 4, 2, 1, 1, 0, 0, 0, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 3,
+	6, 1, 1, 4, 3, 2, 2, 2, 5, 3,
+	5, 4, 1, 2, 3, 1, 1, 4, 4, 1,
+	7, 1, 4, 1, 1, 4, 4, 1, 4, 1,
+	4, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	1, 4, 1, 1, 1, 4, 1, 2, 4, 4,
+	1, 1, 1, 1, 4, 4, 7, 1, 1, 1,
+	4, 1, 1, 1, 1, 1, 2, 2, 1, 2,
+	1, 1, 1, 3, 4, 6, 7, 5, 4, 3,
+	4, 1, 1, 1, 3, 5, 1, 1, 1, 1,
+	1, 1, 4, 1, 1, 3, 1, 7, 1, 5,
+	2, 5, 3, 4, 4, 2, 3, 2, 3, 3,
+	3, 2, 2, 3, 3, 3, 3, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 2, 1, 3, 1, 3, 1, 2, 1,
+	2, 2, 2, 1, 1, 3, 3, 4, 6, 7,
+	1, 3, 1, 1, 1, 6, 0, 2, 2, 3,
+	2, 1, 1, 1, 0, 2, 2, 2, 4, 1,
+	1, 4, 4, 4, 4, 1, 3, 2, 3, 1,
+	3, 6, 4, 2, 1, 1, 0, 0, 0, 1,
 }
 var mtailChk = [...]int{
 
-	-1000, -46, -1, -2, -5, -6, -22, -24, -25, -28,
-	17, 13, 20, 4, -17, 18, 66, -7, -35, -48,
-	16, -16, -27, -13, 14, -14, -21, -8, -12, -15,
-	-20, -18, 22, 25, 26, 24, 61, 29, 30, -11,
-	51, -10, -26, -19, -9, 27, -19, -4, -39, 59,
-	52, 53, -4, 66, -30, 5, 6, 7, 8, 9,
-	34, 15, 28, -11, -8, -38, 48, 50, 49, -36,
-	42, 43, 44, 45, 46, 47, -42, 57, 58, 55,
-	54, -37, 40, 41, 38, 63, 61, -7, -17, -48,
-	-43, 32, 33, -12, -40, 38, 37, -41, 36, 34,
-	35, 39, -20, 19, -47, 66, -1, -23, -29, 27,
-	24, -49, 27, -4, 10, -47, -47, -47, -47, -47,
-	-47, -47, -3, -16, -12, 62, -3, 62, -47, -47,
-	-4, -16, -27, 60, -33, -31, -44, 12, 11, 21,
-	23, -4, 31, -14, -15, -21, -8, -17, -17, -10,
-	-26, -19, 64, 65, 62, -9, -12, -34, -32, 27,
-	24, 24, -45, 30, 29, 34, -16, 65, 65, -32,
-	30, 29,
+	-1000, -75, -1, -2, -5, -6, -25, -27, -28, -36,
+	-37, -41, -42, -43, -31, -45, -34, -51, 31, 23,
+	34, 4, -19, 32, -50, 103, -7, -56, 13, 24,
+	-76, -38, 27, 30, 47, -20, -13, 5, 6, 7,
+	8, 9, 10, 11, 12, 15, 16, 17, 14, 37,
+	-14, -30, -17, -12, -16, -24, 88, -8, -11, 85,
+	-15, -23, -21, 55, -33, -40, 58, 59, 57, 96,
+	-52, 63, 64, 65, 18, 19, -10, -29, -22, 61,
+	48, -9, 60, -22, -40, -4, 101, 87, 94, -4,
+	-4, 103, -26, -35, 60, 57, 96, -56, 25, 26,
+	11, 46, 68, 29, 40, 38, 50, 53, 62, 103,
+	-19, 11, 27, -76, -12, -32, 98, 60, -11, -8,
+	-22, 86, 96, -62, 76, 77, 78, 79, 80, 81,
+	90, 89, -64, 82, 84, 83, -30, -12, -67, 92,
+	93, -68, 66, 67, -12, 88, -63, 74, 75, 72,
+	98, 96, 99, 96, -7, -19, -19, -65, 72, 71,
+	-66, 70, 68, 69, 73, -23, 96, 33, -44, 39,
+	-77, 103, -77, -1, -60, 49, -57, 51, 52, 54,
+	-69, -70, 20, 43, 44, 45, 22, 21, 35, 36,
+	63, -26, -56, -56, 63, -78, 60, -59, 61, -19,
+	57, 57, 57, -4, 103, 28, 60, 20, 90, -77,
+	-3, -18, -14, 70, -77, -77, -77, -77, -77, -77,
+	-77, -3, 97, -3, -24, 98, 97, -3, 97, 94,
+	-77, -77, -39, -22, -4, -19, -17, -20, 95, -74,
+	-72, -73, 60, 57, 60, 63, 65, 65, 65, 65,
+	-61, -58, 60, 57, 57, -71, 64, 63, -71, 97,
+	-26, -26, 68, 56, -4, 96, 94, 103, 103, 103,
+	57, 65, -77, -14, -30, 97, 100, 101, -16, -17,
+	-17, -15, -24, -8, -10, -29, -22, -40, 99, 97,
+	100, -18, 97, -53, -9, -12, 97, 100, -4, 102,
+	100, 63, 100, 100, -26, 63, 68, 97, -39, -46,
+	-17, -18, -77, 96, 98, -3, 99, 95, 103, 100,
+	-54, -55, 57, 42, -23, -22, 33, -44, -77, -72,
+	-58, 64, 63, -4, 97, 95, 103, -47, -48, -49,
+	41, 42, 103, -17, -3, -3, 97, 102, -4, -17,
+	-4, -3, -4, 102, 97, 99, -77, -4, -77, 57,
+	-17,
 }
 var mtailDef = [...]int{
 
 	2, -2, -2, 3, 4, 5, 6, 7, 8, 9,
-	10, 0, 12, 13, 21, 0, 17, 0, 0, 0,
-	0, 24, 25, 20, 89, 30, 49, 68, 60, 35,
-	54, 72, 0, 75, 76, 77, 116, 79, 80, 66,
-	0, 43, 55, 81, 47, 83, 116, 15, 118, 2,
-	28, 29, 16, 18, 0, 96, 97, 98, 99, 100,
-	117, 0, 0, 113, 68, 118, 32, 33, 34, 118,
-	37, 38, 39, 40, 41, 42, 118, 52, 53, 118,
-	118, 118, 45, 46, 118, 0, 0, 0, 21, 0,
-	69, 70, 71, 67, 118, 58, 59, 118, 62, 63,
-	64, 65, 11, 0, 116, 119, -2, 87, 93, 94,
-	95, 0, 0, 111, 0, 0, 0, 116, 116, 116,
-	0, 116, 0, 84, 60, 73, 0, 78, 0, 0,
-	14, 26, 27, 19, 90, 91, 92, 0, 0, 0,
-	0, 110, 112, 31, 36, 50, 51, 22, 23, 44,
-	56, 57, 82, 0, 74, 48, 61, 101, 102, 114,
-	115, 104, 105, 106, 107, 86, 85, 0, 0, 103,
-	108, 109,
+	10, 11, 12, 13, 14, 15, 16, 17, 18, 0,
+	21, 22, 39, 0, 0, 32, 0, 0, 0, 0,
+	0, 206, 0, 0, 0, 41, 35, 140, 141, 142,
+	143, 144, 145, 146, 147, 148, 149, 150, 151, 199,
+	43, 44, 36, 79, 47, 66, 206, 88, 85, 0,
+	49, 72, 92, 0, 0, 0, 101, 102, 103, 206,
+	206, 106, 107, 108, 109, 110, 60, 73, 111, 174,
+	183, 64, 113, 206, 0, 25, 208, 208, 2, 26,
+	27, 33, 120, 137, 138, 139, 0, 0, 0, 0,
+	146, 0, 207, 0, 206, 0, 0, 0, 0, 197,
+	0, 0, 0, 0, 79, 0, 0, 195, 203, 88,
+	0, 208, 0, 208, 54, 55, 56, 57, 58, 59,
+	208, 208, 208, 51, 52, 53, 67, 87, 208, 70,
+	71, 89, 90, 91, 86, 0, 208, 62, 63, 208,
+	0, 206, 0, 0, 0, 39, 0, 208, 77, 78,
+	208, 81, 82, 83, 84, 19, 0, 0, 24, 206,
+	206, 209, 206, 206, 125, 0, 127, 0, 0, 0,
+	131, 132, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 122, 0, 0, 0, 0, 172, 0, 173, 0,
+	0, 0, 0, 200, 198, 0, 196, 0, 208, 206,
+	0, 114, 116, 118, 0, 206, 206, 0, 206, 0,
+	206, 0, 93, 0, 0, 0, 99, 0, 104, 184,
+	0, 0, 0, 170, 23, 0, 0, 42, 34, 126,
+	155, 157, 159, 128, 129, 130, 133, 134, 135, 136,
+	152, 153, 204, 205, 160, 161, 163, 164, 162, 0,
+	123, 124, 0, 0, 167, 0, 176, 191, 192, 193,
+	194, 202, 206, 45, 46, 98, 0, 208, 48, 37,
+	38, 50, 68, 69, 61, 74, 75, 0, 112, 94,
+	0, 0, 100, 0, 65, 80, 206, 0, 29, 208,
+	0, 158, 0, 0, 121, 28, 119, 0, 0, 0,
+	0, 115, 206, 0, 0, 0, 97, 105, 185, 186,
+	187, 0, 189, 190, 20, 171, 0, 31, 206, 156,
+	154, 165, 166, 168, 0, 175, 177, 178, 0, 0,
+	181, 182, 201, 0, 0, 0, 95, 208, 30, 40,
+	169, 0, 180, 208, 76, 96, 0, 179, 206, 188,
+	117,
 }
 var mtailTok1 = [...]int{
 
@@ -344,7 +548,11 @@ var mtailTok2 = [...]int{
 	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
 	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
 	52, 53, 54, 55, 56, 57, 58, 59, 60, 61,
-	62, 63, 64, 65, 66,
+	62, 63, 64, 65, 66, 67, 68, 69, 70, 71,
+	72, 73, 74, 75, 76, 77, 78, 79, 80, 81,
+	82, 83, 84, 85, 86, 87, 88, 89, 90, 91,
+	92, 93, 94, 95, 96, 97, 98, 99, 100, 101,
+	102, 103,
 }
 var mtailTok3 = [...]int{
 	0,
@@ -355,10 +563,10 @@ var mtailErrorMessages = [...]struct {
 	token int
 	msg   string
 }{
-	{111, 4, "unexpected end of file, expecting '/' to end regex"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
+	{195, 4, "unexpected end of file, expecting '/' to end regex"},
+	{30, 1, "unexpected end of file, expecting '}' to end block"},
+	{30, 1, "unexpected end of file, expecting '}' to end block"},
+	{30, 1, "unexpected end of file, expecting '}' to end block"},
 }
 
 //line yaccpar:1
@@ -694,19 +902,19 @@ mtaildefault:
 
 	case 1:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:88
+//line parser.y:101
 		{
 			mtaillex.(*parser).root = mtailDollar[1].n
 		}
 	case 2:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:95
+//line parser.y:108
 		{
 			mtailVAL.n = &ast.StmtList{}
 		}
 	case 3:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:99
+//line parser.y:112
 		{
 			mtailVAL.n = mtailDollar[1].n
 			if mtailDollar[2].n != nil {
@@ -715,711 +923,1348 @@ mtaildefault:
 		}
 	case 4:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:109
+//line parser.y:122
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 5:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:111
+//line parser.y:124
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 6:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:113
+//line parser.y:126
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 7:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:115
+//line parser.y:128
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 8:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:117
+//line parser.y:130
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 9:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:119
+//line parser.y:132
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 10:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:121
+//line parser.y:134
 		{
-			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 11:
-		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:125
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:136
 		{
-			mtailVAL.n = &ast.PatternFragment{Id: mtailDollar[2].n, Expr: mtailDollar[3].n}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 12:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:129
+//line parser.y:138
 		{
-			mtailVAL.n = &ast.StopStmt{tokenpos(mtaillex)}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 13:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:133
+//line parser.y:140
 		{
-			mtailVAL.n = &ast.Error{tokenpos(mtaillex), mtailDollar[1].text}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 14:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:140
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:142
 		{
-			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 15:
-		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
 //line parser.y:144
 		{
-			if mtailDollar[1].n != nil {
-				mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil}
-			} else {
-				mtailVAL.n = mtailDollar[2].n
-			}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 16:
-		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:152
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:146
 		{
-			o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
-			mtailVAL.n = &ast.CondStmt{o, mtailDollar[2].n, nil, nil}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 17:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:160
+//line parser.y:148
 		{
-			mtailVAL.n = nil
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 18:
-		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:162
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:150
 		{
-			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
 		}
 	case 19:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:167
+//line parser.y:154
 		{
-			mtailVAL.n = mtailDollar[2].n
+			mtailVAL.n = &ast.PatternFragment{Id: mtailDollar[2].n, Expr: mtailDollar[3].n}
 		}
 	case 20:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:174
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:158
 		{
-			mtailVAL.n = mtailDollar[1].n
+			// A pattern constant with parameters is expanded where it is called,
+			// so it leaves nothing in the tree.
+			mtaillex.(*parser).defineMacro(mtailDollar[2].n.(*ast.FuncCall), mtailDollar[4].n.(*ast.ExprList), mtailDollar[6].n)
+			mtailVAL.n = nil
 		}
 	case 21:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:179
+//line parser.y:165
 		{
-			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n = &ast.StopStmt{tokenpos(mtaillex)}
 		}
 	case 22:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:183
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:169
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+			mtailVAL.n = &ast.Error{tokenpos(mtaillex), mtailDollar[1].text}
 		}
 	case 23:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:187
+//line parser.y:176
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil}
 		}
 	case 24:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:194
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:180
 		{
-			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[3].n, nil}
 		}
 	case 25:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:196
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:184
 		{
-			mtailVAL.n = mtailDollar[1].n
+			if mtailDollar[1].n != nil {
+				mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil}
+			} else {
+				mtailVAL.n = mtailDollar[2].n
+			}
 		}
 	case 26:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:198
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:192
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+			o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
+			mtailVAL.n = &ast.CondStmt{o, mtailDollar[2].n, nil, nil}
 		}
 	case 27:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:202
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:197
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil}
 		}
 	case 28:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:209
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:206
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mp := markedpos(mtaillex)
+			tp := tokenpos(mtaillex)
+			s := &ast.SampleExpr{P: *ast.MergePosition(&mp, &tp), Rate: mtailDollar[5].intVal}
+			// Only a sampling rate of one in some number of lines can be applied
+			// to integer counters.
+			if mtailDollar[3].intVal != 1 || mtailDollar[5].intVal < 1 {
+				mtaillex.(*parser).ErrorP("Sampling rate must be 1/N, for a whole number N.", &s.P)
+			}
+			mtailVAL.n = s
 		}
 	case 29:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:211
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:223
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = &ast.StmtList{Children: []ast.Node{&ast.CondStmt{mtailDollar[2].n, mtailDollar[3].n, nil, nil}}}
 		}
 	case 30:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:216
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:227
 		{
-			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n = &ast.StmtList{Children: []ast.Node{&ast.CondStmt{mtailDollar[2].n, mtailDollar[3].n, mtailDollar[5].n, nil}}}
 		}
 	case 31:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:218
+//line parser.y:231
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+			mtailVAL.n = &ast.StmtList{Children: []ast.Node{&ast.CondStmt{mtailDollar[2].n, mtailDollar[3].n, mtailDollar[4].n, nil}}}
 		}
 	case 32:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:225
+//line parser.y:238
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = nil
 		}
 	case 33:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:227
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:240
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 34:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:229
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:245
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = mtailDollar[2].n
 		}
 	case 35:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:234
+//line parser.y:252
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 36:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:236
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:257
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 37:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:243
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:261
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 38:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:245
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:265
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 39:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:247
+//line parser.y:273
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 40:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:249
+		mtailDollar = mtailS[mtailpt-7 : mtailpt+1]
+//line parser.y:275
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = &ast.TernaryExpr{Cond: mtailDollar[1].n, Truth: mtailDollar[4].n, Else: mtailDollar[7].n}
 		}
 	case 41:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:251
+//line parser.y:283
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 42:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:253
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:285
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 43:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:258
+//line parser.y:292
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 44:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:260
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:294
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 45:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:267
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:296
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 46:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:269
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:300
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 47:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:274
+//line parser.y:307
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 48:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:276
+//line parser.y:309
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 49:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:283
+//line parser.y:316
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 50:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:285
+//line parser.y:318
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 51:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:289
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:325
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 52:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:296
+//line parser.y:327
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
 	case 53:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:298
+//line parser.y:329
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
 	case 54:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:303
+//line parser.y:334
 		{
-			mtailVAL.n = &ast.PatternExpr{Expr: mtailDollar[1].n}
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 55:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:310
+//line parser.y:336
 		{
-			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 56:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:312
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:338
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 57:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:316
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:340
 		{
-			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 58:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:323
+//line parser.y:342
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
 	case 59:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:325
+//line parser.y:344
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
 	case 60:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:330
+//line parser.y:349
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 61:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:332
+//line parser.y:351
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 62:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:339
+//line parser.y:358
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
 	case 63:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:341
+//line parser.y:360
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
 	case 64:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:343
+//line parser.y:365
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 65:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:345
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:367
 		{
-			mtailVAL.op = mtailDollar[1].op
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 66:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:350
+//line parser.y:374
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 67:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:352
+//line parser.y:376
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[2].n, Op: mtailDollar[1].op}
 		}
 	case 68:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:359
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:380
 		{
-			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 69:
-		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:361
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:384
 		{
-			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[1].n, Op: mtailDollar[2].op}
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 70:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:368
+//line parser.y:391
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
 	case 71:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:370
+//line parser.y:393
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
 	case 72:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:375
+//line parser.y:398
 		{
-			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n = &ast.PatternExpr{Expr: mtailDollar[1].n}
 		}
 	case 73:
-		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:377
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:405
 		{
-			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: nil}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 74:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:381
+//line parser.y:407
 		{
-			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
 	case 75:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:385
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:411
 		{
-			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, false, nil}
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
 	case 76:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:389
+		mtailDollar = mtailS[mtailpt-7 : mtailpt+1]
+//line parser.y:415
 		{
-			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, true, nil}
+			m := mtaillex.(*parser).mustExpandMacro(mtailDollar[4].n.(*ast.FuncCall), mtailDollar[6].n.(*ast.ExprList))
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: m, Op: CONCAT}
 		}
 	case 77:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:393
+//line parser.y:423
 		{
-			mtailVAL.n = &ast.StringLit{tokenpos(mtaillex), mtailDollar[1].text}
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 78:
-		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:397
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:425
 		{
-			mtailVAL.n = mtailDollar[2].n
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 79:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:401
+//line parser.y:430
 		{
-			mtailVAL.n = &ast.IntLit{tokenpos(mtaillex), mtailDollar[1].intVal}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 80:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:405
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:432
 		{
-			mtailVAL.n = &ast.FloatLit{tokenpos(mtaillex), mtailDollar[1].floatVal}
+			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
 	case 81:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:412
+//line parser.y:439
 		{
-			mtailVAL.n = &ast.IndexedExpr{Lhs: mtailDollar[1].n, Index: &ast.ExprList{}}
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 82:
-		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:416
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:441
 		{
-			mtailVAL.n = mtailDollar[1].n
-			mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children = append(
-				mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children,
-				mtailDollar[3].n.(*ast.ExprList).Children...)
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 83:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:426
+//line parser.y:443
 		{
-			mtailVAL.n = &ast.IdTerm{tokenpos(mtaillex), mtailDollar[1].text, nil, false}
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 84:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:433
+//line parser.y:445
 		{
-			mtailVAL.n = &ast.ExprList{}
-			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[1].n)
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 85:
-		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:438
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:450
 		{
 			mtailVAL.n = mtailDollar[1].n
-			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
 		}
 	case 86:
-		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
-//line parser.y:446
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:452
 		{
-			mp := markedpos(mtaillex)
-			tp := tokenpos(mtaillex)
-			pos := ast.MergePosition(&mp, &tp)
-			mtailVAL.n = &ast.PatternLit{P: *pos, Pattern: mtailDollar[4].text}
+			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[2].n, Op: mtailDollar[1].op}
 		}
 	case 87:
-		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
 //line parser.y:456
 		{
-			mtailVAL.n = mtailDollar[3].n
-			d := mtailVAL.n.(*ast.VarDecl)
-			d.Kind = mtailDollar[2].kind
-			d.Hidden = mtailDollar[1].flag
+			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[2].n, Op: mtailDollar[1].op}
 		}
 	case 88:
-		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:466
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:463
 		{
-			mtailVAL.flag = false
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 89:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:470
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:465
 		{
-			mtailVAL.flag = true
+			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[1].n, Op: mtailDollar[2].op}
 		}
 	case 90:
-		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:477
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:472
 		{
-			mtailVAL.n = mtailDollar[1].n
-			mtailVAL.n.(*ast.VarDecl).Keys = mtailDollar[2].texts
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 91:
-		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:482
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:474
 		{
-			mtailVAL.n = mtailDollar[1].n
-			mtailVAL.n.(*ast.VarDecl).ExportedName = mtailDollar[2].text
+			mtailVAL.op = mtailDollar[1].op
 		}
 	case 92:
-		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:487
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:479
 		{
 			mtailVAL.n = mtailDollar[1].n
-			mtailVAL.n.(*ast.VarDecl).Buckets = mtailDollar[2].floats
 		}
 	case 93:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:492
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:481
 		{
-			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: nil}
 		}
 	case 94:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:499
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:485
 		{
-			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
+			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}
 		}
 	case 95:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:503
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:489
 		{
-			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
+			mtailDollar[5].n.(*ast.ExprList).Children = append([]ast.Node{mtailDollar[3].n}, mtailDollar[5].n.(*ast.ExprList).Children...)
+			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[5].n}
 		}
 	case 96:
+		mtailDollar = mtailS[mtailpt-7 : mtailpt+1]
+//line parser.y:494
+		{
+			mtailVAL.n = &ast.IndexedExpr{Lhs: &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}, Index: mtailDollar[6].n}
+		}
+	case 97:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:498
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.LookupExpr).Key = mtailDollar[4].n
+		}
+	case 98:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:503
+		{
+			// `bool' names both the metric kind and the conversion builtin.
+			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: "bool", Args: mtailDollar[3].n}
+		}
+	case 99:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:508
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 100:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:512
+		{
+			// A call of a pattern constant with parameters is its pattern.
+			if m, ok := mtaillex.(*parser).expandMacro(mtailDollar[1].n.(*ast.FuncCall), mtailDollar[3].n.(*ast.ExprList)); ok {
+				mtailVAL.n = &ast.PatternExpr{Expr: m}
+			} else {
+				mtailVAL.n = mtailDollar[1].n
+				mtailVAL.n.(*ast.FuncCall).Args = mtailDollar[3].n
+			}
+		}
+	case 101:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:522
+		{
+			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, false, nil}
+		}
+	case 102:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:526
+		{
+			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, true, nil}
+		}
+	case 103:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:530
+		{
+			var err error
+			mtailVAL.n, err = interpolate(tokenpos(mtaillex), mtailDollar[1].text)
+			if err != nil {
+				pos := tokenpos(mtaillex)
+				mtaillex.(*parser).ErrorP(err.Error(), &pos)
+				mtailVAL.n = &ast.StringLit{pos, mtailDollar[1].text}
+			}
+		}
+	case 104:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:540
+		{
+			mtailVAL.n = mtailDollar[2].n
+		}
+	case 105:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:544
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.MapExpr).Expr = mtailDollar[2].n
+			for _, c := range mtailDollar[4].n.(*ast.StmtList).Children {
+				mtailVAL.n.(*ast.MapExpr).Cases = append(mtailVAL.n.(*ast.MapExpr).Cases, c.(*ast.MapCase))
+			}
+		}
+	case 106:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:552
+		{
+			mtailVAL.n = &ast.IntLit{tokenpos(mtaillex), mtailDollar[1].intVal}
+		}
+	case 107:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:556
+		{
+			mtailVAL.n = &ast.FloatLit{tokenpos(mtaillex), mtailDollar[1].floatVal}
+		}
+	case 108:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:560
+		{
+			// A duration in an expression is its number of seconds, like the
+			// values of timestamp().
+			if mtailDollar[1].duration%time.Second == 0 {
+				mtailVAL.n = &ast.IntLit{tokenpos(mtaillex), int64(mtailDollar[1].duration / time.Second)}
+			} else {
+				mtailVAL.n = &ast.FloatLit{tokenpos(mtaillex), mtailDollar[1].duration.Seconds()}
+			}
+		}
+	case 109:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:570
+		{
+			mtailVAL.n = &ast.BoolLit{tokenpos(mtaillex), true}
+		}
+	case 110:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:574
+		{
+			mtailVAL.n = &ast.BoolLit{tokenpos(mtaillex), false}
+		}
+	case 111:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:581
+		{
+			mtailVAL.n = &ast.IndexedExpr{Lhs: mtailDollar[1].n, Index: &ast.ExprList{}}
+		}
+	case 112:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:585
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children = append(
+				mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children,
+				mtailDollar[3].n.(*ast.ExprList).Children...)
+		}
+	case 113:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:595
+		{
+			mtailVAL.n = &ast.IdTerm{tokenpos(mtaillex), mtailDollar[1].text, nil, false}
+		}
+	case 114:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:602
+		{
+			mtailVAL.n = &ast.ExprList{}
+			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[1].n)
+		}
+	case 115:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:607
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
+		}
+	case 116:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:619
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 117:
+		mtailDollar = mtailS[mtailpt-7 : mtailpt+1]
+//line parser.y:621
+		{
+			mtailVAL.n = &ast.TernaryExpr{Cond: mtailDollar[1].n, Truth: mtailDollar[4].n, Else: mtailDollar[7].n}
+		}
+	case 118:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:510
+//line parser.y:625
+		{
+			mtailVAL.n = &ast.WildcardTerm{P: tokenpos(mtaillex)}
+		}
+	case 119:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:632
+		{
+			mp := markedpos(mtaillex)
+			tp := tokenpos(mtaillex)
+			pos := ast.MergePosition(&mp, &tp)
+			mtailVAL.n = &ast.PatternLit{P: *pos, Pattern: mtailDollar[4].text}
+		}
+	case 120:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:644
+		{
+			mtailVAL.n = mtailDollar[2].n
+			mtailVAL.n.(*ast.VarDecl).Kind = mtailDollar[1].kind
+		}
+	case 121:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:649
+		{
+			// A top-k metric counts only its heaviest label values.
+			mtailVAL.n = mtailDollar[5].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Kind = metrics.Counter
+			d.TopK = mtailDollar[3].intVal
+			if mtailDollar[3].intVal < 1 {
+				mtaillex.(*parser).ErrorP("A top-k metric must track at least one label value.", d.Pos())
+			}
+		}
+	case 122:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:660
+		{
+			mtailVAL.n = mtailDollar[3].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Kind = mtailDollar[2].kind
+			d.Hidden = true
+		}
+	case 123:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:667
+		{
+			mtailVAL.n = mtailDollar[4].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Kind = mtailDollar[3].kind
+			d.Hidden = true
+			d.Persist = true
+		}
+	case 124:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:675
+		{
+			mtailVAL.n = mtailDollar[4].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Kind = mtailDollar[3].kind
+			d.Hidden = true
+			d.Transient = true
+		}
+	case 125:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:686
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Keys = append(mtailVAL.n.(*ast.VarDecl).Keys, mtailDollar[2].texts...)
+		}
+	case 126:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:691
+		{
+			// The normalizers apply to the key before them.
+			mtailVAL.n = mtailDollar[1].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			if len(d.Keys) == 0 {
+				mtaillex.(*parser).ErrorP("Normalizers must follow the key they apply to, like `by path normalize lowercase'.", mtailDollar[3].normalizers[0].Pos())
+			} else {
+				key := d.Keys[len(d.Keys)-1]
+				if d.Normalizers == nil {
+					d.Normalizers = make(map[string][]*ast.Normalizer)
+				}
+				d.Normalizers[key] = append(d.Normalizers[key], mtailDollar[3].normalizers...)
+			}
+		}
+	case 127:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:706
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).ExportedName = mtailDollar[2].text
+		}
+	case 128:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:711
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Help = mtailDollar[3].text
+		}
+	case 129:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:716
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Unit = mtailDollar[3].text
+		}
+	case 130:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:721
+		{
+			mtailVAL.n = mtailDollar[1].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Limit = mtailDollar[3].intVal
+			if mtailDollar[3].intVal < 1 {
+				mtaillex.(*parser).ErrorP("A limit must allow at least one label value.", d.Pos())
+			}
+		}
+	case 131:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:730
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Buckets = mtailDollar[2].floats
+		}
+	case 132:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:735
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Quantiles = mtailDollar[2].floats
+		}
+	case 133:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:740
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Expiry = mtailDollar[3].duration
+		}
+	case 134:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:745
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Expiry = mtailDollar[3].duration
+		}
+	case 135:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:750
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).HalfLife = mtailDollar[3].duration
+		}
+	case 136:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:755
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Interval = mtailDollar[3].duration
+		}
+	case 137:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:760
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 138:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:767
+		{
+			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
+		}
+	case 139:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:771
+		{
+			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
+		}
+	case 140:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:778
 		{
 			mtailVAL.kind = metrics.Counter
 		}
-	case 97:
+	case 141:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:514
+//line parser.y:782
 		{
 			mtailVAL.kind = metrics.Gauge
 		}
-	case 98:
+	case 142:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:518
+//line parser.y:786
 		{
 			mtailVAL.kind = metrics.Timer
 		}
-	case 99:
+	case 143:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:522
+//line parser.y:790
 		{
 			mtailVAL.kind = metrics.Text
 		}
-	case 100:
+	case 144:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:526
+//line parser.y:794
 		{
 			mtailVAL.kind = metrics.Histogram
 		}
-	case 101:
+	case 145:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:798
+		{
+			mtailVAL.kind = metrics.Summary
+		}
+	case 146:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:802
+		{
+			mtailVAL.kind = metrics.Bool
+		}
+	case 147:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:806
+		{
+			mtailVAL.kind = metrics.EWMA
+		}
+	case 148:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:810
+		{
+			mtailVAL.kind = metrics.Min
+		}
+	case 149:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:814
+		{
+			mtailVAL.kind = metrics.Max
+		}
+	case 150:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:818
+		{
+			mtailVAL.kind = metrics.Stddev
+		}
+	case 151:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:822
+		{
+			mtailVAL.kind = metrics.Unique
+		}
+	case 152:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:533
+//line parser.y:829
 		{
 			mtailVAL.texts = mtailDollar[2].texts
 		}
-	case 102:
+	case 153:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:540
+//line parser.y:836
 		{
 			mtailVAL.texts = make([]string, 0)
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[1].text)
 		}
-	case 103:
+	case 154:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:545
+//line parser.y:841
 		{
 			mtailVAL.texts = mtailDollar[1].texts
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[3].text)
 		}
-	case 104:
+	case 155:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:849
+		{
+			mtailVAL.normalizers = []*ast.Normalizer{mtailDollar[1].normalizer}
+		}
+	case 156:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:853
+		{
+			mtailVAL.normalizers = append(mtailDollar[1].normalizers, mtailDollar[3].normalizer)
+		}
+	case 157:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:860
+		{
+			mtailVAL.normalizer = mtailDollar[1].normalizer
+		}
+	case 158:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:864
+		{
+			mtailVAL.normalizer = mtailDollar[1].normalizer
+			mtailVAL.normalizer.Arg = mtailDollar[2].intVal
+			mtailVAL.normalizer.HasArg = true
+		}
+	case 159:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:875
+		{
+			mtailVAL.normalizer = &ast.Normalizer{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
+		}
+	case 160:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:553
+//line parser.y:882
 		{
 			mtailVAL.text = mtailDollar[2].text
 		}
-	case 105:
+	case 161:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:560
+//line parser.y:889
 		{
 			mtailVAL.floats = mtailDollar[2].floats
 		}
-	case 106:
+	case 162:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:895
+		{
+			mtailVAL.floats = mtailDollar[2].floats
+		}
+	case 163:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:566
+//line parser.y:902
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[1].floatVal)
 		}
-	case 107:
+	case 164:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:571
+//line parser.y:907
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[1].intVal))
 		}
-	case 108:
+	case 165:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:576
+//line parser.y:912
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[3].floatVal)
 		}
-	case 109:
+	case 166:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:581
+//line parser.y:917
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[3].intVal))
 		}
-	case 110:
+	case 167:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:588
+//line parser.y:924
 		{
 			mtailVAL.n = &ast.DecoDecl{P: markedpos(mtaillex), Name: mtailDollar[3].text, Block: mtailDollar[4].n}
 		}
-	case 111:
+	case 168:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:931
+		{
+			mtailVAL.n = &ast.FuncDecl{P: markedpos(mtaillex), Name: mtailDollar[3].text, Block: mtailDollar[6].n}
+		}
+	case 169:
+		mtailDollar = mtailS[mtailpt-7 : mtailpt+1]
+//line parser.y:935
+		{
+			f := &ast.FuncDecl{P: markedpos(mtaillex), Name: mtailDollar[3].text, Block: mtailDollar[7].n}
+			for _, p := range mtailDollar[5].n.(*ast.ExprList).Children {
+				f.Params = append(f.Params, p.(*ast.IdTerm))
+			}
+			mtailVAL.n = f
+		}
+	case 170:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:946
+		{
+			mtailVAL.n = &ast.ExprList{}
+			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[1].n)
+		}
+	case 171:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:595
+//line parser.y:951
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
+		}
+	case 172:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:959
+		{
+			mtailVAL.text = mtailDollar[1].text
+		}
+	case 173:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:963
+		{
+			mtailVAL.text = mtailDollar[1].text
+		}
+	case 174:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:972
+		{
+			mtailVAL.n = &ast.FuncCall{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
+		}
+	case 175:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:979
+		{
+			s := &ast.SwitchStmt{P: markedpos(mtaillex), Expr: mtailDollar[3].n}
+			for _, c := range mtailDollar[5].n.(*ast.StmtList).Children {
+				s.Cases = append(s.Cases, c.(*ast.CaseClause))
+			}
+			mtailVAL.n = s
+		}
+	case 176:
+		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
+//line parser.y:990
+		{
+			mtailVAL.n = &ast.StmtList{}
+		}
+	case 177:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:994
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 178:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:998
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.StmtList).Children = append(mtailVAL.n.(*ast.StmtList).Children, mtailDollar[2].n)
+		}
+	case 179:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:1006
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.CaseClause).Values = mtailDollar[2].n
+			mtailVAL.n.(*ast.CaseClause).Block = mtailDollar[3].n
+		}
+	case 180:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:1012
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.CaseClause).Block = mtailDollar[2].n
+		}
+	case 181:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:1022
+		{
+			mtailVAL.n = &ast.CaseClause{P: tokenpos(mtaillex)}
+		}
+	case 182:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:1029
+		{
+			mtailVAL.n = &ast.CaseClause{P: tokenpos(mtaillex)}
+		}
+	case 183:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:1036
+		{
+			mtailVAL.n = &ast.MapExpr{P: tokenpos(mtaillex)}
+		}
+	case 184:
+		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
+//line parser.y:1044
+		{
+			mtailVAL.n = &ast.StmtList{}
+		}
+	case 185:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:1048
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 186:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:1052
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 187:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:1056
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.StmtList).Children = append(mtailVAL.n.(*ast.StmtList).Children, mtailDollar[2].n)
+		}
+	case 188:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:1064
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.MapCase).Value = mtailDollar[4].text
+		}
+	case 189:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:1074
+		{
+			mtailVAL.n = &ast.MapCase{P: tokenpos(mtaillex), Pattern: mtailDollar[1].text}
+		}
+	case 190:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:1078
+		{
+			mtailVAL.n = &ast.MapCase{P: tokenpos(mtaillex), Default: true}
+		}
+	case 191:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:1085
+		{
+			mtailVAL.n = &ast.ImportStmt{P: markedpos(mtaillex), Path: mtailDollar[3].text}
+		}
+	case 192:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:1093
+		{
+			mtailVAL.n = &ast.NamespaceStmt{P: markedpos(mtaillex), Name: mtailDollar[3].text}
+		}
+	case 193:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:1101
+		{
+			mtailVAL.n = &ast.TimezoneStmt{P: markedpos(mtaillex), Name: mtailDollar[3].text}
+		}
+	case 194:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:1108
+		{
+			mtailVAL.n = mtailDollar[2].n
+			mtailVAL.n.(*ast.LookupDecl).Path = mtailDollar[4].text
+		}
+	case 195:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:1116
+		{
+			mtailVAL.n = &ast.LookupDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
+		}
+	case 196:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:1124
+		{
+			mtailVAL.n = &ast.LookupExpr{P: tokenpos(mtaillex), Name: mtailDollar[3].text}
+		}
+	case 197:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:1131
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 198:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:1135
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.ReturnStmt).Expr = mtailDollar[2].n
+		}
+	case 199:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:1145
+		{
+			mtailVAL.n = &ast.ReturnStmt{P: tokenpos(mtaillex)}
+		}
+	case 200:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:1152
 		{
 			mtailVAL.n = &ast.DecoStmt{markedpos(mtaillex), mtailDollar[2].text, mtailDollar[3].n, nil, nil}
 		}
-	case 112:
+	case 201:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:1161
+		{
+			id := mtailDollar[2].n.(*ast.IdTerm)
+			mtailVAL.n = &ast.LetStmt{P: id.P, Name: id.Name, Expr: mtailDollar[5].n}
+		}
+	case 202:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:602
+//line parser.y:1169
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n, Expiry: mtailDollar[4].duration}
 		}
-	case 113:
+	case 203:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:606
+//line parser.y:1173
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n}
 		}
-	case 114:
+	case 204:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:612
+//line parser.y:1179
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 115:
+	case 205:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:616
+//line parser.y:1183
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 116:
+	case 206:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:626
+//line parser.y:1193
 		{
 			glog.V(2).Infof("position marked at %v", tokenpos(mtaillex))
 			mtaillex.(*parser).pos = tokenpos(mtaillex)
 		}
-	case 117:
+	case 207:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:636
+//line parser.y:1203
 		{
 			mtaillex.(*parser).inRegex()
 		}
@@ -23,38 +23,44 @@ import (
     op int
     text string
     texts []string
-    flag bool
     n ast.Node
     kind metrics.Kind
     duration time.Duration
+    normalizer *ast.Normalizer
+    normalizers []*ast.Normalizer
 }
 
 %type <n> stmt_list stmt arg_expr_list compound_statement conditional_statement expression_statement
 %type <n> expr primary_expr multiplicative_expr additive_expr postfix_expr unary_expr assign_expr
-%type <n> rel_expr shift_expr bitwise_expr logical_expr indexed_expr id_expr concat_expr pattern_expr
+%type <n> rel_expr shift_expr bitwise_expr ternary_expr arg_expr logical_expr logical_and_expr indexed_expr id_expr concat_expr pattern_expr
 %type <n> declaration decl_attribute_spec decorator_declaration decoration_statement regex_pattern match_expr
-%type <n> delete_statement var_name_spec
+%type <n> lookup_declaration lookup_name lookup_ref delete_statement var_name_spec function_declaration return_statement return_keyword param_list func_call import_statement namespace_statement timezone_statement elif_clause
+%type <n> switch_statement case_list case_clause case_keyword default_keyword sample_rate let_statement
+%type <n> map_keyword map_case_list map_case map_key
 %type <kind> type_spec
-%type <text> as_spec id_or_string
+%type <text> as_spec id_or_string func_name
 %type <texts> by_spec by_expr_list
-%type <flag> hide_spec
-%type <op> rel_op shift_op bitwise_op logical_op add_op mul_op match_op postfix_op
-%type <floats> buckets_spec buckets_list
+%type <op> rel_op shift_op bitwise_op add_op mul_op match_op postfix_op
+%type <floats> buckets_spec quantiles_spec buckets_list
+%type <normalizer> normalizer normalizer_name
+%type <normalizers> normalizer_list
 // Tokens and types are defined here.
 // Invalid input
 %token <text> INVALID
 // Types
-%token COUNTER GAUGE TIMER TEXT HISTOGRAM
+%token COUNTER GAUGE TIMER TEXT HISTOGRAM SUMMARY BOOL EWMA TOPK UNIQUE MIN MAX STDDEV
 // Reserved words
-%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS
+%token TRUE FALSE
+%token AFTER AS BY CONST HIDDEN PERSIST TRANSIENT LOOKUP FROM DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS QUANTILES RETURN IMPORT ELIF SWITCH CASE DEFAULT TTL HALFLIFE INTERVAL SAMPLE LET MAP NORMALIZE NAMESPACE HELP UNIT TIMEZONE LIMIT
 // Builtins
 %token <text> BUILTIN
 // Literals: re2 syntax regular expression, quoted strings, regex capture group
-// references, identifiers, decorators, and numerical constants.
+// references, identifiers, function names, decorators, and numerical constants.
 %token <text> REGEX
 %token <text> STRING
 %token <text> CAPREF CAPREF_NAMED
 %token <text> ID
+%token <text> FUNC_NAME
 %token <text> DECO
 %token <intVal> INTLITERAL
 %token <floatVal> FLOATLITERAL
@@ -64,15 +70,22 @@ import (
 %token <op> DIV MOD MUL MINUS PLUS POW
 %token <op> SHL SHR
 %token <op> LT GT LE GE EQ NE
-%token <op> BITAND XOR BITOR NOT AND OR
+%token <op> BITAND XOR BITOR NOT AND OR LNOT
 %token <op> ADD_ASSIGN ASSIGN
 %token <op> CONCAT
 %token <op> MATCH NOT_MATCH
 // Punctuation
 %token LCURLY RCURLY LPAREN RPAREN LSQUARE RSQUARE
-%token COMMA
+%token COMMA QUESTION COLON
 %token NL
 
+// A statement can follow a declaration on the same line, so the number after
+// a normalizer like `max_len 64' could also be the start of the next
+// statement.  NORMALIZE binds less tightly than INTLITERAL so that the number
+// is the normalizer's argument.
+%nonassoc NORMALIZE
+%nonassoc INTLITERAL
+
 %start start
 
 // The %error directive takes a list of tokens describing a parser state in error, and an error message.
@@ -115,8 +128,24 @@ stmt
   { $$ = $1 }
   | decoration_statement
   { $$ = $1 }
+  | function_declaration
+  { $$ = $1 }
+  | return_statement
+  { $$ = $1 }
+  | import_statement
+  { $$ = $1 }
+  | namespace_statement
+  { $$ = $1 }
+  | timezone_statement
+  { $$ = $1 }
+  | lookup_declaration
+  { $$ = $1 }
+  | switch_statement
+  { $$ = $1 }
   | delete_statement
   { $$ = $1 }
+  | let_statement
+  { $$ = $1 }
   | NEXT
   {
     $$ = &ast.NextStmt{tokenpos(mtaillex)}
@@ -125,6 +154,13 @@ stmt
   {
     $$ = &ast.PatternFragment{Id: $2, Expr: $3}
   }
+  | CONST func_call LPAREN param_list RPAREN concat_expr
+  {
+    // A pattern constant with parameters is expanded where it is called,
+    // so it leaves nothing in the tree.
+    mtaillex.(*parser).defineMacro($2.(*ast.FuncCall), $4.(*ast.ExprList), $6)
+    $$ = nil
+  }
   | STOP
   {
     $$ = &ast.StopStmt{tokenpos(mtaillex)}
@@ -140,6 +176,10 @@ conditional_statement
   {
     $$ = &ast.CondStmt{$1, $2, $4, nil}
   }
+  | logical_expr compound_statement elif_clause
+  {
+    $$ = &ast.CondStmt{$1, $2, $3, nil}
+  }
   | logical_expr compound_statement
   {
     if $1 != nil {
@@ -153,6 +193,44 @@ conditional_statement
     o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
     $$ = &ast.CondStmt{o, $2, nil, nil}
   }
+  | sample_rate compound_statement
+  {
+    $$ = &ast.CondStmt{$1, $2, nil, nil}
+  }
+  ;
+
+// sample_rate is the condition of a sample block, true for one in some number
+// of lines.
+sample_rate
+  : mark_pos SAMPLE INTLITERAL DIV INTLITERAL
+  {
+    mp := markedpos(mtaillex)
+    tp := tokenpos(mtaillex)
+    s := &ast.SampleExpr{P: *ast.MergePosition(&mp, &tp), Rate: $5}
+    // Only a sampling rate of one in some number of lines can be applied
+    // to integer counters.
+    if $3 != 1 || $5 < 1 {
+      mtaillex.(*parser).ErrorP("Sampling rate must be 1/N, for a whole number N.", &s.P)
+    }
+    $$ = s
+  }
+  ;
+
+// elif_clause is the else block of a conditional, holding the next
+// conditional in the chain.
+elif_clause
+  : ELIF logical_expr compound_statement
+  {
+    $$ = &ast.StmtList{Children: []ast.Node{&ast.CondStmt{$2, $3, nil, nil}}}
+  }
+  | ELIF logical_expr compound_statement ELSE compound_statement
+  {
+    $$ = &ast.StmtList{Children: []ast.Node{&ast.CondStmt{$2, $3, $5, nil}}}
+  }
+  | ELIF logical_expr compound_statement elif_clause
+  {
+    $$ = &ast.StmtList{Children: []ast.Node{&ast.CondStmt{$2, $3, $4, nil}}}
+  }
   ;
 
 expression_statement
@@ -175,46 +253,68 @@ expr
   ;
 
 assign_expr
-  : logical_expr
+  : ternary_expr
   {
     $$ = $1
   }
-  | unary_expr ASSIGN opt_nl logical_expr
+  | unary_expr ASSIGN opt_nl ternary_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
   }
-  | unary_expr ADD_ASSIGN opt_nl logical_expr
+  | unary_expr ADD_ASSIGN opt_nl ternary_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
   }
   ;
 
+// The conditional operator binds least tightly, and groups to the right.
+ternary_expr
+  : logical_expr
+  { $$ = $1 }
+  | logical_expr QUESTION opt_nl ternary_expr COLON opt_nl ternary_expr
+  {
+    $$ = &ast.TernaryExpr{Cond: $1, Truth: $4, Else: $7}
+  }
+  ;
+
+// `&&' binds more tightly than `||'.
 logical_expr
-  : bitwise_expr
+  : logical_and_expr
+  { $$ = $1 }
+  | logical_expr OR opt_nl logical_and_expr
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
+  }
+  ;
+
+logical_and_expr
+  : rel_expr
   { $$ = $1 }
   | match_expr
   { $$ = $1 }
-  | logical_expr logical_op opt_nl bitwise_expr
+  | logical_and_expr AND opt_nl rel_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
   }
-  | logical_expr logical_op opt_nl match_expr
+  | logical_and_expr AND opt_nl match_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
   }
   ;
 
-logical_op
-  : AND
-  { $$ = $1 }
-  | OR
+rel_expr
+  : bitwise_expr
   { $$ = $1 }
+  | rel_expr rel_op opt_nl bitwise_expr
+  {
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
+  }
   ;
 
 bitwise_expr
-  : rel_expr
+  : shift_expr
   { $$ = $1 }
-  | bitwise_expr bitwise_op opt_nl rel_expr
+  | bitwise_expr bitwise_op opt_nl shift_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
   }
@@ -229,15 +329,6 @@ bitwise_op
   { $$ = $1 }
   ;
 
-rel_expr
-  : shift_expr
-  { $$ = $1 }
-  | rel_expr rel_op opt_nl shift_expr
-  {
-    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
-  }
-  ;
-
 rel_op
   : LT
   { $$ = $1 }
@@ -281,6 +372,10 @@ additive_expr
 match_expr
   : pattern_expr
   { $$ = $1 }
+  | LNOT match_expr
+  {
+    $$ = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: $2, Op: $1}
+  }
   | primary_expr match_op opt_nl pattern_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: $2}
@@ -316,6 +411,11 @@ concat_expr
   {
     $$ = &ast.BinaryExpr{Lhs: $1, Rhs: $4, Op: CONCAT}
   }
+  | concat_expr PLUS opt_nl func_call LPAREN arg_expr_list RPAREN
+  {
+    m := mtaillex.(*parser).mustExpandMacro($4.(*ast.FuncCall), $6.(*ast.ExprList))
+    $$ = &ast.BinaryExpr{Lhs: $1, Rhs: m, Op: CONCAT}
+  }
   ;
 
 add_op
@@ -352,6 +452,10 @@ unary_expr
   {
     $$ = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: $2, Op: $1}
   }
+  | LNOT unary_expr
+  {
+    $$ = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: $2, Op: $1}
+  }
   ;
 
 postfix_expr
@@ -381,6 +485,39 @@ primary_expr
   {
     $$ = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: $1, Args: $3}
   }
+  | BUILTIN LPAREN pattern_expr COMMA arg_expr_list RPAREN
+  {
+    $5.(*ast.ExprList).Children = append([]ast.Node{$3}, $5.(*ast.ExprList).Children...)
+    $$ = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: $1, Args: $5}
+  }
+  | BUILTIN LPAREN arg_expr_list RPAREN LSQUARE arg_expr_list RSQUARE
+  {
+    $$ = &ast.IndexedExpr{Lhs: &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: $1, Args: $3}, Index: $6}
+  }
+  | lookup_ref RSQUARE LSQUARE arg_expr RSQUARE
+  {
+    $$ = $1
+    $$.(*ast.LookupExpr).Key = $4
+  }
+  | BOOL LPAREN arg_expr_list RPAREN
+  {
+    // `bool' names both the metric kind and the conversion builtin.
+    $$ = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: "bool", Args: $3}
+  }
+  | func_call LPAREN RPAREN
+  {
+    $$ = $1
+  }
+  | func_call LPAREN arg_expr_list RPAREN
+  {
+    // A call of a pattern constant with parameters is its pattern.
+    if m, ok := mtaillex.(*parser).expandMacro($1.(*ast.FuncCall), $3.(*ast.ExprList)); ok {
+      $$ = &ast.PatternExpr{Expr: m}
+    } else {
+      $$ = $1
+      $$.(*ast.FuncCall).Args = $3
+    }
+  }
   | CAPREF
   {
     $$ = &ast.CaprefTerm{tokenpos(mtaillex), $1, false, nil}
@@ -391,12 +528,26 @@ primary_expr
   }
   | STRING
   {
-    $$ = &ast.StringLit{tokenpos(mtaillex), $1}
+    var err error
+    $$, err = interpolate(tokenpos(mtaillex), $1)
+    if err != nil {
+      pos := tokenpos(mtaillex)
+      mtaillex.(*parser).ErrorP(err.Error(), &pos)
+      $$ = &ast.StringLit{pos, $1}
+    }
   }
   | LPAREN expr RPAREN
   {
     $$ = $2
   }
+  | map_keyword logical_expr LCURLY map_case_list RCURLY
+  {
+    $$ = $1
+    $$.(*ast.MapExpr).Expr = $2
+    for _, c := range $4.(*ast.StmtList).Children {
+      $$.(*ast.MapExpr).Cases = append($$.(*ast.MapExpr).Cases, c.(*ast.MapCase))
+    }
+  }
   | INTLITERAL
   {
     $$ = &ast.IntLit{tokenpos(mtaillex), $1}
@@ -405,6 +556,24 @@ primary_expr
   {
     $$ = &ast.FloatLit{tokenpos(mtaillex), $1}
   }
+  | DURATIONLITERAL
+  {
+    // A duration in an expression is its number of seconds, like the
+    // values of timestamp().
+    if $1%time.Second == 0 {
+      $$ = &ast.IntLit{tokenpos(mtaillex), int64($1 / time.Second)}
+    } else {
+      $$ = &ast.FloatLit{tokenpos(mtaillex), $1.Seconds()}
+    }
+  }
+  | TRUE
+  {
+    $$ = &ast.BoolLit{tokenpos(mtaillex), true}
+  }
+  | FALSE
+  {
+    $$ = &ast.BoolLit{tokenpos(mtaillex), false}
+  }
   ;
 
 indexed_expr
@@ -429,18 +598,35 @@ id_expr
   ;
 
 arg_expr_list
-  : bitwise_expr
+  : arg_expr
   {
     $$ = &ast.ExprList{}
     $$.(*ast.ExprList).Children = append($$.(*ast.ExprList).Children, $1)
   }
-  | arg_expr_list COMMA bitwise_expr
+  | arg_expr_list COMMA arg_expr
   {
     $$ = $1
     $$.(*ast.ExprList).Children = append($$.(*ast.ExprList).Children, $3)
   }
   ;
 
+// arg_expr is an argument or index expression.  A bare pattern can't be the
+// condition of a ternary here, as it would be ambiguous with the pattern
+// argument of a builtin.  A `*' is only allowed by the checker as a key of a
+// del statement.
+arg_expr
+  : rel_expr
+  { $$ = $1 }
+  | rel_expr QUESTION opt_nl ternary_expr COLON opt_nl ternary_expr
+  {
+    $$ = &ast.TernaryExpr{Cond: $1, Truth: $4, Else: $7}
+  }
+  | MUL
+  {
+    $$ = &ast.WildcardTerm{P: tokenpos(mtaillex)}
+  }
+  ;
+
 regex_pattern
   : mark_pos DIV in_regex REGEX DIV
   {
@@ -451,24 +637,47 @@ regex_pattern
   }
   ;
 
+// `hidden' is not an optional rule of its own, so that the parser needn't
+// decide whether a statement is a declaration before it sees `bool'.
 declaration
-  : hide_spec type_spec decl_attribute_spec
+  : type_spec decl_attribute_spec
+  {
+    $$ = $2
+    $$.(*ast.VarDecl).Kind = $1
+  }
+  | TOPK LPAREN INTLITERAL RPAREN decl_attribute_spec
+  {
+    // A top-k metric counts only its heaviest label values.
+    $$ = $5
+    d := $$.(*ast.VarDecl)
+    d.Kind = metrics.Counter
+    d.TopK = $3
+    if $3 < 1 {
+      mtaillex.(*parser).ErrorP("A top-k metric must track at least one label value.", d.Pos())
+    }
+  }
+  | HIDDEN type_spec decl_attribute_spec
   {
     $$ = $3
     d := $$.(*ast.VarDecl)
     d.Kind = $2
-    d.Hidden = $1
+    d.Hidden = true
   }
-  ;
-
-hide_spec
-  : /* empty */
+  | HIDDEN PERSIST type_spec decl_attribute_spec
   {
-    $$ = false
+    $$ = $4
+    d := $$.(*ast.VarDecl)
+    d.Kind = $3
+    d.Hidden = true
+    d.Persist = true
   }
-  | HIDDEN
+  | HIDDEN TRANSIENT type_spec decl_attribute_spec
   {
-    $$ = true
+    $$ = $4
+    d := $$.(*ast.VarDecl)
+    d.Kind = $3
+    d.Hidden = true
+    d.Transient = true
   }
   ;
 
@@ -476,18 +685,77 @@ decl_attribute_spec
   : decl_attribute_spec by_spec
   {
     $$ = $1
-    $$.(*ast.VarDecl).Keys = $2
+    $$.(*ast.VarDecl).Keys = append($$.(*ast.VarDecl).Keys, $2...)
+  }
+  | decl_attribute_spec NORMALIZE normalizer_list
+  {
+    // The normalizers apply to the key before them.
+    $$ = $1
+    d := $$.(*ast.VarDecl)
+    if len(d.Keys) == 0 {
+      mtaillex.(*parser).ErrorP("Normalizers must follow the key they apply to, like `by path normalize lowercase'.", $3[0].Pos())
+    } else {
+      key := d.Keys[len(d.Keys)-1]
+      if d.Normalizers == nil {
+        d.Normalizers = make(map[string][]*ast.Normalizer)
+      }
+      d.Normalizers[key] = append(d.Normalizers[key], $3...)
+    }
   }
   | decl_attribute_spec as_spec
   {
     $$ = $1
     $$.(*ast.VarDecl).ExportedName = $2
   }
+  | decl_attribute_spec HELP STRING
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Help = $3
+  }
+  | decl_attribute_spec UNIT ID
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Unit = $3
+  }
+  | decl_attribute_spec LIMIT INTLITERAL
+  {
+    $$ = $1
+    d := $$.(*ast.VarDecl)
+    d.Limit = $3
+    if $3 < 1 {
+      mtaillex.(*parser).ErrorP("A limit must allow at least one label value.", d.Pos())
+    }
+  }
   | decl_attribute_spec buckets_spec
   {
     $$ = $1
     $$.(*ast.VarDecl).Buckets = $2
   }
+  | decl_attribute_spec quantiles_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Quantiles = $2
+  }
+  | decl_attribute_spec AFTER DURATIONLITERAL
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Expiry = $3
+  }
+  | decl_attribute_spec TTL DURATIONLITERAL
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Expiry = $3
+  }
+  | decl_attribute_spec HALFLIFE DURATIONLITERAL
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).HalfLife = $3
+  }
+  | decl_attribute_spec INTERVAL DURATIONLITERAL
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Interval = $3
+  }
   | var_name_spec
   {
     $$ = $1
@@ -526,6 +794,34 @@ type_spec
   {
     $$ = metrics.Histogram
   }
+  | SUMMARY
+  {
+    $$ = metrics.Summary
+  }
+  | BOOL
+  {
+    $$ = metrics.Bool
+  }
+  | EWMA
+  {
+    $$ = metrics.EWMA
+  }
+  | MIN
+  {
+    $$ = metrics.Min
+  }
+  | MAX
+  {
+    $$ = metrics.Max
+  }
+  | STDDEV
+  {
+    $$ = metrics.Stddev
+  }
+  | UNIQUE
+  {
+    $$ = metrics.Unique
+  }
   ;
 
 by_spec
@@ -548,6 +844,39 @@ by_expr_list
   }
   ;
 
+normalizer_list
+  : normalizer
+  {
+    $$ = []*ast.Normalizer{$1}
+  }
+  | normalizer_list COMMA normalizer
+  {
+    $$ = append($1, $3)
+  }
+  ;
+
+normalizer
+  : normalizer_name %prec NORMALIZE
+  {
+    $$ = $1
+  }
+  | normalizer_name INTLITERAL
+  {
+    $$ = $1
+    $$.Arg = $2
+    $$.HasArg = true
+  }
+  ;
+
+// normalizer_name is reduced on the name, so that the normalizer has its
+// position.
+normalizer_name
+  : ID
+  {
+    $$ = &ast.Normalizer{P: tokenpos(mtaillex), Name: $1}
+  }
+  ;
+
 as_spec
   : AS STRING
   {
@@ -561,6 +890,13 @@ buckets_spec
     $$ = $2
   }
 
+quantiles_spec
+  : QUANTILES buckets_list
+  {
+    $$ = $2
+  }
+  ;
+
 buckets_list
   : FLOATLITERAL
   {
@@ -590,6 +926,227 @@ decorator_declaration
   }
   ;
 
+function_declaration
+  : mark_pos DEF func_name LPAREN RPAREN compound_statement
+  {
+    $$ = &ast.FuncDecl{P: markedpos(mtaillex), Name: $3, Block: $6}
+  }
+  | mark_pos DEF func_name LPAREN param_list RPAREN compound_statement
+  {
+    f := &ast.FuncDecl{P: markedpos(mtaillex), Name: $3, Block: $7}
+    for _, p := range $5.(*ast.ExprList).Children {
+      f.Params = append(f.Params, p.(*ast.IdTerm))
+    }
+    $$ = f
+  }
+  ;
+
+param_list
+  : id_expr
+  {
+    $$ = &ast.ExprList{}
+    $$.(*ast.ExprList).Children = append($$.(*ast.ExprList).Children, $1)
+  }
+  | param_list COMMA id_expr
+  {
+    $$ = $1
+    $$.(*ast.ExprList).Children = append($$.(*ast.ExprList).Children, $3)
+  }
+  ;
+
+func_name
+  : ID
+  {
+    $$ = $1
+  }
+  | FUNC_NAME
+  {
+    $$ = $1
+  }
+  ;
+
+// func_call is reduced on the function name, so that the call has the name's
+// position.
+func_call
+  : FUNC_NAME
+  {
+    $$ = &ast.FuncCall{P: tokenpos(mtaillex), Name: $1}
+  }
+  ;
+
+switch_statement
+  : mark_pos SWITCH logical_expr LCURLY case_list RCURLY
+  {
+    s := &ast.SwitchStmt{P: markedpos(mtaillex), Expr: $3}
+    for _, c := range $5.(*ast.StmtList).Children {
+      s.Cases = append(s.Cases, c.(*ast.CaseClause))
+    }
+    $$ = s
+  }
+  ;
+
+case_list
+  : /* empty */
+  {
+    $$ = &ast.StmtList{}
+  }
+  | case_list NL
+  {
+    $$ = $1
+  }
+  | case_list case_clause
+  {
+    $$ = $1
+    $$.(*ast.StmtList).Children = append($$.(*ast.StmtList).Children, $2)
+  }
+  ;
+
+case_clause
+  : case_keyword arg_expr_list compound_statement
+  {
+    $$ = $1
+    $$.(*ast.CaseClause).Values = $2
+    $$.(*ast.CaseClause).Block = $3
+  }
+  | default_keyword compound_statement
+  {
+    $$ = $1
+    $$.(*ast.CaseClause).Block = $2
+  }
+  ;
+
+// case_keyword and default_keyword are reduced on the keyword, so that the
+// clause has the keyword's position.
+case_keyword
+  : CASE
+  {
+    $$ = &ast.CaseClause{P: tokenpos(mtaillex)}
+  }
+  ;
+
+default_keyword
+  : DEFAULT
+  {
+    $$ = &ast.CaseClause{P: tokenpos(mtaillex)}
+  }
+  ;
+
+map_keyword
+  : MAP
+  {
+    $$ = &ast.MapExpr{P: tokenpos(mtaillex)}
+  }
+  ;
+
+// The cases of a map expression are separated by commas or newlines.
+map_case_list
+  : /* empty */
+  {
+    $$ = &ast.StmtList{}
+  }
+  | map_case_list NL
+  {
+    $$ = $1
+  }
+  | map_case_list COMMA
+  {
+    $$ = $1
+  }
+  | map_case_list map_case
+  {
+    $$ = $1
+    $$.(*ast.StmtList).Children = append($$.(*ast.StmtList).Children, $2)
+  }
+  ;
+
+map_case
+  : map_key COLON opt_nl STRING
+  {
+    $$ = $1
+    $$.(*ast.MapCase).Value = $4
+  }
+  ;
+
+// map_key is reduced on the pattern or keyword, so that the case has its
+// position.
+map_key
+  : STRING
+  {
+    $$ = &ast.MapCase{P: tokenpos(mtaillex), Pattern: $1}
+  }
+  | DEFAULT
+  {
+    $$ = &ast.MapCase{P: tokenpos(mtaillex), Default: true}
+  }
+  ;
+
+import_statement
+  : mark_pos IMPORT STRING NL
+  {
+    $$ = &ast.ImportStmt{P: markedpos(mtaillex), Path: $3}
+  }
+  ;
+
+// A namespace prefixes the names of the metrics exported by the program.
+namespace_statement
+  : mark_pos NAMESPACE STRING NL
+  {
+    $$ = &ast.NamespaceStmt{P: markedpos(mtaillex), Name: $3}
+  }
+  ;
+
+// A timezone is the location of the times without a zone parsed by the program.
+timezone_statement
+  : mark_pos TIMEZONE STRING NL
+  {
+    $$ = &ast.TimezoneStmt{P: markedpos(mtaillex), Name: $3}
+  }
+  ;
+
+lookup_declaration
+  : LOOKUP lookup_name FROM STRING
+  {
+    $$ = $2
+    $$.(*ast.LookupDecl).Path = $4
+  }
+  ;
+
+lookup_name
+  : ID
+  {
+    $$ = &ast.LookupDecl{P: tokenpos(mtaillex), Name: $1}
+  }
+  ;
+
+/* The lookup expression's position is that of the table name. */
+lookup_ref
+  : LOOKUP LSQUARE ID
+  {
+    $$ = &ast.LookupExpr{P: tokenpos(mtaillex), Name: $3}
+  }
+  ;
+
+return_statement
+  : return_keyword NL
+  {
+    $$ = $1
+  }
+  | return_keyword logical_expr NL
+  {
+    $$ = $1
+    $$.(*ast.ReturnStmt).Expr = $2
+  }
+  ;
+
+// return_keyword is reduced on the keyword, so that the statement has the
+// keyword's position.
+return_keyword
+  : RETURN
+  {
+    $$ = &ast.ReturnStmt{P: tokenpos(mtaillex)}
+  }
+  ;
+
 decoration_statement
   : mark_pos DECO compound_statement
   {
@@ -597,6 +1154,16 @@ decoration_statement
   }
   ;
 
+// let_statement declares a local variable, set for the rest of the block on
+// each line.
+let_statement
+  : LET id_expr ASSIGN opt_nl ternary_expr NL
+  {
+    id := $2.(*ast.IdTerm)
+    $$ = &ast.LetStmt{P: id.P, Name: id.Name, Expr: $5}
+  }
+  ;
+
 delete_statement
   : DEL postfix_expr AFTER DURATIONLITERAL
   {
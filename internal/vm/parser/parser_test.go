@@ -37,12 +37,39 @@ var parserTests = []struct {
 	{"declare hidden counter",
 		"hidden counter foo\n"},
 
+	{"declare hidden persistent gauge",
+		"hidden persist gauge foo by bar after 1h\n"},
+
+	{"declare hidden transient counter",
+		"hidden transient counter foo by bar, baz after 30s\n"},
+
+	{"declare counter with expiry",
+		"counter foo by bar after 168h\n"},
+
+	{"duration in expression",
+		"gauge age\n/(\\d+)/ {\n  age = timestamp() - $1 > 5m\n}\n"},
+
+	{"declare counter with ttl",
+		"counter requests by path ttl 24h\n"},
+
 	{"declare gauge",
 		"gauge foo\n"},
 
 	{"declare timer",
 		"timer foo\n"},
 
+	{"declare ewma",
+		"ewma depth by queue halflife 30s\n"},
+
+	{"declare min max stddev",
+		"min latency_min by path interval 10s\nmax latency_max\nstddev latency_stddev by path interval 1m\n"},
+
+	{"declare topk",
+		"topk(10) requests by path\n"},
+
+	{"declare unique",
+		"unique clients by service\n"},
+
 	{"declare text",
 		"text stringy\n"},
 
@@ -54,6 +81,10 @@ var parserTests = []struct {
 		"histogram foo by code buckets 0, 1, 2\n"},
 	{"declare histogram reversed syntax ",
 		"histogram foo buckets 0, 1, 2 by code\n"},
+	{"declare summary",
+		"summary foo quantiles 0.5, 0.9, 0.99\n"},
+	{"declare summary by",
+		"summary foo by code quantiles 0.5\n"},
 
 	{"simple pattern action",
 		"/foo/ {}\n"},
@@ -181,6 +212,49 @@ var parserTests = []struct {
 			"@foo { }\n",
 	},
 
+	{"function definition and call",
+		"def add(a, b) {\n" +
+			"  return a + b\n" +
+			"}\n" +
+			"def nothing() {\n" +
+			"  return\n" +
+			"}\n" +
+			"counter c\n" +
+			"/(\\d+)/ {\n" +
+			"  c += add($1, 1)\n" +
+			"  nothing()\n" +
+			"}\n",
+	},
+
+	{"help",
+		"counter errors_total help \"Count of ERROR lines\"\n",
+	},
+
+	{"unit",
+		"gauge latency unit seconds\n" +
+			"counter sent_bytes_total unit bytes help \"Bytes sent\"\n",
+	},
+
+	{"limit",
+		"hidden gauge request_start by txid limit 10000 after 5m\n",
+	},
+
+	{"timezone",
+		"timezone \"America/New_York\"\n" +
+			"counter requests_total\n",
+	},
+
+	{"namespace",
+		"namespace \"nginx\"\n" +
+			"counter requests_total\n",
+	},
+
+	{"import",
+		"import \"common.mtail\"\n" +
+			"/foo/ {\n" +
+			"}\n",
+	},
+
 	{"const regex",
 		"const X /foo/\n" +
 			"/foo / + X + / bar/ {\n" +
@@ -250,6 +324,107 @@ foo = 3.14
 	{"nested else clause",
 		"/foo/ { / bar/ {}  } else { /quux/ {} else {} }"},
 
+	{"elif clause",
+		"/foo/ {} elif /bar/ {}"},
+
+	{"elif chain with else",
+		"/foo/ {\n} elif /bar/ {\n} elif $1 > 2 {\n} else {\n}\n"},
+
+	{"switch statement",
+		`counter c by method
+/(\w+) / {
+  switch $1 {
+    case "GET", "HEAD" {
+      c["read"]++
+    }
+    case "POST" {
+      c["write"]++
+    }
+    default {
+      c["other"]++
+    }
+  }
+}`},
+
+	{"empty switch",
+		"/(\\d+)/ {\n  switch $1 {\n  }\n}\n"},
+
+	{"split index",
+		`counter c by user
+/(.*)/ {
+  c[split($1, ":")[0]] += int(split($1, ":")[-1])
+}`},
+
+	{"logfmt index",
+		`counter requests by level
+/.*/ {
+  logfmt($0)["status"] >= 500 {
+    requests[logfmt($0)["level"]]++
+  }
+}`},
+
+	{"json",
+		`counter requests by method
+gauge latency
+/^{.*}$/ {
+  requests[json($0, "req.method")]++
+  json($0, "resp.headers[0].size") > 1024 {
+    latency = json($0, "latency_ms")
+  }
+}`},
+
+	{"csv index",
+		`counter requests by method, status
+/^.*$/ {
+  requests[split(csv($0)[1], " ")[0], csv($0)[-1]]++
+}`},
+
+	{"cidrmatch",
+		`counter requests by network
+/^(?P<ip>\S+) / {
+  requests[(cidrmatch("10.0.0.0/8", $ip) || cidrmatch("fd00::/8", $ip)) ? "internal" : "external"]++
+}`},
+
+	{"geoip",
+		`counter requests by country, asn
+/^(?P<ip>\S+) / {
+  requests[geoip_country($ip), geoip_asn($ip)]++
+}`},
+
+	{"free-spacing regex",
+		`counter c by method
+/(?x) ^ (?P<method> GET | POST )  # the request method
+      \s+ \S+                     # and its path
+/ + /(?i) http/ {
+  c[$method]++
+}`},
+
+	{"hostname",
+		`counter requests by host, short
+// {
+  requests[hostname(), shorthostname()]++
+}`},
+
+	{"getenv",
+		`counter requests by region, code
+/(?P<code>\d+)/ {
+  requests[getenv("REGION"), $code]++
+}`},
+
+	{"lookup table",
+		`lookup servicemap from "services.csv"
+counter requests by service
+/^(?P<vhost>\S+) / {
+  requests[lookup[servicemap][$vhost]]++
+}`},
+
+	{"subst and substr",
+		`counter c by path
+const QUERY /\?.*/
+/(\S+)/ {
+  c[substr(subst(/\/+$/ + QUERY, "", subst("//", "/", $1)), 0, 64)]++
+}`},
+
 	{"mod operator",
 		`/foo/ {
   3 % 1
@@ -267,6 +442,12 @@ foo = 3.14
   del foo[$1] after 168h
 }`},
 
+	{"delete wildcard",
+		`counter foo by bar, baz
+/foo/ {
+  del foo["a*", *]
+}`},
+
 	{"getfilename", `
 getfilename()
 `},
@@ -284,6 +465,53 @@ counter foo by a,b
 	{"regex cond expr", `
 /(\d)/ && 1 {
 }
+`},
+
+	{"logical not", `
+!/foo/ && !($1 > 2) {
+}
+`},
+
+	{"bitwise precedence", `
+/(\d+)/ {
+  $1 & 4 != 0 && ($1 | 8) ^ 1 << 2 > 0 {
+  }
+}
+`},
+
+	{"arithmetic grouping", `
+gauge g
+/(\d+)/ {
+  g = ($1 - (2 - 3)) * (4 + $1 % 3)
+}
+`},
+
+	{"logical precedence", `
+(0 || 1) && !(1 && 0) {
+}
+`},
+
+	{"ternary", `
+counter c by class
+gauge g
+/(?P<method>\w+) (?P<status>\d+)/ {
+  c[$status >= 500 ? "error" : $status >= 400 ? "client" : "ok"]++
+  g = $method == "HEAD" || $method == "GET" ?
+    (/x/ ? 1 : 2) + 1 :
+    0
+}
+`},
+
+	{"bool metric", `
+bool up by service
+hidden bool ready
+/(?P<service>\w+) (started|stopped)/ {
+  up[$service] = $2 == "started"
+  ready = !up[$service] && bool($2)
+}
+/reset/ {
+  ready = false
+}
 `},
 
 	{"concat expr 1", `
@@ -323,6 +551,63 @@ $foo =~ X {
 // {
   stop
 }`},
+
+	{"sample", `
+counter c
+sample 1/100 {
+  c++
+}`},
+
+	{"pattern macros", `
+const IP /\d+\.\d+\.\d+\.\d+/
+const IPPORT(p) /(?P<${p}_ip>/ + IP + /):(?P<${p}_port>\d+)/
+counter c by src, dst
+/from / + IPPORT("src") + / to / + IPPORT("dst") {
+  c[$src_ip, $dst_ip]++
+}
+IPPORT("any") {
+  c[$any_ip, $any_ip]++
+}`},
+
+	{"let", `
+counter latency_ms by route
+/(?P<route>\S+) (?P<s>\d+)/ {
+  let ms = $s * 1000
+  let route = strtol($route, 10) > 0 ? "numbered" :
+    $route
+  latency_ms[route] += ms
+}`},
+
+	{"map", `
+counter requests by class, method
+/(?P<code>\d+) (?P<method>\S+)/ {
+  requests[map $code { "2..": "ok", "5..": "server_error", default: "other" }, map $method {
+      "GET|HEAD": "read"
+      "POST|PUT|DELETE": "write",
+      default: "other",
+    }]++
+}`},
+
+	{"normalizers", `
+counter requests by method normalize uppercase by path normalize lowercase, strip_query, max_len 64
+counter requests_by_host by host, path normalize max_len 32
+counter visits by path normalize strip_query by client
+/(?P<method>\S+) (?P<path>\S+)/ {
+  requests[$method, $path]++
+}`},
+
+	{"regex flags", `
+counter errors
+/error: (.*)/is {
+  errors++
+}`},
+
+	{"string interpolation", `
+counter c by endpoint
+/(?P<host>\S+) (\d+)/ {
+  c["${host}:${2}"]++
+  c[$host + ":" + $2]++
+}`},
 }
 
 func TestParserRoundTrip(t *testing.T) {
@@ -380,8 +665,8 @@ type parserInvalidProgram struct {
 
 var parserInvalidPrograms = []parserInvalidProgram{
 	{"unknown character",
-		"?\n",
-		[]string{"unknown character:1:1: Unexpected input: '?'"}},
+		"`\n",
+		[]string{"unknown character:1:1: Unexpected input: '`'"}},
 
 	{"unterminated regex",
 		"/foo\n",
@@ -397,6 +682,28 @@ var parserInvalidPrograms = []parserInvalidProgram{
 		[]string{"unterminated const regex:1:10-17: Unterminated regular expression: \"/(?P<foo>\"",
 			"unterminated const regex:1:10-17: syntax error: unexpected end of file, expecting '/' to end regex"}},
 
+	{"topk of nothing",
+		"topk(0) requests by path\n",
+		[]string{"topk of nothing:1:9-16: A top-k metric must track at least one label value."}},
+
+	{"undefined pattern macro",
+		"// + IPPORT(\"a\") {\n}\n",
+		[]string{"undefined pattern macro:1:6-11: Pattern constant `IPPORT' not defined.\n\tTry adding `const IPPORT(...) /.../' earlier in the program."}},
+
+	{"pattern macro errors",
+		"const KV(k) /${k}=${v}/\n// + KV(\"a\", \"b\") {\n}\n// + KV(1) {\n}\n",
+		[]string{"pattern macro errors:1:11-23: Pattern constant `KV' has no parameter `v'.",
+			"pattern macro errors:2:6-7: Wrong number of arguments to pattern constant `KV': expected 1, received 2.",
+			"pattern macro errors:4:9: Arguments to pattern constant `KV' must be strings."}},
+
+	{"sample rate",
+		"sample 2/3 {\n}\n",
+		[]string{"sample rate:1:1-10: Sampling rate must be 1/N, for a whole number N."}},
+
+	{"unterminated interpolation",
+		"// {\n  x = \"${host\"\n}\n",
+		[]string{"unterminated interpolation:2:7-14: Unterminated capture group reference in string \"${host\"."}},
+
 	{"unbalanced {",
 		"/foo/ {\n",
 		[]string{"unbalanced {:2:1: syntax error: unexpected end of file, expecting '}' to end block"}},
@@ -412,6 +719,10 @@ var parserInvalidPrograms = []parserInvalidProgram{
 	foo++[$1]++
 	}`,
 		[]string{"index of non-terminal 1:2:7: syntax error: unexpected LSQUARE, expecting NL"}},
+	{"normalize without key",
+		`counter c normalize lowercase
+`,
+		[]string{"normalize without key:1:21-29: Normalizers must follow the key they apply to, like `by path normalize lowercase'."}},
 	{"index of non-terminal 2",
 		`// {
 	0[$1]++
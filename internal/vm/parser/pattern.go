@@ -0,0 +1,124 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"regexp"
+	"strings"
+)
+
+// flagGroup matches the inline flag group that may start a regular expression
+// literal.  Besides the flags understood by the regexp package, it may set
+// `x' for free-spacing mode, and `p' to match after a syslog priority.
+var flagGroup = regexp.MustCompile(`^\(\?([imsUxp]*)(?:-([imsUxp]*))?\)`)
+
+// freeSpacing reports whether the regular expression literal text s starts
+// with a flag group that sets free-spacing mode.
+func freeSpacing(s string) bool {
+	m := flagGroup.FindStringSubmatch(s)
+	return m != nil && strings.ContainsRune(m[1], 'x')
+}
+
+// SyslogPriority reports whether the regular expression literal text s starts
+// with a flag group that sets `p'.  Unlike the other flags it applies to the
+// whole pattern the literal is part of, which is matched against the line
+// after any syslog priority prefix like `<34>', and defines the capture groups
+// $syslog_severity and $syslog_facility.
+func SyslogPriority(s string) bool {
+	m := flagGroup.FindStringSubmatch(s)
+	return m != nil && strings.ContainsRune(m[1], 'p')
+}
+
+// trailingFlags are the flags that may follow the trailing slash of a regular
+// expression literal, like `/error/i'.
+const trailingFlags = "imsU"
+
+// addFlags returns the regular expression literal text s with flags added to
+// its leading flag group, or to a new one if it has none.
+func addFlags(s, flags string) string {
+	if flags == "" {
+		return s
+	}
+	m := flagGroup.FindStringSubmatchIndex(s)
+	if m == nil {
+		return "(?" + flags + ")" + s
+	}
+	return s[:m[3]] + flags + s[m[3]:]
+}
+
+// ExpandPattern returns the text of a regular expression literal as a pattern
+// for the regexp package.  The flags in a leading flag group apply only to
+// the literal, not to the rest of a pattern it is concatenated into, and in
+// free-spacing mode unescaped whitespace and comments starting with `#'
+// outside character classes are removed.
+func ExpandPattern(s string) string {
+	m := flagGroup.FindStringSubmatch(s)
+	if m == nil || m[1] == "" && m[2] == "" {
+		return s
+	}
+	on, off := m[1], m[2]
+	rest := s[len(m[0]):]
+	if strings.ContainsRune(on, 'x') {
+		rest = stripFreeSpacing(rest)
+	}
+	for _, f := range []string{"x", "p"} {
+		on = strings.Replace(on, f, "", -1)
+		off = strings.Replace(off, f, "", -1)
+	}
+	flags := on
+	if off != "" {
+		flags += "-" + off
+	}
+	if flags == "" {
+		return "(?:" + rest + ")"
+	}
+	return "(?" + flags + ":" + rest + ")"
+}
+
+// stripFreeSpacing removes whitespace and comments from the free-spacing
+// pattern s.
+func stripFreeSpacing(s string) string {
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			b.WriteByte(c)
+			i++
+			b.WriteByte(s[i])
+		case inClass:
+			if strings.HasPrefix(s[i:], "[:") {
+				if j := strings.Index(s[i:], ":]"); j > 0 {
+					b.WriteString(s[i : i+j+2])
+					i += j + 1
+					break
+				}
+			}
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+			// A `]' first in the class is a literal.
+			if strings.HasPrefix(s[i+1:], "^]") {
+				b.WriteString("^]")
+				i += 2
+			} else if strings.HasPrefix(s[i+1:], "]") {
+				b.WriteByte(']')
+				i++
+			}
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == ' ', c == '\t', c == '\n', c == '\r', c == '\f', c == '\v':
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var expandPatternTests = []struct {
+	name     string
+	pattern  string
+	expected string
+}{
+	{"no flags",
+		`a b|c`,
+		`a b|c`},
+	{"flags not leading",
+		`a(?i)b`,
+		`a(?i)b`},
+	{"empty flags",
+		`(?)a`,
+		`(?)a`},
+	{"case insensitive",
+		`(?i)get|post`,
+		`(?i:get|post)`},
+	{"flags cleared",
+		`(?i-s).`,
+		`(?i-s:.)`},
+	{"free spacing",
+		"(?x) a b  # comment\n\t| c\n",
+		`(?:ab|c)`},
+	{"free spacing and case insensitive",
+		`(?xi) get | post`,
+		`(?i:get|post)`},
+	{"free spacing only cleared",
+		`(?i-x) a`,
+		`(?i: a)`},
+	{"escaped space and hash",
+		`(?x)a\ b \# c`,
+		`(?:a\ b\#c)`},
+	{"character class",
+		"(?x)[ #x] [^] a] [[:space:] ] # c",
+		`(?:[ #x][^] a][[:space:] ])`},
+	{"literal close bracket",
+		`(?x)[] ]`,
+		`(?:[] ])`},
+	{"syslog priority",
+		`(?p)^sshd`,
+		`(?:^sshd)`},
+	{"syslog priority and case insensitive",
+		`(?ip)^sshd`,
+		`(?i:^sshd)`},
+}
+
+func TestExpandPattern(t *testing.T) {
+	for _, tc := range expandPatternTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := testutil.Diff(tc.expected, ExpandPattern(tc.pattern)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestAddFlags(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, flags, expected string
+	}{
+		{`error`, ``, `error`},
+		{`error`, `i`, `(?i)error`},
+		{`(?x) a b`, `is`, `(?xis) a b`},
+		{`(?-s).`, `i`, `(?i-s).`},
+		{`a(?s).`, `i`, `(?i)a(?s).`},
+	} {
+		if got := addFlags(tc.pattern, tc.flags); got != tc.expected {
+			t.Errorf("addFlags(%q, %q) = %q, expected %q", tc.pattern, tc.flags, got, tc.expected)
+		}
+	}
+}
+
+func TestSyslogPriority(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		expected bool
+	}{
+		{`(?p)^sshd`, true},
+		{`(?ixp) sshd`, true},
+		{`(?i-p)sshd`, false},
+		{`a(?p)`, false},
+		{`<(?P<pri>\d+)>`, false},
+	} {
+		if got := SyslogPriority(tc.pattern); got != tc.expected {
+			t.Errorf("SyslogPriority(%q) = %v, expected %v", tc.pattern, got, tc.expected)
+		}
+	}
+}
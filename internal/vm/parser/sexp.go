@@ -147,6 +147,18 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			s.emit("timer ")
 		case metrics.Text:
 			s.emit("text ")
+		case metrics.Bool:
+			s.emit("bool ")
+		case metrics.EWMA:
+			s.emit("ewma ")
+		case metrics.Unique:
+			s.emit("unique ")
+		case metrics.Min:
+			s.emit("min ")
+		case metrics.Max:
+			s.emit("max ")
+		case metrics.Stddev:
+			s.emit("stddev ")
 		}
 		s.emit(v.Name)
 		if len(v.Keys) > 0 {
@@ -154,6 +166,14 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			s.emit(strings.Join(v.Keys, " "))
 			s.emit(")")
 		}
+		for _, k := range v.Keys {
+			for _, n := range v.Normalizers[k] {
+				s.emit(fmt.Sprintf(" %s:%s", k, n.Name))
+				if n.HasArg {
+					s.emit(fmt.Sprintf("(%d)", n.Arg))
+				}
+			}
+		}
 
 	case *ast.UnaryExpr:
 		switch v.Op {
@@ -163,6 +183,8 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			s.emit("--")
 		case NOT:
 			s.emit("~")
+		case LNOT:
+			s.emit("!")
 		default:
 			s.emit(fmt.Sprintf("Unexpected op: %s", Kind(v.Op)))
 		}
@@ -172,16 +194,78 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StringLit:
 		s.emit("\"" + v.Text + "\"")
 
+	case *ast.WildcardTerm:
+		s.emit("*")
+
 	case *ast.IntLit:
 		s.emit(strconv.FormatInt(v.I, 10))
 
+	case *ast.BoolLit:
+		s.emit(strconv.FormatBool(v.B))
+
 	case *ast.FloatLit:
 		s.emit(strconv.FormatFloat(v.F, 'g', -1, 64))
 
+	case *ast.FuncDecl:
+		s.emit("def " + v.Name)
+		s.newline()
+
+	case *ast.FuncCall:
+		s.emit("\"" + v.Name + "\"")
+		s.newline()
+
+	case *ast.ReturnStmt:
+		s.emit("return")
+
+	case *ast.ImportStmt:
+		s.emit("import \"" + v.Path + "\"")
+		s.newline()
+
+	case *ast.NamespaceStmt:
+		s.emit("namespace \"" + v.Name + "\"")
+		s.newline()
+
+	case *ast.TimezoneStmt:
+		s.emit("timezone \"" + v.Name + "\"")
+		s.newline()
+
+	case *ast.LookupDecl:
+		s.emit("lookup " + v.Name + " from \"" + v.Path + "\"")
+
+	case *ast.LookupExpr:
+		s.emit("lookup " + v.Name)
+		s.newline()
+
+	case *ast.SwitchStmt:
+		s.emit("switch")
+		s.newline()
+
+	case *ast.MapExpr:
+		s.emit("map")
+		for _, c := range v.Cases {
+			if c.Default {
+				s.emit(" default:\"" + c.Value + "\"")
+			} else {
+				s.emit(" \"" + c.Pattern + "\":\"" + c.Value + "\"")
+			}
+		}
+		s.newline()
+
+	case *ast.CaseClause:
+		if v.Values != nil {
+			s.emit("case")
+		} else {
+			s.emit("default")
+		}
+		s.newline()
+
 	case *ast.NextStmt:
 		s.emit("next")
 	case *ast.OtherwiseStmt:
 		s.emit("otherwise")
+	case *ast.LetStmt:
+		s.emit(fmt.Sprintf("let %q", v.Name))
+		s.newline()
 	case *ast.DelStmt:
 		s.emit("del")
 		if v.Expiry > 0 {
@@ -197,7 +281,10 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		s.emit("stop")
 
-	case *ast.IndexedExpr, *ast.StmtList, *ast.ExprList, *ast.CondStmt, *ast.DecoDecl, *ast.DecoStmt, *ast.PatternExpr: // normal walk
+	case *ast.SampleExpr:
+		s.emit(fmt.Sprintf("sample 1/%d", v.Rate))
+
+	case *ast.IndexedExpr, *ast.StmtList, *ast.ExprList, *ast.CondStmt, *ast.DecoDecl, *ast.DecoStmt, *ast.PatternExpr, *ast.TernaryExpr: // normal walk
 
 	default:
 		panic(fmt.Sprintf("sexp found undefined type %T", n))
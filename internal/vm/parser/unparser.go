@@ -75,6 +75,12 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		u.newline()
 		u.indent()
 		ast.Walk(u, v.Truth)
+		if elif := elifStmt(v.Else); elif != nil {
+			u.outdent()
+			u.emit("} elif ")
+			ast.Walk(u, elif)
+			break
+		}
 		if v.Else != nil {
 			u.outdent()
 			u.emit("} else {")
@@ -84,6 +90,50 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		u.outdent()
 		u.emit("}")
 
+	case *ast.SwitchStmt:
+		u.emit("switch ")
+		ast.Walk(u, v.Expr)
+		u.emit(" {")
+		u.newline()
+		u.indent()
+		for _, c := range v.Cases {
+			ast.Walk(u, c)
+			u.newline()
+		}
+		u.outdent()
+		u.emit("}")
+
+	case *ast.MapExpr:
+		u.emit("map ")
+		ast.Walk(u, v.Expr)
+		u.emit(" {")
+		for i, c := range v.Cases {
+			if i > 0 {
+				u.emit(",")
+			}
+			if c.Default {
+				u.emit(" default")
+			} else {
+				u.emit(" \"" + c.Pattern + "\"")
+			}
+			u.emit(": \"" + c.Value + "\"")
+		}
+		u.emit(" }")
+
+	case *ast.CaseClause:
+		if v.Values != nil {
+			u.emit("case ")
+			ast.Walk(u, v.Values)
+			u.emit(" {")
+		} else {
+			u.emit("default {")
+		}
+		u.newline()
+		u.indent()
+		ast.Walk(u, v.Block)
+		u.outdent()
+		u.emit("}")
+
 	case *ast.PatternFragment:
 		u.emit("const ")
 		ast.Walk(u, v.Id)
@@ -94,7 +144,7 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		u.emit("/" + strings.Replace(v.Pattern, "/", "\\/", -1) + "/")
 
 	case *ast.BinaryExpr:
-		ast.Walk(u, v.Lhs)
+		u.walkOperand(v.Lhs, v.Op, false)
 		switch v.Op {
 		case LT:
 			u.emit(" < ")
@@ -149,7 +199,7 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		default:
 			u.emit(fmt.Sprintf("Unexpected op: %v", v.Op))
 		}
-		ast.Walk(u, v.Rhs)
+		u.walkOperand(v.Rhs, v.Op, true)
 
 	case *ast.IdTerm:
 		u.emit(v.Name)
@@ -173,9 +223,21 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		}
 
 	case *ast.VarDecl:
+		if v.Hidden {
+			u.emit("hidden ")
+		}
+		if v.Persist {
+			u.emit("persist ")
+		} else if v.Transient {
+			u.emit("transient ")
+		}
 		switch v.Kind {
 		case metrics.Counter:
-			u.emit("counter ")
+			if v.TopK > 0 {
+				u.emit(fmt.Sprintf("topk(%d) ", v.TopK))
+			} else {
+				u.emit("counter ")
+			}
 		case metrics.Gauge:
 			u.emit("gauge ")
 		case metrics.Timer:
@@ -184,10 +246,40 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			u.emit("text ")
 		case metrics.Histogram:
 			u.emit("histogram ")
+		case metrics.Summary:
+			u.emit("summary ")
+		case metrics.Bool:
+			u.emit("bool ")
+		case metrics.EWMA:
+			u.emit("ewma ")
+		case metrics.Unique:
+			u.emit("unique ")
+		case metrics.Min:
+			u.emit("min ")
+		case metrics.Max:
+			u.emit("max ")
+		case metrics.Stddev:
+			u.emit("stddev ")
 		}
 		u.emit(v.Name)
-		if len(v.Keys) > 0 {
-			u.emit(" by " + strings.Join(v.Keys, ", "))
+		// Each key with normalizers ends a by clause.
+		sep := " by "
+		for _, k := range v.Keys {
+			u.emit(sep + k)
+			sep = ", "
+			if ns := v.Normalizers[k]; len(ns) > 0 {
+				u.emit(" normalize ")
+				for i, n := range ns {
+					if i > 0 {
+						u.emit(", ")
+					}
+					u.emit(n.Name)
+					if n.HasArg {
+						u.emit(fmt.Sprintf(" %d", n.Arg))
+					}
+				}
+				sep = " by "
+			}
 		}
 		if len(v.Buckets) > 0 {
 			buckets := strings.Builder{}
@@ -197,6 +289,39 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			}
 			u.emit(buckets.String()[:buckets.Len()-2])
 		}
+		if len(v.Quantiles) > 0 {
+			quantiles := strings.Builder{}
+			quantiles.WriteString(" quantiles ")
+			for _, f := range v.Quantiles {
+				quantiles.WriteString(fmt.Sprintf("%f, ", f))
+			}
+			u.emit(quantiles.String()[:quantiles.Len()-2])
+		}
+		if v.Expiry > 0 {
+			u.emit(fmt.Sprintf(" after %s", v.Expiry))
+		}
+		if v.HalfLife > 0 {
+			u.emit(fmt.Sprintf(" halflife %s", v.HalfLife))
+		}
+		if v.Interval > 0 {
+			u.emit(fmt.Sprintf(" interval %s", v.Interval))
+		}
+		if v.Help != "" {
+			u.emit(" help \"" + v.Help + "\"")
+		}
+		if v.Unit != "" {
+			u.emit(" unit " + v.Unit)
+		}
+		if v.Limit > 0 {
+			u.emit(fmt.Sprintf(" limit %d", v.Limit))
+		}
+
+	case *ast.TernaryExpr:
+		u.walkCond(v.Cond)
+		u.emit(" ? ")
+		ast.Walk(u, v.Truth)
+		u.emit(" : ")
+		ast.Walk(u, v.Else)
 
 	case *ast.UnaryExpr:
 		switch v.Op {
@@ -208,17 +333,26 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			u.emit("--")
 		case NOT:
 			u.emit(" ~")
-			ast.Walk(u, v.Expr)
+			u.walkOperand(v.Expr, NOT, false)
+		case LNOT:
+			u.emit("!")
+			u.walkOperand(v.Expr, LNOT, false)
 		default:
 			u.emit(fmt.Sprintf("Unexpected op: %s", Kind(v.Op)))
 		}
 
 	case *ast.StringLit:
-		u.emit("\"" + v.Text + "\"")
+		u.emit("\"" + strings.Replace(v.Text, "${", `\${`, -1) + "\"")
+
+	case *ast.WildcardTerm:
+		u.emit("*")
 
 	case *ast.IntLit:
 		u.emit(strconv.FormatInt(v.I, 10))
 
+	case *ast.BoolLit:
+		u.emit(strconv.FormatBool(v.B))
+
 	case *ast.FloatLit:
 		u.emit(strconv.FormatFloat(v.F, 'g', -1, 64))
 
@@ -238,12 +372,63 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		u.outdent()
 		u.emit("}")
 
+	case *ast.FuncDecl:
+		u.emit(fmt.Sprintf("def %s(", v.Name))
+		for i, p := range v.Params {
+			if i > 0 {
+				u.emit(", ")
+			}
+			u.emit(p.Name)
+		}
+		u.emit(") {")
+		u.newline()
+		u.indent()
+		ast.Walk(u, v.Block)
+		u.outdent()
+		u.emit("}")
+
+	case *ast.FuncCall:
+		u.emit(v.Name + "(")
+		if v.Args != nil {
+			ast.Walk(u, v.Args)
+		}
+		u.emit(")")
+
+	case *ast.ReturnStmt:
+		u.emit("return")
+		if v.Expr != nil {
+			u.emit(" ")
+			ast.Walk(u, v.Expr)
+		}
+
+	case *ast.ImportStmt:
+		u.emit("import \"" + v.Path + "\"")
+
+	case *ast.NamespaceStmt:
+		u.emit("namespace \"" + v.Name + "\"")
+
+	case *ast.TimezoneStmt:
+		u.emit("timezone \"" + v.Name + "\"")
+
+	case *ast.LookupDecl:
+		u.emit("lookup " + v.Name + " from \"" + v.Path + "\"")
+
+	case *ast.LookupExpr:
+		u.emit("lookup[" + v.Name + "][")
+		ast.Walk(u, v.Key)
+		u.emit("]")
+
 	case *ast.NextStmt:
 		u.emit("next")
 
 	case *ast.OtherwiseStmt:
 		u.emit("otherwise")
 
+	case *ast.LetStmt:
+		u.emit(fmt.Sprintf("let %s = ", v.Name))
+		ast.Walk(u, v.Expr)
+		u.newline()
+
 	case *ast.DelStmt:
 		u.emit("del ")
 		ast.Walk(u, v.N)
@@ -266,6 +451,9 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		u.emit("stop")
 
+	case *ast.SampleExpr:
+		u.emit(fmt.Sprintf("sample 1/%d", v.Rate))
+
 	default:
 		panic(fmt.Sprintf("unfound undefined type %T", n))
 	}
@@ -275,6 +463,91 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	return nil, n
 }
 
+// walkOperand unparses n, an operand of the operator op, in parentheses if it
+// is an expression that would otherwise be parsed differently: one whose
+// operator binds less tightly than op, or, on the right hand side, as tightly.
+func (u *Unparser) walkOperand(n ast.Node, op int, right bool) {
+	q := precedence(op)
+	switch v := n.(type) {
+	case *ast.BinaryExpr:
+		p := precedence(v.Op)
+		if p > 0 && q > 0 && (p < q || (right && p == q)) {
+			u.walkParens(n)
+			return
+		}
+	case *ast.TernaryExpr:
+		if q > 0 {
+			u.walkParens(n)
+			return
+		}
+	}
+	ast.Walk(u, n)
+}
+
+// walkCond unparses n, the condition of a ternary expression, in parentheses
+// unless it is a relational expression or binds more tightly, as only those
+// can be the condition of a ternary in an argument list.
+func (u *Unparser) walkCond(n ast.Node) {
+	switch v := n.(type) {
+	case *ast.TernaryExpr, *ast.PatternExpr:
+		u.walkParens(n)
+		return
+	case *ast.BinaryExpr:
+		if precedence(v.Op) < precedence(EQ) {
+			u.walkParens(n)
+			return
+		}
+	}
+	ast.Walk(u, n)
+}
+
+func (u *Unparser) walkParens(n ast.Node) {
+	u.emit("(")
+	ast.Walk(u, n)
+	u.emit(")")
+}
+
+// precedence returns how tightly the expression operator op binds, or 0 if op
+// has no operands that need grouping.
+func precedence(op int) int {
+	switch op {
+	case OR:
+		return 1
+	case AND:
+		return 2
+	case LT, GT, LE, GE, EQ, NE:
+		return 3
+	case BITAND, BITOR, XOR:
+		return 4
+	case SHL, SHR:
+		return 5
+	case PLUS, MINUS:
+		return 6
+	case MUL, DIV, MOD, POW:
+		return 7
+	case NOT, LNOT:
+		return 8
+	}
+	return 0
+}
+
+// elifStmt returns the conditional in an else block that can be written as an
+// elif clause, or nil if there isn't one.
+func elifStmt(n ast.Node) *ast.CondStmt {
+	l, ok := n.(*ast.StmtList)
+	if !ok || len(l.Children) != 1 {
+		return nil
+	}
+	c, ok := l.Children[0].(*ast.CondStmt)
+	if !ok || c.Cond == nil {
+		return nil
+	}
+	if _, ok := c.Cond.(*ast.OtherwiseStmt); ok {
+		return nil
+	}
+	return c
+}
+
 // VisitAfter implements the ast.Visitor interface.
 func (u *Unparser) VisitAfter(n ast.Node) ast.Node {
 	return n
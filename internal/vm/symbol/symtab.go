@@ -20,6 +20,10 @@ const (
 	CaprefSymbol                    // Capture group references
 	DecoSymbol                      // Decorators
 	PatternSymbol                   // Named pattern constants
+	FuncSymbol                      // User-defined functions
+	ParamSymbol                     // Function parameters
+	LookupSymbol                    // Lookup tables
+	LocalSymbol                     // Local variables
 	endSymbol                       // for testing
 )
 
@@ -33,6 +37,14 @@ func (k SymbolKind) String() string {
 		return "decorator"
 	case PatternSymbol:
 		return "named pattern constant"
+	case FuncSymbol:
+		return "function"
+	case ParamSymbol:
+		return "parameter"
+	case LookupSymbol:
+		return "lookup table"
+	case LocalSymbol:
+		return "local variable"
 	default:
 		panic("unexpected symbolkind")
 	}
@@ -166,6 +166,34 @@ func IsDimension(t Type) bool {
 	return false
 }
 
+// List is a convenience method which instantiates a new List type scheme,
+// with the given type as the type of its elements.
+func List(elem Type) *Operator {
+	return &Operator{"List", []Type{elem}}
+}
+
+// IsList returns true if the given type is a List type.
+func IsList(t Type) bool {
+	if v, ok := t.(*Operator); ok {
+		return v.Name == "List"
+	}
+	return false
+}
+
+// Map is a convenience method which instantiates a new Map type scheme, with
+// the given types as the types of its keys and values.
+func Map(key, value Type) *Operator {
+	return &Operator{"Map", []Type{key, value}}
+}
+
+// IsMap returns true if the given type is a Map type.
+func IsMap(t Type) bool {
+	if v, ok := t.(*Operator); ok {
+		return v.Name == "Map"
+	}
+	return false
+}
+
 // IsComplete returns true if the type and all its arguments have non-variable exemplars.
 func IsComplete(t Type) bool {
 	switch v := t.Root().(type) {
@@ -194,21 +222,61 @@ var (
 	Pattern = &Operator{"Pattern", []Type{}}
 	// TODO(jaq): use composite type so we can typecheck the bucket directly, e.g. hist[j] = i
 	Buckets = &Operator{"Buckets", []Type{}}
+	// Quantiles is the storage type of a summary.
+	Quantiles = &Operator{"Quantiles", []Type{}}
+	// Distinct is the storage type of a unique metric.
+	Distinct = &Operator{"Distinct", []Type{}}
 )
 
+// number is the type of the argument and result of abs(), which is an Int
+// for an Int and a Float for a Float.
+var number = NewVariable()
+
 // Builtins is a mapping of the builtin language functions to their type definitions.
 var Builtins = map[string]Type{
-	"int":         Function(NewVariable(), Int),
-	"bool":        Function(NewVariable(), Bool),
-	"float":       Function(NewVariable(), Float),
-	"string":      Function(NewVariable(), String),
-	"timestamp":   Function(Int),
-	"len":         Function(String, Int),
-	"settime":     Function(Int, None),
-	"strptime":    Function(String, String, None),
-	"strtol":      Function(String, Int, Int),
-	"tolower":     Function(String, String),
-	"getfilename": Function(String),
+	"int":           Function(NewVariable(), Int),
+	"bool":          Function(NewVariable(), Bool),
+	"float":         Function(NewVariable(), Float),
+	"string":        Function(NewVariable(), String),
+	"timestamp":     Function(Int),
+	"len":           Function(String, Int),
+	"settime":       Function(Int, None),
+	"settime_ms":    Function(Int, None),
+	"settime_ns":    Function(Int, None),
+	"strptime":      Function(String, String, Bool),
+	"rfc3339":       Function(String, Bool),
+	"strtol":        Function(String, Int, Int),
+	"hex":           Function(String, Int),
+	"tolower":       Function(String, String),
+	"toupper":       Function(String, String),
+	"trim":          Function(String, String),
+	"substr":        Function(String, Int, Int, String),
+	"subst":         Function(NewVariable(), String, String, String),
+	"split":         Function(String, String, List(String)),
+	"csv":           Function(String, List(String)),
+	"cidrmatch":     Function(String, String, Bool),
+	"geoip_country": Function(String, String),
+	"geoip_asn":     Function(String, Int),
+	"logfmt":        Function(String, Map(String, String)),
+	"json":          Function(String, String, NewVariable()),
+	"rate":          Function(NewVariable(), Int, Float),
+	"delta":         Function(NewVariable(), Int, Float),
+	"movavg":        Function(NewVariable(), Int, Float),
+	"duration":      Function(String, Float),
+	"floor":         Function(Float, Int),
+	"ceil":          Function(Float, Int),
+	"round":         Function(Float, Int),
+	"abs":           Function(number, number),
+	"pow":           Function(Float, Float, Float),
+	"log":           Function(Float, Float),
+	"hour":          Function(Int, Int),
+	"weekday":       Function(Int, Int),
+	"strftime":      Function(Int, String, String),
+	"getenv":        Function(String, String),
+	"getfilename":   Function(String),
+	"hostname":      Function(String),
+	"shorthostname": Function(String),
+	"forward":       Function(None),
 }
 
 // FreshType returns a new type from the provided type scheme, replacing any
@@ -391,12 +459,16 @@ func LeastUpperBound(a, b Type) Type {
 // inferCaprefType determines a type for a capturing group, based on contents
 // of that capture group.
 func InferCaprefType(re *syntax.Regexp, cap int) Type {
-	group := getCaptureGroup(re, cap)
+	// Group 0 is the whole match.
+	group := re
+	if cap > 0 {
+		group = getCaptureGroup(re, cap)
+	}
 	if group == nil {
 		return None
 	}
 	switch {
-	case groupOnlyMatches(group, "+-0123456789"):
+	case groupOnlyMatches(group, "+-0123456789"), isPrefixedIntGroup(group):
 		return Int
 	case groupOnlyMatches(group, "+-0123456789.eE"):
 		if strings.Count(group.String(), ".") <= 1 {
@@ -407,6 +479,41 @@ func InferCaprefType(re *syntax.Regexp, cap int) Type {
 	return String
 }
 
+// isPrefixedIntGroup returns true iff re only matches hexadecimal integers with
+// a 0x prefix, or octal integers with a 0o prefix, like `0x[0-9a-f]+`.
+func isPrefixedIntGroup(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpCapture {
+		return isPrefixedIntGroup(re.Sub[0])
+	}
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpLiteral {
+		return false
+	}
+	lit := re.Sub[0].Rune
+	if len(lit) < 2 || lit[0] != '0' {
+		return false
+	}
+	var digits string
+	switch lit[1] {
+	case 'x', 'X':
+		digits = "0123456789abcdefABCDEF"
+	case 'o', 'O':
+		digits = "01234567"
+	default:
+		return false
+	}
+	for _, r := range lit[2:] {
+		if !strings.ContainsRune(digits, r) {
+			return false
+		}
+	}
+	for _, sub := range re.Sub[1:] {
+		if !groupOnlyMatches(sub, digits) {
+			return false
+		}
+	}
+	return true
+}
+
 // getCaptureGroup returns the Regexp node of the capturing group numbered cap
 // in re.
 func getCaptureGroup(re *syntax.Regexp, cap int) *syntax.Regexp {
@@ -204,6 +204,18 @@ var inferCaprefTypeTests = []struct {
 	{`\d+\.\d+\.\d+\.\d+`,
 		String,
 	},
+	{`0x[0-9a-f]+`,
+		Int,
+	},
+	{`0o[0-7]{3}`,
+		Int,
+	},
+	{`0x[0-9a-z]+`,
+		String,
+	},
+	{`[0-9a-f]+`,
+		String,
+	},
 }
 
 func TestInferCaprefType(t *testing.T) {
@@ -223,6 +235,24 @@ func TestInferCaprefType(t *testing.T) {
 	}
 }
 
+func TestInferCaprefTypeWholeMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		typ     Type
+	}{
+		{`\d+`, Int},
+		{`status=\d+`, String},
+	} {
+		re, err := syntax.Parse(tc.pattern, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := InferCaprefType(re, 0); !Equals(tc.typ, r) {
+			t.Errorf("Types don't match: %q infers %v for $0, not %v", tc.pattern, r, tc.typ)
+		}
+	}
+}
+
 func TestTypeEquals(t *testing.T) {
 	if Equals(NewVariable(), NewVariable()) {
 		t.Error("Type variables are not same")
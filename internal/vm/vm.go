@@ -7,14 +7,18 @@ package vm
 
 import (
 	"bytes"
+	"expvar"
 	"fmt"
 	"math"
+	"net"
+	"reflect"
 	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
@@ -24,6 +28,7 @@ import (
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/vm/code"
 	"github.com/google/mtail/internal/vm/object"
+	"github.com/google/mtail/internal/vm/position"
 
 	"github.com/golang/groupcache/lru"
 )
@@ -34,6 +39,36 @@ type thread struct {
 	matches map[int][]string // Match result variables.
 	time    time.Time        // Time register.
 	stack   []interface{}    // Data stack.
+	locals  []interface{}    // Function parameter and local variable storage.
+
+	decoded map[decodeKey]interface{} // Memo of structured decodes of strings during this line.
+}
+
+// decodeKey identifies the result of a structured decoder applied to an input string.
+type decodeKey struct {
+	decoder string
+	input   string
+}
+
+// decode returns the result of applying the named decoder function to input,
+// memoizing the result for the lifetime of the thread.  A thread lives for the
+// processing of one log line, so several conditions that refer to fields of
+// the same structured payload only pay for its parsing once.  Errors are not
+// memoized.
+func (t *thread) decode(decoder, input string, f func(string) (interface{}, error)) (interface{}, error) {
+	k := decodeKey{decoder, input}
+	if r, ok := t.decoded[k]; ok {
+		return r, nil
+	}
+	r, err := f(input)
+	if err != nil {
+		return nil, err
+	}
+	if t.decoded == nil {
+		t.decoded = make(map[decodeKey]interface{})
+	}
+	t.decoded[k] = r
+	return r, nil
 }
 
 // VM describes the virtual machine for each program.  It contains virtual
@@ -43,12 +78,43 @@ type thread struct {
 type VM struct {
 	name string
 	prog []code.Instr
+	// lines is the source position of the statement of each instruction in prog.
+	lines []*position.Position
 
 	re  []*regexp.Regexp  // Regular expression constants
 	str []string          // String constants
 	m   []*metrics.Metric // Metrics accessible to this program.
 
+	lookups []map[string]string // Lookup tables
+
+	warnings error // Warnings from compiling the program, if any
+
+	arithmetic arithmeticPolicy // what to do on an arithmetic fault
+	overflow   overflowPolicy   // what to do when an int metric overflows
+
+	budget      lineBudget // limits of the work done on each line
+	overruns    int        // lines the program ran over its budget on
+	quarantined bool       // set if the program processes no more lines for running over budget
+
+	conditionLines   map[int]int   // source line of each top-level condition, by the address of its block
+	conditionMatches []*expvar.Int // match counter of the top-level condition whose block starts at each address, if counting
+	conditionBlocks  []bool        // whether a top-level condition's block starts at each address, if reporting matches
+
+	sampled map[int]int64 // lines seen since the last line sampled, by the address after each sample instruction
+
+	lineDone func(*logline.LogLine, bool) // called with each line processed and whether a top-level condition matched it, if reporting matches
+
 	timeMemos *lru.Cache // memo of time string parse results
+	cidrMemos *lru.Cache // memo of CIDR network parse results
+
+	windows       map[windowKey]*window    // recent values of the data passed to rate() and delta()
+	averages      map[windowKey]*avgWindow // recent observations of the data assigned from movavg()
+	observed      map[windowKey]time.Time  // time of the last observation of each ewma datum, by half-life
+	aggregates    map[windowKey]*aggregate // observations of each min, max or stddev datum in its current interval
+	windowUpdates int                      // number of window updates, to schedule sweeps of unused windows
+
+	forwarder Forwarder // destination of lines sent with forward()
+	geoip     GeoIP     // database used by geoip_country() and geoip_asn()
 
 	t *thread // Current thread of execution
 
@@ -61,6 +127,26 @@ type VM struct {
 	loc                  *time.Location // Override local timezone with provided, if not empty
 }
 
+// Forwarder is the interface to a destination for lines sent with the
+// forward() builtin.
+type Forwarder interface {
+	Forward(*logline.LogLine)
+}
+
+// LineFilter is the interface to the filters applied to lines before they
+// are passed to the programs.  Filter returns the line to pass on, or false
+// if the line is dropped.
+type LineFilter interface {
+	Filter(*logline.LogLine) (*logline.LogLine, bool)
+}
+
+// GeoIP is the interface to a database of the country and autonomous system
+// of IP addresses, used by the geoip_country() and geoip_asn() builtins.
+type GeoIP interface {
+	Country(net.IP) (string, error)
+	ASN(net.IP) (int64, error)
+}
+
 // Push a value onto the stack
 func (t *thread) Push(value interface{}) {
 	t.stack = append(t.stack, value)
@@ -77,7 +163,7 @@ func (t *thread) Pop() (value interface{}) {
 // Log a runtime error and terminate the program
 func (v *VM) errorf(format string, args ...interface{}) {
 	progRuntimeErrors.Add(v.name, 1)
-	glog.Infof(v.name+": Runtime error: "+format+"\n", args...)
+	glog.Infof(v.source()+": Runtime error: "+format+"\n", args...)
 	glog.Infof("VM stack:\n%s", debug.Stack())
 	glog.Infof("Dumping vm state")
 	glog.Infof("Name: %s", v.name)
@@ -92,6 +178,17 @@ func (v *VM) errorf(format string, args ...interface{}) {
 	v.terminate = true
 }
 
+// source returns the source position of the statement of the instruction
+// being executed, or the program name if it is unknown.
+func (v *VM) source() string {
+	if v.t != nil {
+		if pc := v.t.pc - 1; pc >= 0 && pc < len(v.lines) && v.lines[pc] != nil {
+			return v.lines[pc].String()
+		}
+	}
+	return v.name
+}
+
 func (t *thread) PopInt() (int64, error) {
 	val := t.Pop()
 	switch n := val.(type) {
@@ -118,6 +215,8 @@ func (t *thread) PopFloat() (float64, error) {
 	switch n := val.(type) {
 	case float64:
 		return n, nil
+	case int64:
+		return float64(n), nil
 	case int:
 		return float64(n), nil
 	case string:
@@ -254,15 +353,13 @@ func compare(a, b interface{}, opnd int) (bool, error) {
 }
 
 // ParseTime performs location and syslog-year aware timestamp parsing.
-func (v *VM) ParseTime(layout, value string) (tm time.Time) {
-	var err error
+func (v *VM) ParseTime(layout, value string) (tm time.Time, err error) {
 	if v.loc != nil {
 		tm, err = time.ParseInLocation(layout, value, v.loc)
 	} else {
 		tm, err = time.Parse(layout, value)
 	}
 	if err != nil {
-		v.errorf("strptime (%v, %v, %v) failed: %s", layout, value, v.loc, err)
 		return
 	}
 	// Hack for yearless syslog.
@@ -278,6 +375,132 @@ func (v *VM) ParseTime(layout, value string) (tm time.Time) {
 	return
 }
 
+// normalize returns the label value s rewritten by n.
+func normalize(n code.Normalizer, s string) string {
+	switch n.Name {
+	case "lowercase":
+		return strings.ToLower(s)
+	case "uppercase":
+		return strings.ToUpper(s)
+	case "strip_query":
+		if i := strings.IndexByte(s, '?'); i >= 0 {
+			return s[:i]
+		}
+	case "max_len":
+		if utf8.RuneCountInString(s) > n.Arg {
+			return string([]rune(s)[:n.Arg])
+		}
+	}
+	return s
+}
+
+// parseInt parses the integer in s in base, like C's strtol: base 16 allows a
+// 0x prefix, and base 0 takes the base from the prefix, 0x for hexadecimal and
+// 0o or 0 for octal.  A conversion, like int(), is in base 10 unless s has a 0x
+// or 0o prefix, so that zero padded numbers are still decimal.
+func parseInt(s string, base int, conversion bool) (int64, error) {
+	digits := strings.TrimLeft(s, "+-")
+	prefix := len(digits) > 1 && digits[0] == '0' && strings.ContainsRune("xXoO", rune(digits[1]))
+	switch {
+	case conversion && prefix:
+		base = 0
+	case base == 16 && prefix && (digits[1] == 'x' || digits[1] == 'X'):
+		s = s[:len(s)-len(digits)] + digits[2:]
+	}
+	return strconv.ParseInt(s, base, 64)
+}
+
+// localTime returns the time of the Unix timestamp ts in the timezone used to
+// parse log timestamps, UTC unless overridden.
+func (v *VM) localTime(ts int64) time.Time {
+	tm := time.Unix(ts, 0).UTC()
+	if v.loc != nil {
+		tm = tm.In(v.loc)
+	}
+	return tm
+}
+
+// rfc3339Layouts are the layouts of the RFC 3339 and ISO 8601 timestamps
+// parsed by rfc3339(), once a space or `t' between the date and time is
+// replaced with a `T'.  Each accepts fractional seconds.
+var rfc3339Layouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05Z07",
+	"2006-01-02T15:04:05",
+}
+
+// parseRFC3339 parses the RFC 3339 or ISO 8601 timestamp value.  A timestamp
+// without a zone is in the override location, like those parsed by strptime.
+func (v *VM) parseRFC3339(value string) (tm time.Time, err error) {
+	if len(value) > 10 && (value[10] == ' ' || value[10] == 't') {
+		value = value[:10] + "T" + value[11:]
+	}
+	if strings.HasSuffix(value, "z") {
+		value = value[:len(value)-1] + "Z"
+	}
+	for _, layout := range rfc3339Layouts {
+		if tm, err = v.ParseTime(layout, value); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// defaultSyslogPriority is the priority of a line without one, user.notice,
+// which RFC 3164 has relays give messages that arrive without a priority.
+const defaultSyslogPriority = 13
+
+// splitSyslogPriority returns the line after its syslog priority prefix like
+// `<34>', and the priority, or the line and the default priority if it has no
+// valid prefix.
+func splitSyslogPriority(line string) (string, int) {
+	end := strings.IndexByte(line, '>')
+	if len(line) < 3 || line[0] != '<' || end < 2 || end > 4 {
+		return line, defaultSyslogPriority
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 || line[1] == '+' || line[1] == '-' {
+		return line, defaultSyslogPriority
+	}
+	return line[end+1:], pri
+}
+
+// parseDuration returns the number of seconds in the duration value, written
+// either like "1.5s" or "1h30m", in the units accepted by time.ParseDuration,
+// or like a clock, as "H:MM:SS" or "MM:SS" with optional fractional seconds.
+// A plain number is a number of seconds.
+func parseDuration(value string) (float64, error) {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, nil
+	}
+	if !strings.Contains(value, ":") {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, err
+		}
+		return d.Seconds(), nil
+	}
+	s, sign := value, 1.0
+	if strings.HasPrefix(s, "-") {
+		s, sign = s[1:], -1
+	}
+	fields := strings.Split(s, ":")
+	if len(fields) > 3 {
+		return 0, errors.Errorf("invalid duration %q", value)
+	}
+	var secs float64
+	for i, f := range fields {
+		n, err := strconv.ParseFloat(f, 64)
+		// Only the seconds may have a fraction.
+		if err != nil || n < 0 || (i < len(fields)-1 && strings.ContainsAny(f, ".eE")) {
+			return 0, errors.Errorf("invalid duration %q", value)
+		}
+		secs = secs*60 + n
+	}
+	return sign * secs, nil
+}
+
 // execute performs an instruction cycle in the VM. acting on the instruction
 // i in thread t.
 func (v *VM) execute(t *thread, i code.Instr) {
@@ -311,6 +534,18 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		t.matches[index] = v.re[index].FindStringSubmatch(line)
 		t.Push(t.matches[index] != nil)
 
+	case code.Pmatch:
+		// Match regex against the line after its syslog priority, and
+		// append the severity and facility to the capture groups.
+		index := i.Operand.(int)
+		line, pri := splitSyslogPriority(v.input.Line)
+		m := v.re[index].FindStringSubmatch(line)
+		if m != nil {
+			m = append(m, strconv.Itoa(pri%8), strconv.Itoa(pri/8))
+		}
+		t.matches[index] = m
+		t.Push(m != nil)
+
 	case code.Cmp:
 		// Compare two elements on the stack.
 		// Set the match register based on the truthiness of the comparison.
@@ -380,6 +615,44 @@ func (v *VM) execute(t *thread, i code.Instr) {
 	case code.Jmp:
 		t.pc = i.Operand.(int)
 
+	case code.Sample:
+		// The first of each rate lines is sampled, counting the lines at
+		// each sample instruction.
+		rate := i.Operand.(int64)
+		if v.sampled == nil {
+			v.sampled = make(map[int]int64)
+		}
+		n := v.sampled[t.pc]
+		v.sampled[t.pc] = (n + 1) % rate
+		t.Push(n == 0)
+
+	case code.Jtab:
+		jt := i.Operand.(*code.JumpTable)
+		if pc, ok := jt.Targets[t.Pop()]; ok {
+			t.pc = pc
+		} else {
+			t.pc = jt.Default
+		}
+
+	case code.Vmap:
+		vmap := i.Operand.(*code.ValueMap)
+		s := t.Pop().(string)
+		value := vmap.Default
+		for j, re := range vmap.Regexps {
+			if v.re[re].MatchString(s) {
+				value = vmap.Values[j]
+				break
+			}
+		}
+		t.Push(value)
+
+	case code.Normalize:
+		s := t.Pop().(string)
+		for _, n := range i.Operand.([]code.Normalizer) {
+			s = normalize(n, s)
+		}
+		t.Push(s)
+
 	case code.Inc:
 		// Increment a datum
 		var delta int64 = 1
@@ -392,7 +665,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			}
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
-			datum.IncIntBy(n, delta, t.time)
+			v.incInt(t, n, delta)
 		} else {
 			v.errorf("Unexpected type to increment: %T %q", n, n)
 		}
@@ -421,11 +694,36 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			v.errorf("%s", err)
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
+			if v.negativeObservation(n, float64(value)) {
+				if !v.arithmeticFault(errors.Errorf("negative observation %d of a histogram", value)) {
+					break
+				}
+				value = 0
+			}
 			datum.SetInt(n, value, t.time)
 		} else {
 			v.errorf("Unexpected type to iset: %T %q", n, n)
 		}
 
+	case code.Bset:
+		// Set a bool datum, counting each change of value in its flap
+		// counter.
+		f, fok := t.Pop().(datum.Datum)
+		b, bok := t.Pop().(bool)
+		n, nok := t.Pop().(datum.Datum)
+		if !fok || !bok || !nok {
+			v.errorf("Unexpected types to bset: %T %T %T", n, b, f)
+			break
+		}
+		var value int64
+		if b {
+			value = 1
+		}
+		if datum.GetInt(n) != value {
+			datum.IncIntBy(f, 1, t.time)
+		}
+		datum.SetInt(n, value, t.time)
+
 	case code.Fset:
 		// Set a datum
 		value, err := t.PopFloat()
@@ -433,11 +731,41 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			v.errorf("%s", err)
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
+			if v.negativeObservation(n, value) {
+				if !v.arithmeticFault(errors.Errorf("negative observation %g of a histogram", value)) {
+					break
+				}
+				value = 0
+			}
 			datum.SetFloat(n, value, t.time)
 		} else {
 			v.errorf("Unexpected type to fset: %T %q", n, n)
 		}
 
+	case code.Eset:
+		// Blend an observation into an ewma datum.
+		value, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		if n, ok := t.Pop().(datum.Datum); ok {
+			datum.SetFloat(n, v.decayedAverage(n, i.Operand.(time.Duration), value), t.time)
+		} else {
+			v.errorf("Unexpected type to eset: %T %q", n, n)
+		}
+
+	case code.Aset:
+		// Aggregate an observation into a min, max or stddev datum.
+		value, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		if n, ok := t.Pop().(datum.Datum); ok {
+			datum.SetFloat(n, v.aggregate(n, i.Operand.(code.Aggregate), value), t.time)
+		} else {
+			v.errorf("Unexpected type to aset: %T %q", n, n)
+		}
+
 	case code.Sset:
 		// Set a string datum
 		value, ok := t.Pop().(string)
@@ -451,8 +779,17 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 
 	case code.Strptime:
-		// Parse a time string into the time register
-		layout := t.Pop().(string)
+		// Parse a time string into the time register, with the first of
+		// the layouts that parses it.  The operand is the number of
+		// arguments, the time string and at least one layout.
+		n := 1
+		if nargs, ok := i.Operand.(int); ok && nargs > 2 {
+			n = nargs - 1
+		}
+		layouts := make([]string, n)
+		for j := n - 1; j >= 0; j-- {
+			layouts[j] = t.Pop().(string)
+		}
 
 		var ts string
 		switch s := t.Pop().(type) {
@@ -465,12 +802,146 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			// Store the result from the re'th index at the s'th index
 			ts = t.matches[re][s]
 		}
-		if cached, ok := v.timeMemos.Get(ts); !ok {
-			tm := v.ParseTime(layout, ts)
-			v.timeMemos.Add(ts, tm)
+		// A time that doesn't parse leaves the time register alone, so that
+		// the program can branch on the result and try another layout.
+		parsed := false
+		for _, layout := range layouts {
+			key := layout + "\x00" + ts
+			cached, ok := v.timeMemos.Get(key)
+			if !ok {
+				tm, err := v.ParseTime(layout, ts)
+				if err != nil {
+					glog.V(1).Infof("%s: strptime(%q, %q) failed: %s", v.name, ts, layout, err)
+					cached = nil
+				} else {
+					cached = tm
+				}
+				v.timeMemos.Add(key, cached)
+			}
+			if tm, ok := cached.(time.Time); ok {
+				t.time = tm
+				parsed = true
+				break
+			}
+		}
+		if !parsed {
+			strptimeErrors.Add(v.name, 1)
+		}
+		t.Push(parsed)
+
+	case code.Rate, code.Delta:
+		length := time.Duration(t.Pop().(int64)) * time.Second
+		d := t.Pop().(datum.Datum)
+		delta := v.windowDelta(d, length)
+		if i.Opcode == code.Rate {
+			delta /= length.Seconds()
+		}
+		t.Push(delta)
+
+	case code.Movavg:
+		// The datum the average is assigned to is below the arguments.
+		length := time.Duration(t.Pop().(int64)) * time.Second
+		x, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		d := t.stack[len(t.stack)-1].(datum.Datum)
+		t.Push(v.movingAverage(d, length, x))
+
+	case code.Duration:
+		// Parse a duration into its number of seconds.
+		s := t.Pop().(string)
+		secs, err := parseDuration(s)
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(secs)
+
+	case code.Floor, code.Ceil, code.Round, code.Log:
+		x, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		switch i.Opcode {
+		case code.Floor:
+			x = math.Floor(x)
+		case code.Ceil:
+			x = math.Ceil(x)
+		case code.Round:
+			x = math.Round(x)
+		case code.Log:
+			t.Push(math.Log(x))
+			return
+		}
+		r, err := floatToInt(x)
+		if err != nil && !v.arithmeticFault(err) {
+			return
+		}
+		t.Push(r)
+
+	case code.Hour, code.Weekday, code.Strftime:
+		// Break down a timestamp in the timezone of the log timestamps.
+		var layout string
+		if i.Opcode == code.Strftime {
+			layout = t.Pop().(string)
+		}
+		ts, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		tm := v.localTime(ts)
+		switch i.Opcode {
+		case code.Hour:
+			t.Push(int64(tm.Hour()))
+		case code.Weekday:
+			t.Push(int64(tm.Weekday()))
+		case code.Strftime:
+			t.Push(tm.Format(layout))
+		}
+
+	case code.Abs:
+		// The absolute value has the type of the number.
+		switch x := t.Pop().(type) {
+		case int64:
+			if x == math.MinInt64 {
+				if !v.arithmeticFault(errors.Errorf("integer overflow in abs(%d)", x)) {
+					return
+				}
+				x = math.MaxInt64
+			} else if x < 0 {
+				x = -x
+			}
+			t.Push(x)
+		case float64:
+			t.Push(math.Abs(x))
+		default:
+			v.errorf("unexpected type for abs: %T %q", x, x)
+		}
+
+	case code.Rfc3339:
+		ts := t.Pop().(string)
+		key := "\x00rfc3339\x00" + ts
+		cached, ok := v.timeMemos.Get(key)
+		if !ok {
+			tm, err := v.parseRFC3339(ts)
+			if err != nil {
+				glog.V(1).Infof("%s: rfc3339(%q) failed: %s", v.name, ts, err)
+				cached = nil
+			} else {
+				cached = tm
+			}
+			v.timeMemos.Add(key, cached)
+		}
+		if tm, ok := cached.(time.Time); ok {
 			t.time = tm
+			t.Push(true)
 		} else {
-			t.time = cached.(time.Time)
+			strptimeErrors.Add(v.name, 1)
+			t.Push(false)
 		}
 
 	case code.Timestamp:
@@ -486,10 +957,21 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		// Pop TOS and store in time register
 		t.time = time.Unix(t.Pop().(int64), 0).UTC()
 
+	case code.SettimeMs:
+		t.time = time.Unix(0, t.Pop().(int64)*int64(time.Millisecond)).UTC()
+
+	case code.SettimeNs:
+		t.time = time.Unix(0, t.Pop().(int64)).UTC()
+
 	case code.Capref:
 		// Put a capture group reference onto the stack.
 		// First find the match storage index on the stack,
 		re := t.Pop().(int)
+		// The pattern didn't match if this is in its else block.
+		if t.matches[re] == nil {
+			v.errorf("capture group %d of pattern %q used where the pattern didn't match", i.Operand, v.re[re])
+			return
+		}
 		// Push the result from the re'th match at operandth index
 		t.Push(t.matches[re][i.Operand.(int)])
 
@@ -536,20 +1018,12 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			v.errorf("%s", err)
 		}
 		switch i.Opcode {
-		case code.Iadd:
-			t.Push(a + b)
-		case code.Isub:
-			t.Push(a - b)
-		case code.Imul:
-			t.Push(a * b)
-		case code.Idiv:
-			// Integer division
-			t.Push(a / b)
-		case code.Imod:
-			t.Push(a % b)
-		case code.Ipow:
-			// TODO(jaq): replace with type coercion
-			t.Push(int64(math.Pow(float64(a), float64(b))))
+		case code.Iadd, code.Isub, code.Imul, code.Idiv, code.Imod, code.Ipow:
+			r, err := intOp(i.Opcode, a, b)
+			if err != nil && !v.arithmeticFault(err) {
+				break
+			}
+			t.Push(r)
 		case code.Shl:
 			t.Push(a << uint(b))
 		case code.Shr:
@@ -577,7 +1051,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		// Load a metric at operand onto stack
 		t.Push(v.m[i.Operand.(int)])
 
-	case code.Dload:
+	case code.Dload, code.Dpeek:
 		// Load a datum from metric at TOS onto stack
 		//fmt.Printf("Stack: %v\n", t.stack)
 		m := t.Pop().(*metrics.Metric)
@@ -592,9 +1066,13 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			//fmt.Printf("Keys: %v\n", keys)
 		}
 		//fmt.Printf("Keys: %v\n", keys)
-		d, err := m.GetDatum(keys...)
+		get := m.GetDatum
+		if i.Opcode == code.Dpeek {
+			get = m.PeekDatum
+		}
+		d, err := get(keys...)
 		if err != nil {
-			v.errorf("dload (GetDatum) failed: %s", err)
+			v.errorf("%s (GetDatum) failed: %s", i.Opcode, err)
 		}
 		//fmt.Printf("Found %v\n", d)
 		t.Push(d)
@@ -639,11 +1117,200 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			v.errorf("%s", err)
 		}
 
+	case code.Delmatch:
+		km := i.Operand.(code.KeyMatch)
+		m := t.Pop().(*metrics.Metric)
+		keys := make([]string, len(km.Globs))
+		for j := len(keys) - 1; j >= 0; j-- {
+			keys[j] = t.Pop().(string)
+		}
+		if len(keys) != len(m.Keys) {
+			v.errorf("del: label values requested (%q) not same length as keys for metric %v", keys, m)
+			return
+		}
+		match := func(labels []string) bool {
+			for j, l := range labels {
+				if km.Globs[j] && !globMatch(keys[j], l) || !km.Globs[j] && keys[j] != l {
+					return false
+				}
+			}
+			return true
+		}
+		if km.Expire {
+			m.ExpireMatchingDatum(t.Pop().(time.Duration), match)
+		} else {
+			m.RemoveMatchingDatum(match)
+		}
+
 	case code.Tolower:
 		// Lowercase code.a string from TOS, and push result back.
 		s := t.Pop().(string)
 		t.Push(strings.ToLower(s))
 
+	case code.Toupper:
+		// Uppercase a string from TOS, and push result back.
+		s := t.Pop().(string)
+		t.Push(strings.ToUpper(s))
+
+	case code.Trim:
+		// Trim whitespace from both ends of a string from TOS, and push result back.
+		s := t.Pop().(string)
+		t.Push(strings.TrimSpace(s))
+
+	case code.Substr:
+		// Take the substring of at most length bytes from start, clamped to
+		// the bounds of the string.
+		length, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		start, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		s := t.Pop().(string)
+		if start < 0 {
+			start = 0
+		}
+		if start > int64(len(s)) {
+			start = int64(len(s))
+		}
+		end := start
+		if length > 0 {
+			end = start + length
+		}
+		if end > int64(len(s)) {
+			end = int64(len(s))
+		}
+		t.Push(s[start:end])
+
+	case code.Subst:
+		// Replace every occurrence of old in s.
+		s := t.Pop().(string)
+		repl := t.Pop().(string)
+		old := t.Pop().(string)
+		t.Push(strings.Replace(s, old, repl, -1))
+
+	case code.Rsubst:
+		// Replace every match of the regex in s, expanding capture groups in
+		// the replacement.
+		index := i.Operand.(int)
+		s := t.Pop().(string)
+		repl := t.Pop().(string)
+		t.Push(v.re[index].ReplaceAllString(s, repl))
+
+	case code.Split:
+		delim := t.Pop().(string)
+		s := t.Pop().(string)
+		t.Push(strings.Split(s, delim))
+
+	case code.Lindex:
+		// Negative indexes count back from the end of the list, and indexes
+		// out of range give the empty string.
+		index, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		l := t.Pop().([]string)
+		if index < 0 {
+			index += int64(len(l))
+		}
+		if index < 0 || index >= int64(len(l)) {
+			t.Push("")
+		} else {
+			t.Push(l[index])
+		}
+
+	case code.Logfmt:
+		s := t.Pop().(string)
+		m, _ := t.decode("logfmt", s, func(s string) (interface{}, error) {
+			return parseLogfmt(s), nil
+		})
+		t.Push(m)
+
+	case code.Json:
+		// Lines that aren't JSON have no fields, so that logs mixing JSON
+		// and plain text lines can be processed.
+		path := t.Pop().(string)
+		s := t.Pop().(string)
+		doc, err := t.decode("json", s, decodeJSON)
+		if err != nil {
+			glog.V(2).Infof("json decode of %q failed: %s", s, err)
+		}
+		t.Push(jsonString(lookupJSON(doc, path)))
+
+	case code.Csv:
+		// Lines that aren't valid CSV have no fields.
+		s := t.Pop().(string)
+		l, err := t.decode("csv", s, func(s string) (interface{}, error) {
+			return parseCSV(s)
+		})
+		if err != nil {
+			glog.V(2).Infof("csv parse of %q failed: %s", s, err)
+		}
+		fields, _ := l.([]string)
+		t.Push(fields)
+
+	case code.Cidrmatch:
+		// Addresses that don't parse, like "-" for a missing client, aren't
+		// in any network.
+		addr := t.Pop().(string)
+		cidr := t.Pop().(string)
+		var network *net.IPNet
+		if cached, ok := v.cidrMemos.Get(cidr); ok {
+			network = cached.(*net.IPNet)
+		} else {
+			var err error
+			_, network, err = net.ParseCIDR(cidr)
+			if err != nil {
+				v.errorf("%s", err)
+				break
+			}
+			v.cidrMemos.Add(cidr, network)
+		}
+		ip := net.ParseIP(addr)
+		t.Push(ip != nil && network.Contains(ip))
+
+	case code.GeoipCountry, code.GeoipAsn:
+		// Addresses that don't parse or aren't in the database have no
+		// country or autonomous system.
+		ip := net.ParseIP(t.Pop().(string))
+		if v.geoip == nil {
+			geoipUnconfigured.Add(v.name, 1)
+		}
+		if i.Opcode == code.GeoipCountry {
+			var country string
+			if v.geoip != nil && ip != nil {
+				var err error
+				if country, err = v.geoip.Country(ip); err != nil {
+					v.errorf("%s", err)
+					break
+				}
+			}
+			t.Push(country)
+		} else {
+			var asn int64
+			if v.geoip != nil && ip != nil {
+				var err error
+				if asn, err = v.geoip.ASN(ip); err != nil {
+					v.errorf("%s", err)
+					break
+				}
+			}
+			t.Push(asn)
+		}
+
+	case code.Lookup:
+		// Missing keys give the empty string.
+		key := t.Pop().(string)
+		t.Push(v.lookups[i.Operand.(int)][key])
+
+	case code.Mindex:
+		// Missing keys give the empty string.
+		key := t.Pop().(string)
+		m := t.Pop().(map[string]string)
+		t.Push(m[key])
+
 	case code.Length:
 		// Compute the length of a string from TOS, and push result back.
 		s := t.Pop().(string)
@@ -652,7 +1319,8 @@ func (v *VM) execute(t *thread, i code.Instr) {
 	case code.S2i:
 		base := int64(10)
 		var err error
-		if i.Operand != nil {
+		conversion := i.Operand == nil
+		if !conversion {
 			// strtol is emitted with an arglen, int is not
 			base, err = t.PopInt()
 			if err != nil {
@@ -660,7 +1328,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			}
 		}
 		str := t.Pop().(string)
-		i, err := strconv.ParseInt(str, int(base), 64)
+		i, err := parseInt(str, int(base), conversion)
 		if err != nil {
 			v.errorf("%s", err)
 		}
@@ -695,6 +1363,17 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		t.Push(fmt.Sprintf("%g", f))
 
+	case code.F2i:
+		f, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		if math.IsNaN(f) || f >= math.MaxInt64 || f < math.MinInt64 {
+			v.errorf("can't convert %g to an int", f)
+			return
+		}
+		t.Push(int64(f))
+
 	case code.Setmatched:
 		t.matched = i.Operand.(bool)
 
@@ -702,9 +1381,32 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		// Only match if the matched flag is false.
 		t.Push(!t.matched)
 
+	case code.Getmatched:
+		t.Push(t.matched)
+
+	case code.Popmatched:
+		t.matched = t.Pop().(bool)
+
 	case code.Getfilename:
 		t.Push(v.input.Filename)
 
+	case code.Forward:
+		if v.forwarder == nil {
+			forwardUnconfigured.Add(v.name, 1)
+			break
+		}
+		v.forwarder.Forward(v.input)
+
+	case code.Lload:
+		t.Push(t.locals[i.Operand.(int)])
+
+	case code.Lstore:
+		n := i.Operand.(int)
+		for len(t.locals) <= n {
+			t.locals = append(t.locals, nil)
+		}
+		t.locals[n] = t.Pop()
+
 	case code.Cat:
 		s1 := t.Pop().(string)
 		s2 := t.Pop().(string)
@@ -715,6 +1417,35 @@ func (v *VM) execute(t *thread, i code.Instr) {
 	}
 }
 
+// countConditionMatches makes the VM count the lines matched by each
+// top-level condition of the program, by source line, in
+// prog_condition_matches_total.  The counts of any previous version of the
+// program are discarded, as its lines may have moved.
+func (v *VM) countConditionMatches() {
+	lines := new(expvar.Map).Init()
+	v.conditionMatches = make([]*expvar.Int, len(v.prog))
+	for pc, line := range v.conditionLines {
+		key := strconv.Itoa(line)
+		c, ok := lines.Get(key).(*expvar.Int)
+		if !ok {
+			c = new(expvar.Int)
+			lines.Set(key, c)
+		}
+		v.conditionMatches[pc] = c
+	}
+	conditionMatches.Set(v.name, lines)
+}
+
+// reportMatches makes the VM call done with each line it processes, and
+// whether any of the program's top-level conditions matched it.
+func (v *VM) reportMatches(done func(*logline.LogLine, bool)) {
+	v.conditionBlocks = make([]bool, len(v.prog))
+	for pc := range v.conditionLines {
+		v.conditionBlocks[pc] = true
+	}
+	v.lineDone = done
+}
+
 // processLine handles the incoming lines from the input channel, by running a
 // fetch-execute cycle on the VM bytecode with the line as input to the
 // program, until termination.
@@ -725,17 +1456,71 @@ func (v *VM) processLine(line *logline.LogLine) {
 	v.input = line
 	t.stack = make([]interface{}, 0)
 	t.matches = make(map[int][]string, len(v.re))
-	for {
+	matched := false
+	if v.quarantined {
+		if v.lineDone != nil {
+			v.lineDone(line, false)
+		}
+		return
+	}
+	var start time.Time
+	if v.budget.wallTime > 0 {
+		start = time.Now()
+	}
+	for n := 1; ; n++ {
 		if t.pc >= len(v.prog) {
-			return
+			break
 		}
 		i := v.prog[t.pc]
+		n += v.matchCost(t, i)
+		if v.overBudget(n, start) {
+			break
+		}
+		if v.conditionMatches != nil {
+			if c := v.conditionMatches[t.pc]; c != nil {
+				c.Add(1)
+			}
+		}
+		if v.conditionBlocks != nil && v.conditionBlocks[t.pc] {
+			matched = true
+		}
 		t.pc++
 		v.execute(t, i)
 		if v.terminate || v.abort {
 			// Terminate only stops this invocation on this line of input; reset the terminate flag.
 			v.terminate = false
-			return
+			break
+		}
+	}
+	if v.lineDone != nil {
+		v.lineDone(line, matched)
+	}
+}
+
+// hiddenExpiryInterval is how often a virtual machine removes expired values
+// from its hidden metrics.  These aren't in the metric store, so the store's
+// expiry loop never sees them.
+var hiddenExpiryInterval = time.Minute
+
+// expireHidden removes the values of hidden metrics that have not been
+// updated within their expiry.
+func (v *VM) expireHidden(now time.Time) {
+	for _, m := range v.m {
+		if !m.Hidden {
+			continue
+		}
+		m.RLock()
+		expired := make([][]string, 0)
+		for _, lv := range m.LabelValues {
+			if lv.Expiry > 0 && now.Sub(lv.Value.TimeUTC()) > lv.Expiry {
+				expired = append(expired, lv.Labels)
+			}
+		}
+		m.RUnlock()
+		for _, labels := range expired {
+			if err := m.RemoveDatum(labels...); err != nil {
+				glog.Info(err)
+			}
 		}
 	}
 }
@@ -747,24 +1532,69 @@ func (v *VM) Run(_ uint32, lines <-chan *logline.LogLine, shutdown chan<- struct
 	defer close(shutdown)
 
 	glog.Infof("Starting program %s", v.name)
+	ticker := time.NewTicker(hiddenExpiryInterval)
+	defer ticker.Stop()
 	close(started)
-	for line := range lines {
-		// TODO(jaq): measure and export the processLine runtime per VM as a histo.
-		v.processLine(line)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				glog.Infof("Stopping program %s", v.name)
+				return
+			}
+			// TODO(jaq): measure and export the processLine runtime per VM as a histo.
+			v.processLine(line)
+		case now := <-ticker.C:
+			v.expireHidden(now)
+		}
+	}
+}
+
+// carryPersistent copies the values of the persistent hidden metrics in old
+// into the metrics of the same name, kind, type and keys in v, so that they
+// survive a program reload.  Values of other hidden metrics are discarded
+// with the old program, unless all is set.  Values still using the old
+// declaration's expiry take the new one.
+func (v *VM) carryPersistent(old *VM, all bool) {
+	for _, m := range v.m {
+		if !m.Hidden || !m.Persist && !all {
+			continue
+		}
+		for _, o := range old.m {
+			if !o.Hidden || !o.Persist && !all || o.Name != m.Name || o.Kind != m.Kind || o.Type != m.Type || !reflect.DeepEqual(o.Keys, m.Keys) {
+				continue
+			}
+			o.RLock()
+			m.LabelValues = append(m.LabelValues[:0], o.LabelValues...)
+			o.RUnlock()
+			for _, lv := range m.LabelValues {
+				if lv.Expiry == o.Expiry {
+					lv.Expiry = m.Expiry
+				}
+			}
+			break
+		}
 	}
-	glog.Infof("Stopping program %s", v.name)
 }
 
 // New creates a new virtual machine with the given name, and compiler
 // artifacts for executable and data segments.
 func New(name string, obj *object.Object, syslogUseCurrentYear bool, loc *time.Location) *VM {
+	if obj.Location != nil {
+		// The program's own timezone overrides the one for all programs.
+		loc = obj.Location
+	}
 	return &VM{
 		name:                 name,
 		re:                   obj.Regexps,
 		str:                  obj.Strings,
 		m:                    obj.Metrics,
+		lookups:              obj.Lookups,
+		conditionLines:       obj.Conditions,
 		prog:                 obj.Program,
+		lines:                obj.Lines,
 		timeMemos:            lru.New(64),
+		cidrMemos:            lru.New(64),
 		syslogUseCurrentYear: syslogUseCurrentYear,
 		loc:                  loc,
 	}
@@ -800,3 +1630,24 @@ func (v *VM) DumpByteCode(name string) string {
 	}
 	return b.String()
 }
+
+// globMatch returns true if s matches the glob pattern, in which `*' matches
+// any run of characters and every other character must be equal.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
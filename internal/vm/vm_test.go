@@ -4,7 +4,13 @@
 package vm
 
 import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
 	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +19,7 @@ import (
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/codegen"
 	"github.com/google/mtail/internal/vm/object"
 )
 
@@ -153,14 +160,35 @@ var instructions = []struct {
 		[]interface{}{},
 		[]interface{}{},
 		thread{pc: 37, matches: map[int][]string{}}},
+	{"jtab",
+		code.Instr{code.Jtab, &code.JumpTable{Targets: map[interface{}]int{"GET": 37, int64(2): 42}, Default: 12}},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"GET"},
+		[]interface{}{},
+		thread{pc: 37, matches: map[int][]string{}}},
+	{"jtab default",
+		code.Instr{code.Jtab, &code.JumpTable{Targets: map[interface{}]int{"GET": 37, int64(2): 42}, Default: 12}},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"POST"},
+		[]interface{}{},
+		thread{pc: 12, matches: map[int][]string{}}},
 	{"strptime",
 		code.Instr{code.Strptime, 0},
 		[]*regexp.Regexp{},
 		[]string{},
 		[]interface{}{"2012/01/18 06:25:00", "2006/01/02 15:04:05"},
-		[]interface{}{},
+		[]interface{}{true},
 		thread{pc: 0, time: time.Date(2012, 1, 18, 6, 25, 0, 0, time.UTC),
 			matches: map[int][]string{}}},
+	{"strptime failed",
+		code.Instr{code.Strptime, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"-", "2006/01/02 15:04:05"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"iadd",
 		code.Instr{code.Iadd, 0},
 		[]*regexp.Regexp{},
@@ -210,6 +238,164 @@ var instructions = []struct {
 		[]interface{}{"mIxeDCasE"},
 		[]interface{}{"mixedcase"},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"toupper",
+		code.Instr{code.Toupper, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"mIxeDCasE"},
+		[]interface{}{"MIXEDCASE"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"trim",
+		code.Instr{code.Trim, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{" \tpadded \n"},
+		[]interface{}{"padded"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"substr",
+		code.Instr{code.Substr, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/path?query", int64(1), int64(4)},
+		[]interface{}{"path"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"substr out of range",
+		code.Instr{code.Substr, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/path", int64(-1), int64(10)},
+		[]interface{}{"/path"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"split",
+		code.Instr{code.Split, 2},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"a:b::c", ":"},
+		[]interface{}{[]string{"a", "b", "", "c"}},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"lindex",
+		code.Instr{code.Lindex, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{[]string{"a", "b", "c"}, int64(1)},
+		[]interface{}{"b"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"lindex negative",
+		code.Instr{code.Lindex, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{[]string{"a", "b", "c"}, int64(-1)},
+		[]interface{}{"c"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"lindex out of range",
+		code.Instr{code.Lindex, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{[]string{"a"}, int64(3)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"cidrmatch",
+		code.Instr{code.Cidrmatch, 2},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"10.0.0.0/8", "10.1.2.3"},
+		[]interface{}{true},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"cidrmatch outside",
+		code.Instr{code.Cidrmatch, 2},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"10.0.0.0/8", "192.168.1.1"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"cidrmatch ipv6",
+		code.Instr{code.Cidrmatch, 2},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"2001:db8::/32", "2001:db8::1"},
+		[]interface{}{true},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"cidrmatch not an address",
+		code.Instr{code.Cidrmatch, 2},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"10.0.0.0/8", "-"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"geoip_country unconfigured",
+		code.Instr{code.GeoipCountry, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"192.0.2.1"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"geoip_asn unconfigured",
+		code.Instr{code.GeoipAsn, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"192.0.2.1"},
+		[]interface{}{int64(0)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"csv",
+		code.Instr{code.Csv, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`a,"b,c",d`},
+		[]interface{}{[]string{"a", "b,c", "d"}},
+		thread{pc: 0, matches: map[int][]string{}, decoded: map[decodeKey]interface{}{
+			{"csv", `a,"b,c",d`}: []string{"a", "b,c", "d"}}}},
+	{"logfmt",
+		code.Instr{code.Logfmt, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`a=1 b="x y"`},
+		[]interface{}{map[string]string{"a": "1", "b": "x y"}},
+		thread{pc: 0, matches: map[int][]string{}, decoded: map[decodeKey]interface{}{
+			{"logfmt", `a=1 b="x y"`}: map[string]string{"a": "1", "b": "x y"}}}},
+	{"json",
+		code.Instr{code.Json, 2},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`{"a": [{"b": 2}]}`, "a[0].b"},
+		[]interface{}{"2"},
+		thread{pc: 0, matches: map[int][]string{}, decoded: map[decodeKey]interface{}{
+			{"json", `{"a": [{"b": 2}]}`}: map[string]interface{}{
+				"a": []interface{}{map[string]interface{}{"b": json.Number("2")}}}}}},
+	{"json not json",
+		code.Instr{code.Json, 2},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"plain text", "a"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"mindex",
+		code.Instr{code.Mindex, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{map[string]string{"a": "1"}, "a"},
+		[]interface{}{"1"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"mindex missing key",
+		code.Instr{code.Mindex, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{map[string]string{"a": "1"}, "b"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"subst",
+		code.Instr{code.Subst, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"//", "/", "//a//b"},
+		[]interface{}{"/a/b"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"rsubst",
+		code.Instr{code.Rsubst, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`\?.*`)},
+		[]string{},
+		[]interface{}{"", "/path?query"},
+		[]interface{}{"/path"},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"length",
 		code.Instr{code.Length, 0},
 		[]*regexp.Regexp{},
@@ -329,6 +515,20 @@ var instructions = []struct {
 		[]interface{}{int64(0)},
 		[]interface{}{},
 		thread{pc: 0, time: time.Unix(0, 0).UTC(), matches: map[int][]string{}}},
+	{"settime_ms",
+		code.Instr{code.SettimeMs, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(1560000000123)},
+		[]interface{}{},
+		thread{pc: 0, time: time.Unix(1560000000, 123000000).UTC(), matches: map[int][]string{}}},
+	{"settime_ns",
+		code.Instr{code.SettimeNs, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(1560000000123456789)},
+		[]interface{}{},
+		thread{pc: 0, time: time.Unix(1560000000, 123456789).UTC(), matches: map[int][]string{}}},
 	{"push int",
 		code.Instr{code.Push, 1},
 		[]*regexp.Regexp{},
@@ -427,6 +627,13 @@ var instructions = []struct {
 		[]interface{}{3.1},
 		[]interface{}{"3.1"},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"f2i",
+		code.Instr{code.F2i, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{-3.7},
+		[]interface{}{int64(-3)},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"cat",
 		code.Instr{code.Cat, 0},
 		[]*regexp.Regexp{},
@@ -523,6 +730,8 @@ func TestDatumSetInstrs(t *testing.T) {
 		metrics.NewMetric("b", "tst", metrics.Counter, metrics.Float),
 		metrics.NewMetric("c", "tst", metrics.Gauge, metrics.String),
 		metrics.NewMetric("d", "tst", metrics.Histogram, metrics.Float),
+		metrics.NewMetric("e", "tst", metrics.Bool, metrics.Int),
+		metrics.NewMetric("e_flaps_total", "tst", metrics.Counter, metrics.Int),
 	)
 
 	// simple inc
@@ -713,6 +922,32 @@ func TestDatumSetInstrs(t *testing.T) {
 	if d.ValueString() != "3.1" {
 		t.Errorf("Unexpected value %v", d)
 	}
+
+	// bset, only counting changes of value as flaps
+	for _, b := range []bool{true, true, false} {
+		v = makeVM(code.Instr{code.Bset, nil}, m)
+		d, err = m[4].GetDatum()
+		testutil.FatalIfErr(t, err)
+		f, err := m[5].GetDatum()
+		testutil.FatalIfErr(t, err)
+		v.t.Push(d)
+		v.t.Push(b)
+		v.t.Push(f)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatalf("Execution failed, see info log.")
+		}
+	}
+	d, err = m[4].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "0" {
+		t.Errorf("Unexpected value %v", d)
+	}
+	d, err = m[5].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if d.ValueString() != "2" {
+		t.Errorf("Unexpected flaps %v", d)
+	}
 }
 
 func TestStrptimeWithTimezone(t *testing.T) {
@@ -868,3 +1103,1132 @@ func TestTimestampInstr(t *testing.T) {
 		t.Errorf("Expecting timestamp to be %s, was %s", newT, tos)
 	}
 }
+
+func TestThreadDecodeMemo(t *testing.T) {
+	th := new(thread)
+	calls := 0
+	f := func(s string) (interface{}, error) {
+		calls++
+		return strings.Split(s, ","), nil
+	}
+	for i := 0; i < 3; i++ {
+		r, err := th.decode("split", "a,b", f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := testutil.Diff([]string{"a", "b"}, r); diff != "" {
+			t.Error(diff)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("decoder called %d times, expected 1", calls)
+	}
+	if _, err := th.decode("split", "c,d", f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := th.decode("other", "a,b", f); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("decoder called %d times, expected 3", calls)
+	}
+
+	failing := func(s string) (interface{}, error) {
+		calls++
+		return nil, errors.New("bad input")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := th.decode("fail", "x", failing); err == nil {
+			t.Error("expected error")
+		}
+	}
+	if calls != 5 {
+		t.Errorf("failing decoder called %d times, expected errors not to be memoized", calls-3)
+	}
+
+	// A new line gets a new thread, and so an empty memo.
+	th = new(thread)
+	if _, err := th.decode("split", "a,b", f); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 6 {
+		t.Errorf("decoder called %d times, expected 6", calls)
+	}
+}
+
+func TestExpireHidden(t *testing.T) {
+	hidden := metrics.NewMetric("a", "tst", metrics.Counter, metrics.Int, "a")
+	hidden.Hidden = true
+	hidden.Expiry = time.Minute
+	exported := metrics.NewMetric("b", "tst", metrics.Counter, metrics.Int, "a")
+	exported.Expiry = time.Minute
+	m := []*metrics.Metric{hidden, exported}
+	now := time.Now()
+	for _, m := range m {
+		for labels, age := range map[string]time.Duration{"stale": time.Hour, "fresh": time.Second} {
+			d, err := m.GetDatum(labels)
+			testutil.FatalIfErr(t, err)
+			datum.SetInt(d, 1, now.Add(-age))
+		}
+	}
+
+	v := makeVM(code.Instr{code.Stop, nil}, m)
+	v.expireHidden(now)
+	if lv := hidden.FindLabelValueOrNil([]string{"stale"}); lv != nil {
+		t.Errorf("stale hidden value not expired: %v", lv)
+	}
+	if lv := hidden.FindLabelValueOrNil([]string{"fresh"}); lv == nil {
+		t.Error("fresh hidden value expired")
+	}
+	// Exported metrics are expired by the store.
+	if lv := exported.FindLabelValueOrNil([]string{"stale"}); lv == nil {
+		t.Error("exported value expired")
+	}
+}
+
+func TestCarryPersistent(t *testing.T) {
+	newMetrics := func(expiry time.Duration) []*metrics.Metric {
+		p := metrics.NewMetric("p", "tst", metrics.Gauge, metrics.Int, "a")
+		p.Hidden = true
+		p.Persist = true
+		p.Expiry = expiry
+		q := metrics.NewMetric("q", "tst", metrics.Gauge, metrics.Int, "a")
+		q.Hidden = true
+		return []*metrics.Metric{p, q}
+	}
+	oldMetrics := newMetrics(time.Minute)
+	for _, m := range oldMetrics {
+		d, err := m.GetDatum("x")
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 7, time.Now())
+	}
+	old := makeVM(code.Instr{code.Stop, nil}, oldMetrics)
+
+	v := makeVM(code.Instr{code.Stop, nil}, newMetrics(time.Hour))
+	v.carryPersistent(old, false)
+	lv := v.m[0].FindLabelValueOrNil([]string{"x"})
+	if lv == nil {
+		t.Fatal("persistent value not carried over")
+	}
+	if lv.Value.ValueString() != "7" {
+		t.Errorf("persistent value is %s, expected 7", lv.Value.ValueString())
+	}
+	if lv.Expiry != time.Hour {
+		t.Errorf("persistent value expiry is %v, expected the new declaration's", lv.Expiry)
+	}
+	if lv := v.m[1].FindLabelValueOrNil([]string{"x"}); lv != nil {
+		t.Errorf("transient value carried over: %v", lv)
+	}
+
+	v = makeVM(code.Instr{code.Stop, nil}, newMetrics(time.Hour))
+	v.carryPersistent(old, true)
+	if lv := v.m[1].FindLabelValueOrNil([]string{"x"}); lv == nil {
+		t.Error("transient value not carried over when keeping all values")
+	}
+}
+
+func TestLookupInstr(t *testing.T) {
+	v := makeVM(code.Instr{code.Lookup, 1}, nil)
+	v.lookups = []map[string]string{nil, {"www.example.com": "web"}}
+	for _, tc := range []struct {
+		key      string
+		expected string
+	}{
+		{"www.example.com", "web"},
+		{"api.example.com", ""},
+	} {
+		v.t.Push(tc.key)
+		v.execute(v.t, v.prog[0])
+		if diff := testutil.Diff(tc.expected, v.t.Pop()); diff != "" {
+			t.Errorf("%s: %s", tc.key, diff)
+		}
+	}
+}
+
+// fakeGeoIP knows the country and autonomous system of one address.
+type fakeGeoIP struct{}
+
+func (fakeGeoIP) Country(ip net.IP) (string, error) {
+	if ip.Equal(net.ParseIP("192.0.2.1")) {
+		return "AU", nil
+	}
+	return "", nil
+}
+
+func (fakeGeoIP) ASN(ip net.IP) (int64, error) {
+	if ip.Equal(net.ParseIP("192.0.2.1")) {
+		return 64496, nil
+	}
+	return 0, errors.New("corrupt database")
+}
+
+func TestGeoipInstrs(t *testing.T) {
+	for _, tc := range []struct {
+		op       code.Opcode
+		addr     string
+		expected interface{}
+	}{
+		{code.GeoipCountry, "192.0.2.1", "AU"},
+		{code.GeoipCountry, "198.51.100.1", ""},
+		{code.GeoipCountry, "-", ""},
+		{code.GeoipAsn, "192.0.2.1", int64(64496)},
+		{code.GeoipAsn, "-", int64(0)},
+	} {
+		v := makeVM(code.Instr{tc.op, 1}, nil)
+		v.geoip = fakeGeoIP{}
+		v.t.Push(tc.addr)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatalf("%s %s: execution failed, see info log", tc.op, tc.addr)
+		}
+		if diff := testutil.Diff(tc.expected, v.t.Pop()); diff != "" {
+			t.Errorf("%s %s: %s", tc.op, tc.addr, diff)
+		}
+	}
+
+	v := makeVM(code.Instr{code.GeoipAsn, 1}, nil)
+	v.geoip = fakeGeoIP{}
+	v.t.Push("198.51.100.1")
+	v.execute(v.t, v.prog[0])
+	if !v.terminate {
+		t.Error("expected lookup error to terminate the program")
+	}
+}
+
+func TestStrptimeFormats(t *testing.T) {
+	v := makeVM(code.Instr{code.Strptime, 3}, nil)
+	v.name = "strptimeformats"
+	v.t.Push("2012-01-18T06:25:00Z")
+	v.t.Push("02/Jan/2006:15:04:05 -0700")
+	v.t.Push("2006-01-02T15:04:05Z07:00")
+	v.execute(v.t, v.prog[0])
+	if v.terminate {
+		t.Fatal("execution failed, see info log")
+	}
+	if diff := testutil.Diff([]interface{}{true}, v.t.stack); diff != "" {
+		t.Error(diff)
+	}
+	if !v.t.time.Equal(time.Date(2012, 1, 18, 6, 25, 0, 0, time.UTC)) {
+		t.Errorf("time not set by the second layout: %s", v.t.time)
+	}
+	if strptimeErrors.Get(v.name) != nil {
+		t.Errorf("unexpected strptime errors: %s", strptimeErrors.Get(v.name))
+	}
+}
+
+var rfc3339Tests = []struct {
+	ts       string
+	expected time.Time
+}{
+	{"2012-01-18T06:25:00Z", time.Date(2012, 1, 18, 6, 25, 0, 0, time.UTC)},
+	{"2012-01-18T06:25:00.123456Z", time.Date(2012, 1, 18, 6, 25, 0, 123456000, time.UTC)},
+	{"2012-01-18T16:25:00+10:00", time.Date(2012, 1, 18, 6, 25, 0, 0, time.UTC)},
+	{"2012-01-18T16:25:00.5+1000", time.Date(2012, 1, 18, 6, 25, 0, 500000000, time.UTC)},
+	{"2012-01-18T16:25:00+10", time.Date(2012, 1, 18, 6, 25, 0, 0, time.UTC)},
+	{"2012-01-18 06:25:00z", time.Date(2012, 1, 18, 6, 25, 0, 0, time.UTC)},
+	{"2012-01-18T06:25:00", time.Date(2012, 1, 18, 6, 25, 0, 0, time.UTC)},
+	{"18/Jan/2012:06:25:00 +0000", time.Time{}},
+}
+
+func TestRfc3339(t *testing.T) {
+	for _, tc := range rfc3339Tests {
+		tc := tc
+		t.Run(tc.ts, func(t *testing.T) {
+			v := makeVM(code.Instr{code.Rfc3339, 1}, nil)
+			v.t.Push(tc.ts)
+			v.execute(v.t, v.prog[0])
+			if v.terminate {
+				t.Fatal("execution failed, see info log")
+			}
+			if diff := testutil.Diff([]interface{}{!tc.expected.IsZero()}, v.t.stack); diff != "" {
+				t.Error(diff)
+			}
+			if !v.t.time.Equal(tc.expected) {
+				t.Errorf("time is %s, expected %s", v.t.time, tc.expected)
+			}
+		})
+	}
+}
+
+func TestStrptimeFallback(t *testing.T) {
+	v := makeVM(code.Instr{code.Strptime, 0}, nil)
+	v.name = "strptimefallback"
+	for _, layout := range []string{"2006-01-02T15:04:05Z07:00", "02/Jan/2006:15:04:05 -0700", "2006-01-02T15:04:05Z07:00"} {
+		v.t.Push("18/Jan/2012:06:25:00 +0000")
+		v.t.Push(layout)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatal("execution failed, see info log")
+		}
+	}
+	if diff := testutil.Diff([]interface{}{false, true, false}, v.t.stack); diff != "" {
+		t.Error(diff)
+	}
+	if !v.t.time.Equal(time.Date(2012, 1, 18, 6, 25, 0, 0, time.UTC)) {
+		t.Errorf("time not set by the layout that parsed: %s", v.t.time)
+	}
+	if diff := testutil.Diff("2", strptimeErrors.Get(v.name).String()); diff != "" {
+		t.Errorf("strptime errors: %s", diff)
+	}
+}
+
+func TestCountConditionMatches(t *testing.T) {
+	prog := "counter a\n/foo/ {\n  /bar/ {\n    a++\n  }\n}\n/baz/ {\n  a++\n}\n"
+	v, err := Compile("conditions.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.countConditionMatches()
+	for _, line := range []string{"foo bar", "foo", "qux"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	// Only the top-level conditions are counted, by their source line.
+	if diff := testutil.Diff(`{"2": 2, "7": 0}`, conditionMatches.Get("conditions.mtail").String()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestRuntimeErrorSource(t *testing.T) {
+	prog := "counter c\n/(.*)/ {\n  c += int($1)\n}\n"
+	v, err := Compile("errors.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.processLine(logline.NewLogLine("log", "not a number"))
+	// The error is reported at the statement that failed.
+	if diff := testutil.Diff("errors.mtail:3:3", v.source()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCaprefInElseBlock(t *testing.T) {
+	prog := "counter c by host\n/^(?P<host>\\w+):/ {\n  c[$host]++\n} else {\n  c[$host]++\n}\n"
+	v, err := Compile("else.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"a: ok", "no host", "b: ok"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	// The line that didn't match only stops with an error, and the program
+	// goes on processing the lines after it.
+	if v.abort {
+		t.Error("program aborted")
+	}
+	if diff := testutil.Diff(2, len(v.m[0].LabelValues)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestRateDelta(t *testing.T) {
+	prog := `counter errors
+gauge errors_rate
+gauge errors_delta
+/^(\d+) error/ {
+  settime($1)
+  errors++
+  errors_rate = rate(errors, 60)
+  errors_delta = delta(errors, 60)
+}
+`
+	v, err := Compile("rate.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		line  string
+		delta float64
+	}{
+		{"0 error", 0},
+		{"10 error", 1},
+		{"20 error", 2},
+		// The samples before 10 have left the window.
+		{"70 error", 2},
+		{"200 error", 1},
+	} {
+		v.processLine(logline.NewLogLine("log", tc.line))
+		d, err := v.m[2].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.delta, datum.GetFloat(d)); diff != "" {
+			t.Errorf("%s: delta %s", tc.line, diff)
+		}
+		r, err := v.m[1].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.delta/60, datum.GetFloat(r)); diff != "" {
+			t.Errorf("%s: rate %s", tc.line, diff)
+		}
+	}
+}
+
+func TestMovavg(t *testing.T) {
+	prog := `gauge latency_avg by path
+/^(\d+) (\S+) (\d+)$/ {
+  settime($1)
+  latency_avg[$2] = movavg($3, 1m)
+}
+`
+	v, err := Compile("movavg.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		line     string
+		path     string
+		expected float64
+	}{
+		{"0 /a 10", "/a", 10},
+		{"30 /a 20", "/a", 15},
+		// Each key has its own window.
+		{"30 /b 100", "/b", 100},
+		// The observation at 0 has left the window.
+		{"70 /a 30", "/a", 25},
+	} {
+		v.processLine(logline.NewLogLine("log", tc.line))
+		d, err := v.m[0].GetDatum(tc.path)
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.expected, datum.GetFloat(d)); diff != "" {
+			t.Errorf("%s: %s", tc.line, diff)
+		}
+	}
+}
+
+func TestEwma(t *testing.T) {
+	prog := `ewma depth by queue halflife 10s
+/^(\d+) (\S+) (\d+)$/ {
+  settime($1)
+  depth[$2] = $3
+}
+`
+	v, err := Compile("ewma.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		line     string
+		queue    string
+		expected float64
+	}{
+		{"0 a 100", "a", 100},
+		// One half-life later the old value has half the weight.
+		{"10 a 0", "a", 50},
+		// Each key has its own value.
+		{"10 b 8", "b", 8},
+		// An observation at the same time doesn't move the value.
+		{"10 a 100", "a", 50},
+		{"30 a 10", "a", 20},
+	} {
+		v.processLine(logline.NewLogLine("log", tc.line))
+		d, err := v.m[0].GetDatum(tc.queue)
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.expected, datum.GetFloat(d)); diff != "" {
+			t.Errorf("%s: %s", tc.line, diff)
+		}
+	}
+}
+
+func TestTopK(t *testing.T) {
+	prog := `topk(2) requests by path
+/^(\S+)$/ {
+  requests[$1]++
+}
+`
+	v, err := Compile("topk.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"/a", "/a", "/a", "/b", "/c"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	values := make(map[string]int64)
+	for _, lv := range v.m[0].LabelValues {
+		values[lv.Labels[0]] = datum.GetInt(lv.Value)
+	}
+	expected := map[string]int64{"/a": 3, "/c": 1, metrics.OtherLabel: 1}
+	if diff := testutil.Diff(expected, values); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestUnique(t *testing.T) {
+	prog := `unique clients by service
+/^(\S+) (\S+)$/ {
+  clients[$1] = $2
+}
+`
+	v, err := Compile("unique.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"www 10.0.0.1", "www 10.0.0.2", "www 10.0.0.1", "mail 10.0.0.1"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	for service, expected := range map[string]uint64{"www": 2, "mail": 1} {
+		d, err := v.m[0].GetDatum(service)
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(expected, datum.GetDistinctCount(d)); diff != "" {
+			t.Errorf("%s: %s", service, diff)
+		}
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	prog := `min lo interval 10s
+max hi interval 10s
+stddev sd interval 10s
+/^(\d+) (\d+)$/ {
+  settime($1)
+  lo = $2
+  hi = $2
+  sd = $2
+}
+`
+	v, err := Compile("aggregates.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		line   string
+		lo, hi float64
+		sd     float64
+	}{
+		{"0 4", 4, 4, 0},
+		{"3 8", 4, 8, 2},
+		{"9 6", 4, 8, math.Sqrt(8.0 / 3)},
+		// A new interval starts afresh.
+		{"10 20", 20, 20, 0},
+		{"15 10", 10, 20, 5},
+	} {
+		v.processLine(logline.NewLogLine("log", tc.line))
+		for i, expected := range []float64{tc.lo, tc.hi, tc.sd} {
+			d, err := v.m[i].GetDatum()
+			testutil.FatalIfErr(t, err)
+			if got := datumValue(d); math.Abs(got-expected) > 1e-9 {
+				t.Errorf("%s: %s is %g, expected %g", tc.line, v.m[i].Name, got, expected)
+			}
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected float64
+		fault    bool
+	}{
+		{"1.5s", 1.5, false},
+		{"1h30m", 5400, false},
+		{"250ms", 0.25, false},
+		{"12", 12, false},
+		{"0.5", 0.5, false},
+		{"01:02:03", 3723, false},
+		{"02:03.25", 123.25, false},
+		{"-0:30", -30, false},
+		{"1:2:3:4", 0, true},
+		{"1.5:00", 0, true},
+		{"1:-2", 0, true},
+		{"soon", 0, true},
+	} {
+		d, err := parseDuration(tc.value)
+		if (err != nil) != tc.fault {
+			t.Errorf("%q: error is %v, expected fault %v", tc.value, err, tc.fault)
+		}
+		if d != tc.expected {
+			t.Errorf("%q: duration is %g, expected %g", tc.value, d, tc.expected)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	prog := `gauge elapsed_ms
+counter slow
+/^(\S+) (\S+)$/ {
+  elapsed_ms = (duration($2) - duration($1)) * 1000
+  duration($2) - duration($1) > 1m {
+    slow++
+  }
+}
+`
+	v, err := Compile("duration.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		line    string
+		elapsed float64
+		slow    int64
+	}{
+		{"1.5s 00:00:03", 1500, 0},
+		{"10:00 1h", 3000000, 1},
+	} {
+		v.processLine(logline.NewLogLine("log", tc.line))
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.elapsed, datum.GetFloat(d)); diff != "" {
+			t.Errorf("%s: elapsed: %s", tc.line, diff)
+		}
+		d, err = v.m[1].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.slow, datum.GetInt(d)); diff != "" {
+			t.Errorf("%s: slow: %s", tc.line, diff)
+		}
+	}
+}
+
+func TestSyslogPriority(t *testing.T) {
+	prog := `counter events by severity, facility, user
+/(?p)^sshd: login (\w+)$/ {
+  events[$syslog_severity, $syslog_facility, $1]++
+}
+`
+	v, err := Compile("syslog.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{
+		"<38>sshd: login alice", // auth.info
+		"sshd: login alice",     // no priority, user.notice
+		"<999>sshd: login bob",  // not a priority
+		"<4>sshd: login bob",    // kern.warning
+	} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	counts := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	expected := map[string]int64{
+		"6 4 alice": 1,
+		"5 1 alice": 1,
+		"4 0 bob":   1,
+	}
+	if diff := testutil.Diff(expected, counts); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestRegexFlags(t *testing.T) {
+	prog := `counter errors
+counter multiline
+/error/i {
+  errors++
+}
+/begin.end/s {
+  multiline++
+}
+`
+	v, err := Compile("flags.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"ERROR: disk", "Error: net", "begin\nend", "begin"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	for i, expected := range []int64{2, 1} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(expected, datum.GetInt(d)); diff != "" {
+			t.Errorf("%s: %s", v.m[i].Name, diff)
+		}
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	prog := `counter flags_total by flag
+gauge mode
+/flags=0x(?P<flags>[0-9a-f]+) mode=(?P<mode>\d+)/ {
+  strtol($flags, 16) & 1 != 0 {
+    flags_total["syn"]++
+  }
+  strtol($flags, 16) & 0x10 != 0 {
+    flags_total["ack"]++
+  }
+  mode = ($mode >> 6 & 7) << 8 | (($mode ^ 1) & 7)
+}
+`
+	v, err := Compile("bitwise.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.processLine(logline.NewLogLine("log", "flags=0x11 mode=420"))
+	v.processLine(logline.NewLogLine("log", "flags=0x2 mode=420"))
+	v.processLine(logline.NewLogLine("log", "flags=0x10 mode=493"))
+	counts := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	if diff := testutil.Diff(map[string]int64{"syn": 1, "ack": 2}, counts); diff != "" {
+		t.Error(diff)
+	}
+	d, err := v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	// 493 is 0755: owner 7, and 0755 ^ 1 is 0754, whose low bits are 4.
+	if diff := testutil.Diff(int64(7<<8|4), datum.GetInt(d)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestTernary(t *testing.T) {
+	prog := `counter requests by class
+gauge last_size
+/(?P<status>\d+) (?P<size>\d+)/ {
+  requests[$status >= 500 ? "error" : $status >= 400 ? "client" : "ok"]++
+  last_size = $status == 200 ? $size : 0
+}
+`
+	v, err := Compile("ternary.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"200 10", "404 20", "503 30", "200 40", "301 50"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	counts := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	if diff := testutil.Diff(map[string]int64{"ok": 3, "client": 1, "error": 1}, counts); diff != "" {
+		t.Error(diff)
+	}
+	d, err := v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	// The last line is not a 200, so the gauge is reset.
+	if diff := testutil.Diff(int64(0), datum.GetInt(d)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestLetLocals(t *testing.T) {
+	prog := `counter bytes by class
+gauge last_kb
+/(?P<status>\d+) (?P<size>\d+)/ {
+  let class = $status >= 500 ? "error" : "ok"
+  let kb = $size / 1024
+  bytes[class] += $size
+  /^2/ {
+    let class = "success"
+    bytes[class] += $size
+  }
+  last_kb = kb
+}
+`
+	v, err := Compile("let.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"200 2048", "503 1024", "200 4096"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	counts := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	// The local in the inner block hides the one in the outer block only
+	// until the end of the inner block.
+	if diff := testutil.Diff(map[string]int64{"ok": 6144, "error": 1024, "success": 6144}, counts); diff != "" {
+		t.Error(diff)
+	}
+	d, err := v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff(int64(4), datum.GetInt(d)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestPatternMacros(t *testing.T) {
+	prog := `const KV(k) /\b${k}=(?P<${k}>\S+)/
+counter requests by user, status
+// + KV("user") + / / + KV("status") {
+  requests[$user, $status]++
+}
+`
+	v, err := Compile("macros.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.processLine(logline.NewLogLine("log", "user=alice status=200"))
+	v.processLine(logline.NewLogLine("log", "user=bob status=404"))
+	v.processLine(logline.NewLogLine("log", "user=alice status=200"))
+	counts := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	expected := map[string]int64{"alice 200": 2, "bob 404": 1}
+	if diff := testutil.Diff(expected, counts); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestStopSkipsRemainingRules(t *testing.T) {
+	prog := `counter noise
+counter errors
+/healthcheck/ {
+  noise++
+  stop
+}
+/error/ {
+  errors++
+}
+`
+	v, err := Compile("stop.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"healthcheck error", "error", "healthcheck", "another error"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	for i, expected := range []int64{2, 2} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(expected, datum.GetInt(d)); diff != "" {
+			t.Errorf("%s: %s", v.m[i].Name, diff)
+		}
+	}
+}
+
+func TestOtherwiseAfterFunctionCall(t *testing.T) {
+	prog := `counter a
+counter b
+counter c
+counter d
+def f(x) {
+  x > 5 {
+    return 1
+  }
+  return 0
+}
+def g(x) {
+  x > 5 {
+    c++
+  }
+}
+/(?P<n>\d+)/ {
+  /foo/ {
+    a++
+  }
+  a += f($n)
+  otherwise {
+    b++
+  }
+}
+/^bar (?P<m>\d+)/ {
+  g($m)
+  otherwise {
+    d++
+  }
+}
+`
+	v, err := Compile("otherwise.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"foo 7", "bar 7", "bar 3"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	// Neither returning from inside a condition in f nor falling off the end
+	// of one in g changes whether the caller's otherwise block runs.
+	for i, expected := range []int64{3, 2, 1, 2} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(expected, datum.GetInt(d)); diff != "" {
+			t.Errorf("%s: %s", v.m[i].Name, diff)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	prog := `counter lines
+counter bytes
+gauge sampled
+/(\d+)/ {
+  sample 1/4 {
+    lines++
+    bytes += $1
+    sampled = 1
+  }
+}
+`
+	v, err := Compile("sample.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for i := 0; i < 10; i++ {
+		v.processLine(logline.NewLogLine("log", strconv.Itoa(i)))
+	}
+	// Lines 0, 4 and 8 are sampled.
+	for i, expected := range []int64{12, 48, 1} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(expected, datum.GetInt(d)); diff != "" {
+			t.Errorf("%s: %s", v.m[i].Name, diff)
+		}
+	}
+}
+
+func TestMathBuiltins(t *testing.T) {
+	prog := `gauge floored
+gauge ceiled
+gauge rounded
+gauge rounded_down
+gauge absolute
+gauge absolute_float
+gauge power
+gauge logarithm
+/(?P<ms>-?\d+) (?P<ratio>-?\d+\.\d+)/ {
+  floored = floor($ratio)
+  ceiled = ceil($ratio)
+  rounded = round($ratio + 0.5)
+  rounded_down = floor($ms / 100.0) * 100
+  absolute = abs($ms)
+  absolute_float = abs($ratio)
+  power = pow(2, $ratio)
+  logarithm = log(pow(2.718281828459045, 2))
+}
+`
+	v, err := Compile("math.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.processLine(logline.NewLogLine("log", "-250 -1.5"))
+	for i, expected := range []float64{-2, -1, -1, -300, 250, 1.5, math.Pow(2, -1.5), 2} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datumValue(d); math.Abs(got-expected) > 1e-9 {
+			t.Errorf("%s: expected %g, received %g", v.m[i].Name, expected, got)
+		}
+	}
+}
+
+var mathBuiltinFaultTests = []struct {
+	op      code.Opcode
+	x       interface{}
+	clamped int64
+}{
+	{code.Floor, math.NaN(), 0},
+	{code.Ceil, math.Inf(+1), math.MaxInt64},
+	{code.Round, math.Inf(+1), math.MaxInt64},
+	{code.Round, math.Inf(-1), math.MinInt64},
+	{code.Floor, 1e19, math.MaxInt64},
+	{code.Abs, int64(math.MinInt64), math.MaxInt64},
+}
+
+func TestMathBuiltinFaults(t *testing.T) {
+	for _, tc := range mathBuiltinFaultTests {
+		for _, p := range []arithmeticPolicy{arithmeticSkip, arithmeticClamp} {
+			v := makeVM(code.Instr{tc.op, nil}, nil)
+			v.name = "mathbuiltinfaults"
+			v.arithmetic = p
+			v.t.Push(tc.x)
+			v.execute(v.t, v.prog[0])
+			if p == arithmeticSkip {
+				if !v.terminate {
+					t.Errorf("%s(%v) skip: expected the program to stop processing the line", tc.op, tc.x)
+				}
+				continue
+			}
+			if v.terminate {
+				t.Errorf("%s(%v) clamp: expected the program to carry on", tc.op, tc.x)
+			}
+			if diff := testutil.Diff([]interface{}{tc.clamped}, v.t.stack); diff != "" {
+				t.Errorf("%s(%v) clamp: %s", tc.op, tc.x, diff)
+			}
+		}
+	}
+	if diff := testutil.Diff("12", arithmeticErrors.Get("mathbuiltinfaults").String()); diff != "" {
+		t.Errorf("arithmetic errors: %s", diff)
+	}
+}
+
+func TestTimeBuiltins(t *testing.T) {
+	prog := `counter requests by period, day
+text last_date
+/^(?P<date>\S+) / {
+  strptime($date, "2006-01-02T15:04:05Z07:00")
+  let h = hour(timestamp())
+  requests[h < 9 ? "after_hours" : h < 17 ? "business" : "after_hours", strftime(timestamp(), "Mon")]++
+  weekday(timestamp()) == 0 || weekday(timestamp()) == 6 {
+    requests["weekend", "all"]++
+  }
+  last_date = strftime(timestamp(), "2006-01-02")
+}
+`
+	for _, tc := range []struct {
+		loc      *time.Location
+		expected map[string]int64
+		date     string
+	}{
+		{nil, map[string]int64{"business Fri": 1, "business Sat": 1, "weekend all": 1}, "2019-06-15"},
+		// The hours and days are in the overridden timezone, so the first
+		// line is after hours.
+		{time.FixedZone("UTC+10", 10*3600), map[string]int64{"after_hours Fri": 1, "after_hours Sat": 1, "weekend all": 1}, "2019-06-15"},
+	} {
+		v, err := Compile("time.mtail", strings.NewReader(prog), false, false, false, tc.loc, false, codegen.RegexOptions{})
+		testutil.FatalIfErr(t, err)
+		for _, line := range []string{"2019-06-14T10:00:00Z GET /", "2019-06-15T10:00:00Z GET /"} {
+			v.processLine(logline.NewLogLine("log", line))
+		}
+		counts := map[string]int64{}
+		for _, lv := range v.m[0].LabelValues {
+			counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+		}
+		if diff := testutil.Diff(tc.expected, counts); diff != "" {
+			t.Errorf("%v: %s", tc.loc, diff)
+		}
+		d, err := v.m[1].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.date, d.ValueString()); diff != "" {
+			t.Errorf("%v: %s", tc.loc, diff)
+		}
+	}
+}
+
+func TestProgramTimezone(t *testing.T) {
+	override, err := time.LoadLocation("Europe/Berlin")
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		decl     string
+		expected int64
+	}{
+		{"", time.Date(2019, 6, 14, 8, 0, 0, 0, time.UTC).Unix()},
+		// The program's timezone is used instead of the override.
+		{"timezone \"America/New_York\"\n", time.Date(2019, 6, 14, 14, 0, 0, 0, time.UTC).Unix()},
+	} {
+		prog := tc.decl + `gauge t
+/^(?P<date>\S+ \S+)$/ {
+  strptime($date, "2006-01-02 15:04:05")
+  t = timestamp()
+}
+`
+		v, err := Compile("tz.mtail", strings.NewReader(prog), false, false, false, override, false, codegen.RegexOptions{})
+		testutil.FatalIfErr(t, err)
+		v.processLine(logline.NewLogLine("log", "2019-06-14 10:00:00"))
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.expected, datum.GetInt(d)); diff != "" {
+			t.Errorf("%q: %s", tc.decl, diff)
+		}
+	}
+}
+
+func TestMapExpr(t *testing.T) {
+	prog := `counter requests by class
+/(?P<code>\d+) (?P<path>\S+)/ {
+  requests[map $code { "2..": "ok", "30[12]": "redirect", "5..": "server_error", default: "other" }]++
+}
+`
+	v, err := Compile("map.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"200 /", "204 /a", "301 /b", "304 /c", "503 /d", "2000 /e"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	counts := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	// Each pattern must match the whole value, so 2000 is not ok.
+	if diff := testutil.Diff(map[string]int64{"ok": 2, "redirect": 1, "server_error": 1, "other": 2}, counts); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestHexAndOctalNumbers(t *testing.T) {
+	prog := `gauge dev
+gauge id
+gauge mode
+gauge padded
+gauge literals
+/dev=(?P<dev>0x[0-9a-f]+) id=(?P<id>[0-9a-f]+) mode=(?P<mode>\S+) seq=(?P<seq>\d+)/ {
+  dev = $dev
+  id = hex($id) + hex("0x" + $id)
+  mode = strtol($mode, 8)
+  padded = $seq
+  literals = 0o17 + 0x10
+}
+`
+	v, err := Compile("hex.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	v.processLine(logline.NewLogLine("log", "dev=0x1f id=ff mode=755 seq=007"))
+	// Zero padded decimal captures are not octal.
+	for i, expected := range []int64{31, 510, 493, 7, 31} {
+		d, err := v.m[i].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(expected, datum.GetInt(d)); diff != "" {
+			t.Errorf("%s: %s", v.m[i].Name, diff)
+		}
+	}
+}
+
+func TestNormalizers(t *testing.T) {
+	prog := `counter requests by method normalize uppercase by path normalize lowercase, strip_query, max_len 8
+/(?P<method>\S+) (?P<path>\S+)/ {
+  requests[$method, $path]++
+}
+`
+	v, err := Compile("normalize.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"get /Index.html", "GET /index.html?q=1", "post /Very/Long/Path"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	counts := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	if diff := testutil.Diff(map[string]int64{"GET /index.h": 2, "POST /very/lo": 1}, counts); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestTimestampArithmetic(t *testing.T) {
+	prog := `gauge since by host
+hidden gauge last by host
+/^(?P<ts>\d+) (?P<host>\S+) ERROR$/ {
+  settime($ts)
+  last[$host] > 0 {
+    since[$host] = timestamp() - last[$host]
+  }
+  last[$host] = timestamp()
+}
+/^(?P<ts>\d+) later$/ {
+  settime($ts)
+  settime(timestamp() + 3600)
+}
+`
+	v, err := Compile("timestamp.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"100 web1 ERROR", "130 web1 ERROR", "175 web1 ERROR", "200 web2 ERROR", "300 later"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	since := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		since[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	if diff := testutil.Diff(map[string]int64{"web1": 45}, since); diff != "" {
+		t.Error(diff)
+	}
+	if diff := testutil.Diff(time.Unix(3900, 0).UTC(), v.t.time); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCorrelateRequests(t *testing.T) {
+	prog := `histogram request_seconds buckets 1, 10
+hidden gauge request_start by txid limit 2
+/^(?P<ts>\d+) request (?P<txid>\S+)$/ {
+  settime($ts)
+  request_start[$txid] = timestamp()
+}
+/^(?P<ts>\d+) response (?P<txid>\S+)$/ {
+  settime($ts)
+  request_start[$txid] > 0 {
+    request_seconds = timestamp() - request_start[$txid]
+  }
+  del request_start[$txid]
+}
+`
+	v, err := Compile("correlate.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	// The request for c is never answered, and is evicted by e.
+	for _, line := range []string{"100 request a", "101 request b", "103 response a", "104 request c", "120 response b", "121 request d", "122 request e", "130 response x"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff(uint64(2), datum.GetBucketsCount(d)); diff != "" {
+		t.Error(diff)
+	}
+	if diff := testutil.Diff(float64(22), datum.GetBucketsSum(d)); diff != "" {
+		t.Error(diff)
+	}
+	var pending []string
+	for _, lv := range v.m[1].LabelValues {
+		pending = append(pending, lv.Labels[0])
+	}
+	if diff := testutil.Diff([]string{"d", "e"}, pending); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDelWildcard(t *testing.T) {
+	prog := `counter requests by host, path
+/^(?P<host>web\S*) (?P<path>\S+)$/ {
+  requests[$host, $path]++
+}
+/^cleanup (?P<host>\S+)$/ {
+  del requests[$host, *]
+}
+/^cleanup api$/ {
+  del requests[*, "/api/*"]
+}
+`
+	v, err := Compile("del.mtail", strings.NewReader(prog), false, false, false, nil, false, codegen.RegexOptions{})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"web1 /index", "web1 /api/users", "web2 /index", "web2 /api/users", "web2 /apidocs", "cleanup web1", "cleanup api"} {
+		v.processLine(logline.NewLogLine("log", line))
+	}
+	counts := map[string]int64{}
+	for _, lv := range v.m[0].LabelValues {
+		counts[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	if diff := testutil.Diff(map[string]int64{"web2 /apidocs": 1, "web2 /index": 1}, counts); diff != "" {
+		t.Error(diff)
+	}
+}
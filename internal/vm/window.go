@@ -0,0 +1,279 @@
+// Copyright 2019 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/code"
+)
+
+// windowSlots is the number of samples a window keeps, so each window has a
+// resolution of a sixtieth of its length, e.g. one second for a minute.
+const windowSlots = 60
+
+// ewmaForgetHalfLives is the number of half-lives after which an ewma datum's
+// last observation has too little weight to remember, so the next observation
+// replaces its value.
+const ewmaForgetHalfLives = 16
+
+// windowSweepInterval is the number of window updates between sweeps for
+// windows that have not been updated for longer than their length.
+const windowSweepInterval = 1024
+
+type windowSample struct {
+	t time.Time
+	v float64
+}
+
+// windowKey identifies a window by its datum and length, as a datum may be
+// given windows of different lengths in different calls.
+type windowKey struct {
+	d      datum.Datum
+	length time.Duration
+}
+
+// window is the recent history of the value of a datum, used by the rate()
+// and delta() builtins.
+type window struct {
+	length  time.Duration
+	samples []windowSample // oldest first
+}
+
+// add records the value v at time t, and drops the samples that are no longer
+// needed to find the value one window length before t.
+func (w *window) add(t time.Time, v float64) {
+	res := w.length / windowSlots
+	if n := len(w.samples); n > 0 && t.Truncate(res).Equal(w.samples[n-1].t.Truncate(res)) {
+		w.samples[n-1] = windowSample{t, v}
+	} else {
+		w.samples = append(w.samples, windowSample{t, v})
+	}
+	start := t.Add(-w.length)
+	i := 0
+	for i+1 < len(w.samples) && !w.samples[i+1].t.After(start) {
+		i++
+	}
+	w.samples = w.samples[i:]
+}
+
+// delta returns the change in value since the start of the window, or since
+// the oldest sample if the window is not yet full.
+func (w *window) delta() float64 {
+	return w.samples[len(w.samples)-1].v - w.samples[0].v
+}
+
+// avgSlot is the sum and count of the values observed in one slot of an
+// avgWindow.
+type avgSlot struct {
+	t     time.Time
+	sum   float64
+	count int
+}
+
+// avgWindow is the recent history of the values observed for a datum, used
+// by the movavg() builtin.
+type avgWindow struct {
+	length time.Duration
+	slots  []avgSlot // oldest first
+}
+
+// add records the observation v at time t, and drops the slots that have
+// left the window.
+func (w *avgWindow) add(t time.Time, v float64) {
+	res := w.length / windowSlots
+	slot := t.Truncate(res)
+	if n := len(w.slots); n > 0 && slot.Equal(w.slots[n-1].t) {
+		w.slots[n-1].sum += v
+		w.slots[n-1].count++
+	} else {
+		w.slots = append(w.slots, avgSlot{slot, v, 1})
+	}
+	start := t.Add(-w.length)
+	i := 0
+	for i < len(w.slots)-1 && !w.slots[i].t.Add(res).After(start) {
+		i++
+	}
+	w.slots = w.slots[i:]
+}
+
+// average returns the mean of the observations in the window.
+func (w *avgWindow) average() float64 {
+	sum, count := 0.0, 0
+	for _, s := range w.slots {
+		sum += s.sum
+		count += s.count
+	}
+	return sum / float64(count)
+}
+
+// datumValue returns the value of the Int or Float datum d as a float.
+func datumValue(d datum.Datum) float64 {
+	if i, ok := d.(*datum.IntDatum); ok {
+		return float64(i.Get())
+	}
+	return datum.GetFloat(d)
+}
+
+// windowDelta records the current value of the datum d in its window of the
+// given length, and returns the change in its value over the window.
+func (v *VM) windowDelta(d datum.Datum, length time.Duration) float64 {
+	if v.windows == nil {
+		v.windows = make(map[windowKey]*window)
+	}
+	now := v.now()
+	v.sweepWindows(now)
+	k := windowKey{d, length}
+	w, ok := v.windows[k]
+	if !ok {
+		w = &window{length: length}
+		v.windows[k] = w
+	}
+	w.add(now, datumValue(d))
+	return w.delta()
+}
+
+// movingAverage records the observation x in the window of the given length
+// of the datum d, and returns the average of the observations in the window.
+func (v *VM) movingAverage(d datum.Datum, length time.Duration, x float64) float64 {
+	if v.averages == nil {
+		v.averages = make(map[windowKey]*avgWindow)
+	}
+	now := v.now()
+	v.sweepWindows(now)
+	k := windowKey{d, length}
+	w, ok := v.averages[k]
+	if !ok {
+		w = &avgWindow{length: length}
+		v.averages[k] = w
+	}
+	w.add(now, x)
+	return w.average()
+}
+
+// decayedAverage returns the value of the ewma datum d after the observation
+// x, which is weighted against the current value by the time since the
+// previous observation, so that the current value has half the weight after
+// one halfLife.  The first observation of a datum is its value.
+func (v *VM) decayedAverage(d datum.Datum, halfLife time.Duration, x float64) float64 {
+	if v.observed == nil {
+		v.observed = make(map[windowKey]time.Time)
+	}
+	now := v.now()
+	v.sweepWindows(now)
+	k := windowKey{d, halfLife}
+	last, ok := v.observed[k]
+	v.observed[k] = now
+	if !ok {
+		return x
+	}
+	elapsed := now.Sub(last)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	w := math.Exp2(-elapsed.Seconds() / halfLife.Seconds())
+	return x + (datumValue(d)-x)*w
+}
+
+// aggregate is the count, mean, sum of squared differences from the mean, and
+// extremes of the observations of a datum in one interval, used by the min,
+// max and stddev metrics.
+type aggregate struct {
+	start    time.Time // start of the interval
+	count    int
+	mean     float64
+	m2       float64
+	min, max float64
+}
+
+// add records the observation x, updating the mean and squared differences
+// with Welford's method.
+func (a *aggregate) add(x float64) {
+	if a.count == 0 || x < a.min {
+		a.min = x
+	}
+	if a.count == 0 || x > a.max {
+		a.max = x
+	}
+	a.count++
+	d := x - a.mean
+	a.mean += d / float64(a.count)
+	a.m2 += d * (x - a.mean)
+}
+
+// stat returns the named statistic of the observations.  The standard
+// deviation is that of the observations as a population.
+func (a *aggregate) stat(name string) float64 {
+	switch name {
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	}
+	return math.Sqrt(a.m2 / float64(a.count))
+}
+
+// aggregate records the observation x of the min, max or stddev datum d in the
+// interval of the timestamp register, and returns the statistic of the
+// observations in that interval.  Intervals are aligned to the Unix epoch, and
+// each starts afresh, so the metric holds the statistic of the interval so far.
+func (v *VM) aggregate(d datum.Datum, op code.Aggregate, x float64) float64 {
+	if v.aggregates == nil {
+		v.aggregates = make(map[windowKey]*aggregate)
+	}
+	now := v.now()
+	v.sweepWindows(now)
+	k := windowKey{d, op.Interval}
+	start := now.Truncate(op.Interval)
+	a, ok := v.aggregates[k]
+	// Observations timestamped before the current interval, such as from
+	// a log read out of order, are counted in the current interval.
+	if !ok || start.After(a.start) {
+		a = &aggregate{start: start}
+		v.aggregates[k] = a
+	}
+	a.add(x)
+	return a.stat(op.Stat)
+}
+
+// now returns the current timestamp register, or the system time if it is
+// not set.
+func (v *VM) now() time.Time {
+	if v.t.time.IsZero() {
+		return time.Now()
+	}
+	return v.t.time
+}
+
+// sweepWindows periodically forgets the windows of data that have not been
+// updated for longer than their length, such as those that have expired or
+// been deleted from their metric.
+func (v *VM) sweepWindows(now time.Time) {
+	v.windowUpdates++
+	if v.windowUpdates%windowSweepInterval != 0 {
+		return
+	}
+	for k, w := range v.windows {
+		if now.Sub(w.samples[len(w.samples)-1].t) > w.length {
+			delete(v.windows, k)
+		}
+	}
+	for k, w := range v.averages {
+		if now.Sub(w.slots[len(w.slots)-1].t) > w.length {
+			delete(v.averages, k)
+		}
+	}
+	for k, a := range v.aggregates {
+		if now.Sub(a.start) > k.length {
+			delete(v.aggregates, k)
+		}
+	}
+	for k, t := range v.observed {
+		if now.Sub(t) > ewmaForgetHalfLives*k.length {
+			delete(v.observed, k)
+		}
+	}
+}